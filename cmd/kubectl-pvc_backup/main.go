@@ -0,0 +1,9 @@
+// Command kubectl-pvc_backup is the kubectl plugin of local-pvc-backup, run as
+// kubectl pvc-backup once installed on the PATH
+package main
+
+import "github.com/monlor/local-pvc-backup/pkg/plugin"
+
+func main() {
+	plugin.Execute()
+}
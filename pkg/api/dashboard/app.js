@@ -0,0 +1,259 @@
+"use strict";
+
+// The token is kept for the browser tab only and sent with every API call
+const tokenKey = "local-pvc-backup-token";
+
+function token() {
+  return sessionStorage.getItem(tokenKey) || "";
+}
+
+async function api(path, options = {}) {
+  const headers = { Authorization: "Bearer " + token() };
+  if (options.body) {
+    headers["Content-Type"] = "application/json";
+  }
+  const response = await fetch(path, { ...options, headers });
+  const body = await response.json().catch(() => ({}));
+  if (!response.ok) {
+    const error = new Error(body.error || response.statusText);
+    error.status = response.status;
+    throw error;
+  }
+  return body;
+}
+
+function showMessage(text) {
+  const message = document.getElementById("message");
+  message.textContent = text;
+  message.hidden = !text;
+}
+
+function formatBytes(bytes) {
+  if (bytes === undefined || bytes === null) {
+    return "";
+  }
+  const units = ["B", "KiB", "MiB", "GiB", "TiB", "PiB"];
+  let value = bytes;
+  let unit = 0;
+  while (value >= 1024 && unit < units.length - 1) {
+    value /= 1024;
+    unit++;
+  }
+  return (unit === 0 ? value : value.toFixed(1)) + " " + units[unit];
+}
+
+function formatTime(time) {
+  return time ? new Date(time).toLocaleString() : "";
+}
+
+// cell appends a cell with the given text, never interpreted as markup
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text === undefined || text === null ? "" : String(text);
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function button(row, label, onClick) {
+  const b = document.createElement("button");
+  b.textContent = label;
+  b.addEventListener("click", onClick);
+  row.insertCell().appendChild(b);
+  return b;
+}
+
+function emptyRow(tbody, columns, text) {
+  const row = tbody.insertRow();
+  const td = cell(row, text, "empty");
+  td.colSpan = columns;
+}
+
+async function loadPVCs() {
+  const tbody = document.getElementById("pvcs");
+  const failures = document.getElementById("failures");
+  tbody.replaceChildren();
+  failures.replaceChildren();
+
+  const pvcs = await api("api/v1/pvcs");
+  if (pvcs.length === 0) {
+    emptyRow(tbody, 7, "No PVCs you may read are backed up on this node");
+  }
+
+  const failed = [];
+  for (const pvc of pvcs) {
+    const name = pvc.namespace + "/" + pvc.name;
+    const status = pvc.status || { size: {} };
+    const row = tbody.insertRow();
+    cell(row, name);
+    cell(row, formatTime(status.lastSuccess), "ok");
+    cell(row, formatTime(status.lastFailure), status.lastFailure ? "failed" : "");
+    cell(row, formatBytes(status.size && status.size.bytes));
+    cell(row, formatBytes(status.size && status.size.addedBytes));
+
+    const running = pvc.backup && pvc.backup.state === "running";
+    const run = button(row, running ? "Running" : "Run now", () => runBackup(pvc, run));
+    run.disabled = running;
+    button(row, "Snapshots", () => loadSnapshots(pvc));
+
+    for (const record of status.history || []) {
+      if (record.status === "failed") {
+        failed.push({ time: record.time, pvc: name, error: record.error });
+      }
+    }
+  }
+
+  failed.sort((a, b) => new Date(b.time) - new Date(a.time));
+  if (failed.length === 0) {
+    emptyRow(failures, 3, "No failures in the kept history");
+  }
+  for (const failure of failed.slice(0, 20)) {
+    const row = failures.insertRow();
+    cell(row, formatTime(failure.time));
+    cell(row, failure.pvc);
+    cell(row, failure.error, "error");
+  }
+}
+
+async function loadRepositories() {
+  const tbody = document.getElementById("repositories");
+  tbody.replaceChildren();
+  try {
+    const repositories = await api("api/v1/repositories");
+    for (const repository of repositories) {
+      const row = tbody.insertRow();
+      cell(row, repository.repository);
+      cell(row, formatBytes(repository.bytes));
+      cell(row, repository.snapshots);
+    }
+    if (repositories.length === 0) {
+      emptyRow(tbody, 3, "No repository used yet");
+    }
+  } catch (error) {
+    // Repository sizes require read access to the PVCs of all namespaces
+    emptyRow(tbody, 3, error.status === 403 ? "Not allowed to read the repositories" : error.message);
+  }
+}
+
+async function runBackup(pvc, runButton) {
+  if (!confirm("Back up " + pvc.namespace + "/" + pvc.name + " now?")) {
+    return;
+  }
+  try {
+    await api("api/v1/backups", {
+      method: "POST",
+      body: JSON.stringify({ namespace: pvc.namespace, name: pvc.name, description: "dashboard" }),
+    });
+    runButton.textContent = "Running";
+    runButton.disabled = true;
+    showMessage("Backup of " + pvc.namespace + "/" + pvc.name + " started");
+  } catch (error) {
+    showMessage("Backup of " + pvc.namespace + "/" + pvc.name + " failed to start: " + error.message);
+  }
+}
+
+async function loadSnapshots(pvc) {
+  const path = "api/v1/pvcs/" + encodeURIComponent(pvc.namespace) + "/" + encodeURIComponent(pvc.name);
+  document.getElementById("details").hidden = false;
+  document.getElementById("preview").hidden = true;
+  document.getElementById("details-title").textContent = "Snapshots of " + pvc.namespace + "/" + pvc.name;
+  const tbody = document.getElementById("snapshots");
+  tbody.replaceChildren();
+  emptyRow(tbody, 6, "Loading...");
+
+  try {
+    const list = await api(path + "/snapshots");
+    tbody.replaceChildren();
+    const snapshots = list.snapshots.slice().reverse();
+    if (snapshots.length === 0) {
+      emptyRow(tbody, 6, "No snapshots");
+    }
+    for (const snapshot of snapshots) {
+      const row = tbody.insertRow();
+      const description = (snapshot.tags || []).find((tag) => tag.startsWith("description="));
+      cell(row, snapshot.short_id);
+      cell(row, formatTime(snapshot.time));
+      cell(row, description ? description.slice("description=".length) : "");
+      cell(row, snapshot.summary ? snapshot.summary.total_files_processed : "");
+      cell(row, snapshot.summary ? formatBytes(snapshot.summary.data_added) : "");
+      button(row, "Preview restore", () => previewRestore(path, snapshot));
+    }
+  } catch (error) {
+    tbody.replaceChildren();
+    emptyRow(tbody, 6, error.message);
+  }
+}
+
+async function previewRestore(path, snapshot) {
+  const preview = document.getElementById("preview");
+  const tbody = document.getElementById("changes");
+  preview.hidden = false;
+  document.getElementById("preview-title").textContent = "Restore preview of snapshot " + snapshot.short_id;
+  const summary = document.getElementById("preview-summary");
+  summary.textContent = "Comparing the snapshot with the data on disk...";
+  tbody.replaceChildren();
+
+  try {
+    const result = await api(path + "/restore-preview?snapshot=" + encodeURIComponent(snapshot.id));
+    summary.textContent = result.total === 0
+      ? "The data on disk matches the snapshot, a restore would change nothing."
+      : result.total + " files differ from the snapshot" + (result.truncated ? ", the first " + result.changes.length + " are listed." : ".");
+    for (const change of result.changes) {
+      const row = tbody.insertRow();
+      cell(row, change.path);
+      cell(row, change.change);
+      cell(row, change.change === "added" ? "" : formatBytes(change.snapshotSize));
+      cell(row, change.change === "deleted" ? "" : formatBytes(change.liveSize));
+    }
+  } catch (error) {
+    summary.textContent = error.message;
+  }
+}
+
+async function refresh() {
+  const signedIn = token() !== "";
+  document.getElementById("token").hidden = signedIn;
+  document.querySelector("#login button[type=submit]").hidden = signedIn;
+  document.getElementById("logout").hidden = !signedIn;
+  if (!signedIn) {
+    showMessage("Sign in with a Kubernetes token allowed to get the PVCs of your namespaces.");
+    return;
+  }
+  try {
+    await loadPVCs();
+    showMessage("");
+    await loadRepositories();
+  } catch (error) {
+    if (error.status === 401) {
+      sessionStorage.removeItem(tokenKey);
+      showMessage("The token was rejected, sign in again.");
+      refresh();
+      return;
+    }
+    showMessage(error.message);
+  }
+}
+
+document.getElementById("login").addEventListener("submit", (event) => {
+  event.preventDefault();
+  sessionStorage.setItem(tokenKey, document.getElementById("token").value.trim());
+  document.getElementById("token").value = "";
+  refresh();
+});
+
+document.getElementById("logout").addEventListener("click", () => {
+  sessionStorage.removeItem(tokenKey);
+  document.getElementById("pvcs").replaceChildren();
+  document.getElementById("failures").replaceChildren();
+  document.getElementById("repositories").replaceChildren();
+  document.getElementById("details").hidden = true;
+  refresh();
+});
+
+refresh();
+setInterval(() => {
+  if (token() !== "") {
+    loadPVCs().catch((error) => showMessage(error.message));
+  }
+}, 30000);
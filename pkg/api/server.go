@@ -0,0 +1,573 @@
+// Package api serves the REST API of the agent, letting platform tooling trigger
+// backups of the PVCs of the node and query their snapshots
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/backup"
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/logging"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+	"github.com/sirupsen/logrus"
+)
+
+// RBAC verbs on the PVCs of a namespace the callers need, the same as for the tenant
+// commands
+const (
+	readVerb   = "get"
+	backupVerb = "update"
+)
+
+// Backup states
+const (
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+)
+
+// BackupRequest is the body of POST /api/v1/backups
+type BackupRequest struct {
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// BackupStatus is the state of the last backup of a PVC triggered through the API
+type BackupStatus struct {
+	Namespace string     `json:"namespace"`
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	Started   time.Time  `json:"started"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// RestoreRequest is the body of POST /api/v1/restores. The PVC is restored in place,
+// from the snapshot or the latest one taken at or before At.
+type RestoreRequest struct {
+	Namespace string     `json:"namespace"`
+	Name      string     `json:"name"`
+	Snapshot  string     `json:"snapshot,omitempty"`
+	At        *time.Time `json:"at,omitempty"`     // Defaults to now
+	Delete    bool       `json:"delete,omitempty"` // Delete files missing from the snapshot
+}
+
+// RestoreStatus is the state of the last restore of a PVC triggered through the API
+type RestoreStatus struct {
+	Namespace      string     `json:"namespace"`
+	Name           string     `json:"name"`
+	State          string     `json:"state"`
+	Started        time.Time  `json:"started"`
+	Finished       *time.Time `json:"finished,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	Snapshot       string     `json:"snapshot,omitempty"`       // Restored snapshot
+	SnapshotTime   *time.Time `json:"snapshotTime,omitempty"`   // Time the restored snapshot was taken
+	SafetySnapshot string     `json:"safetySnapshot,omitempty"` // Snapshot of the overwritten data, undone with rollback
+}
+
+// SnapshotList is the response of GET /api/v1/pvcs/{namespace}/{name}/snapshots
+type SnapshotList struct {
+	Namespace string            `json:"namespace"`
+	Name      string            `json:"name"`
+	Snapshots []restic.Snapshot `json:"snapshots"`
+	Backup    *BackupStatus     `json:"backup,omitempty"` // Last backup triggered through the API
+}
+
+// PVC is an entry of GET /api/v1/pvcs
+type PVC struct {
+	Namespace string               `json:"namespace"`
+	Name      string               `json:"name"`
+	Status    *k8s.PVCBackupStatus `json:"status,omitempty"` // Kept backup status, missing before the first backup
+	Backup    *BackupStatus        `json:"backup,omitempty"` // Last backup triggered through the API
+}
+
+// Repository is an entry of GET /api/v1/repositories
+type Repository struct {
+	Repository string `json:"repository"`
+	Bytes      uint64 `json:"bytes"`
+	Snapshots  int    `json:"snapshots"`
+}
+
+// RestorePreview is the response of GET /api/v1/pvcs/{namespace}/{name}/restore-preview,
+// the files a restore of the snapshot would change
+type RestorePreview struct {
+	Snapshot  *restic.Snapshot `json:"snapshot"`
+	Changes   []FileChange     `json:"changes"`
+	Total     int              `json:"total"`     // Changed files, more than listed when truncated
+	Truncated bool             `json:"truncated"` // Only the first maxPreviewChanges changes are listed
+}
+
+// FileChange is a file of a PVC that differs from the snapshot
+type FileChange struct {
+	Path         string `json:"path"`
+	Change       string `json:"change"`
+	SnapshotSize uint64 `json:"snapshotSize"`
+	LiveSize     uint64 `json:"liveSize"`
+}
+
+// maxPreviewChanges bounds the changes listed by a restore preview
+const maxPreviewChanges = 1000
+
+// Server serves the API. Callers authenticate with a Kubernetes bearer token, e.g. of
+// a service account, and are authorized by the RBAC rules on the PVCs of the namespace.
+type Server struct {
+	ctx       context.Context // Scope of the triggered backups, cancelled on shutdown
+	manager   *backup.Manager
+	k8sClient *k8s.Client
+	audience  string // Audience the bearer tokens must be issued for
+	log       *logrus.Logger
+	backups   map[string]*BackupStatus
+	restores  map[string]*RestoreStatus
+	mu        sync.Mutex
+}
+
+// New creates the API server of a manager, running the triggered backups within ctx
+func New(ctx context.Context, manager *backup.Manager, k8sClient *k8s.Client, audience string, log *logrus.Logger) *Server {
+	return &Server{
+		ctx:       ctx,
+		manager:   manager,
+		k8sClient: k8sClient,
+		audience:  audience,
+		log:       log,
+		backups:   make(map[string]*BackupStatus),
+		restores:  make(map[string]*RestoreStatus),
+	}
+}
+
+// Handler returns the handler of the API routes
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/backups", s.handleBackups)
+	mux.HandleFunc("/api/v1/backups/", s.handleBackupStatus)
+	mux.HandleFunc("/api/v1/restores", s.handleRestores)
+	mux.HandleFunc("/api/v1/restores/", s.handleRestoreStatus)
+	mux.HandleFunc("/api/v1/pvcs", s.handlePVCs)
+	mux.HandleFunc("/api/v1/pvcs/", s.handlePVC)
+	mux.HandleFunc("/api/v1/repositories", s.handleRepositories)
+	mux.Handle("/", dashboard())
+	return mux
+}
+
+// handleBackups triggers a backup of a PVC, answering once it started. Its outcome is
+// reported by GET /api/v1/backups/{namespace}/{name}.
+func (s *Server) handleBackups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	var request BackupRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+	if request.Namespace == "" || request.Name == "" {
+		writeError(w, http.StatusBadRequest, "namespace and name are required")
+		return
+	}
+	if !s.authorize(w, r, request.Namespace, backupVerb) {
+		return
+	}
+
+	key := request.Namespace + "/" + request.Name
+	s.mu.Lock()
+	if status, ok := s.backups[key]; ok && status.State == StateRunning {
+		s.mu.Unlock()
+		writeError(w, http.StatusConflict, fmt.Sprintf("a backup of PVC %s is already running", key))
+		return
+	}
+	status := &BackupStatus{Namespace: request.Namespace, Name: request.Name, State: StateRunning, Started: time.Now().UTC()}
+	s.backups[key] = status
+	response := *status
+	s.mu.Unlock()
+
+	s.log.Infof("Backup of PVC %s requested through the API", key)
+	go s.runBackup(status, request.Description)
+	writeJSON(w, http.StatusAccepted, response)
+}
+
+// runBackup performs a triggered backup and records its outcome
+func (s *Server) runBackup(status *BackupStatus, description string) {
+	err := s.manager.BackupPVC(s.ctx, status.Namespace, status.Name, description)
+	if err != nil {
+		s.log.Errorf("Backup of PVC %s/%s requested through the API failed: %v", status.Namespace, status.Name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := time.Now().UTC()
+	status.Finished = &finished
+	status.State = StateSucceeded
+	if err != nil {
+		status.State = StateFailed
+		status.Error = logging.Redact(s.log, err.Error())
+	}
+}
+
+// handleBackupStatus reports the last backup of a PVC triggered through the API
+func (s *Server) handleBackupStatus(w http.ResponseWriter, r *http.Request) {
+	namespace, name, ok := pvcPath(strings.TrimPrefix(r.URL.Path, "/api/v1/backups/"), "")
+	if !ok {
+		writeError(w, http.StatusNotFound, "expected /api/v1/backups/{namespace}/{name}")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	if !s.authorize(w, r, namespace, readVerb) {
+		return
+	}
+
+	status := s.backupStatus(namespace, name)
+	if status == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no backup of PVC %s/%s was requested through the API", namespace, name))
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleRestores triggers an in-place restore of a PVC, answering once it started. Its
+// outcome is reported by GET /api/v1/restores/{namespace}/{name}. Restores into other
+// directories of the node are left to the restore command.
+func (s *Server) handleRestores(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	var request RestoreRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+	if request.Namespace == "" || request.Name == "" {
+		writeError(w, http.StatusBadRequest, "namespace and name are required")
+		return
+	}
+	if request.Snapshot != "" && request.At != nil {
+		writeError(w, http.StatusBadRequest, "snapshot and at are mutually exclusive")
+		return
+	}
+	if !s.authorize(w, r, request.Namespace, backupVerb) {
+		return
+	}
+
+	key := request.Namespace + "/" + request.Name
+	s.mu.Lock()
+	if status, ok := s.restores[key]; ok && status.State == StateRunning {
+		s.mu.Unlock()
+		writeError(w, http.StatusConflict, fmt.Sprintf("a restore of PVC %s is already running", key))
+		return
+	}
+	status := &RestoreStatus{Namespace: request.Namespace, Name: request.Name, State: StateRunning, Started: time.Now().UTC()}
+	s.restores[key] = status
+	response := *status
+	s.mu.Unlock()
+
+	opts := backup.RestoreOptions{SnapshotID: request.Snapshot, At: time.Now(), Delete: request.Delete}
+	if request.At != nil {
+		opts.At = *request.At
+	}
+	s.log.Infof("Restore of PVC %s requested through the API", key)
+	go s.runRestore(status, opts)
+	writeJSON(w, http.StatusAccepted, response)
+}
+
+// runRestore performs a triggered restore and records its outcome
+func (s *Server) runRestore(status *RestoreStatus, opts backup.RestoreOptions) {
+	result, err := s.manager.Restore(s.ctx, status.Namespace, status.Name, opts)
+	if err != nil {
+		s.log.Errorf("Restore of PVC %s/%s requested through the API failed: %v", status.Namespace, status.Name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := time.Now().UTC()
+	status.Finished = &finished
+	if err != nil {
+		status.State = StateFailed
+		status.Error = logging.Redact(s.log, err.Error())
+		return
+	}
+	status.State = StateSucceeded
+	status.Snapshot = result.Snapshot.ShortID
+	status.SnapshotTime = &result.Snapshot.Time
+	status.SafetySnapshot = result.SafetySnapshotID
+}
+
+// handleRestoreStatus reports the last restore of a PVC triggered through the API
+func (s *Server) handleRestoreStatus(w http.ResponseWriter, r *http.Request) {
+	namespace, name, ok := pvcPath(strings.TrimPrefix(r.URL.Path, "/api/v1/restores/"), "")
+	if !ok {
+		writeError(w, http.StatusNotFound, "expected /api/v1/restores/{namespace}/{name}")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	if !s.authorize(w, r, namespace, readVerb) {
+		return
+	}
+
+	s.mu.Lock()
+	status, found := s.restores[namespace+"/"+name]
+	var copied RestoreStatus
+	if found {
+		copied = *status
+	}
+	s.mu.Unlock()
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no restore of PVC %s/%s was requested through the API", namespace, name))
+		return
+	}
+	writeJSON(w, http.StatusOK, copied)
+}
+
+// handlePVCs lists the PVCs backed up on this node in the namespaces the caller may
+// read, with their backup statuses
+func (s *Server) handlePVCs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	caller := s.authenticate(w, r)
+	if caller == nil {
+		return
+	}
+
+	statuses, err := s.manager.PVCStatuses(r.Context())
+	if err != nil {
+		s.failed(w, "Failed to list PVCs", err)
+		return
+	}
+
+	allowed := make(map[string]bool)
+	pvcs := make([]PVC, 0, len(statuses))
+	for _, status := range statuses {
+		namespace := status.PVC.Namespace
+		if _, ok := allowed[namespace]; !ok {
+			allowed[namespace], err = s.k8sClient.CallerAllowed(r.Context(), caller, namespace, readVerb)
+			if err != nil {
+				s.failed(w, "Failed to authorize API request", err)
+				return
+			}
+		}
+		if !allowed[namespace] {
+			continue
+		}
+		if status.Status != nil {
+			status.Status.LastError = logging.Redact(s.log, status.Status.LastError)
+			for i := range status.Status.History {
+				status.Status.History[i].Error = logging.Redact(s.log, status.Status.History[i].Error)
+			}
+		}
+		pvcs = append(pvcs, PVC{
+			Namespace: namespace,
+			Name:      status.PVC.Name,
+			Status:    status.Status,
+			Backup:    s.backupStatus(namespace, status.PVC.Name),
+		})
+	}
+	sort.Slice(pvcs, func(i, j int) bool {
+		if pvcs[i].Namespace != pvcs[j].Namespace {
+			return pvcs[i].Namespace < pvcs[j].Namespace
+		}
+		return pvcs[i].Name < pvcs[j].Name
+	})
+	writeJSON(w, http.StatusOK, pvcs)
+}
+
+// handlePVC serves the snapshots and the restore preview of a PVC
+func (s *Server) handlePVC(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/pvcs/")
+	namespace, name, ok := pvcPath(path, "snapshots")
+	handle := s.handleSnapshots
+	if !ok {
+		namespace, name, ok = pvcPath(path, "restore-preview")
+		handle = s.handleRestorePreview
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "expected /api/v1/pvcs/{namespace}/{name}/snapshots or /api/v1/pvcs/{namespace}/{name}/restore-preview")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	if !s.authorize(w, r, namespace, readVerb) {
+		return
+	}
+	handle(w, r, namespace, name)
+}
+
+// handleSnapshots lists the snapshots of a PVC
+func (s *Server) handleSnapshots(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	snapshots, err := s.manager.PVCSnapshots(r.Context(), namespace, name)
+	if err != nil {
+		s.failed(w, fmt.Sprintf("Failed to list snapshots of PVC %s/%s", namespace, name), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, SnapshotList{
+		Namespace: namespace,
+		Name:      name,
+		Snapshots: snapshots,
+		Backup:    s.backupStatus(namespace, name),
+	})
+}
+
+// handleRestorePreview compares a snapshot of a PVC, given by the snapshot query
+// parameter or the latest one, with its current data, without restoring anything
+func (s *Server) handleRestorePreview(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	opts := backup.DiffOptions{SnapshotID: r.URL.Query().Get("snapshot"), At: time.Now()}
+	snapshot, changes, err := s.manager.DiffAgainstLive(r.Context(), namespace, name, opts)
+	if err != nil {
+		s.failed(w, fmt.Sprintf("Failed to preview restore of PVC %s/%s", namespace, name), err)
+		return
+	}
+
+	preview := RestorePreview{Snapshot: snapshot, Changes: []FileChange{}, Total: len(changes)}
+	for _, change := range changes {
+		if len(preview.Changes) == maxPreviewChanges {
+			preview.Truncated = true
+			break
+		}
+		preview.Changes = append(preview.Changes, FileChange{
+			Path:         change.Path,
+			Change:       change.Change,
+			SnapshotSize: change.SnapshotSize,
+			LiveSize:     change.LiveSize,
+		})
+	}
+	writeJSON(w, http.StatusOK, preview)
+}
+
+// handleRepositories reports the size of the repositories of this node. They may hold
+// the backups of any namespace, so the caller must be allowed to read all PVCs.
+func (s *Server) handleRepositories(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	if !s.authorize(w, r, "", readVerb) {
+		return
+	}
+
+	usages, err := s.manager.RepositoryUsages(r.Context())
+	if err != nil {
+		s.failed(w, "Failed to read repository sizes", err)
+		return
+	}
+	repositories := make([]Repository, 0, len(usages))
+	for _, usage := range usages {
+		repositories = append(repositories, Repository{
+			Repository: logging.Redact(s.log, usage.Repository),
+			Bytes:      usage.Bytes,
+			Snapshots:  usage.Snapshots,
+		})
+	}
+	writeJSON(w, http.StatusOK, repositories)
+}
+
+// failed answers a request whose operation failed, with 404 for PVCs not backed up on
+// this node
+func (s *Server) failed(w http.ResponseWriter, message string, err error) {
+	var notFound *backup.PVCNotFoundError
+	if errors.As(err, &notFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	s.log.Errorf("%s: %v", message, err)
+	writeError(w, http.StatusInternalServerError, logging.Redact(s.log, err.Error()))
+}
+
+// backupStatus returns a copy of the status of the last backup of a PVC triggered
+// through the API, nil when there is none
+func (s *Server) backupStatus(namespace, name string) *BackupStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.backups[namespace+"/"+name]
+	if !ok {
+		return nil
+	}
+	copied := *status
+	return &copied
+}
+
+// authenticate returns the owner of the bearer token of a request, answering the
+// request and returning nil when it has no valid token
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) *k8s.Caller {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "a bearer token is required")
+		return nil
+	}
+
+	caller, err := s.k8sClient.AuthenticateToken(r.Context(), token, s.audience)
+	if err != nil {
+		s.log.Warnf("Rejected API request: %v", err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return nil
+	}
+	return caller
+}
+
+// authorize authenticates the bearer token of a request and checks that its owner may
+// perform verb on the PVCs of a namespace, or of all namespaces when it is empty,
+// answering the request otherwise
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, namespace, verb string) bool {
+	caller := s.authenticate(w, r)
+	if caller == nil {
+		return false
+	}
+	allowed, err := s.k8sClient.CallerAllowed(r.Context(), caller, namespace, verb)
+	if err != nil {
+		s.log.Errorf("Failed to authorize API request: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to authorize request")
+		return false
+	}
+	if !allowed && namespace == "" {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("%s may not %s persistentvolumeclaims in all namespaces", caller.Name, verb))
+		return false
+	}
+	if !allowed {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("%s may not %s persistentvolumeclaims in namespace %s", caller.Name, verb, namespace))
+		return false
+	}
+	return true
+}
+
+// pvcPath parses {namespace}/{name}, followed by /suffix when suffix is set
+func pvcPath(path, suffix string) (namespace, name string, ok bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	want := 2
+	if suffix != "" {
+		want = 3
+	}
+	if len(parts) != want || parts[0] == "" || parts[1] == "" || (suffix != "" && parts[2] != suffix) {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func writeJSON(w http.ResponseWriter, code int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
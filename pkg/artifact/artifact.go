@@ -0,0 +1,146 @@
+package artifact
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// Compression modes of the artifacts
+const (
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+)
+
+// Prefix is the prefix of the artifacts in the bucket, next to the repositories
+const Prefix = "artifacts"
+
+// Encoder compresses artifacts and encrypts them to the public keys of their readers,
+// so they can be shared without the repository credentials. Encryption runs the age or
+// gpg binary, like the repository operations run restic.
+type Encoder struct {
+	compression      string
+	ageRecipients    []string
+	gpgRecipientFile string
+}
+
+// NewEncoder creates an encoder from the artifact configuration
+func NewEncoder(config cfg.ArtifactConfig) (*Encoder, error) {
+	e := &Encoder{compression: config.Compression, gpgRecipientFile: config.GPGRecipientFile}
+	switch e.compression {
+	case CompressionGzip, CompressionNone:
+	case "":
+		e.compression = CompressionNone
+	default:
+		return nil, fmt.Errorf("invalid artifact compression %s, expected %s or %s", config.Compression, CompressionGzip, CompressionNone)
+	}
+	for _, recipient := range strings.Split(config.AgeRecipients, ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			e.ageRecipients = append(e.ageRecipients, recipient)
+		}
+	}
+	if len(e.ageRecipients) > 0 && e.gpgRecipientFile != "" {
+		return nil, fmt.Errorf("ARTIFACT_AGE_RECIPIENTS and ARTIFACT_GPG_RECIPIENT_FILE cannot be used together")
+	}
+	return e, nil
+}
+
+// Encode compresses and encrypts an artifact, returning the encoded data and the file
+// extensions describing the encoding, e.g. ".gz.age"
+func (e *Encoder) Encode(ctx context.Context, data []byte) ([]byte, string, error) {
+	extension := ""
+	if e.compression == CompressionGzip {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(data); err != nil {
+			return nil, "", fmt.Errorf("failed to compress artifact: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			return nil, "", fmt.Errorf("failed to compress artifact: %v", err)
+		}
+		data = buf.Bytes()
+		extension += ".gz"
+	}
+
+	// Compress first, encrypted data does not compress
+	switch {
+	case len(e.ageRecipients) > 0:
+		args := []string{"--encrypt"}
+		for _, recipient := range e.ageRecipients {
+			args = append(args, "--recipient", recipient)
+		}
+		encrypted, err := run(ctx, data, "age", args...)
+		if err != nil {
+			return nil, "", err
+		}
+		return encrypted, extension + ".age", nil
+	case e.gpgRecipientFile != "":
+		// The key file is trusted by configuration, there is no keyring to trust it in
+		encrypted, err := run(ctx, data, "gpg", "--batch", "--no-tty", "--trust-model", "always",
+			"--recipient-file", e.gpgRecipientFile, "--encrypt")
+		if err != nil {
+			return nil, "", err
+		}
+		return encrypted, extension + ".gpg", nil
+	}
+	return data, extension, nil
+}
+
+// run pipes data through an encryption tool and returns its output
+func run(ctx context.Context, data []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt artifact with %s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// Uploader encodes artifacts and uploads them to the bucket of the repositories
+type Uploader struct {
+	encoder *Encoder
+	storage *storage.Client
+	log     *logrus.Logger
+}
+
+// NewUploader creates an uploader, artifacts require the S3 backend
+func NewUploader(config *cfg.Config, log *logrus.Logger) (*Uploader, error) {
+	if config.BackendType != cfg.BackendS3 {
+		return nil, fmt.Errorf("artifacts are only supported with the %s backend", cfg.BackendS3)
+	}
+	encoder, err := NewEncoder(config.ArtifactConfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := storage.NewClient(config.S3Config, config.ResticConfig.ProxyConfig, log)
+	if err != nil {
+		return nil, err
+	}
+	return &Uploader{encoder: encoder, storage: client, log: log}, nil
+}
+
+// Upload encodes an artifact and stores it as name under the artifacts prefix, with the
+// extensions of its encoding appended. It returns the key of the stored object.
+func (u *Uploader) Upload(ctx context.Context, name string, data []byte) (string, error) {
+	encoded, extension, err := u.encoder.Encode(ctx, data)
+	if err != nil {
+		return "", err
+	}
+	key := path.Join(Prefix, name) + extension
+	if err := u.storage.PutObject(ctx, key, encoded); err != nil {
+		return "", err
+	}
+	u.log.Debugf("Uploaded artifact %s", key)
+	return key, nil
+}
@@ -0,0 +1,221 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// userAnnotations are the backup annotations set on pods and PVCs by their owners
+var userAnnotations = []string{
+	cfg.AnnotationEnabled,
+	cfg.AnnotationInclude,
+	cfg.AnnotationExclude,
+	cfg.AnnotationExcludeCaches,
+	cfg.AnnotationExcludeIfPresent,
+	cfg.AnnotationExcludeLargerThan,
+	cfg.AnnotationDescription,
+	cfg.AnnotationVerifyCommand,
+	cfg.AnnotationPreHook,
+	cfg.AnnotationPostHook,
+	cfg.AnnotationDumpCommand,
+	cfg.AnnotationDumpFilename,
+	cfg.AnnotationDumpOnly,
+	cfg.AnnotationFreeze,
+	cfg.AnnotationVolumeSnapshot,
+	cfg.AnnotationVolumeSnapshotClass,
+	cfg.AnnotationHookContainer,
+	cfg.AnnotationPlans,
+	cfg.AnnotationTTL,
+	cfg.AnnotationArchive,
+	cfg.AnnotationCompression,
+}
+
+// agentAnnotations are the annotations the agents write on PVCs
+var agentAnnotations = []string{
+	cfg.AnnotationLastBackupTime,
+	cfg.AnnotationLastSnapshotID,
+	cfg.AnnotationLastStatus,
+}
+
+// AnnotationReport holds the problems found in the backup annotations of an object
+type AnnotationReport struct {
+	Errors   []string // Annotations the agents cannot apply, e.g. an invalid TTL or an unknown key
+	Warnings []string // Annotations that are likely mistakes, e.g. a look-alike prefix
+}
+
+// Valid reports whether no annotation has an error
+func (r AnnotationReport) Valid() bool {
+	return len(r.Errors) == 0
+}
+
+// ValidateAnnotations checks the backup annotations of a pod or PVC, which are
+// otherwise only read by the agent of its node, where a typo silently results in no
+// backup or a failed one
+func ValidateAnnotations(annotations map[string]string) AnnotationReport {
+	var report AnnotationReport
+	errorf := func(format string, args ...any) {
+		report.Errors = append(report.Errors, fmt.Sprintf(format, args...))
+	}
+
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := annotations[key]
+		switch key {
+		case cfg.AnnotationEnabled, cfg.AnnotationArchive, cfg.AnnotationDumpOnly, cfg.AnnotationFreeze, cfg.AnnotationExcludeCaches:
+			if lower := strings.ToLower(value); lower != "true" && lower != "false" {
+				errorf("%s must be true or false, got %q", key, value)
+			}
+		case cfg.AnnotationInclude, cfg.AnnotationExclude:
+			for _, pattern := range strings.Split(value, ",") {
+				pattern = strings.TrimSpace(pattern)
+				if pattern == "" {
+					continue
+				}
+				if _, err := filepath.Match(pattern, ""); err != nil {
+					errorf("%s: invalid pattern %q: %v", key, pattern, err)
+				}
+				if strings.Contains(pattern, "..") {
+					errorf("%s: pattern %q leaves the PVC directory", key, pattern)
+				}
+			}
+		case cfg.AnnotationVerifyCommand:
+			if strings.TrimSpace(value) == "" {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s is empty, no verification runs", key))
+			}
+		case cfg.AnnotationDumpCommand:
+			if strings.TrimSpace(value) == "" {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s is empty, no dump is taken", key))
+			}
+		case cfg.AnnotationExcludeIfPresent:
+			for _, marker := range strings.Split(value, ",") {
+				if strings.TrimSpace(marker) == "" {
+					continue
+				}
+				if _, err := parseExcludeMarker(marker); err != nil {
+					errorf("%s: %v", key, err)
+				}
+			}
+		case cfg.AnnotationExcludeLargerThan:
+			if _, err := cfg.ParseSize(value); err != nil {
+				errorf("%s: %v, e.g. 500M or 1G", key, err)
+			}
+		case cfg.AnnotationVolumeSnapshot:
+			if err := checkVolumeSnapshot(value); err != nil {
+				errorf("%s: %v", key, err)
+			}
+			if _, ok := annotations[cfg.AnnotationFreeze]; ok {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s is ignored with %s, snapshots are consistent", cfg.AnnotationFreeze, key))
+			}
+		case cfg.AnnotationDumpFilename:
+			if err := checkDumpFilename(value); err != nil {
+				errorf("%s: %v", key, err)
+			}
+		case cfg.AnnotationPreHook, cfg.AnnotationPostHook:
+			if strings.TrimSpace(value) == "" {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s is empty, no hook runs", key))
+			}
+		case cfg.AnnotationPlans:
+			plans, err := ParsePlans(value)
+			if err != nil {
+				errorf("%s: %v", key, err)
+			}
+			for _, plan := range plans {
+				if err := checkRetention(plan.Retention); err != nil {
+					errorf("%s: plan %s: %v", key, plan.Name, err)
+				}
+			}
+		case cfg.AnnotationTTL:
+			if _, err := parseResticDuration(value); err != nil {
+				errorf("%s: %v, e.g. 30d or 1y", key, err)
+			}
+		case cfg.AnnotationCompression:
+			if err := restic.CheckCompression(strings.ToLower(value)); err != nil {
+				errorf("%s: %v", key, err)
+			}
+		case cfg.AnnotationDescription, cfg.AnnotationHookContainer, cfg.AnnotationVolumeSnapshotClass:
+		default:
+			// Nothing else uses the prefix, other keys are typos. Look-alike prefixes may
+			// belong to other tools and are only warned about.
+			problem := unknownAnnotation(key)
+			switch {
+			case problem == "":
+			case strings.HasPrefix(key, cfg.AnnotationPrefix+"/"):
+				report.Errors = append(report.Errors, problem)
+			default:
+				report.Warnings = append(report.Warnings, problem)
+			}
+		}
+	}
+	return report
+}
+
+// checkRetention validates comma-separated restic keep-within durations
+func checkRetention(retention string) error {
+	for _, keep := range strings.Split(retention, ",") {
+		if keep = strings.TrimSpace(keep); keep == "" {
+			continue
+		}
+		if _, err := parseResticDuration(keep); err != nil {
+			return fmt.Errorf("invalid retention: %v, e.g. 14d or 1y6m", err)
+		}
+	}
+	return nil
+}
+
+// unknownAnnotation returns a warning for a key that looks like a backup annotation
+// but is none, suggesting the closest known one, or empty for unrelated annotations
+func unknownAnnotation(key string) string {
+	prefix, name, ok := strings.Cut(key, "/")
+	if !ok || !strings.Contains(prefix, "local-pvc") {
+		return ""
+	}
+	for _, known := range agentAnnotations {
+		if key == known {
+			return ""
+		}
+	}
+
+	// Suggest the closest known annotation, allowing up to two typos in the name
+	best, distance := "", 3
+	for _, known := range userAnnotations {
+		_, knownName, _ := strings.Cut(known, "/")
+		if d := editDistance(name, knownName); d < distance {
+			best, distance = known, d
+		}
+	}
+	if best == "" {
+		return fmt.Sprintf("unknown annotation %s is ignored by the agents", key)
+	}
+	return fmt.Sprintf("unknown annotation %s is ignored by the agents, did you mean %s?", key, best)
+}
+
+// editDistance returns the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,176 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// Anomaly detection settings
+const (
+	// anomalyStateFile holds the change baselines in the cache directory, which survives
+	// agent restarts
+	anomalyStateFile = "change-baselines.json"
+	// anomalyLearningCycles is the number of backups building a baseline before alerts
+	anomalyLearningCycles = 5
+	// anomalyMinFiles is the number of files below which file ratios are not meaningful
+	anomalyMinFiles = 100
+	// anomalyBaselineWeight is the weight of the latest backup in the moving averages
+	anomalyBaselineWeight = 0.2
+)
+
+// changeBaseline holds the usual changes of the regular backups of a PVC
+type changeBaseline struct {
+	Samples      int     `json:"samples"`
+	DataAdded    float64 `json:"data_added"`    // Average bytes added to the repository per backup
+	ChangedRatio float64 `json:"changed_ratio"` // Average share of new and changed files
+	PackedRatio  float64 `json:"packed_ratio"`  // Average size of the stored data relative to the added data
+	Files        int     `json:"files"`         // Number of files of the last backup
+}
+
+// checkAnomaly compares the changes of a regular backup with the baseline of the PVC
+// and warns when they deviate drastically, e.g. because ransomware encrypted or renamed
+// the files or an application is corrupting its data
+func (m *Manager) checkAnomaly(ctx context.Context, pvc k8s.PVCInfo, summary *restic.BackupSummary) {
+	if m.anomalyFactor <= 0 || !m.featureEnabled(FeatureAnomalyDetection) {
+		return
+	}
+
+	m.baselinesMu.Lock()
+	if m.baselines == nil {
+		m.baselines = m.loadBaselines()
+	}
+	baseline := m.baselines[pvc.UID]
+	reasons := baseline.anomalies(summary, m.anomalyFactor, m.anomalyMinBytes)
+	m.baselines[pvc.UID] = baseline.update(summary)
+	err := m.saveBaselines()
+	m.baselinesMu.Unlock()
+	if err != nil {
+		m.log.Warnf("Failed to save change baselines: %v", err)
+	}
+
+	labels := pvcLabels(pvc)
+	if len(reasons) == 0 {
+		m.metrics.Set(metricPVCChangeAnomaly, labels, 0)
+		return
+	}
+	m.metrics.Set(metricPVCChangeAnomaly, labels, 1)
+
+	message := fmt.Sprintf("Unusual changes in snapshot %s: %s", summary.SnapshotID, strings.Join(reasons, "; "))
+	m.log.Warnf("PVC %s/%s: %s", pvc.Namespace, pvc.Name, message)
+	if err := m.k8sClient.RecordPVCEvent(ctx, pvc, "BackupChangeAnomaly", message); err != nil {
+		m.log.Errorf("%v", err)
+	}
+}
+
+// anomalies returns the ways a backup deviates from the baseline
+func (b changeBaseline) anomalies(summary *restic.BackupSummary, factor float64, minBytes uint64) []string {
+	if b.Samples < anomalyLearningCycles {
+		return nil
+	}
+
+	var reasons []string
+	added := float64(summary.DataAdded)
+	if summary.DataAdded >= minBytes && added > factor*b.DataAdded {
+		reasons = append(reasons, fmt.Sprintf("%s added, %.0fx the usual %s",
+			FormatBytes(summary.DataAdded), added/max(b.DataAdded, 1), FormatBytes(uint64(b.DataAdded))))
+	}
+
+	if summary.TotalFilesProcessed >= anomalyMinFiles {
+		ratio := changedRatio(summary)
+		if ratio >= 0.5 && ratio > factor*b.ChangedRatio {
+			reasons = append(reasons, fmt.Sprintf("%.0f%% of the files are new or changed, usually %.1f%%", ratio*100, b.ChangedRatio*100))
+		}
+	}
+
+	// Renamed files show up as new files while as many files are gone
+	if b.Files >= anomalyMinFiles {
+		deleted := b.Files - summary.FilesUnmodified - summary.FilesChanged
+		if renamed := min(summary.FilesNew, deleted); float64(renamed) >= 0.3*float64(b.Files) {
+			reasons = append(reasons, fmt.Sprintf("about %d of %d files were replaced by new files, as when renamed", renamed, b.Files))
+		}
+	}
+
+	// Encrypted data does not compress, while the data of the PVC usually did
+	if summary.DataAdded >= minBytes && b.PackedRatio > 0 && b.PackedRatio < 0.7 && packedRatio(summary) > 0.95 {
+		reasons = append(reasons, fmt.Sprintf("the new data is incompressible, usually it compresses to %.0f%%", b.PackedRatio*100))
+	}
+	return reasons
+}
+
+// update returns the baseline including a backup
+func (b changeBaseline) update(summary *restic.BackupSummary) changeBaseline {
+	average := func(current, sample float64) float64 {
+		if b.Samples == 0 {
+			return sample
+		}
+		return (1-anomalyBaselineWeight)*current + anomalyBaselineWeight*sample
+	}
+
+	b.DataAdded = average(b.DataAdded, float64(summary.DataAdded))
+	b.ChangedRatio = average(b.ChangedRatio, changedRatio(summary))
+	// Backups adding little data say nothing about its compression
+	if summary.DataAdded >= minThroughputSample {
+		if b.PackedRatio == 0 {
+			b.PackedRatio = packedRatio(summary)
+		} else {
+			b.PackedRatio = average(b.PackedRatio, packedRatio(summary))
+		}
+	}
+	b.Files = summary.TotalFilesProcessed
+	b.Samples++
+	return b
+}
+
+// changedRatio returns the share of new and changed files of a backup
+func changedRatio(summary *restic.BackupSummary) float64 {
+	if summary.TotalFilesProcessed == 0 {
+		return 0
+	}
+	return float64(summary.FilesNew+summary.FilesChanged) / float64(summary.TotalFilesProcessed)
+}
+
+// packedRatio returns the size of the stored data relative to the added data
+func packedRatio(summary *restic.BackupSummary) float64 {
+	if summary.DataAdded == 0 {
+		return 0
+	}
+	return float64(summary.DataAddedPacked) / float64(summary.DataAdded)
+}
+
+// loadBaselines reads the change baselines, starting over when they cannot be read
+func (m *Manager) loadBaselines() map[string]changeBaseline {
+	baselines := make(map[string]changeBaseline)
+	data, err := os.ReadFile(filepath.Join(m.cachePath, anomalyStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return baselines
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &baselines)
+	}
+	if err != nil {
+		m.log.Warnf("Failed to read change baselines, learning them again: %v", err)
+		return make(map[string]changeBaseline)
+	}
+	return baselines
+}
+
+// saveBaselines writes the change baselines
+func (m *Manager) saveBaselines() error {
+	data, err := json.Marshal(m.baselines)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(m.cachePath, anomalyStateFile)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
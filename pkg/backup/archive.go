@@ -0,0 +1,42 @@
+package backup
+
+import (
+	"context"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// skipArchived drops the archive PVCs that already have a snapshot, their data is frozen
+// so a single backup is enough
+func (m *Manager) skipArchived(ctx context.Context, pvcs []k8s.PVCInfo) []k8s.PVCInfo {
+	var pending []k8s.PVCInfo
+	for _, pvc := range pvcs {
+		if pvc.Config.Archive {
+			archived, err := m.archived(ctx, pvc)
+			if err != nil {
+				m.log.Warnf("Failed to check for the snapshot of archive PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+			}
+			if archived {
+				m.log.Debugf("Archive PVC %s/%s is backed up, skipping", pvc.Namespace, pvc.Name)
+				continue
+			}
+		}
+		pending = append(pending, pvc)
+	}
+	return pending
+}
+
+// archived reports whether an archive PVC has a snapshot in its repository. It is checked
+// every cycle, so an archive whose snapshot was forgotten is backed up again.
+func (m *Manager) archived(ctx context.Context, pvc k8s.PVCInfo) (bool, error) {
+	client, err := m.repositoryFor(ctx, pvc)
+	if err != nil {
+		return false, err
+	}
+	snapshots, err := client.Snapshots(ctx, []string{restic.PVCIDTagPrefix + pvc.UID})
+	if err != nil {
+		return false, err
+	}
+	return len(snapshots) > 0, nil
+}
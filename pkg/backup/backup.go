@@ -2,67 +2,316 @@ package backup
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/monlor/local-pvc-backup/pkg/artifact"
 	cfg "github.com/monlor/local-pvc-backup/pkg/config"
 	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/logging"
+	"github.com/monlor/local-pvc-backup/pkg/metrics"
+	"github.com/monlor/local-pvc-backup/pkg/notify"
 	"github.com/monlor/local-pvc-backup/pkg/restic"
+	"github.com/monlor/local-pvc-backup/pkg/storage"
+	"github.com/monlor/local-pvc-backup/pkg/tracing"
 	"github.com/sirupsen/logrus"
 )
 
 // Manager handles the backup operations
 type Manager struct {
-	resticClient *restic.Client
-	k8sClient    *k8s.Client
-	storagePath  string
-	interval     time.Duration
-	retention    string
-	log          *logrus.Logger
+	resticClient          *restic.Client
+	k8sClient             *k8s.Client
+	metrics               *metrics.Registry
+	storagePath           string
+	cachePath             string
+	cacheMaxSize          uint64 // Size of the cache directory above which cache files are evicted, 0 for no limit
+	interval              time.Duration
+	retention             string
+	checkInterval         time.Duration
+	checkReadDataSubset   string
+	pruneInterval         time.Duration
+	clockEndpoint         string // Endpoint the node clock is compared against, empty skips the check
+	clockClient           *http.Client
+	clockSkewThreshold    time.Duration
+	leaderElection        bool
+	leaseNamespace        string
+	leaseName             string
+	leader                atomic.Bool
+	stopElection          context.CancelFunc // Leaves the maintenance leader election, nil when not taking part
+	featureConfig         map[string]bool    // Feature flags of the configuration
+	features              map[string]bool    // Feature flags in effect on this node, nil until refreshed
+	featuresMu            sync.Mutex
+	throughput            float64 // Observed repository throughput in bytes per second
+	throughputMu          sync.Mutex
+	policy                Policy
+	uploadLimit           uint64 // Overrides the upload limit of the policy when set, e.g. by the seed
+	quotas                map[string]Quota
+	classPolicies         map[string]ClassPolicy
+	repoLayout            string
+	appendOnly            bool // The repositories refuse deletes, retention is applied by the server owner
+	listStorage           storageLister
+	replica               cfg.ReplicaConfig
+	replicaReady          map[string]bool // Replica repositories known to exist
+	shardedRepositories   map[string]*restic.Client
+	shardedRepositoriesMu sync.Mutex
+	running               map[string]bool // PVCs being backed up by UID, by the cycle or through the API
+	runningMu             sync.Mutex
+	deviceSlots           map[string]chan struct{} // Backup slots of each device, shared with the triggered backups
+	deviceSlotsMu         sync.Mutex
+	clusterRepositories   []*restic.Client // Repositories of all nodes, maintained in the controller role
+	role                  string           // Role of the manager: standalone, agent or controller
+	planRepositories      map[string]*restic.Client
+	planRuns              map[string]time.Time            // Start of the cycle of the last backup of each PVC plan
+	nextRuns              map[string]map[string]time.Time // Next due backups by PVC UID, by plan, "" for the regular backups
+	plansMu               sync.Mutex
+	startedAt             time.Time
+	lastSuccess           time.Time // End of the last successful backup cycle
+	anomalyFactor         float64
+	anomalyMinBytes       uint64
+	baselines             map[string]changeBaseline // Change baselines by PVC UID, loaded on first use
+	baselinesMu           sync.Mutex
+	estimate              string          // PVCs whose backups are estimated with a dry-run first: off, new or always
+	backedUp              map[string]bool // UIDs of the PVCs known to have a snapshot, for the new estimate mode
+	backedUpMu            sync.Mutex
+	changeDetection       string                // Skips the regular backups of unchanged PVCs: off, mtime or dry-run
+	changeMaxAge          time.Duration         // Age of the last backup after which a PVC is backed up even unchanged
+	lastBackups           map[string]lastBackup // Last regular backups by PVC UID, loaded on first use
+	lastBackupsMu         sync.Mutex
+	repoMaxSize           uint64          // Size above which retention is applied early to a repository, 0 for no limit
+	repoQuotaPause        bool            // Skip the backups into repositories over the size quota
+	overQuota             map[string]bool // Repositories over the size quota at the last check
+	quotaMu               sync.Mutex
+	diffReport            bool          // Report the changes of each regular backup against the previous snapshot
+	compression           string        // Default compression of the backups, overridden by the PVC annotation
+	excludeCaches         bool          // Skip directories tagged with CACHEDIR.TAG, overridden by the PVC annotation
+	ignoreFile            string        // File of exclude patterns at the root of the PVCs, empty disables it
+	oneFileSystem         bool          // Do not back up other filesystems mounted inside the PVC directories
+	skipSpecialFiles      bool          // Do not back up sockets, named pipes and device files
+	mountCheckTimeout     time.Duration // Time a PVC directory has to answer the mount check, 0 disables it
+	hookTimeout           time.Duration // Time the pre and post-backup hooks have to complete, 0 for no limit
+	freezeTimeout         time.Duration // Time after which a frozen filesystem is thawed, 0 for no limit
+	lvmSnapshotSize       string        // Size of the snapshots of thick logical volumes, e.g. 10%ORIGIN or 5G
+	csiClone              k8s.CSICloneOptions
+	deviceConcurrency     int    // Number of PVCs on the same device backed up in parallel, 0 for no limit
+	statusAnnotations     bool   // Annotate the PVCs with the outcome of their last backup
+	statusResource        string // Store of the PVC backup statuses, resolved on first use
+	statusResourceOnce    sync.Once
+	operator              bool               // Run the BackupSchedules selecting PVCs of the node
+	artifacts             *artifact.Uploader // Uploads the backup cycle manifests, nil when disabled
+	cycleFailures         map[string]int     // Failed backups of the last cycle by namespace
+	cycleMu               sync.Mutex
+	report                cfg.ReportConfig
+	smtp                  cfg.SMTPConfig      // SMTP server the reports are emailed through
+	notifier              *notify.Dispatcher  // Notifies backup and maintenance failures, nil when disabled
+	pinger                *notify.Pinger      // Pings the dead man's switch around backup cycles, nil when disabled
+	proxy                 cfg.ProxyConfig     // Proxy of the agent's own HTTP traffic
+	reloads               chan reloadSettings // Settings of a reloaded configuration, applied by the backup loop
+	log                   *logrus.Logger
 }
 
 // NewManager creates a new backup manager
-func NewManager(config *cfg.Config, k8sClient *k8s.Client, resticClient *restic.Client, log *logrus.Logger) (*Manager, error) {
-	// Ensure restic repository is initialized
-	if err := resticClient.EnsureRepository(context.Background()); err != nil {
-		return nil, fmt.Errorf("failed to ensure restic repository: %v", err)
+func NewManager(config *cfg.Config, k8sClient *k8s.Client, resticClient *restic.Client, reg *metrics.Registry, log *logrus.Logger) (*Manager, error) {
+	// Ensure restic repository is initialized, sharded repositories are initialized on first backup
+	if !resticClient.Sharded() {
+		if err := resticClient.EnsureRepository(context.Background()); err != nil {
+			return nil, fmt.Errorf("failed to ensure restic repository: %v", err)
+		}
 	}
+	return newManager(config, k8sClient, resticClient, reg, log)
+}
 
-	return &Manager{
-		resticClient: resticClient,
-		k8sClient:    k8sClient,
-		storagePath:  config.BackupConfig.StoragePath,
-		interval:     config.BackupConfig.BackupInterval,
-		retention:    config.BackupConfig.Retention,
-		log:          log,
-	}, nil
+// NewOfflineManager creates a backup manager that never contacts the repository, for
+// the commands reporting what the backups would do
+func NewOfflineManager(config *cfg.Config, k8sClient *k8s.Client, resticClient *restic.Client, log *logrus.Logger) (*Manager, error) {
+	return newManager(config, k8sClient, resticClient, metrics.NewRegistry(), log)
 }
 
-// NewManagerWithClients creates a new backup manager with existing clients
-func NewManagerWithClients(config *cfg.Config, k8sClient *k8s.Client, resticClient *restic.Client, log *logrus.Logger) (*Manager, error) {
-	// Ensure restic repository is initialized
-	if err := resticClient.EnsureRepository(context.Background()); err != nil {
-		return nil, fmt.Errorf("failed to ensure restic repository: %v", err)
+func newManager(config *cfg.Config, k8sClient *k8s.Client, resticClient *restic.Client, reg *metrics.Registry, log *logrus.Logger) (*Manager, error) {
+	throughput, err := cfg.ParseSize(config.BackupConfig.RestoreThroughput)
+	if err != nil {
+		return nil, fmt.Errorf("invalid restore throughput: %v", err)
+	}
+
+	policy, err := ParsePolicy(config.BackupConfig.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	quotas, err := ParseQuotas(config.BackupConfig.NamespaceQuotas)
+	if err != nil {
+		return nil, err
+	}
+
+	classPolicies, err := ParseClassPolicies(config.BackupConfig.ClassPolicies)
+	if err != nil {
+		return nil, err
+	}
+
+	featureConfig, err := parseFeatureConfig(config.BackupConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	anomalyMinBytes, err := cfg.ParseSize(config.BackupConfig.AnomalyMinSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid anomaly minimum size: %v", err)
+	}
+
+	repoMaxSize, err := cfg.ParseSize(config.BackupConfig.RepoMaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository maximum size: %v", err)
+	}
+
+	cacheMaxSize, err := cfg.ParseSize(config.ResticConfig.CacheMaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache maximum size: %v", err)
+	}
+
+	if err := restic.CheckStorageClass(config.ReplicaConfig.StorageClass); err != nil {
+		return nil, fmt.Errorf("invalid replica storage class: %v", err)
+	}
+	if err := restic.CheckEndpoint("REPLICA_ENDPOINT", config.ReplicaConfig.Endpoint); err != nil {
+		return nil, err
+	}
+
+	if err := restic.CheckCompression(config.BackupConfig.Compression); err != nil {
+		return nil, err
+	}
+	if err := checkEstimate(config.BackupConfig.Estimate); err != nil {
+		return nil, err
+	}
+	if err := checkChangeDetection(config.BackupConfig.ChangeDetection); err != nil {
+		return nil, err
+	}
+
+	notifier, err := notify.New(notify.Options{
+		Config:     config.NotifyConfig,
+		Node:       k8sClient.GetNodeName(),
+		Proxy:      config.BackupConfig.ProxyConfig,
+		Kubernetes: k8sClient,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid notifications: %v", err)
 	}
 
-	return &Manager{
-		resticClient: resticClient,
-		k8sClient:    k8sClient,
-		storagePath:  config.BackupConfig.StoragePath,
-		interval:     config.BackupConfig.BackupInterval,
-		retention:    config.BackupConfig.Retention,
-		log:          log,
-	}, nil
+	var artifacts *artifact.Uploader
+	if config.ArtifactConfig.Manifests {
+		if artifacts, err = artifact.NewUploader(config, log); err != nil {
+			return nil, fmt.Errorf("failed to set up artifacts: %v", err)
+		}
+	}
+
+	registerMetrics(reg)
+
+	m := &Manager{
+		resticClient:        resticClient,
+		k8sClient:           k8sClient,
+		metrics:             reg,
+		storagePath:         config.BackupConfig.StoragePath,
+		cachePath:           config.ResticConfig.CachePath,
+		cacheMaxSize:        cacheMaxSize,
+		interval:            config.BackupConfig.BackupInterval,
+		retention:           config.BackupConfig.Retention,
+		checkInterval:       config.BackupConfig.CheckInterval,
+		checkReadDataSubset: config.BackupConfig.CheckReadDataSubset,
+		pruneInterval:       config.BackupConfig.PruneInterval,
+		clockEndpoint:       clockEndpoint(config),
+		clockClient:         storage.HTTPClient(config.ResticConfig.ProxyConfig),
+		clockSkewThreshold:  config.BackupConfig.ClockSkewThreshold,
+		leaderElection:      config.BackupConfig.LeaderElection,
+		featureConfig:       featureConfig,
+		leaseNamespace:      config.BackupConfig.LeaseNamespace,
+		leaseName:           config.BackupConfig.LeaseName,
+		throughput:          float64(throughput),
+		policy:              policy,
+		quotas:              quotas,
+		classPolicies:       classPolicies,
+		repoLayout:          config.BackupConfig.RepoLayout,
+		appendOnly:          config.BackendType == cfg.BackendREST && config.RESTConfig.AppendOnly,
+		listStorage:         newStorageLister(config, log),
+		replica:             config.ReplicaConfig,
+		replicaReady:        make(map[string]bool),
+		shardedRepositories: make(map[string]*restic.Client),
+		planRepositories:    make(map[string]*restic.Client),
+		planRuns:            make(map[string]time.Time),
+		nextRuns:            make(map[string]map[string]time.Time),
+		startedAt:           time.Now(),
+		anomalyFactor:       config.BackupConfig.AnomalyFactor,
+		anomalyMinBytes:     anomalyMinBytes,
+		compression:         config.BackupConfig.Compression,
+		excludeCaches:       config.BackupConfig.ExcludeCaches,
+		ignoreFile:          config.BackupConfig.IgnoreFile,
+		oneFileSystem:       config.BackupConfig.OneFileSystem,
+		skipSpecialFiles:    config.BackupConfig.SkipSpecialFiles,
+		estimate:            config.BackupConfig.Estimate,
+		backedUp:            make(map[string]bool),
+		changeDetection:     config.BackupConfig.ChangeDetection,
+		changeMaxAge:        config.BackupConfig.ChangeMaxAge,
+		diffReport:          config.BackupConfig.DiffReport,
+		repoMaxSize:         repoMaxSize,
+		repoQuotaPause:      config.BackupConfig.RepoQuotaPause,
+		overQuota:           make(map[string]bool),
+		mountCheckTimeout:   config.BackupConfig.MountCheckTimeout,
+		hookTimeout:         config.BackupConfig.HookTimeout,
+		freezeTimeout:       config.BackupConfig.FreezeTimeout,
+		lvmSnapshotSize:     config.BackupConfig.LVMSnapshotSize,
+		csiClone: k8s.CSICloneOptions{
+			ReaderImage: config.BackupConfig.CSIReaderImage,
+			KubeletDir:  config.BackupConfig.KubeletDir,
+			Timeout:     config.BackupConfig.CSITimeout,
+		},
+		deviceConcurrency: config.BackupConfig.DeviceConcurrency,
+		deviceSlots:       make(map[string]chan struct{}),
+		running:           make(map[string]bool),
+		statusAnnotations: config.BackupConfig.StatusAnnotations,
+		statusResource:    config.BackupConfig.StatusResource,
+		operator:          config.BackupConfig.Operator,
+		role:              managerRole(config),
+		artifacts:         artifacts,
+		report:            config.ReportConfig,
+		smtp:              config.SMTPConfig,
+		notifier:          notifier,
+		pinger:            notify.NewPinger(config.NotifyConfig, k8sClient.GetNodeName(), config.BackupConfig.ProxyConfig),
+		proxy:             config.BackupConfig.ProxyConfig,
+		reloads:           make(chan reloadSettings, 1),
+		log:               log,
+	}
+	// Commands running without the backup loop honor the feature flags too
+	m.features = m.resolveFeatures(context.Background())
+	resticClient.SetAutoUnlock(m.features[FeatureAutoUnlock])
+	return m, nil
+}
+
+// NewManagerWithClients creates a new backup manager with existing clients
+func NewManagerWithClients(config *cfg.Config, k8sClient *k8s.Client, resticClient *restic.Client, reg *metrics.Registry, log *logrus.Logger) (*Manager, error) {
+	return NewManager(config, k8sClient, resticClient, reg, log)
 }
 
 // StartBackupLoop starts the backup loop
 func (m *Manager) StartBackupLoop(ctx context.Context) error {
-	// 立即执行一次备份
-	if err := m.performBackups(ctx); err != nil {
+	// Elect the node running repository maintenance, unless disabled on this node
+	m.refreshFeatures(ctx)
+	m.logFeatures()
+	m.updateElection(ctx)
+	m.thawLeftovers(ctx)
+	m.checkVolumeSnapshots(ctx)
+
+	// 立即执行一次备份, in the slot of the node when a controller staggers the agents
+	if !m.waitForSlot(ctx) {
+		return nil
+	}
+	err := m.runCycle(ctx)
+	if err != nil {
 		m.log.Errorf("Initial backup failed: %v", err)
 	}
+	m.reportStatus(ctx, err)
 
 	// 创建定时器
 	ticker := time.NewTicker(m.interval)
@@ -70,18 +319,77 @@ func (m *Manager) StartBackupLoop(ctx context.Context) error {
 
 	m.log.Infof("Starting backup loop with interval: %v", m.interval)
 
+	// Schedule deep repository checks, checkC stays nil when disabled
+	var checkC <-chan time.Time
+	if m.checkInterval > 0 {
+		checkTicker := time.NewTicker(m.checkInterval)
+		defer checkTicker.Stop()
+		checkC = checkTicker.C
+		m.log.Infof("Scheduling deep repository checks every %v, reading %s of data", m.checkInterval, m.checkReadDataSubset)
+	}
+
+	// Schedule prunes separately from the backup cycle, pruneC stays nil when
+	// prunes run along with every forget
+	var pruneC <-chan time.Time
+	if m.pruneInterval > 0 {
+		pruneTicker := time.NewTicker(m.pruneInterval)
+		defer pruneTicker.Stop()
+		pruneC = pruneTicker.C
+		m.log.Infof("Scheduling repository prunes every %v", m.pruneInterval)
+	}
+
+	// Schedule copies to the secondary repository, replicateC stays nil when disabled
+	var replicateC <-chan time.Time
+	if m.replicationEnabled() && m.replica.Interval > 0 {
+		replicateTicker := time.NewTicker(m.replica.Interval)
+		defer replicateTicker.Stop()
+		replicateC = replicateTicker.C
+		m.log.Infof("Scheduling replication to %s/%s every %v", m.replica.Endpoint, m.replica.Bucket, m.replica.Interval)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
+		case settings := <-m.reloads:
+			m.applyReload(settings, ticker)
 		case <-ticker.C:
-			if err := m.performBackups(ctx); err != nil {
+			if !m.waitForSlot(ctx) {
+				return nil
+			}
+			m.refreshFeatures(ctx)
+			m.updateElection(ctx)
+			err := m.runCycle(ctx)
+			if err != nil {
 				m.log.Errorf("Error performing backups: %v", err)
 			}
+			m.reportStatus(ctx, err)
+			m.performReport(ctx)
+		case <-checkC:
+			if err := m.traced(ctx, operationCheck, m.performCheck); err != nil {
+				m.log.Errorf("Error checking repository: %v", err)
+			}
+		case <-pruneC:
+			if err := m.traced(ctx, operationPrune, m.performPrune); err != nil {
+				m.log.Errorf("Error pruning repository: %v", err)
+			}
+		case <-replicateC:
+			if err := m.traced(ctx, operationReplicate, m.performReplication); err != nil {
+				m.log.Errorf("Error replicating repository: %v", err)
+			}
 		}
 	}
 }
 
+// excludesCaches reports whether the backups of a PVC skip the content of directories
+// tagged with CACHEDIR.TAG
+func (m *Manager) excludesCaches(pvc k8s.PVCInfo) bool {
+	if pvc.Config.ExcludeCaches != nil {
+		return *pvc.Config.ExcludeCaches
+	}
+	return m.excludeCaches
+}
+
 // processPatterns processes comma-separated pattern string and returns a list of patterns with base path
 func (m *Manager) processPatterns(basePath, patternStr string) []string {
 	if patternStr == "" {
@@ -103,53 +411,464 @@ func (m *Manager) processPatterns(basePath, patternStr string) []string {
 
 // performBackups performs the backup operation for all eligible PVCs
 func (m *Manager) performBackups(ctx context.Context) error {
-	pvcs, err := m.k8sClient.GetPVCsToBackup(ctx)
+	m.checkClockSkew(ctx)
+	m.recoverInterrupted(ctx)
+
+	discoverCtx, span := tracing.Start(ctx, "discover")
+	pvcs, err := m.k8sClient.GetPVCsToBackup(discoverCtx)
+	span.SetAttributes("pvcs", len(pvcs))
+	span.End(err)
 	if err != nil {
 		return fmt.Errorf("failed to get PVCs to backup: %v", err)
 	}
 
 	if len(pvcs) == 0 {
 		m.log.Info("No PVCs to backup")
-		return nil
+		return m.performSchedules(ctx)
 	}
 
-	// Prepare backup paths and exclude patterns
-	backupPaths := []string{}
-	excludePatterns := []string{}
+	pvcs = m.skipArchived(ctx, m.enforceQuotas(ctx, pvcs))
+	pvcs = m.pauseOverQuota(ctx, pvcs, m.checkRepositoryQuotas(ctx, pvcs))
+	regular := m.enforceClassification(ctx, pvcs)
 
-	// Add backup paths and exclude rules for each enabled PVC
-	for _, pvc := range pvcs {
-		m.log.Infof("Configuring backup for PVC %s/%s, include: %s, exclude: %s", pvc.Namespace, pvc.Name, pvc.Config.Include, pvc.Config.Exclude)
+	rule := m.policy.Evaluate(time.Now())
+	m.log.Infof("Backing up %d PVCs with %s", len(regular), rule)
 
-		// Add base PVC path if no include paths specified
-		if pvc.Config.Include == "" {
-			backupPaths = append(backupPaths, pvc.Path)
-		} else {
-			// Process include paths
-			if paths := m.processPatterns(pvc.Path, pvc.Config.Include); len(paths) > 0 {
-				backupPaths = append(backupPaths, paths...)
+	// Back up up to the allowed number of PVCs at once, and of PVCs on the same device,
+	// stopping at the first failure. PVCs with unhealthy mounts are skipped without
+	// stopping the others.
+	devices, regular := m.newDeviceScheduler(ctx, regular)
+	manifest := newManifestRecorder(m.k8sClient.GetNodeName())
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		errs     []error
+		skipped  []error
+		backedUp int
+	)
+	slots := make(chan struct{}, rule.Concurrency)
+	for _, pvc := range regular {
+		slots <- struct{}{}
+		mu.Lock()
+		failed := len(errs) > 0
+		mu.Unlock()
+		if failed {
+			<-slots
+			break
+		}
+
+		wg.Add(1)
+		go func(pvc k8s.PVCInfo) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			finish, ok := m.startBackup(pvc)
+			if !ok {
+				m.log.WithFields(pvcFields(pvc)).Infof("Skipping backup of PVC %s/%s, a backup of it is already running", pvc.Namespace, pvc.Name)
+				return
+			}
+			defer finish()
+			release := devices.acquire(pvc)
+			defer release()
+			if m.unchanged(ctx, pvc) {
+				m.recordStatus(ctx, pvc, nil, errors.New("Backup skipped, the PVC is unchanged since its last backup"), pvcStatusSkipped)
+				return
+			}
+			started := time.Now()
+			ctx, span := tracing.Start(ctx, "backup pvc", logging.FieldNamespace, pvc.Namespace, logging.FieldPVC, pvc.Name)
+			summary, err := m.backupPVC(ctx, pvc, pvc.Config.Description)
+			if summary != nil {
+				span.SetAttributes(logging.FieldSnapshotID, summary.SnapshotID, "bytes_added", summary.DataAdded)
 			}
+			span.End(err)
+			manifest.record(pvc, summary, err)
+			var mountErr *MountError
+			if errors.As(err, &mountErr) {
+				m.log.WithFields(pvcFields(pvc)).Warnf("Skipping backup of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+				m.recordStatus(ctx, pvc, nil, err, pvcStatusSkipped)
+				if err := m.k8sClient.RecordPVCEvent(ctx, pvc, "BackupMountUnhealthy", err.Error()); err != nil {
+					m.log.Errorf("%v", err)
+				}
+				mu.Lock()
+				skipped = append(skipped, err)
+				mu.Unlock()
+				return
+			}
+			if err != nil {
+				m.recordStatus(ctx, pvc, summary, err, pvcStatusFailed)
+				m.notify(ctx, notify.Event{Kind: notify.EventBackupFailed, Namespace: pvc.Namespace, PVC: pvc.Name, PVCUID: pvc.UID, Error: err.Error()})
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return
+			}
+			m.recordStatus(ctx, pvc, summary, nil, pvcStatusSuccess)
+			m.recordLastBackup(pvc, started, summary)
+			mu.Lock()
+			backedUp++
+			mu.Unlock()
+			m.checkAnomaly(ctx, pvc, summary)
+			m.reportChanges(ctx, pvc, summary)
+		}(pvc)
+	}
+	wg.Wait()
+	m.cycleMu.Lock()
+	m.cycleFailures = manifest.failures()
+	m.cycleMu.Unlock()
+	m.uploadManifest(ctx, manifest)
+	if len(errs) > 0 {
+		errs = append(errs, skipped...)
+		err := errors.Join(errs...)
+		if backedUp > 0 {
+			return &PartialError{Err: err, Succeeded: backedUp, Failed: len(errs)}
+		}
+		return err
+	}
+
+	// Unhealthy mounts only concern their own PVCs, the maintenance of the others still runs
+	if len(skipped) > 0 {
+		m.log.Warnf("Skipped %d of %d PVCs with unhealthy mounts", len(skipped), len(regular))
+	}
+
+	if err := m.performExpiry(ctx); err != nil {
+		m.log.Errorf("Error expiring backups of deleted PVCs: %v", err)
+	}
+
+	// Clean up old backups using global retention policy, pruning right away
+	// unless prunes have their own schedule
+	if m.appendOnly {
+		m.log.Debug("Append-only repository, skipping retention")
+	} else if m.deletionsAllowed(ctx, "retention") {
+		for _, client := range m.repositories() {
+			if err := client.Forget(ctx, m.retention, m.pruneInterval == 0 && m.isMaintenanceLeader()); err != nil {
+				m.log.Errorf("Error cleaning up old backups: %v", err)
+			}
+		}
+	}
+
+	return errors.Join(m.performPlans(ctx, pvcs), m.performSchedules(ctx), errors.Join(skipped...))
+}
+
+// PartialError reports a backup cycle in which some PVCs were backed up and others failed
+type PartialError struct {
+	Err       error
+	Succeeded int
+	Failed    int
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d of %d PVCs failed: %v", e.Failed, e.Succeeded+e.Failed, e.Err)
+}
+
+// RunOnce performs a single backup cycle and reports its status, for CronJobs and CI
+// pipelines running the agent instead of the backup loop
+func (m *Manager) RunOnce(ctx context.Context) error {
+	m.thawLeftovers(ctx)
+	err := m.runCycle(ctx)
+	m.reportStatus(ctx, err)
+	return err
+}
+
+// runCycle performs a traced backup cycle, pinging the dead man's switch at its start
+// and end
+func (m *Manager) runCycle(ctx context.Context) error {
+	if err := m.pinger.Start(ctx); err != nil {
+		m.log.Warnf("Failed to ping start of backup cycle: %v", err)
+	}
+	err := m.traced(ctx, "backup cycle", m.performBackups)
+	// The monitoring service is outside the cluster, the error must not leak credentials
+	failure := err
+	if err != nil {
+		failure = errors.New(logging.Redact(m.log, err.Error()))
+	}
+	if pingErr := m.pinger.Finish(ctx, failure); pingErr != nil {
+		m.log.Warnf("Failed to ping end of backup cycle: %v", pingErr)
+	}
+	m.manageCache(ctx)
+	return err
+}
+
+// backupPVC backs up a single PVC, tagging the snapshot with the description if set
+// and with the extra tags
+func (m *Manager) backupPVC(ctx context.Context, pvc k8s.PVCInfo, description string, tags ...string) (*restic.BackupSummary, error) {
+	client, err := m.repositoryFor(ctx, pvc)
+	if err != nil {
+		return nil, err
+	}
+	return m.backupPVCTo(ctx, client, pvc, description, tags...)
+}
+
+// backupPVCTo backs up a single PVC into the repository of the given client and
+// verifies the backup
+func (m *Manager) backupPVCTo(ctx context.Context, client *restic.Client, pvc k8s.PVCInfo, description string, tags ...string) (*restic.BackupSummary, error) {
+	summary, err := m.snapshotPVC(ctx, client, pvc, description, tags...)
+	if err != nil {
+		return nil, err
+	}
+
+	// A failed verification does not invalidate the backup itself
+	if err := m.verifyBackup(ctx, client, pvc, summary.SnapshotID); err != nil {
+		m.log.WithFields(pvcFields(pvc)).WithField(logging.FieldSnapshotID, summary.SnapshotID).Errorf("Failed to verify backup of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+	return summary, nil
+}
+
+// snapshotPVC backs up a single PVC into the repository of the given client
+func (m *Manager) snapshotPVC(ctx context.Context, client *restic.Client, pvc k8s.PVCInfo, description string, tags ...string) (*restic.BackupSummary, error) {
+	m.log.WithFields(pvcFields(pvc)).Infof("Configuring backup for PVC %s/%s, include: %s, exclude: %s", pvc.Namespace, pvc.Name, pvc.Config.Include, pvc.Config.Exclude)
+	backupPaths, opts := m.backupOptions(pvc, description, tags)
+
+	// A dump is read from the application pod, not from the PVC directory
+	dumpOnly := pvc.Config.DumpOnly && pvc.Config.DumpCommand != ""
+	if !dumpOnly {
+		if err := m.checkMount(ctx, client, pvc); err != nil {
+			return nil, err
+		}
+		m.estimateBackup(ctx, client, pvc, backupPaths, opts)
+	}
+
+	// The post-hook also runs when the pre-hook or the backup failed, so an application
+	// told to pause writes always resumes them
+	if err := m.runHook(ctx, pvc, "pre-hook", pvc.Config.PreHook); err != nil {
+		m.runPostHook(ctx, pvc)
+		return nil, fmt.Errorf("failed to backup PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+
+	// Execute backup for this PVC, the files first and then the dump
+	start := time.Now()
+	var summary *restic.BackupSummary
+	var err error
+	if !dumpOnly {
+		summary, err = m.backupFiles(ctx, client, pvc, backupPaths, opts)
+	}
+	if err == nil && pvc.Config.DumpCommand != "" {
+		var dump *restic.BackupSummary
+		if dump, err = m.dumpPVC(ctx, client, pvc, opts); summary == nil {
+			summary = dump
 		}
+	}
+	m.runPostHook(ctx, pvc)
+	if err != nil {
+		m.log.WithFields(pvcFields(pvc)).WithField(logging.FieldDuration, time.Since(start).Seconds()).Errorf("Backup of PVC %s/%s failed: %v", pvc.Namespace, pvc.Name, err)
+		return nil, fmt.Errorf("failed to backup PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+	m.recordBackup(ctx, pvc, summary)
+
+	m.log.WithFields(pvcFields(pvc)).WithFields(logrus.Fields{
+		logging.FieldSnapshotID: summary.SnapshotID,
+		logging.FieldDuration:   summary.Duration().Seconds(),
+	}).Infof("Backed up PVC %s/%s to snapshot %s", pvc.Namespace, pvc.Name, summary.SnapshotID)
+	return summary, nil
+}
+
+// backupOptions returns the paths and options restic backs up a PVC with
+func (m *Manager) backupOptions(pvc k8s.PVCInfo, description string, tags []string) ([]string, restic.BackupOptions) {
+	// Add base PVC path if no include paths specified
+	backupPaths := []string{pvc.Path}
+	if pvc.Config.Include != "" {
+		// Process include paths
+		backupPaths = m.processPatterns(pvc.Path, pvc.Config.Include)
+	}
 
-		// Process exclude patterns
-		if patterns := m.processPatterns(pvc.Path, pvc.Config.Exclude); len(patterns) > 0 {
-			excludePatterns = append(excludePatterns, patterns...)
+	opts := restic.BackupOptions{
+		PVCID:         pvc.UID,
+		PVCName:       pvc.Name,
+		Namespace:     pvc.Namespace,
+		Tags:          tags,
+		LimitUpload:   m.policy.Evaluate(time.Now()).BackupUploadLimit(),
+		Compression:   m.compression,
+		ExcludeCaches: m.excludesCaches(pvc),
+		OneFileSystem: m.oneFileSystem,
+	}
+	// The ignore file lets volume owners exclude files without Kubernetes permissions.
+	// Later patterns win in restic, so its negations come first and cannot bring back
+	// the files the exclude annotation leaves out.
+	if rules, err := readIgnoreFile(pvc.Path, m.ignoreFile); err != nil {
+		m.log.Warnf("Ignoring the ignore file of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	} else {
+		for _, rule := range rules {
+			opts.ExcludePatterns = append(opts.ExcludePatterns, rule.resticPattern(pvc.Path))
+		}
+	}
+	opts.ExcludePatterns = append(opts.ExcludePatterns, m.processPatterns(pvc.Path, pvc.Config.Exclude)...)
+	for _, marker := range m.excludeMarkers(pvc) {
+		if marker != cacheDirMarker {
+			opts.ExcludeIfPresent = append(opts.ExcludeIfPresent, marker.String())
 		}
+	}
+	if m.uploadLimit > 0 {
+		opts.LimitUpload = m.uploadLimit
+	}
+	if description != "" {
+		opts.Tags = append(opts.Tags, restic.DescriptionTag(description))
+	}
+	// The TTL is stored with the snapshots, it must outlive the PVC annotation
+	if pvc.Config.TTL != "" {
+		if _, err := parseResticDuration(pvc.Config.TTL); err != nil {
+			m.log.Warnf("Ignoring invalid TTL of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		} else {
+			opts.Tags = append(opts.Tags, restic.TTLTag(pvc.Config.TTL))
+		}
+	}
 
-		// Execute backup for this PVC
-		if err := m.resticClient.Backup(ctx, backupPaths, excludePatterns, pvc.UID, pvc.Name, pvc.Namespace); err != nil {
-			return fmt.Errorf("failed to backup PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	if pvc.Config.ExcludeLargerThan != "" {
+		if size, err := cfg.ParseSize(pvc.Config.ExcludeLargerThan); err != nil {
+			m.log.Warnf("Ignoring exclude-larger-than of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		} else {
+			opts.ExcludeLargerThan = size
 		}
+	}
 
-		// Reset paths and patterns for next PVC
-		backupPaths = backupPaths[:0]
-		excludePatterns = excludePatterns[:0]
+	if pvc.Config.Compression != "" {
+		if err := restic.CheckCompression(pvc.Config.Compression); err != nil {
+			m.log.Warnf("Ignoring compression of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		} else {
+			opts.Compression = pvc.Config.Compression
+		}
 	}
+	return backupPaths, opts
+}
 
-	// Clean up old backups using global retention policy
-	if err := m.resticClient.Forget(ctx, m.retention); err != nil {
-		m.log.Errorf("Error cleaning up old backups: %v", err)
+// BackupPVC performs an on-demand backup of a PVC on this node, overriding the
+// description annotation when description is set. A backup taken whose verification
+// command failed is reported as VerificationError.
+func (m *Manager) BackupPVC(ctx context.Context, namespace, name, description string) error {
+	pvc, err := m.findPVC(ctx, namespace, name)
+	if err != nil {
+		return err
 	}
 
+	if len(m.enforceQuotas(ctx, []k8s.PVCInfo{pvc})) == 0 {
+		return fmt.Errorf("namespace %s is over its backup quota", namespace)
+	}
+	if reason := m.checkClassification(ctx, pvc, m.regularDestinations()...); reason != "" {
+		return fmt.Errorf("backup refused, %s", reason)
+	}
+
+	if description == "" {
+		description = pvc.Config.Description
+	}
+	finish, ok := m.startBackup(pvc)
+	if !ok {
+		return fmt.Errorf("a backup of PVC %s/%s is already running", namespace, name)
+	}
+	defer finish()
+	release := m.acquirePVCDevice(ctx, pvc)
+	defer release()
+
+	client, err := m.repositoryFor(ctx, pvc)
+	if err != nil {
+		m.recordStatus(ctx, pvc, nil, err, pvcStatusFailed)
+		return err
+	}
+	started := time.Now()
+	summary, err := m.snapshotPVC(ctx, client, pvc, description)
+	var mountErr *MountError
+	if errors.As(err, &mountErr) {
+		m.recordStatus(ctx, pvc, nil, err, pvcStatusSkipped)
+		return err
+	}
+	if err != nil {
+		m.recordStatus(ctx, pvc, nil, err, pvcStatusFailed)
+		return err
+	}
+	m.recordStatus(ctx, pvc, summary, nil, pvcStatusSuccess)
+	m.recordLastBackup(pvc, started, summary)
+	if err := m.verifyBackup(ctx, client, pvc, summary.SnapshotID); err != nil {
+		return &VerificationError{Err: fmt.Errorf("snapshot %s of PVC %s/%s was taken but its verification failed: %v", summary.SnapshotID, namespace, name, err)}
+	}
 	return nil
 }
+
+// startBackup marks a PVC as being backed up and returns the function unmarking it,
+// or false when a backup of the PVC is already running
+func (m *Manager) startBackup(pvc k8s.PVCInfo) (func(), bool) {
+	m.runningMu.Lock()
+	defer m.runningMu.Unlock()
+
+	if m.running[pvc.UID] {
+		return nil, false
+	}
+	m.running[pvc.UID] = true
+	return func() {
+		m.runningMu.Lock()
+		delete(m.running, pvc.UID)
+		m.runningMu.Unlock()
+	}, true
+}
+
+// findPVC returns the PVC enabled for backup on this node with the given namespace and name
+func (m *Manager) findPVC(ctx context.Context, namespace, name string) (k8s.PVCInfo, error) {
+	pvcs, err := m.k8sClient.GetPVCsToBackup(ctx)
+	if err != nil {
+		return k8s.PVCInfo{}, fmt.Errorf("failed to get PVCs to backup: %v", err)
+	}
+
+	for _, pvc := range pvcs {
+		if pvc.Namespace == namespace && pvc.Name == name {
+			return pvc, nil
+		}
+	}
+	return k8s.PVCInfo{}, &PVCNotFoundError{Namespace: namespace, Name: name, Node: m.k8sClient.GetNodeName()}
+}
+
+// PVCNotFoundError reports a PVC that is not backed up on this node, because it does
+// not exist, is not enabled for backup or is stored on another node
+type PVCNotFoundError struct {
+	Namespace string
+	Name      string
+	Node      string
+}
+
+func (e *PVCNotFoundError) Error() string {
+	return fmt.Sprintf("PVC %s/%s is not enabled for backup on node %s", e.Namespace, e.Name, e.Node)
+}
+
+// repositoryFor returns the client of the repository holding the backups of a PVC,
+// initializing sharded repositories on first use
+func (m *Manager) repositoryFor(ctx context.Context, pvc k8s.PVCInfo) (*restic.Client, error) {
+	if !m.resticClient.Sharded() {
+		return m.resticClient, nil
+	}
+
+	m.shardedRepositoriesMu.Lock()
+	defer m.shardedRepositoriesMu.Unlock()
+
+	client := m.resticClient.ForPVC(pvc.Namespace, pvc.Name)
+	key := client.GetRepository()
+	if known, ok := m.shardedRepositories[key]; ok {
+		return known, nil
+	}
+
+	if err := client.EnsureRepository(ctx); err != nil {
+		return nil, fmt.Errorf("failed to ensure repository of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+	m.shardedRepositories[key] = client
+	return client, nil
+}
+
+// repositories returns the clients of all repositories maintained by this node
+func (m *Manager) repositories() []*restic.Client {
+	m.shardedRepositoriesMu.Lock()
+	defer m.shardedRepositoriesMu.Unlock()
+
+	if m.role == roleController {
+		return m.clusterRepositories
+	}
+	if !m.resticClient.Sharded() {
+		return []*restic.Client{m.resticClient}
+	}
+
+	keys := make([]string, 0, len(m.shardedRepositories))
+	for key := range m.shardedRepositories {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	clients := make([]*restic.Client, 0, len(keys))
+	for _, key := range keys {
+		clients = append(clients, m.shardedRepositories[key])
+	}
+	return clients
+}
@@ -0,0 +1,191 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// Accepted layouts for user supplied timestamps
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ParseTime parses a user supplied timestamp in local time. An empty string means now.
+func ParseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Now(), nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected RFC3339, \"YYYY-MM-DD HH:MM[:SS]\" or \"YYYY-MM-DD\"", value)
+}
+
+// ResolveSnapshotAt returns the latest snapshot of a PVC taken at or before the given time
+func ResolveSnapshotAt(ctx context.Context, resticClient *restic.Client, namespace, pvcName string, at time.Time) (*restic.Snapshot, error) {
+	all, err := resticClient.Snapshots(ctx, restic.PVCTags(namespace, pvcName))
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the snapshots holding verification outputs and dumps, and the safety
+	// snapshots taken before restores
+	var snapshots []restic.Snapshot
+	for _, snapshot := range all {
+		if !snapshot.IsVerification() && !snapshot.IsDump() && snapshot.SafetyFor() == "" {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("no snapshots found for PVC %s/%s", namespace, pvcName)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+
+	var found *restic.Snapshot
+	for i := range snapshots {
+		if snapshots[i].Time.After(at) {
+			break
+		}
+		found = &snapshots[i]
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no snapshot of PVC %s/%s at or before %s, the oldest one is from %s",
+			namespace, pvcName, at.Format(time.RFC3339), snapshots[0].Time.Format(time.RFC3339))
+	}
+	return found, nil
+}
+
+// PVCSnapshots returns the file backup snapshots of a PVC on this node, oldest first,
+// without the snapshots holding verification outputs or dumps
+func (m *Manager) PVCSnapshots(ctx context.Context, namespace, name string) ([]restic.Snapshot, error) {
+	pvc, err := m.findPVC(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	client, err := m.repositoryFor(ctx, pvc)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := client.Snapshots(ctx, restic.PVCTags(namespace, name))
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]restic.Snapshot, 0, len(all))
+	for _, snapshot := range all {
+		if !snapshot.IsVerification() && !snapshot.IsDump() {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+// DiskUsage holds the aggregated size of an entry of a snapshot directory
+type DiskUsage struct {
+	Path  string
+	Size  uint64
+	Files int
+}
+
+// SummarizeUsage aggregates file sizes by the direct children of base
+func SummarizeUsage(nodes []restic.Node, base string) []DiskUsage {
+	usage := make(map[string]*DiskUsage)
+	for _, node := range nodes {
+		if node.Type != "file" {
+			continue
+		}
+
+		rel, err := filepath.Rel(base, node.Path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		entry := filepath.Join(base, strings.SplitN(rel, string(filepath.Separator), 2)[0])
+
+		u, ok := usage[entry]
+		if !ok {
+			u = &DiskUsage{Path: entry}
+			usage[entry] = u
+		}
+		u.Size += node.Size
+		u.Files++
+	}
+
+	result := make([]DiskUsage, 0, len(usage))
+	for _, u := range usage {
+		result = append(result, *u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result
+}
+
+// CommonDir returns the deepest directory containing all the given paths
+func CommonDir(paths []string) string {
+	if len(paths) == 0 {
+		return "/"
+	}
+	if len(paths) == 1 {
+		return paths[0]
+	}
+
+	common := filepath.Dir(paths[0])
+	for _, path := range paths[1:] {
+		for common != "/" && !strings.HasPrefix(path, common+"/") {
+			common = filepath.Dir(common)
+		}
+	}
+	return common
+}
+
+// FormatBytes renders a byte count in a human readable form
+func FormatBytes(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// RepositoryUsage holds the size of a repository maintained by this node
+type RepositoryUsage struct {
+	Repository string
+	Bytes      uint64
+	Snapshots  int
+}
+
+// RepositoryUsages returns the size of the repositories this node backs up into. With
+// sharded repositories, only the ones used since the agent started are known.
+func (m *Manager) RepositoryUsages(ctx context.Context) ([]RepositoryUsage, error) {
+	var usages []RepositoryUsage
+	for _, client := range m.repositories() {
+		stats, err := client.Stats(ctx, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", client.GetRepository(), err)
+		}
+		usages = append(usages, RepositoryUsage{Repository: client.GetRepository(), Bytes: stats.TotalSize, Snapshots: stats.SnapshotsCount})
+	}
+	return usages, nil
+}
@@ -0,0 +1,147 @@
+package backup
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// resticCacheDir matches the cache directories restic creates per repository, named
+// after the repository ID. The other files of the cache directory hold agent state.
+var resticCacheDir = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// resticCacheSubdirs are the directories of a repository cache restic downloads again
+// when a file is missing
+var resticCacheSubdirs = []string{"data", "index", "snapshots"}
+
+// cachedFile is a file of a repository cache, candidate for eviction
+type cachedFile struct {
+	path     string
+	size     uint64
+	accessed time.Time
+}
+
+// manageCache measures the cache directory after a backup cycle. Over the maximum cache
+// size, the caches of repositories unused for 30 days are removed with restic, then the
+// least recently used files of the remaining repository caches are evicted until the
+// cache fits. Evicted files are downloaded again by restic when it needs them.
+func (m *Manager) manageCache(ctx context.Context) {
+	size, err := directorySize(m.cachePath)
+	if err != nil {
+		m.log.Warnf("Failed to measure cache directory %s: %v", m.cachePath, err)
+		return
+	}
+	m.metrics.Set(metricCacheSize, nil, float64(size))
+	if m.cacheMaxSize == 0 || size <= m.cacheMaxSize {
+		return
+	}
+
+	m.log.Infof("Cache directory holds %s, over its limit of %s, cleaning up", FormatBytes(size), FormatBytes(m.cacheMaxSize))
+	if err := m.resticClient.CleanupCache(ctx); err != nil {
+		m.log.Warnf("%v", err)
+	}
+	if size, err = directorySize(m.cachePath); err != nil {
+		m.log.Warnf("Failed to measure cache directory %s: %v", m.cachePath, err)
+		return
+	}
+
+	if size > m.cacheMaxSize {
+		files, err := cachedFiles(m.cachePath)
+		if err != nil {
+			m.log.Warnf("Failed to list cache files: %v", err)
+		}
+		var evicted uint64
+		for _, file := range files {
+			if size <= m.cacheMaxSize {
+				break
+			}
+			if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+				m.log.Warnf("Failed to evict cache file %s: %v", file.path, err)
+				continue
+			}
+			size -= file.size
+			evicted += file.size
+		}
+		m.metrics.Add(metricCacheEvictedBytes, nil, float64(evicted))
+		m.log.Infof("Evicted %s of least recently used cache files", FormatBytes(evicted))
+	}
+
+	m.metrics.Set(metricCacheSize, nil, float64(size))
+	if size > m.cacheMaxSize {
+		m.log.Warnf("Cache directory still holds %s, over its limit of %s", FormatBytes(size), FormatBytes(m.cacheMaxSize))
+	}
+}
+
+// cachedFiles lists the files of the repository caches under the cache directory, least
+// recently used first
+func cachedFiles(cachePath string) ([]cachedFile, error) {
+	entries, err := os.ReadDir(cachePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []cachedFile
+	for _, entry := range entries {
+		if !entry.IsDir() || !resticCacheDir.MatchString(entry.Name()) {
+			continue
+		}
+		for _, subdir := range resticCacheSubdirs {
+			root := filepath.Join(cachePath, entry.Name(), subdir)
+			err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					if os.IsNotExist(err) {
+						return nil
+					}
+					return err
+				}
+				if !entry.Type().IsRegular() {
+					return nil
+				}
+				info, err := entry.Info()
+				if err != nil {
+					return err
+				}
+				files = append(files, cachedFile{path: path, size: uint64(info.Size()), accessed: accessTime(info)})
+				return nil
+			})
+			if err != nil {
+				return files, err
+			}
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].accessed.Before(files[j].accessed) })
+	return files, nil
+}
+
+// directorySize returns the size of the regular files below a directory, 0 when it does
+// not exist yet
+func directorySize(root string) (uint64, error) {
+	var size uint64
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Files removed while walking, e.g. restic temporary files
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		size += uint64(info.Size())
+		return nil
+	})
+	return size, err
+}
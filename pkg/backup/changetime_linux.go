@@ -0,0 +1,31 @@
+package backup
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// changeTime returns the time the content or metadata of a file last changed, the
+// latest of its modification and status change times
+func changeTime(info fs.FileInfo) time.Time {
+	changed := info.ModTime()
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if ctime := time.Unix(stat.Ctim.Unix()); ctime.After(changed) {
+			changed = ctime
+		}
+	}
+	return changed
+}
+
+// accessTime returns the time a file was last read or written, the latest of its access
+// and modification times, as filesystems mounted with noatime only update the latter
+func accessTime(info fs.FileInfo) time.Time {
+	accessed := info.ModTime()
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if atime := time.Unix(stat.Atim.Unix()); atime.After(accessed) {
+			accessed = atime
+		}
+	}
+	return accessed
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package backup
+
+import (
+	"io/fs"
+	"time"
+)
+
+// changeTime returns the modification time of a file, the status change time is not
+// available on this platform
+func changeTime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// accessTime returns the modification time of a file, the access time is not available
+// on this platform
+func accessTime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,239 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+)
+
+// Encryption keys of the repositories
+const (
+	// KeyPrimary is RESTIC_PASSWORD
+	KeyPrimary = "primary"
+	// KeyReplica is REPLICA_PASSWORD, replica repositories use the primary key without it
+	KeyReplica = "replica"
+)
+
+// ClassPolicy restricts where and how long the backups of a data classification are stored
+type ClassPolicy struct {
+	Destinations []string      // Allowed destinations, primary or replica, empty allows all
+	Keys         []string      // Allowed encryption keys, primary or replica, empty allows all
+	MinRetention time.Duration // Minimum time snapshots are kept
+}
+
+// ParseClassPolicies parses per-classification policies separated by ";", each made of a
+// classification and settings:
+//
+//	confidential destinations=primary keys=primary min-retention=90d; internal min-retention=30d
+func ParseClassPolicies(value string) (map[string]ClassPolicy, error) {
+	policies := make(map[string]ClassPolicy)
+	for _, text := range strings.Split(value, ";") {
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		class := fields[0]
+		var policy ClassPolicy
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid setting %q of classification %s, expected key=value", field, class)
+			}
+			switch key {
+			case "destinations":
+				policy.Destinations = strings.Split(value, ",")
+				for _, destination := range policy.Destinations {
+					if destination != PlanDestinationPrimary && destination != PlanDestinationReplica {
+						return nil, fmt.Errorf("invalid destination %q of classification %s", destination, class)
+					}
+				}
+			case "keys":
+				policy.Keys = strings.Split(value, ",")
+				for _, key := range policy.Keys {
+					if key != KeyPrimary && key != KeyReplica {
+						return nil, fmt.Errorf("invalid key %q of classification %s", key, class)
+					}
+				}
+			case "min-retention":
+				retention, err := parseResticDuration(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid minimum retention of classification %s: %v", class, err)
+				}
+				policy.MinRetention = retention
+			default:
+				return nil, fmt.Errorf("unknown setting %q of classification %s", key, class)
+			}
+		}
+		policies[class] = policy
+	}
+	return policies, nil
+}
+
+// parseResticDuration parses a restic duration such as 1y6m or 14d2h, counting years
+// as 365 days and months as 30 days
+func parseResticDuration(value string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		'y': 365 * 24 * time.Hour,
+		'm': 30 * 24 * time.Hour,
+		'd': 24 * time.Hour,
+		'h': time.Hour,
+	}
+
+	var total time.Duration
+	rest := value
+	for rest != "" {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(rest) {
+			return 0, fmt.Errorf("invalid duration %q, expected e.g. 1y6m or 14d", value)
+		}
+		unit, ok := units[rest[i]]
+		if !ok {
+			return 0, fmt.Errorf("invalid unit %q in duration %q", rest[i], value)
+		}
+		n, _ := strconv.Atoi(rest[:i])
+		total += time.Duration(n) * unit
+		rest = rest[i+1:]
+	}
+	return total, nil
+}
+
+// retentionPeriod returns the time a retention policy keeps snapshots, 0 when it keeps
+// them forever
+func retentionPeriod(retention string) (time.Duration, error) {
+	var longest time.Duration
+	for _, policy := range strings.Split(retention, ",") {
+		policy = strings.TrimSpace(policy)
+		if policy == "" {
+			continue
+		}
+		period, err := parseResticDuration(policy)
+		if err != nil {
+			return 0, err
+		}
+		if period > longest {
+			longest = period
+		}
+	}
+	return longest, nil
+}
+
+// destination describes a repository backups of a PVC are stored in
+type destination struct {
+	name      string // primary or replica
+	retention string // Retention policy, empty keeps snapshots forever
+}
+
+// keyOf returns the encryption key of the repositories of a destination
+func (m *Manager) keyOf(destination string) string {
+	if destination == PlanDestinationReplica && m.replica.Password != "" {
+		return KeyReplica
+	}
+	return KeyPrimary
+}
+
+// violation describes why storing backups in a destination breaks the policy, empty
+// when it complies
+func (m *Manager) violation(policy ClassPolicy, d destination) string {
+	if len(policy.Destinations) > 0 && !contains(policy.Destinations, d.name) {
+		return fmt.Sprintf("destination %s is not allowed (allowed: %s)", d.name, strings.Join(policy.Destinations, ", "))
+	}
+	if key := m.keyOf(d.name); len(policy.Keys) > 0 && !contains(policy.Keys, key) {
+		return fmt.Sprintf("destination %s is encrypted with the %s key (allowed: %s)", d.name, key, strings.Join(policy.Keys, ", "))
+	}
+	if policy.MinRetention > 0 && d.retention != "" {
+		period, err := retentionPeriod(d.retention)
+		if err != nil {
+			return fmt.Sprintf("retention %q of destination %s cannot be checked: %v", d.retention, d.name, err)
+		}
+		if period < policy.MinRetention {
+			return fmt.Sprintf("retention %s of destination %s is shorter than the minimum retention", d.retention, d.name)
+		}
+	}
+	return ""
+}
+
+// checkClassification checks the destinations of backups of a PVC against the policy of
+// the classification of its namespace. It fails closed: the classification must have a
+// policy and be readable once policies are configured.
+func (m *Manager) checkClassification(ctx context.Context, pvc k8s.PVCInfo, destinations ...destination) string {
+	if len(m.classPolicies) == 0 {
+		return ""
+	}
+
+	labels, err := m.k8sClient.GetNamespaceLabels(ctx, pvc.Namespace)
+	if err != nil {
+		return fmt.Sprintf("classification of namespace %s cannot be read: %v", pvc.Namespace, err)
+	}
+	class, ok := labels[cfg.LabelClassification]
+	if !ok {
+		return ""
+	}
+	policy, ok := m.classPolicies[class]
+	if !ok {
+		return fmt.Sprintf("namespace %s is classified %s, which has no policy", pvc.Namespace, class)
+	}
+
+	for _, d := range destinations {
+		if reason := m.violation(policy, d); reason != "" {
+			return fmt.Sprintf("namespace %s is classified %s: %s", pvc.Namespace, class, reason)
+		}
+	}
+	return ""
+}
+
+// regularDestinations returns the destinations of the regular backups, replication
+// included
+func (m *Manager) regularDestinations() []destination {
+	destinations := []destination{{name: PlanDestinationPrimary, retention: m.retention}}
+	if m.replicationEnabled() {
+		destinations = append(destinations, destination{name: PlanDestinationReplica, retention: m.replica.Retention})
+	}
+	return destinations
+}
+
+// enforceClassification drops the PVCs whose regular backups break the policy of their
+// classification, recording a warning event on each skipped PVC
+func (m *Manager) enforceClassification(ctx context.Context, pvcs []k8s.PVCInfo) []k8s.PVCInfo {
+	if len(m.classPolicies) == 0 {
+		return pvcs
+	}
+
+	var allowed []k8s.PVCInfo
+	for _, pvc := range pvcs {
+		if reason := m.checkClassification(ctx, pvc, m.regularDestinations()...); reason != "" {
+			message := "Backup skipped, " + reason
+			m.recordClassificationViolation(ctx, pvc, message)
+			m.recordStatus(ctx, pvc, nil, errors.New(message), pvcStatusSkipped)
+			continue
+		}
+		allowed = append(allowed, pvc)
+	}
+	return allowed
+}
+
+// recordClassificationViolation logs a blocked backup and records it as an event on the PVC
+func (m *Manager) recordClassificationViolation(ctx context.Context, pvc k8s.PVCInfo, message string) {
+	m.log.Warnf("PVC %s/%s: %s", pvc.Namespace, pvc.Name, message)
+	if err := m.k8sClient.RecordPVCEvent(ctx, pvc, "BackupClassificationViolation", message); err != nil {
+		m.log.Errorf("%v", err)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
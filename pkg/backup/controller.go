@@ -0,0 +1,229 @@
+package backup
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// Roles of a manager
+const (
+	// roleStandalone is an agent running its own maintenance, through leader election
+	// when enabled
+	roleStandalone = ""
+	// roleAgent is an agent of a controller, backing up its node only
+	roleAgent = "agent"
+	// roleController is the controller, running maintenance, reports and the backup
+	// slots of the agents
+	roleController = "controller"
+)
+
+// managerRole returns the role of the agents of a configuration
+func managerRole(config *cfg.Config) string {
+	if config.BackupConfig.Controller {
+		return roleAgent
+	}
+	return roleStandalone
+}
+
+// scheduleStateName is the ConfigMap holding the backup slot of each agent, as offsets
+// within the backup interval
+const scheduleStateName = "local-pvc-backup-schedule"
+
+// slotTolerance is the distance to its slot within which an agent starts its cycle
+const slotTolerance = time.Minute
+
+// RunController runs the cluster wide tasks of controller mode: prunes, checks and
+// reports over the repositories of all nodes, and the staggering of the agents over
+// the backup interval. Agents with BACKUP_CONTROLLER set leave these tasks to it.
+func (m *Manager) RunController(ctx context.Context) error {
+	m.role = roleController
+
+	cycle := func() {
+		m.refreshClusterRepositories(ctx)
+		m.staggerAgents(ctx)
+		// The agents leave the size quotas of the shared repositories to the controller
+		if m.repoMaxSize > 0 && m.repoLayout == cfg.RepoLayoutShared {
+			m.checkSharedQuotas(ctx)
+		}
+		// The agents expire the snapshots of their own repositories, except the shared and
+		// the sharded ones
+		if m.repoLayout == cfg.RepoLayoutShared || m.resticClient.Sharded() {
+			if err := m.performExpiry(ctx); err != nil {
+				m.log.Errorf("Error expiring backups of deleted PVCs: %v", err)
+			}
+		}
+		if m.pruneInterval == 0 {
+			if err := m.traced(ctx, operationPrune, m.performPrune); err != nil {
+				m.log.Errorf("Error pruning repositories: %v", err)
+			}
+		}
+		m.performReport(ctx)
+	}
+
+	m.log.Infof("Starting controller with interval: %v", m.interval)
+	cycle()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	var checkC, pruneC, replicateC <-chan time.Time
+	if m.checkInterval > 0 {
+		checkTicker := time.NewTicker(m.checkInterval)
+		defer checkTicker.Stop()
+		checkC = checkTicker.C
+	}
+	if m.pruneInterval > 0 {
+		pruneTicker := time.NewTicker(m.pruneInterval)
+		defer pruneTicker.Stop()
+		pruneC = pruneTicker.C
+	}
+	// The agents replicate their own repositories, except the shared one
+	if m.repoLayout == cfg.RepoLayoutShared && m.replicationEnabled() && m.replica.Interval > 0 {
+		replicateTicker := time.NewTicker(m.replica.Interval)
+		defer replicateTicker.Stop()
+		replicateC = replicateTicker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			cycle()
+		case <-checkC:
+			m.refreshClusterRepositories(ctx)
+			if err := m.traced(ctx, operationCheck, m.performCheck); err != nil {
+				m.log.Errorf("Error checking repositories: %v", err)
+			}
+		case <-pruneC:
+			m.refreshClusterRepositories(ctx)
+			if err := m.traced(ctx, operationPrune, m.performPrune); err != nil {
+				m.log.Errorf("Error pruning repositories: %v", err)
+			}
+		case <-replicateC:
+			if err := m.traced(ctx, operationReplicate, m.performReplication); err != nil {
+				m.log.Errorf("Error replicating repository: %v", err)
+			}
+		}
+	}
+}
+
+// refreshClusterRepositories lists the repositories maintained by the controller: the
+// repositories found in the storage, which include those of deleted PVCs, and the
+// repositories and plan repositories of the local PVCs of all nodes
+func (m *Manager) refreshClusterRepositories(ctx context.Context) {
+	pvcs, err := m.k8sClient.ListLocalPVCs(ctx)
+	if err != nil {
+		m.log.Errorf("Failed to list the repositories of the cluster: %v", err)
+		return
+	}
+
+	var candidates []*restic.Client
+	if m.listStorage != nil {
+		stored, err := m.storedRepositories(ctx)
+		if err != nil {
+			m.log.Errorf("Failed to list the repositories of the storage: %v", err)
+			return
+		}
+		candidates = append(candidates, stored...)
+	}
+	for _, pvc := range pvcs {
+		client := m.resticClient.ForNode(pvc.Node).ForPVC(pvc.Namespace, pvc.Name)
+		candidates = append(candidates, client)
+
+		plans, err := ParsePlans(pvc.Plans)
+		if err != nil {
+			continue
+		}
+		for _, plan := range plans {
+			planClient := client
+			if plan.Destination == PlanDestinationReplica {
+				if !m.replicationEnabled() {
+					continue
+				}
+				planClient = planClient.Replica(m.replica)
+			}
+			candidates = append(candidates, planClient.WithRepository(planClient.GetRepository()+"-"+plan.Name))
+		}
+	}
+
+	known := make(map[string]bool)
+	var clients []*restic.Client
+	for _, client := range candidates {
+		if known[client.GetRepository()] {
+			continue
+		}
+		known[client.GetRepository()] = true
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].GetRepository() < clients[j].GetRepository() })
+
+	m.shardedRepositoriesMu.Lock()
+	m.clusterRepositories = clients
+	m.shardedRepositoriesMu.Unlock()
+}
+
+// staggerAgents spreads the backup slots of the reporting agents evenly over the
+// backup interval, so the nodes do not all back up to the storage at once
+func (m *Manager) staggerAgents(ctx context.Context) {
+	statuses, err := m.k8sClient.ListNodeStatuses(ctx, m.leaseNamespace)
+	if err != nil {
+		m.log.Errorf("Failed to list agents: %v", err)
+		return
+	}
+	now := time.Now()
+	var nodes []string
+	for _, status := range statuses {
+		if !status.Stale(now) {
+			nodes = append(nodes, status.Node)
+		}
+	}
+	sort.Strings(nodes)
+
+	err = m.k8sClient.UpdateState(ctx, m.leaseNamespace, scheduleStateName, func(data map[string]string) {
+		for node := range data {
+			delete(data, node)
+		}
+		for i, node := range nodes {
+			offset := m.interval * time.Duration(i) / time.Duration(len(nodes))
+			data[node] = offset.Round(time.Second).String()
+		}
+	})
+	if err != nil {
+		m.log.Errorf("Failed to publish the backup slots: %v", err)
+	}
+}
+
+// waitForSlot delays the backup cycle of an agent of a controller until the slot the
+// controller assigned to its node, returning false when ctx is cancelled meanwhile
+func (m *Manager) waitForSlot(ctx context.Context) bool {
+	if m.role != roleAgent {
+		return true
+	}
+	state, err := m.k8sClient.GetState(ctx, m.leaseNamespace, scheduleStateName)
+	if err != nil {
+		m.log.Warnf("Failed to read the backup slot of the node: %v", err)
+		return true
+	}
+	offset, err := time.ParseDuration(state[m.k8sClient.GetNodeName()])
+	if err != nil {
+		// No slot assigned yet
+		return true
+	}
+
+	phase := time.Duration(time.Now().UnixNano() % int64(m.interval))
+	wait := (offset - phase + m.interval) % m.interval
+	if wait < slotTolerance || wait > m.interval-slotTolerance {
+		return true
+	}
+	m.log.Infof("Waiting %v for the backup slot of the node", wait.Round(time.Second))
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
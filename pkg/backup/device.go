@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+)
+
+// deviceScheduler limits the concurrent backups of the PVCs stored on the same device,
+// so a saturated disk does not get several backups at once while another one idles
+type deviceScheduler struct {
+	manager *Manager
+	devices map[string]string // Device of each PVC by UID
+}
+
+// newDeviceScheduler looks up the devices of the PVCs and returns them reordered
+// round-robin across devices, so the backups started together are spread over the
+// devices. A device concurrency of 0 disables the per-device limit.
+func (m *Manager) newDeviceScheduler(ctx context.Context, pvcs []k8s.PVCInfo) (*deviceScheduler, []k8s.PVCInfo) {
+	s := &deviceScheduler{manager: m, devices: make(map[string]string)}
+	if m.deviceConcurrency <= 0 {
+		return s, pvcs
+	}
+
+	var order []string
+	queues := make(map[string][]k8s.PVCInfo)
+	for _, pvc := range pvcs {
+		device, err := m.deviceOf(ctx, pvc.Path)
+		if err != nil {
+			// The mount check before the backup reports unusable directories
+			m.log.Debugf("Failed to look up the device of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+			device = ""
+		}
+		if _, ok := queues[device]; !ok {
+			order = append(order, device)
+		}
+		queues[device] = append(queues[device], pvc)
+		s.devices[pvc.UID] = device
+	}
+	if len(order) > 1 {
+		m.log.Debugf("PVCs are stored on %d devices, backing up at most %d PVCs per device at once", len(order), m.deviceConcurrency)
+	}
+
+	ordered := make([]k8s.PVCInfo, 0, len(pvcs))
+	for len(ordered) < len(pvcs) {
+		for _, device := range order {
+			if queue := queues[device]; len(queue) > 0 {
+				ordered = append(ordered, queue[0])
+				queues[device] = queue[1:]
+			}
+		}
+	}
+	return s, ordered
+}
+
+// acquire waits for a backup slot on the device of a PVC and returns its release
+func (s *deviceScheduler) acquire(pvc k8s.PVCInfo) func() {
+	device, ok := s.devices[pvc.UID]
+	if !ok {
+		return func() {}
+	}
+	return s.manager.acquireDevice(device)
+}
+
+// acquireDevice waits for one of the backup slots of a device, shared by the backup
+// cycle and the backups triggered outside of it, and returns its release
+func (m *Manager) acquireDevice(device string) func() {
+	m.deviceSlotsMu.Lock()
+	slots, ok := m.deviceSlots[device]
+	if !ok {
+		slots = make(chan struct{}, m.deviceConcurrency)
+		m.deviceSlots[device] = slots
+	}
+	m.deviceSlotsMu.Unlock()
+
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
+// acquirePVCDevice waits for a backup slot on the device of a single PVC, for backups
+// triggered outside of the backup cycle
+func (m *Manager) acquirePVCDevice(ctx context.Context, pvc k8s.PVCInfo) func() {
+	if m.deviceConcurrency <= 0 {
+		return func() {}
+	}
+	device, err := m.deviceOf(ctx, pvc.Path)
+	if err != nil {
+		m.log.Debugf("Failed to look up the device of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		device = ""
+	}
+	return m.acquireDevice(device)
+}
+
+// deviceOf looks up the device holding a PVC directory within the mount check timeout,
+// so a stat stuck on an unresponsive NFS server does not hold up the backup cycle. The
+// stuck lookup is left behind, the kernel does not allow interrupting it.
+func (m *Manager) deviceOf(ctx context.Context, path string) (string, error) {
+	if m.mountCheckTimeout <= 0 {
+		return deviceOf(path)
+	}
+
+	type result struct {
+		device string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		device, err := deviceOf(path)
+		done <- result{device, err}
+	}()
+
+	timer := time.NewTimer(m.mountCheckTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.device, r.err
+	case <-timer.C:
+		return "", fmt.Errorf("%s not responding after %s", path, m.mountCheckTimeout)
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package backup
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// deviceOf returns the ID of the device holding path
+func deviceOf(path string) (string, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return "", err
+	}
+	return fmt.Sprint(uint64(stat.Dev)), nil
+}
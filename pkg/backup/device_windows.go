@@ -0,0 +1,16 @@
+package backup
+
+import "golang.org/x/sys/windows"
+
+// deviceOf returns the root of the volume holding path
+func deviceOf(path string) (string, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	root := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumePathName(name, &root[0], uint32(len(root))); err != nil {
+		return "", err
+	}
+	return windows.UTF16ToString(root), nil
+}
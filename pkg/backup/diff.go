@@ -0,0 +1,239 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// Changes of a file since a snapshot
+const (
+	ChangeAdded    = "added"
+	ChangeModified = "modified"
+	ChangeDeleted  = "deleted"
+)
+
+// FileChange describes a file of a PVC that changed since a snapshot
+type FileChange struct {
+	Path         string
+	Change       string
+	SnapshotSize uint64 // Size in the snapshot, 0 when added
+	LiveSize     uint64 // Size on disk, 0 when deleted
+}
+
+// DiffOptions selects the snapshot the live data is compared against
+type DiffOptions struct {
+	SnapshotID string    // Snapshot to compare, empty resolves the latest one taken at or before At
+	At         time.Time // Point in time to compare against when no snapshot is given
+}
+
+// DiffAgainstLive compares a snapshot of a PVC on this node with its current data on
+// disk without restoring it. Files are compared by type, size and modification time,
+// directories only by existence. What the backups skip is ignored: files matching the
+// exclude annotation or the ignore file, files over the size limit, the content of
+// marked directories, and special files and other filesystems when configured.
+func (m *Manager) DiffAgainstLive(ctx context.Context, namespace, name string, opts DiffOptions) (*restic.Snapshot, []FileChange, error) {
+	pvc, err := m.findPVC(ctx, namespace, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := m.repositoryFor(ctx, pvc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var snapshot *restic.Snapshot
+	if opts.SnapshotID != "" {
+		snapshot, err = findSnapshot(ctx, client, namespace, name, opts.SnapshotID)
+	} else {
+		snapshot, err = ResolveSnapshotAt(ctx, client, namespace, name, opts.At)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nodes, err := client.ListFiles(ctx, snapshot.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	stored := make(map[string]restic.Node, len(nodes))
+	for _, node := range nodes {
+		stored[node.Path] = node
+	}
+
+	// Walk the paths the snapshot was taken of, its include annotation may have changed since
+	roots := make([]string, 0, len(snapshot.Paths))
+	for _, path := range snapshot.Paths {
+		if local := localPath(path, pvc.Path); local != "" {
+			roots = append(roots, local)
+		}
+	}
+	excludes := m.processPatterns(pvc.Path, pvc.Config.Exclude)
+	rules, err := readIgnoreFile(pvc.Path, m.ignoreFile)
+	if err != nil {
+		m.log.Warnf("Ignoring the ignore file of PVC %s/%s: %v", namespace, name, err)
+	}
+	ignoredPath := func(path string) bool {
+		rel, err := filepath.Rel(pvc.Path, path)
+		return err == nil && ignored(rules, filepath.ToSlash(rel))
+	}
+	// Invalid sizes are ignored by the backups as well
+	maxSize, _ := cfg.ParseSize(pvc.Config.ExcludeLargerThan)
+	markers := m.excludeMarkers(pvc)
+	markedDirs := make(map[string]bool)
+	markedOut := func(path string) bool {
+		dir, name := filepath.Split(path)
+		for _, marker := range markers {
+			if name == marker.Name {
+				continue
+			}
+			key := dir + "\x00" + marker.Name
+			marked, ok := markedDirs[key]
+			if !ok {
+				marked = marker.marks(dir)
+				markedDirs[key] = marked
+			}
+			if marked {
+				return true
+			}
+		}
+		return false
+	}
+
+	var changes []FileChange
+	seen := make(map[string]bool, len(nodes))
+	for _, root := range roots {
+		rootDevice, _ := deviceOf(root)
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && path == root {
+					return nil
+				}
+				return err
+			}
+			if path != root && (excluded(path, excludes) || ignoredPath(path)) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if m.oneFileSystem && entry.IsDir() && path != root {
+				if device, err := deviceOf(path); err == nil && device != rootDevice {
+					return filepath.SkipDir
+				}
+			}
+			// restic keeps the marker file of a marked directory and nothing else in it
+			if path != root && markedOut(path) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			if maxSize > 0 && info.Mode().IsRegular() && uint64(info.Size()) > maxSize {
+				return nil
+			}
+			if m.skipSpecialFiles && info.Mode()&specialFileMode != 0 {
+				return nil
+			}
+			key := restic.SnapshotPath(path)
+			seen[key] = true
+			if change := compareNode(key, info, stored); change != nil {
+				changes = append(changes, *change)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read PVC %s/%s: %v", namespace, name, err)
+		}
+	}
+
+	for _, node := range nodes {
+		if !seen[node.Path] && underRoots(node.Path, snapshot.Paths) {
+			changes = append(changes, FileChange{Path: node.Path, Change: ChangeDeleted, SnapshotSize: node.Size})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return snapshot, changes, nil
+}
+
+// compareNode compares a file on disk with its node in the snapshot, nil when unchanged
+func compareNode(path string, info fs.FileInfo, stored map[string]restic.Node) *FileChange {
+	var live uint64
+	if info.Mode().IsRegular() {
+		live = uint64(info.Size())
+	}
+
+	node, ok := stored[path]
+	if !ok {
+		return &FileChange{Path: path, Change: ChangeAdded, LiveSize: live}
+	}
+	if node.Type != nodeType(info) {
+		return &FileChange{Path: path, Change: ChangeModified, SnapshotSize: node.Size, LiveSize: live}
+	}
+	if node.Type == "file" && (node.Size != live || !node.MTime.Equal(info.ModTime())) {
+		return &FileChange{Path: path, Change: ChangeModified, SnapshotSize: node.Size, LiveSize: live}
+	}
+	return nil
+}
+
+// nodeType returns the restic node type of a file on disk
+func nodeType(info fs.FileInfo) string {
+	switch {
+	case info.IsDir():
+		return "dir"
+	case info.Mode()&fs.ModeSymlink != 0:
+		return "symlink"
+	case info.Mode().IsRegular():
+		return "file"
+	default:
+		return "other"
+	}
+}
+
+// localPath returns the local path of a path stored in a snapshot, empty when it is not
+// inside the PVC directory anymore
+func localPath(snapshotPath, pvcPath string) string {
+	base := restic.SnapshotPath(pvcPath)
+	if snapshotPath != base && !strings.HasPrefix(snapshotPath, base+"/") {
+		return ""
+	}
+	return filepath.Join(pvcPath, filepath.FromSlash(strings.TrimPrefix(snapshotPath, base)))
+}
+
+// underRoots reports whether a snapshot path is one of the roots or inside one
+func underRoots(path string, roots []string) bool {
+	for _, root := range roots {
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether a path matches one of the exclude patterns. It approximates
+// the restic pattern matching with filepath.Match on the full path.
+func excluded(path string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+)
+
+// PlannedBackup describes how the backups of a PVC would run on this node
+type PlannedBackup struct {
+	Namespace        string   `json:"namespace"`
+	Name             string   `json:"name"`
+	Path             string   `json:"path"`
+	Repository       string   `json:"repository"`
+	Paths            []string `json:"paths,omitempty"` // Paths given to restic, none for dump-only PVCs
+	Excludes         []string `json:"excludes,omitempty"`
+	ExcludeIfPresent []string `json:"exclude_if_present,omitempty"`
+	Dump             string   `json:"dump,omitempty"` // Name of the dump file, empty without dump command
+	Tags             []string `json:"tags"`
+	Schedules        []string `json:"schedules"`
+	Skipped          string   `json:"skipped,omitempty"` // Reason the regular backups are skipped
+}
+
+// PlanBackups returns the PVCs the backup cycles of this node would back up, resolved
+// from their annotations, ignore files and the configuration, without contacting the
+// repository. Namespace quotas and archived PVCs depend on the repository content and
+// are not checked.
+func (m *Manager) PlanBackups(ctx context.Context) ([]PlannedBackup, error) {
+	pvcs, err := m.k8sClient.GetPVCsToBackup(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PVCs to backup: %v", err)
+	}
+
+	var errs []error
+	planned := make(map[string]*PlannedBackup)
+	for _, pvc := range pvcs {
+		backup := m.planBackup(pvc)
+		regular := fmt.Sprintf("every %v", m.interval)
+		if pvc.Config.Archive {
+			regular = "once, archive PVC"
+		}
+		backup.Schedules = append(backup.Schedules, regular)
+		backup.Skipped = m.checkClassification(ctx, pvc, m.regularDestinations()...)
+
+		plans, err := ParsePlans(pvc.Config.Plans)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("PVC %s/%s: %v", pvc.Namespace, pvc.Name, err))
+		}
+		for _, plan := range plans {
+			backup.Schedules = append(backup.Schedules, formatPlannedPlan("plan", plan))
+		}
+		planned[pvc.Namespace+"/"+pvc.Name] = &backup
+	}
+
+	if err := m.planSchedules(ctx, planned); err != nil {
+		errs = append(errs, err)
+	}
+
+	keys := make([]string, 0, len(planned))
+	for key := range planned {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	backups := make([]PlannedBackup, 0, len(keys))
+	for _, key := range keys {
+		backups = append(backups, *planned[key])
+	}
+	return backups, errors.Join(errs...)
+}
+
+// planBackup resolves the paths, excludes and tags of the backups of a PVC
+func (m *Manager) planBackup(pvc k8s.PVCInfo) PlannedBackup {
+	paths, opts := m.backupOptions(pvc, pvc.Config.Description, nil)
+	backup := PlannedBackup{
+		Namespace:        pvc.Namespace,
+		Name:             pvc.Name,
+		Path:             pvc.Path,
+		Repository:       m.resticClient.ForPVC(pvc.Namespace, pvc.Name).GetRepository(),
+		Paths:            paths,
+		Excludes:         opts.ExcludePatterns,
+		ExcludeIfPresent: opts.ExcludeIfPresent,
+		Tags:             m.resticClient.SnapshotTags(opts),
+	}
+	if opts.ExcludeCaches {
+		backup.ExcludeIfPresent = append([]string{cacheDirMarker.String()}, backup.ExcludeIfPresent...)
+	}
+	if pvc.Config.DumpCommand != "" {
+		backup.Dump = pvc.Config.DumpFilename
+		if backup.Dump == "" {
+			backup.Dump = defaultDumpFilename
+		}
+		if pvc.Config.DumpOnly {
+			backup.Paths = nil
+		}
+	}
+	return backup
+}
+
+// planSchedules adds the BackupSchedules selecting the PVCs of the node, including the
+// PVCs without backup annotations
+func (m *Manager) planSchedules(ctx context.Context, planned map[string]*PlannedBackup) error {
+	if !m.operator {
+		return nil
+	}
+
+	var errs []error
+	schedules, err := m.k8sClient.ListBackupSchedules(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(schedules) == 0 {
+		return errors.Join(errs...)
+	}
+	targets, err := m.k8sClient.ListBackupTargets(ctx)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	pvcs, err := m.k8sClient.ListNodePVCs(ctx)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+
+	for _, schedule := range schedules {
+		target, ok := targets[schedule.Target]
+		if !ok {
+			errs = append(errs, fmt.Errorf("BackupSchedule %s: BackupTarget %s not found", schedule.Name, schedule.Target))
+			continue
+		}
+		plan := Plan{Name: schedule.Name, Interval: schedule.Interval, Retention: schedule.Retention, Destination: target.Destination}
+		if plan.Destination == "" {
+			plan.Destination = PlanDestinationPrimary
+		}
+		for _, pvc := range pvcs {
+			if !schedule.Matches(pvc) {
+				continue
+			}
+			key := pvc.Info.Namespace + "/" + pvc.Info.Name
+			backup, ok := planned[key]
+			if !ok {
+				unannotated := m.planBackup(pvc.Info)
+				unannotated.Skipped = "not enabled for backup"
+				backup = &unannotated
+				planned[key] = backup
+			}
+			text := formatPlannedPlan("BackupSchedule", plan)
+			if schedule.Include != "" || schedule.Exclude != "" {
+				text += fmt.Sprintf(" (include: %s, exclude: %s)", schedule.Include, schedule.Exclude)
+			}
+			backup.Schedules = append(backup.Schedules, text)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// formatPlannedPlan describes a backup plan or schedule
+func formatPlannedPlan(kind string, plan Plan) string {
+	text := fmt.Sprintf("%s %s every %v", kind, plan.Name, plan.Interval)
+	if plan.Retention != "" {
+		text += ", retention " + plan.Retention
+	}
+	return text + " to " + plan.Destination
+}
+
+// FormatPlannedBackups renders planned backups as text
+func FormatPlannedBackups(backups []PlannedBackup) string {
+	if len(backups) == 0 {
+		return "No PVCs to back up\n"
+	}
+
+	var b strings.Builder
+	for i, backup := range backups {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%s/%s\n", backup.Namespace, backup.Name)
+		if backup.Skipped != "" {
+			fmt.Fprintf(&b, "  skipped:     %s\n", backup.Skipped)
+		}
+		fmt.Fprintf(&b, "  path:        %s\n", backup.Path)
+		fmt.Fprintf(&b, "  repository:  %s\n", backup.Repository)
+		if len(backup.Paths) > 0 {
+			fmt.Fprintf(&b, "  include:     %s\n", strings.Join(backup.Paths, ", "))
+		}
+		if len(backup.Excludes) > 0 {
+			fmt.Fprintf(&b, "  exclude:     %s\n", strings.Join(backup.Excludes, ", "))
+		}
+		if len(backup.ExcludeIfPresent) > 0 {
+			fmt.Fprintf(&b, "  markers:     %s\n", strings.Join(backup.ExcludeIfPresent, ", "))
+		}
+		if backup.Dump != "" {
+			fmt.Fprintf(&b, "  dump:        %s\n", backup.Dump)
+		}
+		fmt.Fprintf(&b, "  tags:        %s\n", strings.Join(backup.Tags, ", "))
+		fmt.Fprintf(&b, "  schedules:   %s\n", strings.Join(backup.Schedules, "; "))
+	}
+	return b.String()
+}
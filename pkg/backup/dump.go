@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// defaultDumpFilename is the name of the file holding a dump in its snapshot when the
+// PVC does not set one
+const defaultDumpFilename = "dump"
+
+// checkDumpFilename validates the name of the file holding a dump, stored at the root
+// of its snapshot
+func checkDumpFilename(filename string) error {
+	switch {
+	case strings.TrimSpace(filename) == "":
+		return fmt.Errorf("empty filename")
+	case strings.ContainsAny(filename, `/\`), filename == "." || filename == "..":
+		return fmt.Errorf("%q is not a plain file name", filename)
+	}
+	return nil
+}
+
+// dumpPVC runs the dump command of a PVC in the pod mounting it, e.g. pg_dump, and
+// streams its output into a snapshot tagged dump, giving a logically consistent copy
+// of a database whose files may be mid-write. A dump whose command fails is not kept.
+func (m *Manager) dumpPVC(ctx context.Context, client *restic.Client, pvc k8s.PVCInfo, opts restic.BackupOptions) (*restic.BackupSummary, error) {
+	if pvc.Pod == "" {
+		return nil, fmt.Errorf("no running pod mounts PVC %s/%s to run the dump command in", pvc.Namespace, pvc.Name)
+	}
+	filename := pvc.Config.DumpFilename
+	if filename == "" {
+		filename = defaultDumpFilename
+	}
+	if err := checkDumpFilename(filename); err != nil {
+		return nil, fmt.Errorf("invalid dump filename: %v", err)
+	}
+	opts.ExcludePatterns = nil
+	opts.Tags = append(append([]string{}, opts.Tags...), restic.DumpTag)
+
+	m.log.WithFields(pvcFields(pvc)).Infof("Running dump command of PVC %s/%s in pod %s", pvc.Namespace, pvc.Name, pvc.Pod)
+
+	// restic stores whatever it read once its input ends, so it is killed before the
+	// input of a failed dump is closed
+	backupCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	reader, writer := io.Pipe()
+	var stderr bytes.Buffer
+	var stopped, failed atomic.Bool
+	done := make(chan error, 1)
+	go func() {
+		err := m.k8sClient.ExecInPod(ctx, pvc.Namespace, pvc.Pod, pvc.Config.HookContainer, shellCommand(pvc.Config.DumpCommand), nil, writer, &stderr)
+		if err != nil && !stopped.Load() {
+			failed.Store(true)
+			cancel()
+		}
+		writer.CloseWithError(err)
+		done <- err
+	}()
+
+	summary, err := client.BackupStdin(backupCtx, reader, filename, opts)
+	// Stop the dump when restic gave up reading it
+	stopped.Store(true)
+	reader.Close()
+	dumpErr := <-done
+
+	if failed.Load() {
+		if summary != nil {
+			if err := client.ForgetSnapshots(context.WithoutCancel(ctx), []string{summary.SnapshotID}); err != nil {
+				m.log.Errorf("Failed to forget incomplete dump snapshot %s: %v", summary.SnapshotID, err)
+			}
+		}
+		return nil, fmt.Errorf("dump command failed: %v, output: %s", dumpErr, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to store dump: %v", err)
+	}
+
+	m.log.WithFields(pvcFields(pvc)).Infof("Stored dump of PVC %s/%s in snapshot %s", pvc.Namespace, pvc.Name, summary.SnapshotID)
+	return summary, nil
+}
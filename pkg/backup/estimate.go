@@ -0,0 +1,84 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// Backup estimate modes
+const (
+	EstimateOff    = "off"
+	EstimateNew    = "new" // Only PVCs without a snapshot yet, e.g. newly enabled ones
+	EstimateAlways = "always"
+)
+
+// checkEstimate validates a backup estimate mode
+func checkEstimate(mode string) error {
+	switch mode {
+	case EstimateOff, EstimateNew, EstimateAlways:
+		return nil
+	}
+	return fmt.Errorf("invalid estimate mode %q, expected %s, %s or %s", mode, EstimateOff, EstimateNew, EstimateAlways)
+}
+
+// estimateBackup runs a dry-run backup of a PVC before its backup, logging and exposing
+// the data the backup is expected to add and how long uploading it takes. The estimate
+// reads the PVC like the backup does, and is only an indication: it counts the data
+// before compression, and a failure does not keep the backup from running.
+func (m *Manager) estimateBackup(ctx context.Context, client *restic.Client, pvc k8s.PVCInfo, paths []string, opts restic.BackupOptions) {
+	if !m.needsEstimate(ctx, client, pvc) {
+		return
+	}
+
+	summary, err := client.EstimateBackup(ctx, paths, opts)
+	if err != nil {
+		m.log.WithFields(pvcFields(pvc)).Warnf("Failed to estimate backup of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		return
+	}
+
+	labels := pvcLabels(pvc)
+	m.metrics.Set(metricPVCEstimatedBytes, labels, float64(summary.DataAdded))
+	m.throughputMu.Lock()
+	throughput := m.throughput
+	m.throughputMu.Unlock()
+	expected := "unknown duration"
+	if throughput > 0 {
+		seconds := float64(summary.DataAdded) / throughput
+		m.metrics.Set(metricPVCEstimatedSeconds, labels, seconds)
+		expected = fmt.Sprintf("about %v", (time.Duration(seconds) * time.Second).Round(time.Second))
+	}
+	m.log.WithFields(pvcFields(pvc)).Infof("Backup of PVC %s/%s is expected to add %s of %s in %d files, %s", pvc.Namespace, pvc.Name,
+		FormatBytes(summary.DataAdded), FormatBytes(summary.TotalBytesProcessed), summary.TotalFilesProcessed, expected)
+}
+
+// needsEstimate reports whether the backup of a PVC is estimated first. In the new mode
+// PVCs found with a snapshot are remembered, so their repository is listed only once.
+func (m *Manager) needsEstimate(ctx context.Context, client *restic.Client, pvc k8s.PVCInfo) bool {
+	if m.estimate != EstimateNew {
+		return m.estimate == EstimateAlways
+	}
+
+	m.backedUpMu.Lock()
+	known := m.backedUp[pvc.UID]
+	m.backedUpMu.Unlock()
+	if known {
+		return false
+	}
+
+	snapshots, err := client.Snapshots(ctx, []string{restic.PVCIDTagPrefix + pvc.UID})
+	if err != nil {
+		m.log.Warnf("Failed to look up the snapshots of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		return false
+	}
+	if len(snapshots) == 0 {
+		return true
+	}
+	m.backedUpMu.Lock()
+	m.backedUp[pvc.UID] = true
+	m.backedUpMu.Unlock()
+	return false
+}
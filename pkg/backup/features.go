@@ -0,0 +1,195 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+)
+
+// Feature flags gating behaviors that can be rolled out node by node
+const (
+	// FeatureAutoUnlock removes stale repository locks and retries
+	FeatureAutoUnlock = "auto-unlock"
+	// FeatureAnomalyDetection warns about backups changing drastically more than usual
+	FeatureAnomalyDetection = "anomaly-detection"
+	// FeatureMaintenance lets the node run repository maintenance, taking part in the
+	// maintenance leader election when enabled
+	FeatureMaintenance = "maintenance"
+	// FeatureMountCheck skips PVCs whose directory is an unhealthy mount
+	FeatureMountCheck = "mount-check"
+	// FeatureAutoRestore lets restores pick their snapshots themselves, restoring every
+	// PVC of a selector at a point in time
+	FeatureAutoRestore = "auto-restore"
+)
+
+// featureDefaults are the states of the feature flags not set in the configuration
+var featureDefaults = map[string]bool{
+	FeatureAutoUnlock:       true,
+	FeatureAnomalyDetection: true,
+	FeatureMaintenance:      true,
+	FeatureMountCheck:       true,
+	FeatureAutoRestore:      true,
+}
+
+// ParseFeatures parses comma-separated feature flags, e.g. "anomaly-detection=off,mount-check=on"
+func ParseFeatures(value string) (map[string]bool, error) {
+	flags := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, state, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid feature flag %q, expected name=on or name=off", entry)
+		}
+		if _, known := featureDefaults[name]; !known {
+			return nil, fmt.Errorf("unknown feature %q, available: %s", name, strings.Join(featureNames(), ", "))
+		}
+		switch strings.ToLower(strings.TrimSpace(state)) {
+		case "on", "true", "enabled":
+			flags[name] = true
+		case "off", "false", "disabled":
+			flags[name] = false
+		default:
+			return nil, fmt.Errorf("invalid state %q of feature %s, expected on or off", state, name)
+		}
+	}
+	return flags, nil
+}
+
+// parseFeatureConfig parses the feature flags of the backup configuration. The
+// auto-unlock feature defaults to BACKUP_AUTO_UNLOCK.
+func parseFeatureConfig(config cfg.BackupConfig) (map[string]bool, error) {
+	flags, err := ParseFeatures(config.Features)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BACKUP_FEATURES: %v", err)
+	}
+	if _, ok := flags[FeatureAutoUnlock]; !ok {
+		flags[FeatureAutoUnlock] = config.AutoUnlock
+	}
+	return flags, nil
+}
+
+// featureNames returns the sorted names of the feature flags
+func featureNames() []string {
+	names := make([]string, 0, len(featureDefaults))
+	for name := range featureDefaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// featureEnabled reports whether a feature flag is enabled on this node
+func (m *Manager) featureEnabled(name string) bool {
+	m.featuresMu.Lock()
+	defer m.featuresMu.Unlock()
+
+	if enabled, ok := m.features[name]; ok {
+		return enabled
+	}
+	if enabled, ok := m.featureConfig[name]; ok {
+		return enabled
+	}
+	return featureDefaults[name]
+}
+
+// refreshFeatures applies the feature flags of the configuration, overridden by the
+// features annotation of the node, so single nodes can be switched at runtime, and
+// logs the features switched
+func (m *Manager) refreshFeatures(ctx context.Context) {
+	flags := m.resolveFeatures(ctx)
+
+	m.featuresMu.Lock()
+	previous := m.features
+	m.features = flags
+	m.featuresMu.Unlock()
+
+	for _, name := range featureNames() {
+		if previous[name] != flags[name] {
+			m.log.Infof("Feature %s is %s", name, featureState(flags[name]))
+		}
+	}
+	m.resticClient.SetAutoUnlock(flags[FeatureAutoUnlock])
+}
+
+// logFeatures logs the state of every feature flag
+func (m *Manager) logFeatures() {
+	for _, name := range featureNames() {
+		m.log.Infof("Feature %s is %s", name, featureState(m.featureEnabled(name)))
+	}
+}
+
+// resolveFeatures returns the feature flags of the configuration, overridden by the
+// features annotation of the node. An invalid annotation is reported and ignored.
+func (m *Manager) resolveFeatures(ctx context.Context) map[string]bool {
+	flags := make(map[string]bool, len(featureDefaults))
+	for name, enabled := range featureDefaults {
+		flags[name] = enabled
+	}
+	for name, enabled := range m.featureConfig {
+		flags[name] = enabled
+	}
+
+	// The controller runs on no node of its own
+	if m.k8sClient.GetNodeName() == "" {
+		return flags
+	}
+	annotations, err := m.k8sClient.GetNodeAnnotations(ctx)
+	if err != nil {
+		m.log.Warnf("Failed to read the feature flags of the node: %v", err)
+	} else if value := annotations[cfg.AnnotationFeatures]; value != "" {
+		overrides, err := ParseFeatures(value)
+		if err != nil {
+			m.log.Warnf("Ignoring annotation %s of the node: %v", cfg.AnnotationFeatures, err)
+		}
+		for name, enabled := range overrides {
+			flags[name] = enabled
+		}
+	}
+	return flags
+}
+
+// updateElection starts or stops taking part in the maintenance leader election as
+// the maintenance feature is switched on or off, releasing the lease when stopping
+func (m *Manager) updateElection(ctx context.Context) {
+	if !m.leaderElection {
+		return
+	}
+	enabled := m.featureEnabled(FeatureMaintenance)
+	switch {
+	case enabled && m.stopElection == nil:
+		electionCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		// Stopping waits for the election to exit, so that its last leadership change
+		// cannot overwrite the one of a later election
+		m.stopElection = func() {
+			cancel()
+			<-done
+		}
+		go func() {
+			defer close(done)
+			m.k8sClient.RunLeaderElection(electionCtx, m.leaseNamespace, m.leaseName, func(leading bool) {
+				m.leader.Store(leading)
+			})
+		}()
+	case !enabled && m.stopElection != nil:
+		m.log.Infof("Maintenance is disabled on this node, leaving the maintenance leader election")
+		m.stopElection()
+		m.stopElection = nil
+		m.leader.Store(false)
+	}
+}
+
+// featureState names the state of a feature flag
+func featureState(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// backupFiles backs up the files of a PVC. A PVC with a volume snapshot method is
+// backed up from a snapshot of its volume. Otherwise a PVC annotated freeze has its
+// filesystem frozen for the backup, so no write is torn between the files restic
+// reads, and thawed at the latest after the freeze timeout, which fails the backup.
+func (m *Manager) backupFiles(ctx context.Context, client *restic.Client, pvc k8s.PVCInfo, paths []string, opts restic.BackupOptions) (*restic.BackupSummary, error) {
+	if m.skipSpecialFiles {
+		excludeFile, remove, err := writeSpecialFilesExclude(paths, m.oneFileSystem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list special files: %v", err)
+		}
+		defer remove()
+		opts.ExcludeFile = excludeFile
+	}
+
+	if pvc.Config.VolumeSnapshot != "" {
+		release, err := m.snapshotVolume(ctx, pvc)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return client.Backup(ctx, paths, opts)
+	}
+	if !pvc.Config.Freeze {
+		return client.Backup(ctx, paths, opts)
+	}
+
+	thaw, err := freezeFilesystem(pvc.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to freeze filesystem: %v", err)
+	}
+	m.log.WithFields(pvcFields(pvc)).Infof("Froze filesystem of PVC %s/%s", pvc.Namespace, pvc.Name)
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			// The kernel keeps a filesystem frozen until it is thawed, even when the agent exits
+			if err := thaw(); err != nil {
+				m.log.WithFields(pvcFields(pvc)).Errorf("Failed to thaw filesystem of PVC %s/%s, thaw it with fsfreeze -u %s: %v", pvc.Namespace, pvc.Name, pvc.Path, err)
+				return
+			}
+			m.log.WithFields(pvcFields(pvc)).Infof("Thawed filesystem of PVC %s/%s", pvc.Namespace, pvc.Name)
+		})
+	}
+
+	backupCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var timedOut atomic.Bool
+	if m.freezeTimeout > 0 {
+		timer := time.AfterFunc(m.freezeTimeout, func() {
+			timedOut.Store(true)
+			release()
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	summary, err := client.Backup(backupCtx, paths, opts)
+	release()
+	if timedOut.Load() {
+		// The backup may have ended right as the filesystem was thawed
+		if summary != nil {
+			if err := client.ForgetSnapshots(context.WithoutCancel(ctx), []string{summary.SnapshotID}); err != nil {
+				m.log.Errorf("Failed to forget snapshot %s taken past the freeze timeout: %v", summary.SnapshotID, err)
+			}
+		}
+		return nil, fmt.Errorf("filesystem thawed after the freeze timeout of %s, before the backup ended", m.freezeTimeout)
+	}
+	return summary, err
+}
+
+// thawLeftovers thaws the filesystems of the PVCs annotated freeze, which stay frozen
+// when the agent freezing them was killed during a backup and block the writes of
+// their applications until thawed
+func (m *Manager) thawLeftovers(ctx context.Context) {
+	pvcs, err := m.k8sClient.GetPVCsToBackup(ctx)
+	if err != nil {
+		m.log.Errorf("Failed to look for frozen filesystems: %v", err)
+		return
+	}
+	for _, pvc := range pvcs {
+		if !pvc.Config.Freeze || pvc.Config.VolumeSnapshot != "" {
+			continue
+		}
+		thawed, err := thawFilesystem(pvc.Path)
+		if err != nil {
+			m.log.WithFields(pvcFields(pvc)).Debugf("Failed to thaw filesystem of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+			continue
+		}
+		if thawed {
+			m.log.WithFields(pvcFields(pvc)).Warnf("Thawed filesystem of PVC %s/%s, left frozen by an interrupted backup", pvc.Namespace, pvc.Name)
+		}
+	}
+}
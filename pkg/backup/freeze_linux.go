@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Filesystem freeze ioctls of linux/fs.h
+const (
+	ioctlFIFREEZE = 0xc0045877
+	ioctlFITHAW   = 0xc0045878
+)
+
+// freezeFilesystem freezes the filesystem mounted at path, blocking its writes until
+// the returned function thaws it. Only mountpoints are frozen: a directory of a shared
+// filesystem, e.g. the root filesystem of the node, would block every other writer.
+func freezeFilesystem(path string) (func() error, error) {
+	if err := checkMountpoint(path); err != nil {
+		return nil, err
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioctl(dir, ioctlFIFREEZE); err != nil {
+		dir.Close()
+		return nil, err
+	}
+	return func() error {
+		defer dir.Close()
+		return ioctl(dir, ioctlFITHAW)
+	}, nil
+}
+
+// thawFilesystem thaws the filesystem mounted at path, e.g. left frozen by an agent
+// killed during a backup. It reports whether the filesystem was frozen.
+func thawFilesystem(path string) (bool, error) {
+	if err := checkMountpoint(path); err != nil {
+		return false, err
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer dir.Close()
+	// The kernel refuses to thaw a filesystem that is not frozen
+	if err := ioctl(dir, ioctlFITHAW); err != nil {
+		if errors.Is(err, syscall.EINVAL) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// checkMountpoint fails when path is a directory of the filesystem of its parent
+func checkMountpoint(path string) error {
+	device, err := deviceOf(path)
+	if err != nil {
+		return err
+	}
+	parent, err := deviceOf(filepath.Dir(filepath.Clean(path)))
+	if err != nil {
+		return err
+	}
+	if device == parent {
+		return fmt.Errorf("%s is not a mountpoint, only PVCs with a filesystem of their own can be frozen", path)
+	}
+	return nil
+}
+
+// ioctl runs an ioctl without argument on a file
+func ioctl(file *os.File, request uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
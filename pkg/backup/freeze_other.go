@@ -0,0 +1,15 @@
+//go:build !linux
+
+package backup
+
+import "fmt"
+
+// freezeFilesystem is only supported on Linux
+func freezeFilesystem(path string) (func() error, error) {
+	return nil, fmt.Errorf("freezing filesystems is only supported on Linux")
+}
+
+// thawFilesystem has nothing to thaw where filesystems cannot be frozen
+func thawFilesystem(path string) (bool, error) {
+	return false, nil
+}
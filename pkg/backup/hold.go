@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+)
+
+// holdStateName is the ConfigMap holding the repository hold, set by a security admin
+// during incident response to keep every agent from deleting backup data
+const holdStateName = "local-pvc-backup-hold"
+
+// Keys of the hold ConfigMap
+const (
+	holdKeyHeld   = "held"
+	holdKeyReason = "reason"
+	holdKeySince  = "since"
+	holdKeyBy     = "by"
+)
+
+// Hold describes a repository hold
+type Hold struct {
+	Reason string
+	Since  time.Time
+	By     string
+}
+
+// GetHold returns the repository hold, nil when the repositories are not held
+func GetHold(ctx context.Context, k8sClient *k8s.Client, namespace string) (*Hold, error) {
+	state, err := k8sClient.GetState(ctx, namespace, holdStateName)
+	if err != nil {
+		return nil, err
+	}
+	if state[holdKeyHeld] != "true" {
+		return nil, nil
+	}
+	since, _ := time.Parse(time.RFC3339, state[holdKeySince])
+	return &Hold{Reason: state[holdKeyReason], Since: since, By: state[holdKeyBy]}, nil
+}
+
+// SetHold holds the repositories, keeping the time of an existing hold
+func SetHold(ctx context.Context, k8sClient *k8s.Client, namespace, reason string) error {
+	by, _ := os.Hostname()
+	return k8sClient.UpdateState(ctx, namespace, holdStateName, func(data map[string]string) {
+		if data[holdKeyHeld] != "true" {
+			data[holdKeySince] = time.Now().UTC().Format(time.RFC3339)
+		}
+		data[holdKeyHeld] = "true"
+		data[holdKeyReason] = reason
+		data[holdKeyBy] = by
+	})
+}
+
+// ReleaseHold releases the repository hold
+func ReleaseHold(ctx context.Context, k8sClient *k8s.Client, namespace string) error {
+	return k8sClient.UpdateState(ctx, namespace, holdStateName, func(data map[string]string) {
+		for key := range data {
+			delete(data, key)
+		}
+	})
+}
+
+// CheckHold fails when the repositories are held, or when the hold cannot be read:
+// deletions fail closed, an unreachable API server must not lift a hold
+func CheckHold(ctx context.Context, k8sClient *k8s.Client, namespace string) error {
+	hold, err := GetHold(ctx, k8sClient, namespace)
+	if err != nil {
+		return fmt.Errorf("deletions refused, the repository hold cannot be checked: %v", err)
+	}
+	if hold != nil {
+		return fmt.Errorf("deletions refused, the repositories are held since %s: %s",
+			hold.Since.Local().Format(time.RFC3339), hold.Reason)
+	}
+	return nil
+}
+
+// deletionsAllowed reports whether the agent may forget snapshots and prune data,
+// logging why not
+func (m *Manager) deletionsAllowed(ctx context.Context, operation string) bool {
+	err := CheckHold(ctx, m.k8sClient, m.leaseNamespace)
+	if err != nil {
+		m.metrics.Set(metricHold, nil, 1)
+		m.log.Warnf("Skipping %s: %v", operation, err)
+		return false
+	}
+	m.metrics.Set(metricHold, nil, 0)
+	return true
+}
@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+)
+
+// runHook runs a hook command of a PVC in the pod mounting it. PVCs no running pod
+// mounts have no application state to flush, their hooks are skipped.
+func (m *Manager) runHook(ctx context.Context, pvc k8s.PVCInfo, name, command string) error {
+	if command == "" {
+		return nil
+	}
+	if pvc.Pod == "" {
+		m.log.WithFields(pvcFields(pvc)).Debugf("No running pod mounts PVC %s/%s, skipping its %s", pvc.Namespace, pvc.Name, name)
+		return nil
+	}
+	if m.hookTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.hookTimeout)
+		defer cancel()
+	}
+
+	m.log.WithFields(pvcFields(pvc)).Infof("Running %s of PVC %s/%s in pod %s", name, pvc.Namespace, pvc.Name, pvc.Pod)
+
+	var stderr bytes.Buffer
+	if err := m.k8sClient.ExecInPod(ctx, pvc.Namespace, pvc.Pod, pvc.Config.HookContainer, shellCommand(command), nil, nil, &stderr); err != nil {
+		return fmt.Errorf("%s failed: %v, output: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// runPostHook runs the post-hook of a PVC, even when the backup was cancelled. A failed
+// post-hook does not invalidate the backup, it is logged and recorded on the PVC.
+func (m *Manager) runPostHook(ctx context.Context, pvc k8s.PVCInfo) {
+	ctx = context.WithoutCancel(ctx)
+	if err := m.runHook(ctx, pvc, "post-hook", pvc.Config.PostHook); err != nil {
+		m.log.WithFields(pvcFields(pvc)).Errorf("Post-hook of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		if err := m.k8sClient.RecordPVCEvent(ctx, pvc, "BackupPostHookFailed", err.Error()); err != nil {
+			m.log.Errorf("%v", err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxIgnoreFileSize bounds the part of an ignore file that is read
+const maxIgnoreFileSize = 64 * 1024
+
+// ignoreRule is a pattern of the ignore file of a PVC, e.g. .backupignore
+type ignoreRule struct {
+	Pattern string // Slash-separated, relative to the PVC directory, ** matches any directories
+	Negated bool   // Re-includes what earlier patterns excluded
+}
+
+// parseIgnoreFile parses gitignore-style patterns: blank lines and lines starting with
+// # are skipped, ! negates a pattern, patterns holding a slash other than a trailing
+// one are relative to the PVC directory and the others match at any depth. A trailing
+// slash is dropped, restic cannot restrict a pattern to directories.
+func parseIgnoreFile(r io.Reader) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(io.LimitReader(r, maxIgnoreFileSize))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.Negated = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		line = strings.TrimSuffix(line, "/")
+		if line == "" {
+			continue
+		}
+		if strings.Contains(line, "..") {
+			return nil, fmt.Errorf("pattern %q leaves the PVC directory", line)
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", line, err)
+		}
+
+		if strings.Contains(line, "/") {
+			rule.Pattern = strings.TrimPrefix(line, "/")
+		} else {
+			rule.Pattern = "**/" + line
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// readIgnoreFile reads the ignore file at the root of a PVC directory, nil when the
+// PVC has none or no ignore file is configured
+func readIgnoreFile(pvcPath, name string) ([]ignoreRule, error) {
+	if name == "" {
+		return nil, nil
+	}
+	file, err := os.Open(filepath.Join(pvcPath, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rules, err := parseIgnoreFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return rules, nil
+}
+
+// resticPattern returns the rule as a restic exclude pattern for a PVC directory
+func (r ignoreRule) resticPattern(pvcPath string) string {
+	pattern := filepath.Join(pvcPath, filepath.FromSlash(r.Pattern))
+	if r.Negated {
+		return "!" + pattern
+	}
+	return pattern
+}
+
+// ignored reports whether the rules exclude a slash-separated path relative to the
+// PVC directory. The last matching rule decides, like in restic and git.
+func ignored(rules []ignoreRule, rel string) bool {
+	result := false
+	segments := strings.Split(rel, "/")
+	for _, rule := range rules {
+		if matchSegments(strings.Split(rule.Pattern, "/"), segments) {
+			result = !rule.Negated
+		}
+	}
+	return result
+}
+
+// matchSegments matches path segments against pattern segments, where ** matches any
+// number of segments
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// KeyRotation describes the key rotation of one repository
+type KeyRotation struct {
+	Repository string
+	OldKey     string
+	NewKey     string
+	// Skipped explains why the repository was not rotated, e.g. because it does not exist yet
+	Skipped string
+}
+
+// RotateKeys replaces the key of the configured password with a key of the password
+// stored in newPasswordFile in every repository found in the storage, including the
+// repositories of deleted PVCs and drained nodes. Each repository gets the new key
+// first, the new password is verified by opening the repository with it, and only then
+// the old key is removed. A failed repository does not stop the others, but fails the
+// rotation: running it again resumes, repositories opening with the new password only
+// are already rotated. Replicas sharing the password are rotated along.
+func (m *Manager) RotateKeys(ctx context.Context, newPasswordFile string, progress func(KeyRotation)) error {
+	data, err := os.ReadFile(newPasswordFile)
+	if err != nil {
+		return fmt.Errorf("failed to read new password: %v", err)
+	}
+	newPassword := strings.TrimRight(string(data), "\r\n")
+	if newPassword == "" {
+		return fmt.Errorf("the new password is empty")
+	}
+
+	repositories, err := m.storedRepositories(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list the repositories, the old key is still needed by repositories no PVC leads to: %v", err)
+	}
+	var errs []error
+	for _, repository := range repositories {
+		clients := []*restic.Client{repository}
+		if m.replicationEnabled() && m.replica.Password == "" {
+			clients = append(clients, repository.Replica(m.replica))
+		}
+
+		for _, client := range clients {
+			rotation, err := rotateKey(ctx, client, client.WithPassword(newPassword), newPasswordFile)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to rotate the key of %s: %v", client.GetRepository(), err))
+				continue
+			}
+			progress(*rotation)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d repositories were not rotated, keep the old password: %v", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+// rotateKey replaces the current key of client with a key of the password of newClient
+func rotateKey(ctx context.Context, client, newClient *restic.Client, newPasswordFile string) (*KeyRotation, error) {
+	rotation := &KeyRotation{Repository: client.GetRepository()}
+
+	oldKey, err := client.CurrentKey(ctx)
+	switch {
+	case restic.IsPasswordError(err):
+		// Rotated before, unless the new password does not open it either
+		newKey, err := newClient.CurrentKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rotation.NewKey = newKey
+		rotation.Skipped = "already rotated"
+		return rotation, nil
+	case restic.IsMissingRepositoryError(err):
+		rotation.Skipped = "no repository, nothing backed up yet"
+		return rotation, nil
+	case err != nil:
+		return nil, err
+	}
+	rotation.OldKey = oldKey
+
+	// A previous run may have added the new key already
+	newKey, err := newClient.CurrentKey(ctx)
+	if restic.IsPasswordError(err) {
+		if err := client.AddKey(ctx, newPasswordFile); err != nil {
+			return nil, err
+		}
+		newKey, err = newClient.CurrentKey(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("new password does not open the repository, the old key is kept: %v", err)
+	}
+	if newKey == oldKey {
+		return nil, fmt.Errorf("the new password is the current password")
+	}
+	rotation.NewKey = newKey
+
+	if err := newClient.RemoveKey(ctx, oldKey); err != nil {
+		return nil, err
+	}
+	return rotation, nil
+}
@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// localStateVersion is the format version of exported agent state
+const localStateVersion = 1
+
+// localStateFiles are the files of the cache directory holding the agent state worth
+// keeping across a node replacement
+var localStateFiles = []string{anomalyStateFile, SeedCheckpointFile, restic.KnownHostsFile}
+
+// LocalState is the exported local state of an agent: the change baselines of its PVCs,
+// the seed checkpoint and the SFTP host keys seen first
+type LocalState struct {
+	Version    int               `json:"version"`
+	Node       string            `json:"node"`
+	ExportedAt time.Time         `json:"exported_at"`
+	Files      map[string][]byte `json:"files"` // Content of the state files by name
+}
+
+// ExportLocalState reads the state files of the cache directory of an agent
+func ExportLocalState(cachePath, node string) (*LocalState, error) {
+	state := &LocalState{
+		Version:    localStateVersion,
+		Node:       node,
+		ExportedAt: time.Now().UTC(),
+		Files:      make(map[string][]byte),
+	}
+	for _, name := range localStateFiles {
+		data, err := os.ReadFile(filepath.Join(cachePath, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		state.Files[name] = data
+	}
+	return state, nil
+}
+
+// ImportLocalState writes exported state files into the cache directory of the agent of
+// node, rebinding the seed checkpoint to it. Existing files are only replaced with
+// overwrite. It returns the names of the imported files.
+func ImportLocalState(cachePath, node string, state *LocalState, overwrite bool) ([]string, error) {
+	if state.Version != localStateVersion {
+		return nil, fmt.Errorf("unsupported state version %d, expected %d", state.Version, localStateVersion)
+	}
+
+	names := make([]string, 0, len(state.Files))
+	for name := range state.Files {
+		known := false
+		for _, file := range localStateFiles {
+			known = known || name == file
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown state file %s", name)
+		}
+		if _, err := os.Stat(filepath.Join(cachePath, name)); err == nil && !overwrite {
+			return nil, fmt.Errorf("%s already exists on node %s, import with overwrite to replace it", name, node)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if err := os.MkdirAll(cachePath, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	for _, name := range names {
+		data := state.Files[name]
+		if name == SeedCheckpointFile {
+			var err error
+			if data, err = rebindSeedCheckpoint(data, node); err != nil {
+				return nil, err
+			}
+		}
+
+		path := filepath.Join(cachePath, name)
+		if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %v", name, err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %v", name, err)
+		}
+	}
+	return names, nil
+}
+
+// rebindSeedCheckpoint moves a seed checkpoint to a new node, the seeded PVCs keep their
+// UIDs when their data disks move with them
+func rebindSeedCheckpoint(data []byte, node string) ([]byte, error) {
+	var checkpoint seedCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse seed checkpoint: %v", err)
+	}
+	checkpoint.Node = node
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode seed checkpoint: %v", err)
+	}
+	return data, nil
+}
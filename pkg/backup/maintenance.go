@@ -0,0 +1,206 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/logging"
+	"github.com/monlor/local-pvc-backup/pkg/notify"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+	"github.com/monlor/local-pvc-backup/pkg/storage"
+	"github.com/monlor/local-pvc-backup/pkg/tracing"
+)
+
+// isMaintenanceLeader reports whether this node may run repository wide maintenance
+func (m *Manager) isMaintenanceLeader() bool {
+	switch m.role {
+	case roleController:
+		return true
+	case roleAgent:
+		return false
+	}
+	if !m.featureEnabled(FeatureMaintenance) {
+		return false
+	}
+	return !m.leaderElection || m.leader.Load()
+}
+
+// notify posts a failure notification with the secrets masked, logging when it
+// cannot be delivered
+func (m *Manager) notify(ctx context.Context, event notify.Event) {
+	event.Repository = logging.Redact(m.log, event.Repository)
+	event.Error = logging.Redact(m.log, event.Error)
+	if err := m.notifier.Notify(ctx, event); err != nil {
+		m.log.Errorf("Failed to send %s notification: %v", event.Kind, err)
+	}
+}
+
+// traced runs an operation in a span of its own
+func (m *Manager) traced(ctx context.Context, name string, operation func(context.Context) error) error {
+	ctx, span := tracing.Start(ctx, name)
+	err := operation(ctx)
+	span.End(err)
+	return err
+}
+
+// performCheck runs a deep repository check reading a subset of the pack data
+func (m *Manager) performCheck(ctx context.Context) error {
+	if !m.isMaintenanceLeader() {
+		m.log.Debug("Not the maintenance leader, skipping repository check")
+		return nil
+	}
+
+	m.log.Infof("Running deep repository check, reading %s of data", m.checkReadDataSubset)
+
+	start := time.Now()
+	var errs []error
+	for _, client := range append(m.repositories(), m.plannedRepositories()...) {
+		if err := client.Check(ctx, m.checkReadDataSubset); err != nil {
+			m.notify(ctx, notify.Event{Kind: notify.EventCheckFailed, Repository: client.GetRepository(), Error: err.Error()})
+			errs = append(errs, fmt.Errorf("%s: %v", client.GetRepository(), err))
+		}
+	}
+	err := errors.Join(errs...)
+	m.recordMaintenance(operationCheck, start, err)
+	if err != nil {
+		return err
+	}
+
+	m.log.Infof("Deep repository check succeeded in %v", time.Since(start).Round(time.Second))
+	return nil
+}
+
+// RepositoryCheck is the outcome of the check of a repository by CheckRepositories
+type RepositoryCheck struct {
+	Repository string
+	Err        error
+	Skipped    string // Why the repository was not checked, e.g. it was not created yet
+}
+
+// CheckRepositories checks the repositories of the PVCs of this node, reading the given
+// subset of their data when set. Repositories found damaged fail with a
+// VerificationError.
+func (m *Manager) CheckRepositories(ctx context.Context, readDataSubset string, progress func(RepositoryCheck)) error {
+	clients := []*restic.Client{m.resticClient}
+	if m.resticClient.Sharded() {
+		pvcs, err := m.k8sClient.GetPVCsToBackup(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get PVCs to backup: %v", err)
+		}
+		clients = nil
+		seen := make(map[string]bool)
+		for _, pvc := range pvcs {
+			client := m.resticClient.ForPVC(pvc.Namespace, pvc.Name)
+			if !seen[client.GetRepository()] {
+				seen[client.GetRepository()] = true
+				clients = append(clients, client)
+			}
+		}
+	}
+
+	var errs []error
+	for _, client := range clients {
+		repository := logging.Redact(m.log, client.GetRepository())
+		err := client.Check(ctx, readDataSubset)
+		switch {
+		case err != nil && m.resticClient.Sharded() && restic.IsMissingRepositoryError(err):
+			progress(RepositoryCheck{Repository: repository, Skipped: "no backup was stored yet"})
+			continue
+		case restic.IsIntegrityError(err):
+			err = &VerificationError{Err: err}
+		}
+		progress(RepositoryCheck{Repository: repository, Err: err})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// performPrune removes the data no longer referenced by any snapshot
+func (m *Manager) performPrune(ctx context.Context) error {
+	if !m.isMaintenanceLeader() {
+		m.log.Debug("Not the maintenance leader, skipping repository prune")
+		return nil
+	}
+	if m.appendOnly {
+		m.log.Debug("Append-only repository, skipping repository prune")
+		return nil
+	}
+	if !m.deletionsAllowed(ctx, "repository prune") {
+		return nil
+	}
+
+	m.log.Info("Pruning repository")
+
+	start := time.Now()
+	var errs []error
+	for _, client := range append(m.repositories(), m.plannedRepositories()...) {
+		if err := client.Prune(ctx); err != nil {
+			m.notify(ctx, notify.Event{Kind: notify.EventPruneFailed, Repository: client.GetRepository(), Error: err.Error()})
+			errs = append(errs, fmt.Errorf("%s: %v", client.GetRepository(), err))
+		}
+	}
+	err := errors.Join(errs...)
+	m.recordMaintenance(operationPrune, start, err)
+	if err != nil {
+		return err
+	}
+
+	m.log.Infof("Repository pruned in %v", time.Since(start).Round(time.Second))
+	return nil
+}
+
+// clockEndpoint returns the endpoint of the storage backend serving the reference clock.
+// The check uses the system CAs, endpoints with a private certificate are skipped.
+func clockEndpoint(config *cfg.Config) string {
+	switch config.BackendType {
+	case cfg.BackendS3:
+		if config.S3Config.CACertFile != "" || config.S3Config.InsecureTLS {
+			return ""
+		}
+		return config.S3Config.Endpoint
+	case cfg.BackendGCS:
+		return "https://storage.googleapis.com"
+	case cfg.BackendAzure:
+		suffix := config.AzureConfig.EndpointSuffix
+		if suffix == "" {
+			suffix = "core.windows.net"
+		}
+		return fmt.Sprintf("https://%s.blob.%s", config.AzureConfig.AccountName, suffix)
+	case cfg.BackendB2:
+		return "https://api.backblazeb2.com"
+	case cfg.BackendREST:
+		if config.RESTConfig.CACertFile != "" || config.RESTConfig.InsecureTLS {
+			return ""
+		}
+		return config.RESTConfig.URL
+	default:
+		return ""
+	}
+}
+
+// checkClockSkew compares the node clock against the storage endpoint and warns when they
+// drift apart, since skew breaks request signing long before restic reports it clearly
+func (m *Manager) checkClockSkew(ctx context.Context) {
+	if m.clockEndpoint == "" {
+		return
+	}
+
+	skew, err := storage.ClockSkew(ctx, m.clockClient, m.clockEndpoint)
+	if err != nil {
+		m.log.Warnf("Failed to check clock skew against storage endpoint: %v", err)
+		return
+	}
+
+	m.metrics.Set(metricClockSkew, nil, skew.Seconds())
+	if m.clockSkewThreshold > 0 && (skew > m.clockSkewThreshold || skew < -m.clockSkewThreshold) {
+		m.log.Warnf("Node clock is %v off the storage endpoint clock (threshold %v), requests may fail to authenticate and snapshot times will be wrong, check NTP on node",
+			skew, m.clockSkewThreshold)
+		return
+	}
+	m.log.Debugf("Clock skew against storage endpoint: %v", skew)
+}
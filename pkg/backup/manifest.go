@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+	"github.com/monlor/local-pvc-backup/pkg/version"
+)
+
+// ManifestPrefix is the prefix of the backup cycle manifests under the artifacts prefix
+const ManifestPrefix = "manifests"
+
+// Manifest records the outcome of a backup cycle of a node, for auditors and reports.
+// It holds no repository locations or credentials.
+type Manifest struct {
+	Node     string          `json:"node"`
+	Version  string          `json:"version"`
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Backups  []ManifestEntry `json:"backups"`
+}
+
+// ManifestEntry records the backup of a PVC
+type ManifestEntry struct {
+	Namespace  string    `json:"namespace"`
+	PVC        string    `json:"pvc"`
+	UID        string    `json:"uid"`
+	Snapshot   string    `json:"snapshot,omitempty"`
+	Time       time.Time `json:"time"`
+	Files      int       `json:"files,omitempty"`
+	Bytes      uint64    `json:"bytes,omitempty"`       // Size of the backed up data
+	BytesAdded uint64    `json:"bytes_added,omitempty"` // Data added to the repository
+	Error      string    `json:"error,omitempty"`
+}
+
+// manifestRecorder collects the backups of a cycle
+type manifestRecorder struct {
+	mu       sync.Mutex
+	manifest Manifest
+}
+
+func newManifestRecorder(node string) *manifestRecorder {
+	return &manifestRecorder{manifest: Manifest{Node: node, Version: version.Version, Started: time.Now().UTC()}}
+}
+
+// record adds the outcome of the backup of a PVC
+func (r *manifestRecorder) record(pvc k8s.PVCInfo, summary *restic.BackupSummary, err error) {
+	entry := ManifestEntry{Namespace: pvc.Namespace, PVC: pvc.Name, UID: pvc.UID, Time: time.Now().UTC()}
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.Snapshot = summary.SnapshotID
+		entry.Files = summary.TotalFilesProcessed
+		entry.Bytes = summary.TotalBytesProcessed
+		entry.BytesAdded = summary.DataAdded
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manifest.Backups = append(r.manifest.Backups, entry)
+}
+
+// failures counts the failed backups by namespace
+func (r *manifestRecorder) failures() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	failures := make(map[string]int)
+	for _, entry := range r.manifest.Backups {
+		if entry.Error != "" {
+			failures[entry.Namespace]++
+		}
+	}
+	return failures
+}
+
+// uploadManifest uploads the manifest of a backup cycle as an artifact
+func (m *Manager) uploadManifest(ctx context.Context, recorder *manifestRecorder) {
+	if m.artifacts == nil {
+		return
+	}
+	manifest := recorder.manifest
+	manifest.Finished = time.Now().UTC()
+	sort.Slice(manifest.Backups, func(i, j int) bool {
+		a, b := manifest.Backups[i], manifest.Backups[j]
+		return a.Namespace < b.Namespace || (a.Namespace == b.Namespace && a.PVC < b.PVC)
+	})
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		m.log.Warnf("Failed to encode backup manifest: %v", err)
+		return
+	}
+	name := fmt.Sprintf("%s/%s/%s.json", ManifestPrefix, manifest.Node, manifest.Started.Format("20060102T150405Z"))
+	if _, err := m.artifacts.Upload(ctx, name, data); err != nil {
+		m.log.Warnf("Failed to upload backup manifest: %v", err)
+	}
+}
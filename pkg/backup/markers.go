@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+)
+
+// cacheDirMarker is the file marking cache directories (https://bford.info/cachedir/)
+var cacheDirMarker = excludeMarker{Name: "CACHEDIR.TAG", Header: "Signature: 8a477f597d28d172789f06886806bc55"}
+
+// excludeMarker is a file whose presence excludes the content of its directory from the
+// backups, except the file itself, like restic --exclude-if-present
+type excludeMarker struct {
+	Name   string
+	Header string // Content the file must start with, empty for any
+}
+
+// parseExcludeMarker parses a marker of the exclude-if-present annotation, a file name
+// optionally followed by a colon and the header of the file
+func parseExcludeMarker(value string) (excludeMarker, error) {
+	name, header, _ := strings.Cut(strings.TrimSpace(value), ":")
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return excludeMarker{}, fmt.Errorf("%q is not a plain file name", name)
+	}
+	return excludeMarker{Name: name, Header: header}, nil
+}
+
+// String returns the marker as restic --exclude-if-present takes it
+func (e excludeMarker) String() string {
+	if e.Header == "" {
+		return e.Name
+	}
+	return e.Name + ":" + e.Header
+}
+
+// marks reports whether a directory holds the marker
+func (e excludeMarker) marks(dir string) bool {
+	file, err := os.Open(filepath.Join(dir, e.Name))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	header := make([]byte, len(e.Header))
+	if _, err := io.ReadFull(file, header); err != nil {
+		return false
+	}
+	return string(header) == e.Header
+}
+
+// excludeMarkers returns the markers excluding directories from the backups of a PVC.
+// Invalid markers are ignored, the annotation webhook reports them.
+func (m *Manager) excludeMarkers(pvc k8s.PVCInfo) []excludeMarker {
+	var markers []excludeMarker
+	if m.excludesCaches(pvc) {
+		markers = append(markers, cacheDirMarker)
+	}
+	for _, value := range strings.Split(pvc.Config.ExcludeIfPresent, ",") {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		marker, err := parseExcludeMarker(value)
+		if err != nil {
+			m.log.Warnf("Ignoring exclude-if-present marker of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+			continue
+		}
+		markers = append(markers, marker)
+	}
+	return markers
+}
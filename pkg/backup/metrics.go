@@ -0,0 +1,139 @@
+package backup
+
+import (
+	"context"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/logging"
+	"github.com/monlor/local-pvc-backup/pkg/metrics"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+	"github.com/monlor/local-pvc-backup/pkg/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// Metric names
+const (
+	metricMaintenanceLastRun     = "local_pvc_backup_maintenance_last_run_timestamp_seconds"
+	metricMaintenanceSuccess     = "local_pvc_backup_maintenance_success"
+	metricMaintenanceDuration    = "local_pvc_backup_maintenance_duration_seconds"
+	metricMaintenanceFailTotal   = "local_pvc_backup_maintenance_failures_total"
+	metricClockSkew              = "local_pvc_backup_clock_skew_seconds"
+	metricThroughput             = "local_pvc_backup_repository_throughput_bytes_per_second"
+	metricCacheSize              = "local_pvc_backup_cache_size_bytes"
+	metricCacheEvictedBytes      = "local_pvc_backup_cache_evicted_bytes_total"
+	metricPVCSize                = "local_pvc_backup_pvc_size_bytes"
+	metricPVCRestoreEstimate     = "local_pvc_backup_pvc_estimated_restore_seconds"
+	metricPVCEstimatedBytes      = "local_pvc_backup_pvc_estimated_backup_bytes"
+	metricPVCEstimatedSeconds    = "local_pvc_backup_pvc_estimated_backup_seconds"
+	metricPVCUnchangedTotal      = "local_pvc_backup_pvc_unchanged_skips_total"
+	metricPVCDiffFiles           = "local_pvc_backup_pvc_diff_files"
+	metricPVCDiffBytes           = "local_pvc_backup_pvc_diff_bytes"
+	metricNamespaceUsageBytes    = "local_pvc_backup_namespace_usage_bytes"
+	metricNamespaceSnapshots     = "local_pvc_backup_namespace_snapshots"
+	metricNamespaceQuotaExceeded = "local_pvc_backup_namespace_quota_exceeded"
+	metricRepositorySize         = "local_pvc_backup_repository_size_bytes"
+	metricRepositoryOverQuota    = "local_pvc_backup_repository_quota_exceeded"
+	metricPVCChangeAnomaly       = "local_pvc_backup_pvc_change_anomaly"
+	metricHold                   = "local_pvc_backup_repository_hold"
+	metricPVCMountHealthy        = "local_pvc_backup_pvc_mount_healthy"
+	metricPVCBackupDuration      = "local_pvc_backup_pvc_backup_duration_seconds"
+)
+
+// backupDurationBuckets are the upper bounds of the backup duration histogram buckets,
+// from incremental backups of small volumes to first backups of large ones
+var backupDurationBuckets = []float64{10, 30, 60, 300, 900, 1800, 3600, 7200, 14400, 28800}
+
+// Throughput samples smaller than this are dominated by overhead and ignored
+const minThroughputSample = 64 << 20
+
+// Maintenance operations
+const (
+	operationCheck     = "check"
+	operationPrune     = "prune"
+	operationReplicate = "replicate"
+	operationRecover   = "recover"
+	operationExpire    = "expire"
+	operationReport    = "report"
+)
+
+// registerMetrics declares the metrics exposed by the manager
+func registerMetrics(reg *metrics.Registry) {
+	reg.Register(metricMaintenanceLastRun, "Unix time of the last run of a repository maintenance operation.", metrics.TypeGauge)
+	reg.Register(metricMaintenanceSuccess, "Whether the last run of a repository maintenance operation succeeded.", metrics.TypeGauge)
+	reg.Register(metricMaintenanceDuration, "Duration of the last run of a repository maintenance operation in seconds.", metrics.TypeGauge)
+	reg.Register(metricMaintenanceFailTotal, "Total number of failed repository maintenance operations.", metrics.TypeCounter)
+	reg.Register(metricClockSkew, "Offset of the node clock from the storage endpoint clock in seconds.", metrics.TypeGauge)
+	reg.Register(metricThroughput, "Repository throughput observed during backups in bytes per second.", metrics.TypeGauge)
+	reg.Register(metricCacheSize, "Size of the restic cache directory in bytes.", metrics.TypeGauge)
+	reg.Register(metricCacheEvictedBytes, "Total size of the least recently used cache files evicted to keep the cache directory under its limit in bytes.", metrics.TypeCounter)
+	reg.Register(metricPVCSize, "Size of the latest snapshot of a PVC in bytes.", metrics.TypeGauge)
+	reg.Register(metricPVCRestoreEstimate, "Estimated duration of a full restore of the latest snapshot of a PVC in seconds.", metrics.TypeGauge)
+	reg.Register(metricPVCEstimatedBytes, "Data the next backup of a PVC was estimated to add by a dry-run, before compression, in bytes.", metrics.TypeGauge)
+	reg.Register(metricPVCEstimatedSeconds, "Estimated duration of the upload of the next backup of a PVC in seconds.", metrics.TypeGauge)
+	reg.Register(metricPVCUnchangedTotal, "Total number of backups of a PVC skipped because it did not change.", metrics.TypeCounter)
+	reg.Register(metricPVCDiffFiles, "Files added, removed or modified by the latest backup of a PVC since its previous snapshot.", metrics.TypeGauge)
+	reg.Register(metricPVCDiffBytes, "Data added or removed by the latest backup of a PVC since its previous snapshot in bytes.", metrics.TypeGauge)
+	reg.Register(metricNamespaceUsageBytes, "Repository data referenced by the snapshots of a namespace with a quota in bytes.", metrics.TypeGauge)
+	reg.Register(metricNamespaceSnapshots, "Number of snapshots of a namespace with a quota.", metrics.TypeGauge)
+	reg.Register(metricNamespaceQuotaExceeded, "Whether a namespace is over its backup quota, skipping its backups.", metrics.TypeGauge)
+	reg.Register(metricRepositorySize, "Data stored in a repository in bytes, measured against the repository size quota.", metrics.TypeGauge)
+	reg.Register(metricRepositoryOverQuota, "Whether a repository is over its size quota after applying the retention.", metrics.TypeGauge)
+	reg.Register(metricPVCChangeAnomaly, "Whether the latest backup of a PVC changed drastically more than usual.", metrics.TypeGauge)
+	reg.Register(metricHold, "Whether the last deletion was refused because of a repository hold.", metrics.TypeGauge)
+	reg.Register(metricPVCMountHealthy, "Whether the directory of a PVC passed the mount check before its last backup.", metrics.TypeGauge)
+	reg.RegisterHistogram(metricPVCBackupDuration, "Duration of the backups of a PVC in seconds.", backupDurationBuckets)
+}
+
+// recordMaintenance records the outcome of a repository maintenance operation
+func (m *Manager) recordMaintenance(operation string, start time.Time, err error) {
+	labels := metrics.Labels{"operation": operation}
+
+	m.metrics.Set(metricMaintenanceLastRun, labels, float64(start.Unix()))
+	m.metrics.Set(metricMaintenanceDuration, labels, time.Since(start).Seconds())
+	if err != nil {
+		m.metrics.Set(metricMaintenanceSuccess, labels, 0)
+		m.metrics.Add(metricMaintenanceFailTotal, labels, 1)
+		return
+	}
+	m.metrics.Set(metricMaintenanceSuccess, labels, 1)
+}
+
+// pvcFields returns the log fields identifying a PVC
+func pvcFields(pvc k8s.PVCInfo) logrus.Fields {
+	return logrus.Fields{logging.FieldNamespace: pvc.Namespace, logging.FieldPVC: pvc.Name}
+}
+
+// pvcLabels returns the metric labels identifying a PVC
+func pvcLabels(pvc k8s.PVCInfo) metrics.Labels {
+	return metrics.Labels{"namespace": pvc.Namespace, "pvc": pvc.Name}
+}
+
+// traceExemplar returns the exemplar labels linking a sample to the trace of the
+// operation running with ctx, none when it is not traced
+func traceExemplar(ctx context.Context) metrics.Labels {
+	if id := tracing.TraceID(ctx); id != "" {
+		return metrics.Labels{"trace_id": id}
+	}
+	return nil
+}
+
+// recordBackup updates the observed throughput and the PVC metrics after a backup
+func (m *Manager) recordBackup(ctx context.Context, pvc k8s.PVCInfo, summary *restic.BackupSummary) {
+	m.throughputMu.Lock()
+	defer m.throughputMu.Unlock()
+
+	// Smooth the throughput over backups uploading enough data to be meaningful
+	if duration := summary.Duration().Seconds(); summary.DataAddedPacked >= minThroughputSample && duration > 0 {
+		sample := float64(summary.DataAddedPacked) / duration
+		m.throughput = 0.7*m.throughput + 0.3*sample
+	}
+	m.metrics.Set(metricThroughput, nil, m.throughput)
+
+	labels := pvcLabels(pvc)
+	m.metrics.Observe(metricPVCBackupDuration, labels, summary.Duration().Seconds(), traceExemplar(ctx))
+	m.metrics.Set(metricPVCSize, labels, float64(summary.TotalBytesProcessed))
+	if m.throughput > 0 {
+		m.metrics.Set(metricPVCRestoreEstimate, labels, float64(summary.TotalBytesProcessed)/m.throughput)
+	}
+}
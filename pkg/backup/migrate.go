@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+	"github.com/monlor/local-pvc-backup/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// MigrateOptions holds the options of a migration to the shared repository layout
+type MigrateOptions struct {
+	DryRun             bool
+	DaemonSetNamespace string
+	DaemonSetName      string // Agents DaemonSet switched to the shared layout, empty skips the switch
+}
+
+// MigrateToSharedRepository copies the snapshots of every per-node repository into
+// the shared repository, makes sure they carry their node tag, verifies the snapshot
+// counts and finally switches the agents to the shared layout
+func MigrateToSharedRepository(ctx context.Context, resticClient *restic.Client, storageClient *storage.Client, k8sClient *k8s.Client, opts MigrateOptions, log *logrus.Logger) error {
+	names, err := storageClient.ListRepositories(ctx, cfg.NodeRepositoryPrefix)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no per-node repositories found")
+	}
+
+	shared := resticClient.WithRepository(resticClient.SharedRepository())
+	log.Infof("Migrating %d per-node repositories into %s", len(names), shared.GetRepository())
+	for _, name := range names {
+		log.Infof("  - %s", name)
+	}
+	if opts.DryRun {
+		log.Info("Dry run, nothing changed")
+		return nil
+	}
+
+	nodeRepository := func(name string) string {
+		return resticClient.NodeRepository(strings.TrimPrefix(name, cfg.NodeRepositoryPrefix))
+	}
+
+	// Create the shared repository with the chunker parameters of the first node repository
+	if err := shared.Check(ctx, ""); err != nil {
+		log.Infof("Initializing shared repository %s", shared.GetRepository())
+		if err := shared.InitRepositoryFrom(ctx, resticClient.WithRepository(nodeRepository(names[0]))); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		nodeName := strings.TrimPrefix(name, cfg.NodeRepositoryPrefix)
+		source := resticClient.WithRepository(nodeRepository(name))
+
+		sourceSnapshots, err := source.Snapshots(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to list snapshots of %s: %v", name, err)
+		}
+
+		log.Infof("Copying %d snapshots of node %s", len(sourceSnapshots), nodeName)
+		if err := shared.Copy(ctx, source); err != nil {
+			return fmt.Errorf("failed to copy %s: %v", name, err)
+		}
+
+		// Tag copied snapshots that predate node tagging
+		nodeTag := fmt.Sprintf("node=%s", nodeName)
+		copied, err := shared.Snapshots(ctx, nil)
+		if err != nil {
+			return err
+		}
+		var untagged []string
+		for _, snapshot := range copied {
+			if snapshot.Hostname == nodeName && !snapshot.HasTag(nodeTag) {
+				untagged = append(untagged, snapshot.ID)
+			}
+		}
+		if len(untagged) > 0 {
+			log.Infof("Adding tag %s to %d snapshots", nodeTag, len(untagged))
+			if err := shared.AddTags(ctx, untagged, []string{nodeTag}); err != nil {
+				return err
+			}
+		}
+
+		// Verify every snapshot made it over
+		migrated, err := shared.Snapshots(ctx, []string{nodeTag})
+		if err != nil {
+			return err
+		}
+		if len(migrated) < len(sourceSnapshots) {
+			return &VerificationError{Err: fmt.Errorf("verification failed for node %s: %d snapshots in %s but only %d in the shared repository",
+				nodeName, len(sourceSnapshots), name, len(migrated))}
+		}
+		log.Infof("Verified node %s: %d source snapshots, %d in the shared repository", nodeName, len(sourceSnapshots), len(migrated))
+	}
+
+	if opts.DaemonSetName == "" {
+		log.Infof("Migration done, set BACKUP_REPO_LAYOUT=%s on the agents to switch them over", cfg.RepoLayoutShared)
+		return nil
+	}
+
+	log.Infof("Switching daemonset %s/%s to the %s repository layout", opts.DaemonSetNamespace, opts.DaemonSetName, cfg.RepoLayoutShared)
+	if err := k8sClient.SetDaemonSetEnv(ctx, opts.DaemonSetNamespace, opts.DaemonSetName, "BACKUP_REPO_LAYOUT", cfg.RepoLayoutShared); err != nil {
+		return err
+	}
+
+	log.Info("Migration done, the per-node repositories are left untouched and can be removed once the agents are healthy")
+	return nil
+}
@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// MountError reports a PVC skipped because its directory is not safe to back up, e.g.
+// a stale NFS mount or a mountpoint exposed empty before the provisioner mounted the
+// volume, which would otherwise produce a misleading empty snapshot
+type MountError struct {
+	Path   string
+	Reason string
+}
+
+func (e *MountError) Error() string {
+	return fmt.Sprintf("unhealthy mount %s: %s", e.Path, e.Reason)
+}
+
+// checkMount verifies the directory of a PVC is healthy before it is backed up. A
+// directory that is empty while the last snapshot of the PVC had files is reported as
+// unhealthy, new and deliberately emptied volumes are told apart by their snapshots.
+func (m *Manager) checkMount(ctx context.Context, client *restic.Client, pvc k8s.PVCInfo) error {
+	if m.mountCheckTimeout <= 0 || !m.featureEnabled(FeatureMountCheck) {
+		return nil
+	}
+
+	empty, err := m.probeMount(ctx, pvc.Path)
+	if err == nil && empty {
+		err = m.checkEmpty(ctx, client, pvc)
+	}
+
+	healthy := 1.0
+	var mountErr *MountError
+	if errors.As(err, &mountErr) {
+		healthy = 0
+	}
+	m.metrics.Set(metricPVCMountHealthy, pvcLabels(pvc), healthy)
+	return err
+}
+
+// probeMount checks a directory can be listed within the mount check timeout and
+// reports whether it is empty. A probe stuck on an unresponsive NFS server is left
+// behind, the kernel does not allow interrupting it.
+func (m *Manager) probeMount(ctx context.Context, path string) (bool, error) {
+	type result struct {
+		empty bool
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		empty, err := listMount(path)
+		done <- result{empty, err}
+	}()
+
+	timer := time.NewTimer(m.mountCheckTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		switch {
+		case r.err == nil:
+			return r.empty, nil
+		case staleMount(r.err):
+			return false, &MountError{Path: path, Reason: fmt.Sprintf("stale mount: %v", r.err)}
+		case errors.Is(r.err, os.ErrNotExist):
+			return false, &MountError{Path: path, Reason: "directory does not exist"}
+		}
+		return false, fmt.Errorf("failed to check mount %s: %v", path, r.err)
+	case <-timer.C:
+		return false, &MountError{Path: path, Reason: fmt.Sprintf("not responding after %s", m.mountCheckTimeout)}
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// listMount queries the filesystem of a directory and reports whether it is empty
+func listMount(path string) (bool, error) {
+	if err := statMount(path); err != nil {
+		return false, err
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer dir.Close()
+
+	if _, err := dir.Readdirnames(1); err != nil {
+		if err == io.EOF {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// checkEmpty reports an empty PVC directory as unhealthy when the latest snapshot of
+// the PVC had files. A failed lookup lets the backup go ahead.
+func (m *Manager) checkEmpty(ctx context.Context, client *restic.Client, pvc k8s.PVCInfo) error {
+	snapshots, err := client.Snapshots(ctx, restic.PVCTags(pvc.Namespace, pvc.Name))
+	if err != nil {
+		m.log.Warnf("Failed to look up the last snapshot of empty PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		return nil
+	}
+
+	var latest *restic.Snapshot
+	for i := range snapshots {
+		snapshot := &snapshots[i]
+		if snapshot.IsVerification() || snapshot.IsDump() || snapshot.Summary == nil {
+			continue
+		}
+		if latest == nil || snapshot.Time.After(latest.Time) {
+			latest = snapshot
+		}
+	}
+	if latest == nil || latest.Summary.TotalFilesProcessed == 0 {
+		return nil
+	}
+	return &MountError{
+		Path:   pvc.Path,
+		Reason: fmt.Sprintf("directory is empty but snapshot %s had %d files, the volume may not be mounted", latest.ShortID, latest.Summary.TotalFilesProcessed),
+	}
+}
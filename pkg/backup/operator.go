@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+)
+
+// performSchedules runs the BackupSchedules of operator mode: each schedule is a plan
+// of the local PVCs it selects, stored in the repository or destination of its
+// BackupTarget
+func (m *Manager) performSchedules(ctx context.Context) error {
+	if !m.operator {
+		return nil
+	}
+
+	var errs []error
+	schedules, err := m.k8sClient.ListBackupSchedules(ctx)
+	if err != nil {
+		// Invalid schedules do not keep the valid ones from running
+		errs = append(errs, err)
+	}
+	if len(schedules) == 0 {
+		return errors.Join(errs...)
+	}
+	targets, err := m.k8sClient.ListBackupTargets(ctx)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	pvcs, err := m.k8sClient.ListNodePVCs(ctx)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+
+	now := time.Now()
+	for _, schedule := range schedules {
+		target, ok := targets[schedule.Target]
+		if !ok {
+			errs = append(errs, fmt.Errorf("BackupSchedule %s: BackupTarget %s not found", schedule.Name, schedule.Target))
+			continue
+		}
+		plan := Plan{Name: schedule.Name, Interval: schedule.Interval, Retention: schedule.Retention, Destination: target.Destination}
+		if plan.Destination == "" {
+			plan.Destination = PlanDestinationPrimary
+		}
+		if err := checkSchedulePlan(plan); err != nil {
+			errs = append(errs, fmt.Errorf("BackupSchedule %s: %v", schedule.Name, err))
+			continue
+		}
+		if target.Repository != nil {
+			if plan.Storage, err = m.targetStorage(ctx, target, plan.Destination); err != nil {
+				errs = append(errs, fmt.Errorf("BackupSchedule %s: %v", schedule.Name, err))
+				continue
+			}
+		}
+
+		for _, pvc := range pvcs {
+			if !schedule.Matches(pvc) {
+				continue
+			}
+			info := pvc.Info
+			if schedule.Include != "" {
+				info.Config.Include = schedule.Include
+			}
+			if schedule.Exclude != "" {
+				info.Config.Exclude = schedule.Exclude
+			}
+			if err := m.runPlan(ctx, info, plan, now); err != nil {
+				errs = append(errs, fmt.Errorf("BackupSchedule %s of PVC %s/%s: %v", schedule.Name, info.Namespace, info.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Keys of the Secret holding the credentials of a BackupTarget repository
+const (
+	targetAccessKey    = "accessKey"
+	targetSecretKey    = "secretKey"
+	targetSessionToken = "sessionToken"
+)
+
+// targetStorage returns the S3 storage of the repositories of a BackupTarget, with the
+// credentials of its Secret. Its repositories are encrypted with the key of its
+// destination, so the classification policies apply to them as to that destination.
+func (m *Manager) targetStorage(ctx context.Context, target k8s.BackupTarget, destination string) (*cfg.ReplicaConfig, error) {
+	repository := target.Repository
+	data, err := m.k8sClient.GetSecretData(ctx, m.leaseNamespace, repository.SecretRef.Name)
+	if err != nil {
+		return nil, fmt.Errorf("BackupTarget %s: %v", target.Name, err)
+	}
+	if len(data[targetAccessKey]) == 0 || len(data[targetSecretKey]) == 0 {
+		return nil, fmt.Errorf("BackupTarget %s: secret %s requires %s and %s", target.Name, repository.SecretRef.Name, targetAccessKey, targetSecretKey)
+	}
+
+	storage := &cfg.ReplicaConfig{
+		Endpoint:     repository.Endpoint,
+		Bucket:       repository.Bucket,
+		Path:         repository.Path,
+		Region:       repository.Region,
+		AccessKey:    string(data[targetAccessKey]),
+		SecretKey:    string(data[targetSecretKey]),
+		SessionToken: string(data[targetSessionToken]),
+	}
+	if destination == PlanDestinationReplica {
+		storage.Password = m.replica.Password
+	}
+	return storage, nil
+}
+
+// checkSchedulePlan checks the plan of a schedule against the rules of plan annotations,
+// the schedule name naming its repositories
+func checkSchedulePlan(plan Plan) error {
+	if !planNamePattern.MatchString(plan.Name) {
+		return fmt.Errorf("invalid name, expected lowercase letters, digits and dashes")
+	}
+	if plan.Destination != PlanDestinationPrimary && plan.Destination != PlanDestinationReplica {
+		return fmt.Errorf("invalid destination %q of its target, expected %s or %s", plan.Destination, PlanDestinationPrimary, PlanDestinationReplica)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// Plan destinations
+const (
+	// PlanDestinationPrimary stores the backups of a plan with the configured backend
+	PlanDestinationPrimary = "primary"
+	// PlanDestinationReplica stores the backups of a plan in the replica bucket
+	PlanDestinationReplica = "replica"
+)
+
+// planSlack absorbs the jitter between the start of backup cycles and snapshot times,
+// so a plan with the interval of the cycles runs on every cycle
+const planSlack = time.Minute
+
+var planNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// Plan is an additional backup schedule of a PVC. Each plan has its own repository, so
+// its retention applies independently of the regular backups and of the other plans.
+type Plan struct {
+	Name        string
+	Interval    time.Duration
+	Retention   string             // Retention policy, empty keeps every snapshot
+	Destination string             // Storage of the plan repository, primary or replica
+	Storage     *cfg.ReplicaConfig // S3 storage of the plan repository of a BackupTarget, nil for the configured ones
+}
+
+// ParsePlans parses plans separated by ";", each made of a name and settings:
+//
+//	hourly interval=1h retention=48h; offsite interval=24h retention=90d destination=replica
+func ParsePlans(value string) ([]Plan, error) {
+	var plans []Plan
+	names := make(map[string]bool)
+	for _, text := range strings.Split(value, ";") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		plan, err := parsePlan(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid plan %q: %v", text, err)
+		}
+		if names[plan.Name] {
+			return nil, fmt.Errorf("plan %s declared twice", plan.Name)
+		}
+		names[plan.Name] = true
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+func parsePlan(text string) (Plan, error) {
+	fields := strings.Fields(text)
+	plan := Plan{Name: fields[0], Destination: PlanDestinationPrimary}
+	if !planNamePattern.MatchString(plan.Name) {
+		return Plan{}, fmt.Errorf("invalid name %q, expected lowercase letters, digits and dashes", plan.Name)
+	}
+
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return Plan{}, fmt.Errorf("invalid setting %q, expected key=value", field)
+		}
+		switch key {
+		case "interval":
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval <= 0 {
+				return Plan{}, fmt.Errorf("invalid interval %q", value)
+			}
+			plan.Interval = interval
+		case "retention":
+			plan.Retention = value
+		case "destination":
+			if value != PlanDestinationPrimary && value != PlanDestinationReplica {
+				return Plan{}, fmt.Errorf("invalid destination %q, expected %s or %s", value, PlanDestinationPrimary, PlanDestinationReplica)
+			}
+			plan.Destination = value
+		default:
+			return Plan{}, fmt.Errorf("unknown setting %q", key)
+		}
+	}
+
+	if plan.Interval == 0 {
+		return Plan{}, fmt.Errorf("interval is required")
+	}
+	return plan, nil
+}
+
+// performPlans backs up the PVCs whose plans are due
+func (m *Manager) performPlans(ctx context.Context, pvcs []k8s.PVCInfo) error {
+	now := time.Now()
+	var errs []error
+	for _, pvc := range pvcs {
+		if pvc.Config.Plans == "" {
+			continue
+		}
+
+		plans, err := ParsePlans(pvc.Config.Plans)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("PVC %s/%s: %v", pvc.Namespace, pvc.Name, err))
+			continue
+		}
+		for _, plan := range plans {
+			if err := m.runPlan(ctx, pvc, plan, now); err != nil {
+				errs = append(errs, fmt.Errorf("plan %s of PVC %s/%s: %v", plan.Name, pvc.Namespace, pvc.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runPlan backs up a PVC into the repository of a plan when the plan is due, then applies
+// the retention of the plan
+func (m *Manager) runPlan(ctx context.Context, pvc k8s.PVCInfo, plan Plan, now time.Time) error {
+	// Not even the plan repository is created in a destination the classification forbids
+	if reason := m.checkClassification(ctx, pvc, destination{name: plan.Destination, retention: plan.Retention}); reason != "" {
+		message := fmt.Sprintf("Backup of plan %s skipped, %s", plan.Name, reason)
+		m.recordClassificationViolation(ctx, pvc, message)
+		m.recordPlanStatus(ctx, pvc, plan.Name, nil, errors.New(message), pvcStatusSkipped)
+		return errors.New(message)
+	}
+
+	client, err := m.planRepository(ctx, pvc, plan)
+	if err != nil {
+		return err
+	}
+
+	key := client.GetRepository() + "|" + pvc.Namespace + "/" + pvc.Name
+	last := m.lastPlanRun(ctx, client, pvc, key)
+	if now.Sub(last) < plan.Interval-planSlack {
+		m.log.Debugf("Plan %s of PVC %s/%s is not due before %v", plan.Name, pvc.Namespace, pvc.Name, last.Add(plan.Interval))
+		m.nextRun(pvc, plan.Name, last.Add(plan.Interval))
+		return nil
+	}
+
+	m.log.Infof("Running plan %s of PVC %s/%s", plan.Name, pvc.Namespace, pvc.Name)
+	m.nextRun(pvc, plan.Name, now.Add(plan.Interval))
+	summary, err := m.backupPVCTo(ctx, client, pvc, pvc.Config.Description, restic.PlanTag(plan.Name))
+	if err != nil {
+		m.recordPlanStatus(ctx, pvc, plan.Name, nil, err, pvcStatusFailed)
+		return err
+	}
+	m.recordPlanStatus(ctx, pvc, plan.Name, summary, nil, pvcStatusSuccess)
+	m.plansMu.Lock()
+	m.planRuns[key] = now
+	m.plansMu.Unlock()
+
+	// Append-only servers refuse deletes, only replica repositories can be cleaned up then
+	if plan.Retention == "" || (m.appendOnly && plan.Destination == PlanDestinationPrimary && plan.Storage == nil) {
+		return nil
+	}
+	if !m.deletionsAllowed(ctx, fmt.Sprintf("retention of plan %s", plan.Name)) {
+		return nil
+	}
+	// The controller does not know the plan repositories, their agents prune them
+	prune := m.pruneInterval == 0 && (m.isMaintenanceLeader() || m.role == roleAgent)
+	return client.Forget(ctx, plan.Retention, prune)
+}
+
+// lastPlanRun returns the time of the last backup of a PVC plan, looked up in the plan
+// repository after a restart so plans do not all run again
+func (m *Manager) lastPlanRun(ctx context.Context, client *restic.Client, pvc k8s.PVCInfo, key string) time.Time {
+	m.plansMu.Lock()
+	last, ok := m.planRuns[key]
+	m.plansMu.Unlock()
+	if ok {
+		return last
+	}
+
+	snapshots, err := client.Snapshots(ctx, restic.PVCTags(pvc.Namespace, pvc.Name))
+	if err != nil {
+		m.log.Warnf("Failed to look up the last snapshot in %s: %v", client.GetRepository(), err)
+		return last
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Time.After(last) {
+			last = snapshot.Time
+		}
+	}
+
+	m.plansMu.Lock()
+	m.planRuns[key] = last
+	m.plansMu.Unlock()
+	return last
+}
+
+// planRepository returns the client of the repository of a PVC plan, named after the
+// regular repository of the PVC, initializing it on first use
+func (m *Manager) planRepository(ctx context.Context, pvc k8s.PVCInfo, plan Plan) (*restic.Client, error) {
+	client := m.resticClient
+	if client.Sharded() {
+		client = client.ForPVC(pvc.Namespace, pvc.Name)
+	}
+	switch {
+	case plan.Storage != nil:
+		client = client.Replica(*plan.Storage)
+	case plan.Destination == PlanDestinationReplica:
+		if !m.replicationEnabled() {
+			return nil, fmt.Errorf("destination %s requires REPLICA_ENDPOINT", PlanDestinationReplica)
+		}
+		client = client.Replica(m.replica)
+	}
+	client = client.WithRepository(client.GetRepository() + "-" + plan.Name)
+
+	m.plansMu.Lock()
+	defer m.plansMu.Unlock()
+
+	key := client.GetRepository()
+	if known, ok := m.planRepositories[key]; ok {
+		return known, nil
+	}
+
+	if err := client.EnsureRepository(ctx); err != nil {
+		return nil, fmt.Errorf("failed to ensure plan repository: %v", err)
+	}
+	m.planRepositories[key] = client
+	return client, nil
+}
+
+// plannedRepositories returns the clients of the plan repositories used by this node
+func (m *Manager) plannedRepositories() []*restic.Client {
+	m.plansMu.Lock()
+	defer m.plansMu.Unlock()
+
+	keys := make([]string, 0, len(m.planRepositories))
+	for key := range m.planRepositories {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	clients := make([]*restic.Client, 0, len(keys))
+	for _, key := range keys {
+		clients = append(clients, m.planRepositories[key])
+	}
+	return clients
+}
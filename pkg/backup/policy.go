@@ -0,0 +1,193 @@
+package backup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// PolicyRule limits the backups running during a weekly time window
+type PolicyRule struct {
+	Days        [7]bool       // Days the window starts on, indexed by time.Weekday
+	Start       time.Duration // Window start, as an offset from midnight
+	End         time.Duration // Window end, wraps past midnight when before Start
+	Concurrency int           // Number of PVCs backed up in parallel
+	UploadLimit uint64        // Upload bandwidth in bytes per second shared by the running backups, 0 is unlimited
+}
+
+// defaultPolicyRule applies when no rule matches
+var defaultPolicyRule = PolicyRule{Concurrency: 1}
+
+// Policy is an ordered list of rules, the first rule matching the current time applies
+type Policy []PolicyRule
+
+// ParsePolicy parses rules separated by ";", each made of days, a time range and limits:
+//
+//	Mon-Fri 09:00-18:00 concurrency=1 upload=5MiB; Sat,Sun * concurrency=4
+//
+// Days are a comma separated list of names or ranges, "*" matches every day and every time.
+func ParsePolicy(value string) (Policy, error) {
+	var policy Policy
+	for _, text := range strings.Split(value, ";") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		rule, err := parsePolicyRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy rule %q: %v", text, err)
+		}
+		policy = append(policy, rule)
+	}
+	return policy, nil
+}
+
+func parsePolicyRule(text string) (PolicyRule, error) {
+	fields := strings.Fields(text)
+	if len(fields) < 2 {
+		return PolicyRule{}, fmt.Errorf("expected days and a time range")
+	}
+
+	rule := defaultPolicyRule
+	if err := parseDays(fields[0], &rule.Days); err != nil {
+		return PolicyRule{}, err
+	}
+
+	if fields[1] == "*" {
+		rule.End = 24 * time.Hour
+	} else {
+		start, end, ok := strings.Cut(fields[1], "-")
+		if !ok {
+			return PolicyRule{}, fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", fields[1])
+		}
+		var err error
+		if rule.Start, err = parseClock(start); err != nil {
+			return PolicyRule{}, err
+		}
+		if rule.End, err = parseClock(end); err != nil {
+			return PolicyRule{}, err
+		}
+		if rule.Start == rule.End {
+			return PolicyRule{}, fmt.Errorf("empty time range %q", fields[1])
+		}
+	}
+
+	for _, field := range fields[2:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return PolicyRule{}, fmt.Errorf("invalid limit %q, expected key=value", field)
+		}
+		switch key {
+		case "concurrency":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return PolicyRule{}, fmt.Errorf("invalid concurrency %q", value)
+			}
+			rule.Concurrency = n
+		case "upload":
+			limit, err := cfg.ParseSize(value)
+			if err != nil {
+				return PolicyRule{}, fmt.Errorf("invalid upload limit: %v", err)
+			}
+			rule.UploadLimit = limit
+		default:
+			return PolicyRule{}, fmt.Errorf("unknown limit %q", key)
+		}
+	}
+	return rule, nil
+}
+
+// parseDays parses "*" or a comma separated list of day names and ranges such as Mon-Fri
+func parseDays(value string, days *[7]bool) error {
+	if value == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return nil
+	}
+
+	for _, part := range strings.Split(value, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		if !isRange {
+			to = from
+		}
+		first, ok := weekdays[strings.ToLower(from)]
+		if !ok {
+			return fmt.Errorf("invalid day %q", from)
+		}
+		last, ok := weekdays[strings.ToLower(to)]
+		if !ok {
+			return fmt.Errorf("invalid day %q", to)
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses HH:MM into an offset from midnight, 24:00 included
+func parseClock(value string) (time.Duration, error) {
+	hours, minutes, ok := strings.Cut(value, ":")
+	h, err1 := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if !ok || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// Matches reports whether the time falls in the window of the rule
+func (r PolicyRule) Matches(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	day := t.Weekday()
+	if r.Start < r.End {
+		return r.Days[day] && offset >= r.Start && offset < r.End
+	}
+
+	// The window wraps past midnight, its end belongs to the day before
+	if offset >= r.Start {
+		return r.Days[day]
+	}
+	return offset < r.End && r.Days[(day+6)%7]
+}
+
+// BackupUploadLimit returns the upload bandwidth of each running backup
+func (r PolicyRule) BackupUploadLimit() uint64 {
+	return r.UploadLimit / uint64(r.Concurrency)
+}
+
+// String describes the limits of the rule
+func (r PolicyRule) String() string {
+	upload := "unlimited"
+	if r.UploadLimit > 0 {
+		upload = FormatBytes(r.UploadLimit) + "/s"
+	}
+	return fmt.Sprintf("concurrency %d, upload %s", r.Concurrency, upload)
+}
+
+// Evaluate returns the rule applying at the given time
+func (p Policy) Evaluate(t time.Time) PolicyRule {
+	for _, rule := range p {
+		if rule.Matches(t) {
+			return rule
+		}
+	}
+	return defaultPolicyRule
+}
@@ -0,0 +1,175 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/metrics"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// quotaDefault is the namespace name of the quota applying to namespaces without their own
+const quotaDefault = "*"
+
+// Quota limits the backups stored for a namespace, zero values are unlimited
+type Quota struct {
+	MaxBytes     uint64
+	MaxSnapshots int
+}
+
+// ParseQuotas parses per-namespace quotas separated by ";":
+//
+//	team-a:bytes=50GiB,snapshots=500; *:bytes=10GiB
+//
+// The "*" quota applies to the namespaces without their own quota.
+func ParseQuotas(value string) (map[string]Quota, error) {
+	quotas := make(map[string]Quota)
+	for _, text := range strings.Split(value, ";") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		namespace, limits, ok := strings.Cut(text, ":")
+		namespace = strings.TrimSpace(namespace)
+		if !ok || namespace == "" {
+			return nil, fmt.Errorf("invalid quota %q, expected namespace:limit=value[,limit=value]", text)
+		}
+
+		var quota Quota
+		for _, limit := range strings.Split(limits, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(limit), "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid quota limit %q of namespace %s, expected key=value", limit, namespace)
+			}
+			switch key {
+			case "bytes":
+				size, err := cfg.ParseSize(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid bytes quota of namespace %s: %v", namespace, err)
+				}
+				quota.MaxBytes = size
+			case "snapshots":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("invalid snapshots quota %q of namespace %s", value, namespace)
+				}
+				quota.MaxSnapshots = n
+			default:
+				return nil, fmt.Errorf("unknown quota limit %q of namespace %s", key, namespace)
+			}
+		}
+		quotas[namespace] = quota
+	}
+	return quotas, nil
+}
+
+// quotaFor returns the quota of a namespace
+func (m *Manager) quotaFor(namespace string) (Quota, bool) {
+	if quota, ok := m.quotas[namespace]; ok {
+		return quota, true
+	}
+	quota, ok := m.quotas[quotaDefault]
+	return quota, ok
+}
+
+// enforceQuotas drops the PVCs of the namespaces over their quota, recording a
+// warning event on each skipped PVC. Namespaces whose usage cannot be measured are
+// backed up anyway.
+func (m *Manager) enforceQuotas(ctx context.Context, pvcs []k8s.PVCInfo) []k8s.PVCInfo {
+	if len(m.quotas) == 0 {
+		return pvcs
+	}
+
+	byNamespace := make(map[string][]k8s.PVCInfo)
+	for _, pvc := range pvcs {
+		byNamespace[pvc.Namespace] = append(byNamespace[pvc.Namespace], pvc)
+	}
+
+	var allowed []k8s.PVCInfo
+	for namespace, namespacePVCs := range byNamespace {
+		quota, ok := m.quotaFor(namespace)
+		if !ok {
+			allowed = append(allowed, namespacePVCs...)
+			continue
+		}
+
+		exceeded, err := m.checkQuota(ctx, namespace, namespacePVCs, quota)
+		if err != nil {
+			m.log.Errorf("Failed to check quota of namespace %s: %v", namespace, err)
+			allowed = append(allowed, namespacePVCs...)
+			continue
+		}
+		if exceeded == "" {
+			allowed = append(allowed, namespacePVCs...)
+			continue
+		}
+
+		message := fmt.Sprintf("Backup skipped, namespace %s is over its backup quota: %s", namespace, exceeded)
+		m.log.Warn(message)
+		for _, pvc := range namespacePVCs {
+			if err := m.k8sClient.RecordPVCEvent(ctx, pvc, "BackupQuotaExceeded", message); err != nil {
+				m.log.Errorf("%v", err)
+			}
+			m.recordStatus(ctx, pvc, nil, errors.New(message), pvcStatusSkipped)
+		}
+	}
+	return allowed
+}
+
+// checkQuota measures the backups of a namespace in the repositories of its PVCs and
+// describes the exceeded limit, if any
+func (m *Manager) checkQuota(ctx context.Context, namespace string, pvcs []k8s.PVCInfo, quota Quota) (string, error) {
+	clients := make(map[string]*restic.Client)
+	for _, pvc := range pvcs {
+		client, err := m.repositoryFor(ctx, pvc)
+		if err != nil {
+			return "", err
+		}
+		clients[client.GetRepository()] = client
+	}
+
+	var size uint64
+	var snapshots int
+	for _, client := range clients {
+		stats, err := client.Stats(ctx, []string{restic.NamespaceTag(namespace)})
+		if err != nil {
+			return "", err
+		}
+		size += stats.TotalSize
+
+		list, err := client.Snapshots(ctx, []string{restic.NamespaceTag(namespace)})
+		if err != nil {
+			return "", err
+		}
+		for _, snapshot := range list {
+			if !snapshot.IsVerification() {
+				snapshots++
+			}
+		}
+	}
+
+	labels := metrics.Labels{"namespace": namespace}
+	m.metrics.Set(metricNamespaceUsageBytes, labels, float64(size))
+	m.metrics.Set(metricNamespaceSnapshots, labels, float64(snapshots))
+
+	var exceeded string
+	switch {
+	case quota.MaxBytes > 0 && size >= quota.MaxBytes:
+		exceeded = fmt.Sprintf("%s stored, quota %s", FormatBytes(size), FormatBytes(quota.MaxBytes))
+	case quota.MaxSnapshots > 0 && snapshots >= quota.MaxSnapshots:
+		exceeded = fmt.Sprintf("%d snapshots stored, quota %d", snapshots, quota.MaxSnapshots)
+	}
+
+	if exceeded != "" {
+		m.metrics.Set(metricNamespaceQuotaExceeded, labels, 1)
+	} else {
+		m.metrics.Set(metricNamespaceQuotaExceeded, labels, 0)
+	}
+	return exceeded, nil
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package backup
+
+import (
+	"errors"
+	"syscall"
+)
+
+// readOnly reports whether path is on a filesystem mounted read-only
+func readOnly(path string) (bool, error) {
+	// W_OK, access fails with EROFS on read-only filesystems whatever the permissions
+	err := syscall.Access(path, 0x2)
+	if errors.Is(err, syscall.EROFS) {
+		return true, nil
+	}
+	if err != nil && !errors.Is(err, syscall.EACCES) {
+		return false, err
+	}
+	return false, nil
+}
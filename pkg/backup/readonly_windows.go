@@ -0,0 +1,20 @@
+package backup
+
+import "golang.org/x/sys/windows"
+
+// readOnly reports whether path is on a volume mounted read-only
+func readOnly(path string) (bool, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return false, err
+	}
+	root := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumePathName(name, &root[0], uint32(len(root))); err != nil {
+		return false, err
+	}
+	var flags uint32
+	if err := windows.GetVolumeInformation(&root[0], nil, 0, nil, nil, &flags, nil, 0); err != nil {
+		return false, err
+	}
+	return flags&windows.FILE_READ_ONLY_VOLUME != 0, nil
+}
@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"context"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// recoverInterrupted cleans up the repositories of backups that never completed on
+// this node. Their stale locks would block maintenance and the packs they uploaded
+// are not referenced by any snapshot, so retention never removes them.
+func (m *Manager) recoverInterrupted(ctx context.Context) {
+	repositories, err := m.resticClient.InterruptedRepositories()
+	if err != nil {
+		m.log.Errorf("Failed to look for interrupted backups: %v", err)
+		return
+	}
+
+	for _, repository := range repositories {
+		client := m.interruptedClient(repository)
+		if client == nil {
+			m.log.Infof("Interrupted backups of repository %s are cleaned up once its plan runs again", repository)
+			continue
+		}
+		m.log.Warnf("Found interrupted backups of repository %s, cleaning up their leftovers", repository)
+
+		start := time.Now()
+		err := m.cleanupRepository(ctx, client)
+		m.recordMaintenance(operationRecover, start, err)
+		if err != nil {
+			// Keep the markers to retry on the next cycle
+			m.log.Errorf("Failed to clean up repository %s: %v", repository, err)
+			continue
+		}
+
+		if err := client.ClearInterrupted(); err != nil {
+			m.log.Errorf("%v", err)
+		}
+	}
+}
+
+// interruptedClient returns the client of a repository with interrupted backups, nil
+// when it is a plan repository in the replica bucket not used since the agent started
+func (m *Manager) interruptedClient(repository string) *restic.Client {
+	m.plansMu.Lock()
+	client, ok := m.planRepositories[repository]
+	m.plansMu.Unlock()
+	if ok {
+		return client
+	}
+	if m.resticClient.Stores(repository) {
+		return m.resticClient.WithRepository(repository)
+	}
+	return nil
+}
+
+// cleanupRepository removes stale locks and the data no snapshot references
+func (m *Manager) cleanupRepository(ctx context.Context, client *restic.Client) error {
+	if err := client.Unlock(ctx); err != nil {
+		return err
+	}
+
+	if m.appendOnly {
+		m.log.Info("Append-only repository, unreferenced data is left to the prunes of the server owner")
+		return nil
+	}
+
+	// Prunes are repository wide, other nodes leave the leftovers to the leader
+	if !m.isMaintenanceLeader() {
+		m.log.Info("Not the maintenance leader, unreferenced data is left to the next prune of the leader")
+		return nil
+	}
+	if !m.deletionsAllowed(ctx, "prune of interrupted backups") {
+		return nil
+	}
+
+	if err := client.Prune(ctx); err != nil {
+		return err
+	}
+	m.log.Infof("Removed the leftovers of interrupted backups from repository %s", client.GetRepository())
+	return nil
+}
@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"fmt"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+)
+
+// reloadSettings holds the settings of a reloaded configuration applied by the backup loop
+type reloadSettings struct {
+	interval  time.Duration
+	retention string
+	policy    Policy
+	quotas    map[string]Quota
+	features  map[string]bool
+}
+
+// Reload validates the interval, retention, scheduling policy, namespace quotas and
+// feature flags of a changed configuration and hands them to the backup loop, which applies them
+// between backup cycles. Other settings need a restart.
+func (m *Manager) Reload(config *cfg.Config) error {
+	if config.BackupConfig.BackupInterval <= 0 {
+		return fmt.Errorf("invalid backup interval: %v", config.BackupConfig.BackupInterval)
+	}
+	policy, err := ParsePolicy(config.BackupConfig.Policy)
+	if err != nil {
+		return err
+	}
+	quotas, err := ParseQuotas(config.BackupConfig.NamespaceQuotas)
+	if err != nil {
+		return err
+	}
+	features, err := parseFeatureConfig(config.BackupConfig)
+	if err != nil {
+		return err
+	}
+
+	settings := reloadSettings{
+		interval:  config.BackupConfig.BackupInterval,
+		retention: config.BackupConfig.Retention,
+		policy:    policy,
+		quotas:    quotas,
+		features:  features,
+	}
+	// A reload not yet applied is superseded
+	select {
+	case <-m.reloads:
+	default:
+	}
+	m.reloads <- settings
+	return nil
+}
+
+// applyReload applies reloaded settings, rescheduling the backups when the interval changed
+func (m *Manager) applyReload(settings reloadSettings, ticker *time.Ticker) {
+	if settings.interval != m.interval {
+		m.log.Infof("Rescheduling backups every %v instead of %v", settings.interval, m.interval)
+		m.interval = settings.interval
+		ticker.Reset(m.interval)
+	}
+	if settings.retention != m.retention {
+		m.log.Infof("Applying retention policy %s instead of %s", settings.retention, m.retention)
+		m.retention = settings.retention
+	}
+	m.policy = settings.policy
+	m.quotas = settings.quotas
+	m.featureConfig = settings.features
+}
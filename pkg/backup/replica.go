@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+)
+
+// replicationEnabled reports whether backups are copied to a secondary repository
+func (m *Manager) replicationEnabled() bool {
+	return m.replica.Endpoint != ""
+}
+
+// performReplication copies the new snapshots of every repository into its replica in
+// the secondary bucket, creating the replica on first use
+func (m *Manager) performReplication(ctx context.Context) error {
+	// The shared repository is replicated by a single node
+	if m.repoLayout == cfg.RepoLayoutShared && !m.isMaintenanceLeader() {
+		m.log.Debug("Not the maintenance leader, skipping replication")
+		return nil
+	}
+
+	m.log.Infof("Replicating snapshots to %s/%s", m.replica.Endpoint, m.replica.Bucket)
+
+	start := time.Now()
+	var errs []error
+	for _, client := range m.repositories() {
+		replica := client.Replica(m.replica)
+
+		if !m.replicaReady[replica.GetRepository()] {
+			if err := replica.Check(ctx, ""); err != nil {
+				m.log.Infof("Initializing replica repository %s", replica.GetRepository())
+				if err := replica.InitRepositoryFrom(ctx, client); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %v", replica.GetRepository(), err))
+					continue
+				}
+			}
+			m.replicaReady[replica.GetRepository()] = true
+		}
+
+		if err := replica.Copy(ctx, client); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", replica.GetRepository(), err))
+			continue
+		}
+
+		if m.replica.Retention != "" && m.deletionsAllowed(ctx, "replica retention") {
+			if err := replica.Forget(ctx, m.replica.Retention, true); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", replica.GetRepository(), err))
+			}
+		}
+	}
+	err := errors.Join(errs...)
+	m.recordMaintenance(operationReplicate, start, err)
+	if err != nil {
+		return err
+	}
+
+	m.log.Infof("Replication done in %v", time.Since(start).Round(time.Second))
+	return nil
+}
@@ -0,0 +1,190 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/metrics"
+	"github.com/monlor/local-pvc-backup/pkg/notify"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// quotaStateName is the ConfigMap the maintenance leader publishes the shared
+// repositories over their size quota in, for the other agents
+const quotaStateName = "local-pvc-backup-quota"
+
+// quotaStateKey is the key of the repositories over their quota in the ConfigMap
+const quotaStateKey = "overQuota"
+
+// checkRepositoryQuotas measures the repositories of the PVCs of this node against the
+// maximum repository size before a backup cycle, and returns those over the quota with
+// their size. Shared repositories are measured by the maintenance leader only, the
+// other agents reading the ones it found over the quota.
+func (m *Manager) checkRepositoryQuotas(ctx context.Context, pvcs []k8s.PVCInfo) map[string]string {
+	if m.repoMaxSize == 0 || m.role == roleController {
+		return nil
+	}
+	if m.repoLayout == cfg.RepoLayoutShared {
+		if !m.isMaintenanceLeader() {
+			return m.publishedOverQuota(ctx)
+		}
+		return m.checkSharedQuotas(ctx)
+	}
+
+	seen := make(map[string]bool)
+	var clients []*restic.Client
+	for _, pvc := range pvcs {
+		client := m.resticClient.ForPVC(pvc.Namespace, pvc.Name)
+		if !seen[client.GetRepository()] {
+			seen[client.GetRepository()] = true
+			clients = append(clients, client)
+		}
+	}
+	return m.measureQuotas(ctx, clients)
+}
+
+// checkSharedQuotas measures the shared repositories found in the storage against the
+// quota and publishes those over it
+func (m *Manager) checkSharedQuotas(ctx context.Context) map[string]string {
+	stored, err := m.storedRepositories(ctx)
+	if err != nil {
+		m.log.Errorf("Failed to list the repositories to check their size quota: %v", err)
+		return m.publishedOverQuota(ctx)
+	}
+	// Plan repositories have their own retention and are left out, as on the other layouts
+	var clients []*restic.Client
+	for _, client := range stored {
+		if path.Base(client.GetRepository()) == cfg.SharedRepositoryName {
+			clients = append(clients, client)
+		}
+	}
+
+	exceeded := m.measureQuotas(ctx, clients)
+	data, err := json.Marshal(exceeded)
+	if err == nil {
+		err = m.k8sClient.UpdateState(ctx, m.leaseNamespace, quotaStateName, func(state map[string]string) {
+			state[quotaStateKey] = string(data)
+		})
+	}
+	if err != nil {
+		m.log.Warnf("Failed to publish the repositories over their size quota: %v", err)
+	}
+	return exceeded
+}
+
+// publishedOverQuota returns the shared repositories over their quota published by the
+// maintenance leader, none when it cannot be read
+func (m *Manager) publishedOverQuota(ctx context.Context) map[string]string {
+	state, err := m.k8sClient.GetState(ctx, m.leaseNamespace, quotaStateName)
+	if err != nil {
+		m.log.Warnf("Failed to read the repositories over their size quota: %v", err)
+		return nil
+	}
+	exceeded := make(map[string]string)
+	if value := state[quotaStateKey]; value != "" {
+		if err := json.Unmarshal([]byte(value), &exceeded); err != nil {
+			m.log.Warnf("Invalid repositories over their size quota in %s: %v", quotaStateName, err)
+			return nil
+		}
+	}
+	return exceeded
+}
+
+// measureQuotas measures repositories against the maximum repository size. A repository
+// over the quota has the retention applied and is pruned right away, instead of after
+// the cycle or on the prune schedule, then measured again. It returns the repositories
+// still over the quota with their size. Repositories whose size cannot be measured are
+// assumed within the quota, and repositories not created yet are skipped.
+func (m *Manager) measureQuotas(ctx context.Context, clients []*restic.Client) map[string]string {
+	exceeded := make(map[string]string)
+	for _, client := range clients {
+		size, err := m.repositorySize(ctx, client)
+		if restic.IsMissingRepositoryError(err) {
+			continue
+		}
+		if err != nil {
+			m.log.Errorf("Failed to check the size quota of repository %s: %v", client.GetRepository(), err)
+			continue
+		}
+		if size >= m.repoMaxSize {
+			m.log.Warnf("Repository %s holds %s, over its quota of %s, applying retention", client.GetRepository(), FormatBytes(size), FormatBytes(m.repoMaxSize))
+			if size, err = m.shrinkRepository(ctx, client, size); err != nil {
+				m.log.Errorf("Failed to apply retention to repository %s: %v", client.GetRepository(), err)
+			}
+		}
+
+		repository := client.GetRepository()
+		labels := metrics.Labels{"repository": repository}
+		over := size >= m.repoMaxSize
+		m.quotaMu.Lock()
+		wasOver := m.overQuota[repository]
+		m.overQuota[repository] = over
+		m.quotaMu.Unlock()
+		if !over {
+			m.metrics.Set(metricRepositoryOverQuota, labels, 0)
+			continue
+		}
+
+		m.metrics.Set(metricRepositoryOverQuota, labels, 1)
+		exceeded[repository] = fmt.Sprintf("%s stored, quota %s", FormatBytes(size), FormatBytes(m.repoMaxSize))
+		m.log.Warnf("Repository %s is still over its size quota: %s", repository, exceeded[repository])
+		// Notify once when the repository goes over the quota, not every cycle
+		if !wasOver {
+			m.notify(ctx, notify.Event{Kind: notify.EventOverQuota, Repository: repository, Error: exceeded[repository]})
+		}
+	}
+	return exceeded
+}
+
+// repositorySize returns the size of the data stored in a repository
+func (m *Manager) repositorySize(ctx context.Context, client *restic.Client) (uint64, error) {
+	stats, err := client.Stats(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	m.metrics.Set(metricRepositorySize, metrics.Labels{"repository": client.GetRepository()}, float64(stats.TotalSize))
+	return stats.TotalSize, nil
+}
+
+// shrinkRepository applies the retention to a repository over its quota and prunes it
+// when this node maintains it, returning its size afterwards. Holds and append-only
+// repositories are left as is.
+func (m *Manager) shrinkRepository(ctx context.Context, client *restic.Client, size uint64) (uint64, error) {
+	if m.appendOnly || !m.deletionsAllowed(ctx, "retention of a repository over its quota") {
+		return size, nil
+	}
+	if err := client.Forget(ctx, m.retention, m.isMaintenanceLeader()); err != nil {
+		return size, err
+	}
+	return m.repositorySize(ctx, client)
+}
+
+// pauseOverQuota drops the PVCs backed up into repositories over their size quota,
+// recording a warning event on each skipped PVC
+func (m *Manager) pauseOverQuota(ctx context.Context, pvcs []k8s.PVCInfo, exceeded map[string]string) []k8s.PVCInfo {
+	if !m.repoQuotaPause || len(exceeded) == 0 {
+		return pvcs
+	}
+
+	var allowed []k8s.PVCInfo
+	for _, pvc := range pvcs {
+		repository := m.resticClient.ForPVC(pvc.Namespace, pvc.Name).GetRepository()
+		reason, ok := exceeded[repository]
+		if !ok {
+			allowed = append(allowed, pvc)
+			continue
+		}
+		message := fmt.Sprintf("Backup skipped, repository %s is over its size quota: %s", repository, reason)
+		m.log.Warnf("PVC %s/%s: %s", pvc.Namespace, pvc.Name, message)
+		if err := m.k8sClient.RecordPVCEvent(ctx, pvc, "BackupRepositoryQuotaExceeded", message); err != nil {
+			m.log.Errorf("%v", err)
+		}
+		m.recordStatus(ctx, pvc, nil, errors.New(message), pvcStatusSkipped)
+	}
+	return allowed
+}
@@ -0,0 +1,357 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/notify"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// reportStateName is the ConfigMap recording the last report, the baseline of the
+// repository growth and failures of the next one
+const reportStateName = "local-pvc-backup-report"
+
+// Keys of the report ConfigMap
+const (
+	reportKeySent      = "sent"
+	reportKeySending   = "sending"
+	reportKeySize      = "repository-size"
+	reportKeyFailures  = "failures"
+	reportKeyDelivered = "delivered" // Channels that received the report being sent, comma separated
+)
+
+// Delivery channels of the reports
+const (
+	reportChannelWebhook = "webhook"
+	reportChannelEmail   = "email"
+)
+
+// reportClaimTimeout is the time after which the claim of an agent that failed to send
+// a report is ignored
+const reportClaimTimeout = time.Hour
+
+// defaultReportPeriod is the period of reports built on demand before any was sent
+const defaultReportPeriod = 7 * 24 * time.Hour
+
+// Report summarizes the protection of the cluster over a period
+type Report struct {
+	Cluster          string            `json:"cluster,omitempty"`
+	From             time.Time         `json:"from"`
+	To               time.Time         `json:"to"`
+	PVCs             int               `json:"pvcs"`      // Local PVCs of the cluster
+	Protected        int               `json:"protected"` // Local PVCs with a backup in the period
+	Unprotected      []string          `json:"unprotected"`
+	RepositoryBytes  uint64            `json:"repository_bytes"`
+	RepositoryGrowth *int64            `json:"repository_growth_bytes,omitempty"` // Unknown on the first report
+	DataAdded        uint64            `json:"data_added_bytes"`                  // Data added by the backups of the period, before deduplication across repositories
+	OldestSnapshot   *time.Time        `json:"oldest_snapshot,omitempty"`         // Oldest snapshot kept, how far back the PVCs can be restored
+	Failures         int               `json:"failures"`
+	Namespaces       []NamespaceReport `json:"namespaces"`
+	StaleNodes       []string          `json:"stale_nodes,omitempty"` // Nodes whose agent stopped reporting
+	Errors           []string          `json:"errors,omitempty"`      // Repositories that could not be read, the report is incomplete
+}
+
+// NamespaceReport summarizes the protection of the PVCs of a namespace
+type NamespaceReport struct {
+	Namespace string `json:"namespace"`
+	PVCs      int    `json:"pvcs"`
+	Protected int    `json:"protected"`
+	Failures  int    `json:"failures"` // Failed backups in the period
+}
+
+// BuildReport summarizes the protection of the cluster since the last report: the local
+// PVCs with and without a backup in the period, the growth of their repositories and
+// the failed backups by namespace, counted by the agents in their status Leases. It
+// also returns the report state to record once the report is delivered.
+func (m *Manager) BuildReport(ctx context.Context) (*Report, map[string]string, error) {
+	state, err := m.k8sClient.GetState(ctx, m.leaseNamespace, reportStateName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now().UTC()
+	report := &Report{Cluster: m.report.Cluster, To: now}
+	report.From, err = time.Parse(time.RFC3339, state[reportKeySent])
+	if err != nil {
+		period := m.report.Interval
+		if period <= 0 {
+			period = defaultReportPeriod
+		}
+		report.From = now.Add(-period)
+	}
+
+	pvcs, err := m.k8sClient.ListLocalPVCs(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	namespaces := make(map[string]*NamespaceReport)
+	namespace := func(name string) *NamespaceReport {
+		if namespaces[name] == nil {
+			namespaces[name] = &NamespaceReport{Namespace: name}
+		}
+		return namespaces[name]
+	}
+
+	// List the snapshots and the size of each repository once
+	latest := make(map[string]time.Time)
+	read := make(map[string]bool)
+	for _, pvc := range pvcs {
+		client := m.resticClient.ForNode(pvc.Node).ForPVC(pvc.Namespace, pvc.Name)
+		repository := client.GetRepository()
+		if read[repository] {
+			continue
+		}
+		read[repository] = true
+
+		snapshots, err := client.Snapshots(ctx, nil)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", repository, err))
+			continue
+		}
+		for _, snapshot := range snapshots {
+			uid := snapshot.TagValue(restic.PVCIDTagPrefix)
+			if snapshot.Time.After(latest[uid]) {
+				latest[uid] = snapshot.Time
+			}
+			if snapshot.Summary != nil && snapshot.Time.After(report.From) {
+				report.DataAdded += snapshot.Summary.DataAdded
+			}
+			if report.OldestSnapshot == nil || snapshot.Time.Before(*report.OldestSnapshot) {
+				oldest := snapshot.Time
+				report.OldestSnapshot = &oldest
+			}
+		}
+		stats, err := client.Stats(ctx, nil)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", repository, err))
+			continue
+		}
+		report.RepositoryBytes += stats.TotalSize
+	}
+
+	for _, pvc := range pvcs {
+		entry := namespace(pvc.Namespace)
+		entry.PVCs++
+		report.PVCs++
+		if latest[pvc.UID].After(report.From) {
+			entry.Protected++
+			report.Protected++
+		} else {
+			report.Unprotected = append(report.Unprotected, pvc.Namespace+"/"+pvc.Name)
+		}
+	}
+	sort.Strings(report.Unprotected)
+
+	if previous, err := strconv.ParseUint(state[reportKeySize], 10, 64); err == nil && len(report.Errors) == 0 {
+		growth := int64(report.RepositoryBytes) - int64(previous)
+		report.RepositoryGrowth = &growth
+	}
+
+	// The failure counters only grow, the report counts the increase since the last one
+	statuses, err := m.k8sClient.ListNodeStatuses(ctx, m.leaseNamespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	var baseline map[string]map[string]int
+	json.Unmarshal([]byte(state[reportKeyFailures]), &baseline)
+	counters := make(map[string]map[string]int)
+	for _, status := range statuses {
+		counters[status.Node] = status.Failures
+		if status.Stale(now) {
+			report.StaleNodes = append(report.StaleNodes, status.Node)
+		}
+		for name, count := range status.Failures {
+			// A recreated Lease starts counting again
+			if previous := baseline[status.Node][name]; previous <= count {
+				count -= previous
+			}
+			if count > 0 {
+				namespace(name).Failures += count
+				report.Failures += count
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(namespaces) {
+		report.Namespaces = append(report.Namespaces, *namespaces[name])
+	}
+
+	// The growth is unknown after an incomplete report
+	next := map[string]string{reportKeySent: now.Format(time.RFC3339), reportKeySize: ""}
+	if len(report.Errors) == 0 {
+		next[reportKeySize] = strconv.FormatUint(report.RepositoryBytes, 10)
+	}
+	data, err := json.Marshal(counters)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode failure counters: %v", err)
+	}
+	next[reportKeyFailures] = string(data)
+	return report, next, nil
+}
+
+// RecordReport records a delivered report as the baseline of the next one
+func (m *Manager) RecordReport(ctx context.Context, next map[string]string) error {
+	return m.k8sClient.UpdateState(ctx, m.leaseNamespace, reportStateName, func(data map[string]string) {
+		for key, value := range next {
+			data[key] = value
+		}
+		delete(data, reportKeySending)
+		delete(data, reportKeyDelivered)
+	})
+}
+
+// releaseReport releases the claim of a report that could not be delivered to every
+// channel, keeping the channels that received it so the retry skips them
+func (m *Manager) releaseReport(ctx context.Context) error {
+	return m.k8sClient.UpdateState(ctx, m.leaseNamespace, reportStateName, func(data map[string]string) {
+		delete(data, reportKeySending)
+	})
+}
+
+// recordDelivery records a channel that received the report being sent
+func (m *Manager) recordDelivery(ctx context.Context, channel string) error {
+	return m.k8sClient.UpdateState(ctx, m.leaseNamespace, reportStateName, func(data map[string]string) {
+		if data[reportKeyDelivered] == "" {
+			data[reportKeyDelivered] = channel
+			return
+		}
+		data[reportKeyDelivered] += "," + channel
+	})
+}
+
+// SendReport posts a report to the report webhook, with a text summary for chat tools,
+// and emails the summary to the report recipients. Each channel is recorded once it
+// received the report, so a failure of the other one does not send it twice.
+func (m *Manager) SendReport(ctx context.Context, report *Report) error {
+	if !m.report.Deliverable() {
+		return fmt.Errorf("neither REPORT_WEBHOOK_URL nor REPORT_EMAIL_TO is set")
+	}
+	state, err := m.k8sClient.GetState(ctx, m.leaseNamespace, reportStateName)
+	if err != nil {
+		return err
+	}
+	delivered := strings.Split(state[reportKeyDelivered], ",")
+
+	text := FormatReport(report)
+	if m.report.WebhookURL != "" && !contains(delivered, reportChannelWebhook) {
+		payload := struct {
+			Text   string  `json:"text"`
+			Report *Report `json:"report"`
+		}{text, report}
+		if err := notify.NewWebhook(m.report.WebhookURL, m.proxy).Send(ctx, payload); err != nil {
+			return err
+		}
+		if err := m.recordDelivery(ctx, reportChannelWebhook); err != nil {
+			return err
+		}
+	}
+	if recipients := m.report.Recipients(); len(recipients) > 0 && !contains(delivered, reportChannelEmail) {
+		mailer, err := notify.NewMailer(m.smtp)
+		if err != nil {
+			return err
+		}
+		subject, _, _ := strings.Cut(text, "\n")
+		if err := mailer.Send(ctx, recipients, subject, text); err != nil {
+			return err
+		}
+		if err := m.recordDelivery(ctx, reportChannelEmail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// performReport sends the scheduled report when it is due. The maintenance leader
+// claims it in the report ConfigMap first, so a single agent sends it.
+func (m *Manager) performReport(ctx context.Context) {
+	if m.report.Interval <= 0 || !m.report.Deliverable() || !m.isMaintenanceLeader() {
+		return
+	}
+
+	now := time.Now().UTC()
+	var claimed bool
+	err := m.k8sClient.UpdateState(ctx, m.leaseNamespace, reportStateName, func(data map[string]string) {
+		sent, err := time.Parse(time.RFC3339, data[reportKeySent])
+		due := err != nil || !now.Before(sent.Add(m.report.Interval))
+		sending, err := time.Parse(time.RFC3339, data[reportKeySending])
+		claimed = due && (err != nil || now.Sub(sending) > reportClaimTimeout)
+		if claimed {
+			data[reportKeySending] = now.Format(time.RFC3339)
+		}
+	})
+	if err != nil {
+		m.log.Errorf("Error scheduling report: %v", err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	start := time.Now()
+	err = m.deliverReport(ctx)
+	m.recordMaintenance(operationReport, start, err)
+	if err != nil {
+		m.log.Errorf("Error sending report: %v", err)
+		// Release the claim, the next cycle tries again the channels that failed
+		if err := m.releaseReport(ctx); err != nil {
+			m.log.Errorf("Error releasing report: %v", err)
+		}
+		return
+	}
+	m.log.Info("Sent protection report")
+}
+
+// deliverReport builds the report of the period since the last one and sends it
+func (m *Manager) deliverReport(ctx context.Context) error {
+	report, next, err := m.BuildReport(ctx)
+	if err != nil {
+		return err
+	}
+	if err := m.SendReport(ctx, report); err != nil {
+		return err
+	}
+	return m.RecordReport(ctx, next)
+}
+
+// FormatReport renders a report as text
+func FormatReport(r *Report) string {
+	var b strings.Builder
+	title := "Backup protection report"
+	if r.Cluster != "" {
+		title += " of " + r.Cluster
+	}
+	fmt.Fprintf(&b, "%s, %s to %s\n", title, r.From.Local().Format(time.RFC3339), r.To.Local().Format(time.RFC3339))
+	fmt.Fprintf(&b, "PVCs protected: %d of %d\n", r.Protected, r.PVCs)
+	if len(r.Unprotected) > 0 {
+		fmt.Fprintf(&b, "Without backup in the period: %s\n", strings.Join(r.Unprotected, ", "))
+	}
+	fmt.Fprintf(&b, "Repository size: %s", FormatBytes(r.RepositoryBytes))
+	if r.RepositoryGrowth != nil {
+		sign, growth := "+", *r.RepositoryGrowth
+		if growth < 0 {
+			sign, growth = "-", -growth
+		}
+		fmt.Fprintf(&b, " (%s%s)", sign, FormatBytes(uint64(growth)))
+	}
+	fmt.Fprintf(&b, "\nData added: %s\n", FormatBytes(r.DataAdded))
+	if r.OldestSnapshot != nil {
+		fmt.Fprintf(&b, "Oldest snapshot: %s (%d days old)\n", r.OldestSnapshot.Local().Format(time.RFC3339), int(r.To.Sub(*r.OldestSnapshot).Hours()/24))
+	}
+	fmt.Fprintf(&b, "Failed backups: %d\n", r.Failures)
+	for _, namespace := range r.Namespaces {
+		fmt.Fprintf(&b, "  %s: %d of %d protected, %d failures\n", namespace.Namespace, namespace.Protected, namespace.PVCs, namespace.Failures)
+	}
+	if len(r.StaleNodes) > 0 {
+		fmt.Fprintf(&b, "Agents not reporting: %s\n", strings.Join(r.StaleNodes, ", "))
+	}
+	for _, err := range r.Errors {
+		fmt.Fprintf(&b, "Incomplete: %s\n", err)
+	}
+	return b.String()
+}
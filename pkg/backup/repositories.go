@@ -0,0 +1,114 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/monlor/local-pvc-backup/pkg/artifact"
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+	"github.com/monlor/local-pvc-backup/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// storageLister returns the names of the directories below dir in the storage of the
+// repositories, relative to the configured path
+type storageLister func(ctx context.Context, dir string) ([]string, error)
+
+// newStorageLister returns the lister of the configured backend, nil when the agent
+// cannot list it
+func newStorageLister(config *cfg.Config, log *logrus.Logger) storageLister {
+	switch config.BackendType {
+	case cfg.BackendS3:
+		return func(ctx context.Context, dir string) ([]string, error) {
+			client, err := storage.NewClient(config.S3Config, config.ResticConfig.ProxyConfig, log)
+			if err != nil {
+				return nil, err
+			}
+			if dir != "" {
+				dir += "/"
+			}
+			return client.ListRepositories(ctx, dir)
+		}
+	case cfg.BackendLocal:
+		return func(ctx context.Context, dir string) ([]string, error) {
+			entries, err := os.ReadDir(filepath.Join(config.LocalConfig.Path, dir))
+			if err != nil {
+				return nil, fmt.Errorf("failed to list repositories: %v", err)
+			}
+			var names []string
+			for _, entry := range entries {
+				if entry.IsDir() {
+					names = append(names, path.Join(dir, entry.Name()))
+				}
+			}
+			return names, nil
+		}
+	default:
+		return nil
+	}
+}
+
+// storedRepositories returns the clients of every repository of the configured layout
+// found in the storage, plan repositories included, and the repositories of deleted
+// PVCs and drained nodes no current PVC leads to
+func (m *Manager) storedRepositories(ctx context.Context) ([]*restic.Client, error) {
+	if m.listStorage == nil {
+		if m.repoLayout == cfg.RepoLayoutShared && !m.resticClient.Sharded() {
+			return []*restic.Client{m.resticClient.WithRepository(m.resticClient.SharedRepository())}, nil
+		}
+		return nil, fmt.Errorf("the repositories of this backend cannot be listed")
+	}
+
+	// Plan repositories are named after the repository of the PVC with the plan appended
+	layoutRepository := func(name string) bool {
+		switch m.repoLayout {
+		case cfg.RepoLayoutPVC:
+			return true
+		case cfg.RepoLayoutShared:
+			return name == cfg.SharedRepositoryName || strings.HasPrefix(name, cfg.SharedRepositoryName+"-")
+		default:
+			return strings.HasPrefix(name, cfg.NodeRepositoryPrefix)
+		}
+	}
+
+	top, err := m.listStorage(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range top {
+		if !m.resticClient.Sharded() {
+			if layoutRepository(name) {
+				names = append(names, name)
+			}
+			continue
+		}
+
+		// Sharded repositories are stored by namespace
+		if name == artifact.Prefix {
+			continue
+		}
+		children, err := m.listStorage(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			if layoutRepository(path.Base(child)) {
+				names = append(names, child)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	clients := make([]*restic.Client, 0, len(names))
+	for _, name := range names {
+		clients = append(clients, m.resticClient.ForRepository(name))
+	}
+	return clients, nil
+}
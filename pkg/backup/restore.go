@@ -0,0 +1,284 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/logging"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+	"github.com/sirupsen/logrus"
+)
+
+// RestoreOptions holds the options of a PVC restore
+type RestoreOptions struct {
+	SnapshotID string    // Snapshot to restore, empty resolves the latest one taken at or before At
+	At         time.Time // Point in time to restore when no snapshot is given
+	Target     string    // Directory to restore into, empty restores the PVC in place
+	Delete     bool      // Delete files missing from the snapshot
+	Verify     bool      // Check the restored files against the snapshot
+}
+
+// RestoreResult describes a finished restore
+type RestoreResult struct {
+	Snapshot *restic.Snapshot
+	Target   string
+	// SafetySnapshotID is the snapshot of the state overwritten by an in-place restore
+	SafetySnapshotID string
+}
+
+// Restore restores a snapshot of a PVC on this node. In-place restores first take a
+// safety snapshot of the current data, tagged with the restored snapshot, so that the
+// restore can be undone with Rollback.
+func (m *Manager) Restore(ctx context.Context, namespace, name string, opts RestoreOptions) (*RestoreResult, error) {
+	pvc, err := m.findPVC(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The snapshot can still be restored elsewhere
+	if opts.Target == "" {
+		ro, err := readOnly(pvc.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check the mount of PVC %s/%s: %v", namespace, name, err)
+		}
+		if ro {
+			return nil, fmt.Errorf("PVC %s/%s is mounted read-only, restore it into a target directory instead", namespace, name)
+		}
+	}
+
+	client, err := m.repositoryFor(ctx, pvc)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot *restic.Snapshot
+	if opts.SnapshotID != "" {
+		snapshot, err = findSnapshot(ctx, client, namespace, name, opts.SnapshotID)
+	} else {
+		snapshot, err = ResolveSnapshotAt(ctx, client, namespace, name, opts.At)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.IsDump() {
+		return nil, fmt.Errorf("snapshot %s holds a dump, not files, read it with local-pvc-backup restic dump %s %s", snapshot.ShortID, snapshot.ShortID, strings.Join(snapshot.Paths, " "))
+	}
+	if snapshot.IsVerification() {
+		return nil, fmt.Errorf("snapshot %s holds the verification output of snapshot %s, not the data of PVC %s/%s", snapshot.ShortID, snapshot.TagValue(restic.VerificationTagPrefix), namespace, name)
+	}
+
+	result := &RestoreResult{Snapshot: snapshot, Target: opts.Target}
+	if result.Target == "" {
+		result.Target = pvc.Path
+
+		m.log.Infof("Taking safety snapshot of PVC %s/%s before restoring snapshot %s", namespace, name, snapshot.ShortID)
+		description := fmt.Sprintf("pre-restore of %s", snapshot.ShortID)
+		summary, err := m.backupPVC(ctx, pvc, description, restic.SafetyTag(snapshot.ID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to take safety snapshot, restore aborted: %v", err)
+		}
+		result.SafetySnapshotID = summary.SnapshotID
+	}
+
+	m.log.WithFields(logrus.Fields{
+		logging.FieldNamespace:  namespace,
+		logging.FieldPVC:        name,
+		logging.FieldSnapshotID: snapshot.ID,
+	}).Infof("Restoring snapshot %s of PVC %s/%s into %s", snapshot.ShortID, namespace, name, result.Target)
+	if err := client.Restore(ctx, snapshot.ID, pvc.Path, result.Target, opts.Delete); err != nil {
+		return nil, err
+	}
+	if opts.Verify {
+		if err := verifyRestore(ctx, client, snapshot, pvc.Path, result.Target); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// maxListedMismatches bounds the files listed by a failed restore verification
+const maxListedMismatches = 10
+
+// verifyRestore checks that every file of a snapshot was restored into target with its
+// type, size and modification time, failing with a VerificationError otherwise
+func verifyRestore(ctx context.Context, client *restic.Client, snapshot *restic.Snapshot, dir, target string) error {
+	nodes, err := client.ListFiles(ctx, snapshot.ID)
+	if err != nil {
+		return fmt.Errorf("failed to verify the restore: %v", err)
+	}
+
+	base := restic.SnapshotPath(dir)
+	var mismatches []string
+	for _, node := range nodes {
+		if node.Path != base && !strings.HasPrefix(node.Path, base+"/") {
+			continue
+		}
+		path := filepath.Join(target, filepath.FromSlash(strings.TrimPrefix(node.Path, base)))
+		info, err := os.Lstat(path)
+		switch {
+		case err != nil:
+			mismatches = append(mismatches, fmt.Sprintf("%s is missing", path))
+		case nodeType(info) != node.Type:
+			mismatches = append(mismatches, fmt.Sprintf("%s is a %s instead of a %s", path, nodeType(info), node.Type))
+		case node.Type == "file" && (uint64(info.Size()) != node.Size || !info.ModTime().Equal(node.MTime)):
+			mismatches = append(mismatches, fmt.Sprintf("%s differs in size or modification time", path))
+		}
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	total := len(mismatches)
+	if total > maxListedMismatches {
+		mismatches = append(mismatches[:maxListedMismatches], "...")
+	}
+	return &VerificationError{Err: fmt.Errorf("%d files restored from snapshot %s do not match it: %s", total, snapshot.ShortID, strings.Join(mismatches, ", "))}
+}
+
+// Rollback undoes the last in-place restore of a PVC by restoring the safety snapshot
+// taken before it. The rollback is itself an in-place restore and can be undone too.
+func (m *Manager) Rollback(ctx context.Context, namespace, name string, delete bool) (*RestoreResult, error) {
+	pvc, err := m.findPVC(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := m.repositoryFor(ctx, pvc)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := client.Snapshots(ctx, restic.PVCTags(namespace, name))
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *restic.Snapshot
+	for i := range snapshots {
+		if snapshots[i].SafetyFor() == "" {
+			continue
+		}
+		if latest == nil || snapshots[i].Time.After(latest.Time) {
+			latest = &snapshots[i]
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no safety snapshot found for PVC %s/%s, nothing to roll back", namespace, name)
+	}
+
+	return m.Restore(ctx, namespace, name, RestoreOptions{SnapshotID: latest.ID, Delete: delete})
+}
+
+// findSnapshot returns the snapshot of a PVC with the given full or short ID
+func findSnapshot(ctx context.Context, resticClient *restic.Client, namespace, pvcName, id string) (*restic.Snapshot, error) {
+	snapshots, err := resticClient.Snapshots(ctx, restic.PVCTags(namespace, pvcName))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range snapshots {
+		if strings.HasPrefix(snapshots[i].ID, id) {
+			return &snapshots[i], nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot %s not found for PVC %s/%s", id, namespace, pvcName)
+}
+
+// BatchRestoreResult describes the restore of one PVC of a batch restore
+type BatchRestoreResult struct {
+	Name   string
+	Result *RestoreResult // Nil when the PVC was skipped or its restore failed
+	Err    error
+	// Skipped explains why the PVC was not restored, e.g. because it is on another node
+	Skipped string
+}
+
+// RestoreSelector restores the PVCs of a namespace matching a label selector, one
+// after the other in StatefulSet ordinal order so that e.g. the primary of a database
+// is restored before its replicas. PVCs of other nodes are skipped, they are restored
+// by running the command on their node. The batch stops at the first failed restore
+// since the PVCs after it may depend on it. A target directory receives a
+// subdirectory per PVC.
+func (m *Manager) RestoreSelector(ctx context.Context, namespace, selector string, opts RestoreOptions, progress func(BatchRestoreResult)) error {
+	if opts.SnapshotID != "" {
+		return fmt.Errorf("a snapshot ID selects the snapshot of one PVC, restore a selector at a point in time instead")
+	}
+	if !m.featureEnabled(FeatureAutoRestore) {
+		return fmt.Errorf("restores of a selector are switched off on node %s by the %s feature", m.k8sClient.GetNodeName(), FeatureAutoRestore)
+	}
+
+	names, err := m.k8sClient.ListPVCNames(ctx, namespace, selector)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no PVC in namespace %s matches %s", namespace, selector)
+	}
+	sortByOrdinal(names)
+
+	pvcs, err := m.k8sClient.GetPVCsToBackup(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get PVCs to backup: %v", err)
+	}
+	local := make(map[string]bool)
+	for _, pvc := range pvcs {
+		if pvc.Namespace == namespace {
+			local[pvc.Name] = true
+		}
+	}
+
+	for _, name := range names {
+		if !local[name] {
+			progress(BatchRestoreResult{Name: name, Skipped: fmt.Sprintf("not enabled for backup on node %s", m.k8sClient.GetNodeName())})
+			continue
+		}
+
+		pvcOpts := opts
+		if opts.Target != "" {
+			pvcOpts.Target = filepath.Join(opts.Target, name)
+		}
+		result, err := m.Restore(ctx, namespace, name, pvcOpts)
+		progress(BatchRestoreResult{Name: name, Result: result, Err: err})
+		if err != nil {
+			failed := fmt.Errorf("restore of PVC %s/%s failed, the PVCs after it were not restored: %v", namespace, name, err)
+			var verification *VerificationError
+			if errors.As(err, &verification) {
+				return &VerificationError{Err: failed}
+			}
+			return failed
+		}
+	}
+	return nil
+}
+
+// sortByOrdinal sorts PVC names by the StatefulSet ordinal ending them, e.g. data-db-0,
+// and by name within an ordinal. PVCs without an ordinal come first.
+func sortByOrdinal(names []string) {
+	sort.SliceStable(names, func(i, j int) bool {
+		oi, oj := pvcOrdinal(names[i]), pvcOrdinal(names[j])
+		if oi != oj {
+			return oi < oj
+		}
+		return names[i] < names[j]
+	})
+}
+
+// pvcOrdinal returns the StatefulSet ordinal of a PVC name, -1 without one
+func pvcOrdinal(name string) int {
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return -1
+	}
+	ordinal, err := strconv.Atoi(name[i+1:])
+	if err != nil || ordinal < 0 {
+		return -1
+	}
+	return ordinal
+}
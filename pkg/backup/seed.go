@@ -0,0 +1,146 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// SeedCheckpointFile is the default checkpoint file of the seed in the cache directory
+const SeedCheckpointFile = "seed-checkpoint.json"
+
+// SeedOptions holds the options of the initial seeding of a node
+type SeedOptions struct {
+	Checkpoint  string // File recording the seeded PVCs, so an interrupted seed resumes
+	LimitUpload uint64 // Upload bandwidth in bytes per second, 0 uses the backup policy
+	Restart     bool   // Discard the checkpoint and seed every PVC again
+}
+
+// SeedProgress reports a PVC handled by the seed
+type SeedProgress struct {
+	PVC     k8s.PVCInfo
+	Index   int // Position of the PVC, starting at 1
+	Total   int
+	Resumed bool                  // The PVC was seeded by an earlier run
+	Summary *restic.BackupSummary // Backup of the PVC, nil when resumed
+	Elapsed time.Duration         // Time since the seed started
+	Bytes   uint64                // Bytes processed by this run so far
+}
+
+// seedCheckpoint is the content of the checkpoint file
+type seedCheckpoint struct {
+	Node   string               `json:"node"`
+	Seeded map[string]seededPVC `json:"seeded"` // Keyed by PVC UID
+}
+
+type seededPVC struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Snapshot  string    `json:"snapshot"`
+	Time      time.Time `json:"time"`
+}
+
+// Seed performs the first full backup of the PVCs of this node one at a time, recording
+// each finished PVC in the checkpoint file so that a new run after an interruption skips
+// them. progress is called after each PVC.
+func (m *Manager) Seed(ctx context.Context, opts SeedOptions, progress func(SeedProgress)) error {
+	if opts.Restart {
+		if err := os.Remove(opts.Checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove checkpoint: %v", err)
+		}
+	}
+	checkpoint, err := m.loadSeedCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return err
+	}
+
+	pvcs, err := m.k8sClient.GetPVCsToBackup(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get PVCs to backup: %v", err)
+	}
+	pvcs = m.enforceClassification(ctx, m.enforceQuotas(ctx, pvcs))
+
+	m.uploadLimit = opts.LimitUpload
+	start := time.Now()
+	var processed uint64
+	for i, pvc := range pvcs {
+		report := SeedProgress{PVC: pvc, Index: i + 1, Total: len(pvcs)}
+		if _, ok := checkpoint.Seeded[pvc.UID]; ok {
+			report.Resumed = true
+		} else {
+			summary, err := m.backupPVC(ctx, pvc, "seed")
+			if err != nil {
+				return err
+			}
+			processed += summary.TotalBytesProcessed
+			report.Summary = summary
+
+			checkpoint.Seeded[pvc.UID] = seededPVC{
+				Namespace: pvc.Namespace,
+				Name:      pvc.Name,
+				Snapshot:  summary.SnapshotID,
+				Time:      time.Now(),
+			}
+			if err := saveSeedCheckpoint(opts.Checkpoint, checkpoint); err != nil {
+				return err
+			}
+		}
+
+		report.Elapsed = time.Since(start)
+		report.Bytes = processed
+		progress(report)
+	}
+	return nil
+}
+
+// loadSeedCheckpoint reads the checkpoint file, empty when it does not exist yet
+func (m *Manager) loadSeedCheckpoint(path string) (*seedCheckpoint, error) {
+	node := m.k8sClient.GetNodeName()
+	checkpoint := &seedCheckpoint{Node: node, Seeded: make(map[string]seededPVC)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %v", err)
+	}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %v", path, err)
+	}
+	if checkpoint.Node != node {
+		return nil, fmt.Errorf("checkpoint %s belongs to node %s, not %s", path, checkpoint.Node, node)
+	}
+	if checkpoint.Seeded == nil {
+		checkpoint.Seeded = make(map[string]seededPVC)
+	}
+	return checkpoint, nil
+}
+
+// saveSeedCheckpoint replaces the checkpoint file atomically, an interruption while
+// writing it must not lose the PVCs seeded before
+func saveSeedCheckpoint(path string, checkpoint *seedCheckpoint) error {
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create checkpoint directory: %v", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	return nil
+}
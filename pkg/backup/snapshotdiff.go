@@ -0,0 +1,79 @@
+package backup
+
+import (
+	"context"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/metrics"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// reportChanges compares the snapshot of a regular backup with the previous snapshot of
+// the PVC with restic diff, logging and exposing the files added, removed and modified
+// and the data added and removed, e.g. to spot mass changes or runaway log growth
+func (m *Manager) reportChanges(ctx context.Context, pvc k8s.PVCInfo, summary *restic.BackupSummary) {
+	if !m.diffReport || (pvc.Config.DumpOnly && pvc.Config.DumpCommand != "") {
+		return
+	}
+
+	client, err := m.repositoryFor(ctx, pvc)
+	if err != nil {
+		m.log.Warnf("Failed to report the changes of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		return
+	}
+	previous, err := previousSnapshot(ctx, client, pvc, summary.SnapshotID)
+	if err != nil {
+		m.log.Warnf("Failed to report the changes of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		return
+	}
+	if previous == nil {
+		m.log.Debugf("PVC %s/%s has no previous snapshot to report changes against", pvc.Namespace, pvc.Name)
+		return
+	}
+	stats, err := client.Diff(ctx, previous.ID, summary.SnapshotID)
+	if err != nil {
+		m.log.Warnf("Failed to report the changes of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		return
+	}
+
+	for change, files := range map[string]int{"added": stats.Added.Files, "removed": stats.Removed.Files, "modified": stats.ChangedFiles} {
+		m.metrics.Set(metricPVCDiffFiles, changeLabels(pvc, change), float64(files))
+	}
+	m.metrics.Set(metricPVCDiffBytes, changeLabels(pvc, "added"), float64(stats.Added.Bytes))
+	m.metrics.Set(metricPVCDiffBytes, changeLabels(pvc, "removed"), float64(stats.Removed.Bytes))
+	m.log.WithFields(pvcFields(pvc)).Infof("Snapshot %s of PVC %s/%s changed since snapshot %s: %d files added, %d removed, %d modified, %s added, %s removed",
+		shortID(summary.SnapshotID), pvc.Namespace, pvc.Name, previous.ShortID, stats.Added.Files, stats.Removed.Files, stats.ChangedFiles,
+		FormatBytes(stats.Added.Bytes), FormatBytes(stats.Removed.Bytes))
+}
+
+// previousSnapshot returns the latest regular snapshot of a PVC other than the given one,
+// nil when there is none
+func previousSnapshot(ctx context.Context, client *restic.Client, pvc k8s.PVCInfo, snapshotID string) (*restic.Snapshot, error) {
+	snapshots, err := client.Snapshots(ctx, []string{restic.PVCIDTagPrefix + pvc.UID})
+	if err != nil {
+		return nil, err
+	}
+
+	var previous *restic.Snapshot
+	for i, snapshot := range snapshots {
+		if snapshot.ID == snapshotID || snapshot.IsVerification() || snapshot.IsDump() || snapshot.SafetyFor() != "" {
+			continue
+		}
+		if previous == nil || snapshot.Time.After(previous.Time) {
+			previous = &snapshots[i]
+		}
+	}
+	return previous, nil
+}
+
+// changeLabels returns the metric labels of a kind of change of a PVC
+func changeLabels(pvc k8s.PVCInfo, change string) metrics.Labels {
+	labels := pvcLabels(pvc)
+	labels["change"] = change
+	return labels
+}
+
+// shortID returns the short form of a snapshot ID
+func shortID(id string) string {
+	return id[:min(8, len(id))]
+}
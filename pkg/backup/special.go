@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// specialFileMode selects sockets, named pipes and device files
+const specialFileMode = fs.ModeSocket | fs.ModeNamedPipe | fs.ModeDevice | fs.ModeCharDevice
+
+// writeSpecialFilesExclude lists the special files below paths in a restic exclude
+// file, returning its path and its removal, or an empty path when there is none.
+// restic has no option to skip them. With oneFileSystem, other filesystems are not
+// walked, restic skips them as well.
+func writeSpecialFilesExclude(paths []string, oneFileSystem bool) (string, func(), error) {
+	var patterns []string
+	for _, root := range paths {
+		rootDevice, _ := deviceOf(root)
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				// restic reports the unreadable files
+				if entry != nil && entry.IsDir() && path != root {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if entry.IsDir() && oneFileSystem && path != root {
+				if device, err := deviceOf(path); err == nil && device != rootDevice {
+					return filepath.SkipDir
+				}
+			}
+			if entry.Type()&specialFileMode != 0 {
+				patterns = append(patterns, escapePattern(path))
+			}
+			return nil
+		})
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if len(patterns) == 0 {
+		return "", func() {}, nil
+	}
+
+	file, err := os.CreateTemp("", "local-pvc-backup-special-*")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() { os.Remove(file.Name()) }
+	_, err = file.WriteString(strings.Join(patterns, "\n") + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	return file.Name(), remove, nil
+}
+
+// escapePattern escapes the wildcards of a path for a restic exclude pattern with
+// character classes, which work with both path separators. restic expands
+// environment variables in exclude files and trims their lines, so "$" is doubled and
+// whitespace at either end goes into a character class. A newline, which would split
+// the line, matches any character instead.
+func escapePattern(path string) string {
+	runes := []rune(path)
+	var b strings.Builder
+	for i, r := range runes {
+		switch {
+		case r == '*' || r == '?' || r == '[':
+			b.WriteRune('[')
+			b.WriteRune(r)
+			b.WriteRune(']')
+		case r == '$':
+			b.WriteString("$$")
+		case r == '\n' || r == '\r':
+			b.WriteRune('?')
+		case unicode.IsSpace(r) && (i == 0 || i == len(runes)-1):
+			b.WriteRune('[')
+			b.WriteRune(r)
+			b.WriteRune(']')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
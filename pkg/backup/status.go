@@ -0,0 +1,210 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/logging"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+	"github.com/monlor/local-pvc-backup/pkg/version"
+)
+
+// reportStatus publishes the version of the agent and the outcome of the last backup
+// cycle in the status Lease of the node, read by the rollout-status command
+func (m *Manager) reportStatus(ctx context.Context, cycleErr error) {
+	now := time.Now()
+	m.cycleMu.Lock()
+	status := k8s.NodeStatus{
+		Version:   version.Version,
+		StartedAt: m.startedAt,
+		LastCycle: now,
+		// Missing a few cycles marks the agent as stale
+		Expiry:        3 * m.interval,
+		CycleFailures: m.cycleFailures,
+	}
+	m.cycleFailures = nil
+	m.cycleMu.Unlock()
+	if cycleErr != nil {
+		status.LastError = cycleErr.Error()
+	} else {
+		m.lastSuccess = now
+	}
+	status.LastSuccess = m.lastSuccess
+
+	if err := m.k8sClient.ReportNodeStatus(ctx, m.leaseNamespace, status); err != nil {
+		m.log.Warnf("Failed to report node status: %v", err)
+	}
+}
+
+// Outcomes of the last backup of a PVC in its status annotation
+const (
+	pvcStatusSuccess = "success"
+	pvcStatusFailed  = "failed"
+	pvcStatusSkipped = "skipped"
+)
+
+// statusHistory is the number of backups kept in the history of a PVC backup status
+const statusHistory = 10
+
+// maxStatusError is the length of the errors kept in a PVC backup status
+const maxStatusError = 500
+
+// recordStatus records the outcome of the backup of a PVC in its annotations and its
+// backup status resource
+func (m *Manager) recordStatus(ctx context.Context, pvc k8s.PVCInfo, summary *restic.BackupSummary, backupErr error, status string) {
+	m.annotateStatus(ctx, pvc, summary, status)
+	m.updateBackupStatus(ctx, pvc, "", summary, backupErr, status)
+}
+
+// recordPlanStatus records the outcome of a backup of a plan or schedule of a PVC in
+// the history of its backup status. The last success and size stay those of the
+// regular backups.
+func (m *Manager) recordPlanStatus(ctx context.Context, pvc k8s.PVCInfo, plan string, summary *restic.BackupSummary, backupErr error, status string) {
+	m.updateBackupStatus(ctx, pvc, plan, summary, backupErr, status)
+}
+
+// statusResourceFor resolves the store of the PVC backup statuses once
+func (m *Manager) statusResourceFor() string {
+	m.statusResourceOnce.Do(func() {
+		resource, err := m.k8sClient.ResolveStatusResource(m.statusResource)
+		if err != nil {
+			m.log.Warnf("Not keeping PVC backup statuses: %v", err)
+			resource = k8s.StatusResourceOff
+		}
+		m.statusResource = resource
+	})
+	return m.statusResource
+}
+
+// nextRun records the next due backup of a PVC for a plan, "" for the regular backups,
+// unless due is zero, and returns the earliest upcoming backup of the PVC among its
+// regular backups, plans and schedules. Runs of removed plans pass and are dropped.
+func (m *Manager) nextRun(pvc k8s.PVCInfo, plan string, due time.Time) time.Time {
+	m.plansMu.Lock()
+	defer m.plansMu.Unlock()
+
+	runs := m.nextRuns[pvc.UID]
+	if runs == nil {
+		runs = make(map[string]time.Time)
+		m.nextRuns[pvc.UID] = runs
+	}
+	if !due.IsZero() {
+		runs[plan] = due.UTC()
+	}
+	now := time.Now()
+	var next time.Time
+	for name, run := range runs {
+		if run.Before(now) {
+			delete(runs, name)
+			continue
+		}
+		if next.IsZero() || run.Before(next) {
+			next = run
+		}
+	}
+	return next
+}
+
+// updateBackupStatus adds a backup to the history of the backup status of a PVC,
+// along with its last success, failure or skip, its size and its next scheduled run.
+// plan names the plan or schedule of the backup, empty for the regular backups.
+func (m *Manager) updateBackupStatus(ctx context.Context, pvc k8s.PVCInfo, plan string, summary *restic.BackupSummary, backupErr error, status string) {
+	resource := m.statusResourceFor()
+	if resource == k8s.StatusResourceOff {
+		return
+	}
+
+	now := time.Now().UTC()
+	// Plan runs record their own next run before they start
+	var due time.Time
+	if plan == "" {
+		due = now.Add(m.interval)
+	}
+	next := m.nextRun(pvc, plan, due)
+	record := k8s.BackupRecord{Time: now, Status: status, Plan: plan}
+	if summary != nil {
+		record.SnapshotID = summary.SnapshotID
+		record.Duration = summary.Duration().Round(time.Second).String()
+		record.AddedBytes = summary.DataAdded
+	}
+	if backupErr != nil {
+		message, _, _ := strings.Cut(logging.Redact(m.log, backupErr.Error()), "\n")
+		if len(message) > maxStatusError {
+			message = message[:maxStatusError]
+		}
+		record.Error = message
+	}
+
+	err := m.k8sClient.UpdatePVCBackupStatus(ctx, resource, pvc, func(s *k8s.PVCBackupStatus) {
+		s.Node = m.k8sClient.GetNodeName()
+		if !next.IsZero() {
+			s.NextRun = &next
+		}
+		switch {
+		case status == pvcStatusSuccess && summary != nil && plan == "":
+			s.LastSuccess = &now
+			s.Size = k8s.BackupSize{Bytes: summary.TotalBytesProcessed, Files: summary.TotalFilesProcessed, AddedBytes: summary.DataAdded}
+		case status == pvcStatusSkipped:
+			// Skips by quota, classification or unchanged data are not failures
+			s.LastSkip = &now
+			s.LastSkipReason = record.Error
+		case backupErr != nil:
+			s.LastFailure = &now
+			s.LastError = record.Error
+		}
+		s.History = append([]k8s.BackupRecord{record}, s.History...)
+		if len(s.History) > statusHistory {
+			s.History = s.History[:statusHistory]
+		}
+	})
+	if err != nil {
+		m.log.WithFields(pvcFields(pvc)).Warnf("%v", err)
+	}
+}
+
+// annotateStatus records the outcome of the backup of a PVC in its annotations, so
+// users and controllers see its freshness on the PVC. A failed or skipped backup keeps
+// the time and snapshot of the last successful one.
+func (m *Manager) annotateStatus(ctx context.Context, pvc k8s.PVCInfo, summary *restic.BackupSummary, status string) {
+	if !m.statusAnnotations {
+		return
+	}
+	annotations := map[string]string{cfg.AnnotationLastStatus: status}
+	if status == pvcStatusSuccess && summary != nil {
+		annotations[cfg.AnnotationLastBackupTime] = time.Now().UTC().Format(time.RFC3339)
+		annotations[cfg.AnnotationLastSnapshotID] = summary.SnapshotID
+	}
+	if err := m.k8sClient.AnnotatePVC(ctx, pvc, annotations); err != nil {
+		m.log.WithFields(pvcFields(pvc)).Warnf("Failed to record backup status: %v", err)
+	}
+}
+
+// PVCStatus is a PVC backed up on this node with its kept backup status
+type PVCStatus struct {
+	PVC    k8s.PVCInfo
+	Status *k8s.PVCBackupStatus // Nil when the PVC was not backed up yet or no status is kept
+}
+
+// PVCStatuses returns the PVCs enabled for backup on this node with their backup
+// statuses. A status that cannot be read is logged and left out.
+func (m *Manager) PVCStatuses(ctx context.Context) ([]PVCStatus, error) {
+	pvcs, err := m.k8sClient.GetPVCsToBackup(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PVCs to backup: %v", err)
+	}
+
+	resource := m.statusResourceFor()
+	statuses := make([]PVCStatus, 0, len(pvcs))
+	for _, pvc := range pvcs {
+		status, err := m.k8sClient.GetPVCBackupStatus(ctx, resource, pvc)
+		if err != nil {
+			m.log.Warnf("Failed to read backup status: %v", err)
+		}
+		statuses = append(statuses, PVCStatus{PVC: pvc, Status: status})
+	}
+	return statuses, nil
+}
@@ -0,0 +1,216 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// ttlStateName is the ConfigMap recording when PVCs with a TTL were found deleted, keyed
+// by PVC UID
+const ttlStateName = "local-pvc-backup-ttl"
+
+// expiringPVC gathers the snapshots of a PVC with a TTL across repositories
+type expiringPVC struct {
+	namespace string
+	name      string
+	ttl       string    // TTL of the latest snapshot
+	latest    time.Time // Time of the latest snapshot with a TTL
+	snapshots map[string][]string
+}
+
+// performExpiry deletes all snapshots of the PVCs deleted longer than their TTL ago,
+// from every repository of this node and from the replicas. Repositories shared or
+// sharded across nodes are expired by the maintenance leader. The time a PVC was found
+// deleted is kept in a ConfigMap, so the countdown survives agent restarts.
+func (m *Manager) performExpiry(ctx context.Context) error {
+	if (m.repoLayout == cfg.RepoLayoutShared || m.resticClient.Sharded()) && !m.isMaintenanceLeader() {
+		m.log.Debug("Not the maintenance leader, skipping expiry of deleted PVCs")
+		return nil
+	}
+
+	start := time.Now()
+	clients, pvcs, err := m.gatherExpiringPVCs(ctx)
+	if err != nil {
+		m.recordMaintenance(operationExpire, start, err)
+		return err
+	}
+	if len(pvcs) == 0 {
+		return nil
+	}
+
+	state, err := m.k8sClient.GetState(ctx, m.leaseNamespace, ttlStateName)
+	if err != nil {
+		m.recordMaintenance(operationExpire, start, err)
+		return err
+	}
+
+	// A hold pauses the expiry, the countdowns keep running and expire after the release
+	allowed := m.deletionsAllowed(ctx, "expiry of deleted PVCs")
+	found := make(map[string]time.Time)
+	var errs []error
+	var forgotten []string
+	for _, uid := range sortedKeys(pvcs) {
+		pvc := pvcs[uid]
+		exists, err := m.k8sClient.PVCExists(ctx, pvc.namespace, pvc.name, uid)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if exists {
+			continue
+		}
+
+		deletedAt, err := time.Parse(time.RFC3339, state[uid])
+		if err != nil {
+			deletedAt = start
+			found[uid] = deletedAt
+			m.log.Infof("PVC %s/%s (%s) was deleted, its backups expire in %s", pvc.namespace, pvc.name, uid, pvc.ttl)
+		}
+		ttl, _ := parseResticDuration(pvc.ttl)
+		if start.Before(deletedAt.Add(ttl)) || !allowed {
+			continue
+		}
+
+		if err := m.expirePVC(ctx, clients, uid, pvc); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		forgotten = append(forgotten, uid)
+	}
+
+	if len(found) > 0 || len(forgotten) > 0 {
+		if err := m.k8sClient.UpdateState(ctx, m.leaseNamespace, ttlStateName, func(data map[string]string) {
+			for uid, deletedAt := range found {
+				if _, ok := data[uid]; !ok {
+					data[uid] = deletedAt.UTC().Format(time.RFC3339)
+				}
+			}
+			for _, uid := range forgotten {
+				delete(data, uid)
+			}
+		}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	err = errors.Join(errs...)
+	m.recordMaintenance(operationExpire, start, err)
+	return err
+}
+
+// gatherExpiringPVCs returns the clients of the scanned repositories and the PVCs with a
+// TTL found in them, keyed by UID
+func (m *Manager) gatherExpiringPVCs(ctx context.Context) (map[string]*restic.Client, map[string]*expiringPVC, error) {
+	repositories, err := m.expiryRepositories(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	clients := make(map[string]*restic.Client)
+	for _, client := range append(repositories, m.plannedRepositories()...) {
+		clients[client.GetRepository()] = client
+	}
+	replicas := make(map[string]bool)
+	if m.replicationEnabled() {
+		for _, client := range repositories {
+			replica := client.Replica(m.replica)
+			clients[replica.GetRepository()] = replica
+			replicas[replica.GetRepository()] = true
+		}
+	}
+
+	pvcs := make(map[string]*expiringPVC)
+	for repository, client := range clients {
+		snapshots, err := client.Snapshots(ctx, nil)
+		if err != nil {
+			// Replicas are only created by the first replication
+			if replicas[repository] {
+				m.log.Debugf("Skipping replica %s: %v", repository, err)
+				delete(clients, repository)
+				continue
+			}
+			// A directory of the storage holding no repository
+			if restic.IsMissingRepositoryError(err) {
+				m.log.Debugf("Skipping %s: %v", repository, err)
+				delete(clients, repository)
+				continue
+			}
+			return nil, nil, fmt.Errorf("%s: %v", repository, err)
+		}
+
+		for _, snapshot := range snapshots {
+			uid := snapshot.TagValue(restic.PVCIDTagPrefix)
+			if uid == "" {
+				continue
+			}
+			pvc, ok := pvcs[uid]
+			if !ok {
+				pvc = &expiringPVC{snapshots: make(map[string][]string)}
+				pvcs[uid] = pvc
+			}
+			pvc.snapshots[repository] = append(pvc.snapshots[repository], snapshot.ID)
+
+			if ttl := snapshot.TagValue(restic.TTLTagPrefix); ttl != "" && snapshot.Time.After(pvc.latest) {
+				pvc.ttl = ttl
+				pvc.latest = snapshot.Time
+				pvc.namespace = snapshot.TagValue(restic.NamespaceTagPrefix)
+				pvc.name = snapshot.TagValue(restic.PVCNameTagPrefix)
+			}
+		}
+	}
+
+	// Only PVCs whose latest annotation asked for a TTL expire
+	for uid, pvc := range pvcs {
+		if pvc.ttl == "" {
+			delete(pvcs, uid)
+		}
+	}
+	return clients, pvcs, nil
+}
+
+// expiryRepositories returns the repositories scanned for deleted PVCs. Sharded
+// repositories are listed from the storage, since no backup opens the repository of a
+// deleted PVC after the agent restarted.
+func (m *Manager) expiryRepositories(ctx context.Context) ([]*restic.Client, error) {
+	if !m.resticClient.Sharded() {
+		return m.repositories(), nil
+	}
+	if m.listStorage == nil {
+		m.log.Debug("The repositories of this backend cannot be listed, scanning the repositories used since the agent started")
+		return m.repositories(), nil
+	}
+	return m.storedRepositories(ctx)
+}
+
+// expirePVC forgets all snapshots of a deleted PVC
+func (m *Manager) expirePVC(ctx context.Context, clients map[string]*restic.Client, uid string, pvc *expiringPVC) error {
+	if m.appendOnly {
+		return fmt.Errorf("backups of deleted PVC %s/%s expired, but the repository is append-only", pvc.namespace, pvc.name)
+	}
+
+	count := 0
+	for _, repository := range sortedKeys(pvc.snapshots) {
+		ids := pvc.snapshots[repository]
+		if err := clients[repository].ForgetSnapshots(ctx, ids); err != nil {
+			return fmt.Errorf("failed to expire backups of deleted PVC %s/%s in %s: %v", pvc.namespace, pvc.name, repository, err)
+		}
+		count += len(ids)
+	}
+	m.log.Infof("Forgot %d snapshots of PVC %s/%s (%s), its TTL of %s after deletion expired", count, pvc.namespace, pvc.name, uid, pvc.ttl)
+	return nil
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[T any](values map[string]T) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
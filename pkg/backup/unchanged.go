@@ -0,0 +1,231 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// Change detection modes, skipping the regular backups of unchanged PVCs
+const (
+	ChangeDetectionOff    = "off"
+	ChangeDetectionMtime  = "mtime"   // Compare the change times of the files with the last backup
+	ChangeDetectionDryRun = "dry-run" // Compare the files with the last snapshot with restic backup --dry-run
+)
+
+// Change detection settings
+const (
+	// changeStateFile holds the last regular backup of each PVC in the cache directory
+	changeStateFile = "change-state.json"
+	// changeSlack absorbs the timestamp granularity of filesystems, files changed just
+	// before a backup started count as changed
+	changeSlack = 2 * time.Second
+)
+
+// errChanged stops the scan of a PVC at the first changed file
+var errChanged = errors.New("changed")
+
+// lastBackup is the last regular backup of a PVC, the baseline of its change detection
+type lastBackup struct {
+	Snapshot string    `json:"snapshot"`
+	Started  time.Time `json:"started"`
+	Options  string    `json:"options"` // Fingerprint of the paths and options backed up
+}
+
+// checkChangeDetection validates a change detection mode
+func checkChangeDetection(mode string) error {
+	switch mode {
+	case ChangeDetectionOff, ChangeDetectionMtime, ChangeDetectionDryRun:
+		return nil
+	}
+	return fmt.Errorf("invalid change detection %q, expected %s, %s or %s", mode, ChangeDetectionOff, ChangeDetectionMtime, ChangeDetectionDryRun)
+}
+
+// backupFingerprint identifies the paths and options selecting the files of a backup,
+// a PVC whose annotations or ignore file changed is backed up again
+func backupFingerprint(paths []string, opts restic.BackupOptions) string {
+	data, _ := json.Marshal(struct {
+		Paths             []string
+		Excludes          []string
+		ExcludeIfPresent  []string
+		ExcludeCaches     bool
+		ExcludeLargerThan uint64
+		OneFileSystem     bool
+	}{paths, opts.ExcludePatterns, opts.ExcludeIfPresent, opts.ExcludeCaches, opts.ExcludeLargerThan, opts.OneFileSystem})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// unchanged reports whether a PVC did not change since its last regular backup, whose
+// snapshot then still holds its data and the backup is skipped. PVCs with a dump
+// command, whose data comes from the application, and PVCs with a pre-hook, which may
+// flush the data of the application to the files, are always backed up.
+func (m *Manager) unchanged(ctx context.Context, pvc k8s.PVCInfo) bool {
+	if m.changeDetection == ChangeDetectionOff || pvc.Config.DumpCommand != "" || pvc.Config.PreHook != "" {
+		return false
+	}
+
+	m.lastBackupsMu.Lock()
+	if m.lastBackups == nil {
+		m.lastBackups = m.loadLastBackups()
+	}
+	last, ok := m.lastBackups[pvc.UID]
+	m.lastBackupsMu.Unlock()
+	// A backup is taken at least every max age, keeping the status of the PVC fresh
+	if !ok || (m.changeMaxAge > 0 && time.Since(last.Started) >= m.changeMaxAge) {
+		return false
+	}
+	paths, opts := m.backupOptions(pvc, pvc.Config.Description, nil)
+	if backupFingerprint(paths, opts) != last.Options {
+		return false
+	}
+
+	var changed bool
+	var err error
+	switch m.changeDetection {
+	case ChangeDetectionMtime:
+		// Changes of the files the backups skip do not count, the ignore file was
+		// already reported by backupOptions when unreadable
+		excludes := m.processPatterns(pvc.Path, pvc.Config.Exclude)
+		rules, _ := readIgnoreFile(pvc.Path, m.ignoreFile)
+		skip := func(path string) bool {
+			if excluded(path, excludes) {
+				return true
+			}
+			rel, err := filepath.Rel(pvc.Path, path)
+			return err == nil && ignored(rules, filepath.ToSlash(rel))
+		}
+		changed, err = changedSince(ctx, paths, last.Started.Add(-changeSlack), skip)
+	case ChangeDetectionDryRun:
+		var client *restic.Client
+		if client, err = m.repositoryFor(ctx, pvc); err == nil {
+			var summary *restic.BackupSummary
+			if summary, err = client.EstimateBackup(ctx, paths, opts); err == nil {
+				changed = summary.FilesNew+summary.FilesChanged+summary.DirsNew+summary.DirsChanged > 0
+			}
+		}
+	}
+	if err != nil {
+		m.log.WithFields(pvcFields(pvc)).Warnf("Failed to detect changes of PVC %s/%s, backing it up: %v", pvc.Namespace, pvc.Name, err)
+		return false
+	}
+	if changed {
+		return false
+	}
+
+	// The snapshot may have been forgotten since, e.g. by retention or a restic command
+	client, err := m.repositoryFor(ctx, pvc)
+	var exists bool
+	if err == nil {
+		exists, err = client.SnapshotExists(ctx, last.Snapshot)
+	}
+	if err != nil {
+		m.log.WithFields(pvcFields(pvc)).Warnf("Failed to look up the last snapshot of PVC %s/%s, backing it up: %v", pvc.Namespace, pvc.Name, err)
+		return false
+	}
+	if !exists {
+		m.log.WithFields(pvcFields(pvc)).Infof("Snapshot %s of PVC %s/%s no longer exists, backing it up", last.Snapshot, pvc.Namespace, pvc.Name)
+		return false
+	}
+
+	m.log.WithFields(pvcFields(pvc)).Infof("PVC %s/%s is unchanged since snapshot %s, skipping backup", pvc.Namespace, pvc.Name, last.Snapshot)
+	m.metrics.Add(metricPVCUnchangedTotal, pvcLabels(pvc), 1)
+	return true
+}
+
+// recordLastBackup records a regular backup of a PVC started at the given time as the
+// baseline of its change detection
+func (m *Manager) recordLastBackup(pvc k8s.PVCInfo, started time.Time, summary *restic.BackupSummary) {
+	if m.changeDetection == ChangeDetectionOff {
+		return
+	}
+
+	paths, opts := m.backupOptions(pvc, pvc.Config.Description, nil)
+	m.lastBackupsMu.Lock()
+	if m.lastBackups == nil {
+		m.lastBackups = m.loadLastBackups()
+	}
+	m.lastBackups[pvc.UID] = lastBackup{Snapshot: summary.SnapshotID, Started: started, Options: backupFingerprint(paths, opts)}
+	err := m.saveLastBackups()
+	m.lastBackupsMu.Unlock()
+	if err != nil {
+		m.log.Warnf("Failed to save change detection state: %v", err)
+	}
+}
+
+// changedSince reports whether a file or directory below the paths changed after the
+// given time, leaving out the paths skip reports. Deleting or renaming a file changes
+// its directory.
+func changedSince(ctx context.Context, paths []string, since time.Time, skip func(path string) bool) (bool, error) {
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if path != root && skip(path) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			if !changeTime(info).Before(since) {
+				return errChanged
+			}
+			return nil
+		})
+		if errors.Is(err, errChanged) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// loadLastBackups reads the change detection state, starting over when it cannot be read
+func (m *Manager) loadLastBackups() map[string]lastBackup {
+	backups := make(map[string]lastBackup)
+	data, err := os.ReadFile(filepath.Join(m.cachePath, changeStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return backups
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &backups)
+	}
+	if err != nil {
+		m.log.Warnf("Failed to read change detection state, backing up every PVC: %v", err)
+		return make(map[string]lastBackup)
+	}
+	return backups
+}
+
+// saveLastBackups writes the change detection state
+func (m *Manager) saveLastBackups() error {
+	data, err := json.Marshal(m.lastBackups)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(m.cachePath, changeStateFile)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,149 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/discovery"
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/notify"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// ValidateConfig checks the backup settings of a configuration the backup manager
+// would otherwise only reject one at a time, returning all problems found
+func ValidateConfig(config *cfg.Config) error {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	backupConfig := config.BackupConfig
+	if backupConfig.BackupInterval <= 0 {
+		check(fmt.Errorf("BACKUP_INTERVAL must be positive, got %v", backupConfig.BackupInterval))
+	}
+	for _, keep := range strings.Split(backupConfig.Retention, ",") {
+		if keep = strings.TrimSpace(keep); keep == "" {
+			continue
+		}
+		if _, err := parseResticDuration(keep); err != nil {
+			check(fmt.Errorf("BACKUP_RETENTION: %v, e.g. 14d or 1y6m", err))
+		}
+	}
+	switch backupConfig.RepoLayout {
+	case cfg.RepoLayoutNode, cfg.RepoLayoutShared, cfg.RepoLayoutPVC:
+	default:
+		check(fmt.Errorf("BACKUP_REPO_LAYOUT must be %s, %s or %s, got %q", cfg.RepoLayoutNode, cfg.RepoLayoutShared, cfg.RepoLayoutPVC, backupConfig.RepoLayout))
+	}
+	if _, err := discovery.NewSource(backupConfig.DiscoveryMode, backupConfig); err != nil {
+		check(fmt.Errorf("BACKUP_DISCOVERY_MODE: %v", err))
+	}
+	if _, err := discovery.NewPathResolver(backupConfig.PathResolver, backupConfig); err != nil {
+		check(fmt.Errorf("BACKUP_PATH_RESOLVER: %v", err))
+	}
+	if _, err := ParsePolicy(backupConfig.Policy); err != nil {
+		check(fmt.Errorf("BACKUP_POLICY: %v", err))
+	}
+	if _, err := ParseQuotas(backupConfig.NamespaceQuotas); err != nil {
+		check(fmt.Errorf("BACKUP_NAMESPACE_QUOTAS: %v", err))
+	}
+	if _, err := ParseClassPolicies(backupConfig.ClassPolicies); err != nil {
+		check(fmt.Errorf("BACKUP_CLASS_POLICIES: %v", err))
+	}
+	if _, err := cfg.ParseSize(backupConfig.RestoreThroughput); err != nil {
+		check(fmt.Errorf("BACKUP_RESTORE_THROUGHPUT: %v", err))
+	}
+	if _, err := cfg.ParseSize(backupConfig.AnomalyMinSize); err != nil {
+		check(fmt.Errorf("BACKUP_ANOMALY_MIN_SIZE: %v", err))
+	}
+	if _, err := cfg.ParseSize(backupConfig.RepoMaxSize); err != nil {
+		check(fmt.Errorf("BACKUP_REPO_MAX_SIZE: %v", err))
+	}
+	if _, err := cfg.ParseSize(config.ResticConfig.CacheMaxSize); err != nil {
+		check(fmt.Errorf("RESTIC_CACHE_MAX_SIZE: %v", err))
+	}
+	if err := restic.CheckCompression(backupConfig.Compression); err != nil {
+		check(fmt.Errorf("BACKUP_COMPRESSION: %v", err))
+	}
+	if err := checkEstimate(backupConfig.Estimate); err != nil {
+		check(fmt.Errorf("BACKUP_ESTIMATE: %v", err))
+	}
+	if err := checkChangeDetection(backupConfig.ChangeDetection); err != nil {
+		check(fmt.Errorf("BACKUP_CHANGE_DETECTION: %v", err))
+	}
+	if _, err := ParseFeatures(backupConfig.Features); err != nil {
+		check(fmt.Errorf("BACKUP_FEATURES: %v", err))
+	}
+	switch backupConfig.StatusResource {
+	case k8s.StatusResourceAuto, k8s.StatusResourceCRD, k8s.StatusResourceConfigMap, k8s.StatusResourceOff:
+	default:
+		check(fmt.Errorf("BACKUP_STATUS_RESOURCE must be %s, %s, %s or %s, got %q", k8s.StatusResourceAuto, k8s.StatusResourceCRD, k8s.StatusResourceConfigMap, k8s.StatusResourceOff, backupConfig.StatusResource))
+	}
+	if (backupConfig.APITLSCertFile == "") != (backupConfig.APITLSKeyFile == "") {
+		check(fmt.Errorf("BACKUP_API_TLS_CERT_FILE and BACKUP_API_TLS_KEY_FILE must be set together"))
+	}
+	if err := CheckAPITLS(backupConfig); err != nil {
+		check(err)
+	}
+	if backupConfig.APIAddr != "" && backupConfig.APIAudience == "" {
+		check(fmt.Errorf("BACKUP_API_AUDIENCE must not be empty, tokens issued for the Kubernetes API would be accepted"))
+	}
+	if backupConfig.DeviceConcurrency < 0 {
+		check(fmt.Errorf("BACKUP_DEVICE_CONCURRENCY must not be negative, got %d", backupConfig.DeviceConcurrency))
+	}
+
+	if err := restic.CheckStorageClass(config.ReplicaConfig.StorageClass); err != nil {
+		check(fmt.Errorf("REPLICA_STORAGE_CLASS: %v", err))
+	}
+	check(restic.CheckEndpoint("REPLICA_ENDPOINT", config.ReplicaConfig.Endpoint))
+	if config.ArtifactConfig.Manifests && config.BackendType != cfg.BackendS3 {
+		check(fmt.Errorf("ARTIFACT_MANIFESTS requires BACKEND_TYPE=%s", cfg.BackendS3))
+	}
+	if config.ReportConfig.Interval > 0 && !config.ReportConfig.Deliverable() {
+		check(fmt.Errorf("REPORT_INTERVAL requires REPORT_WEBHOOK_URL or REPORT_EMAIL_TO"))
+	}
+	if len(config.ReportConfig.Recipients()) > 0 {
+		if _, err := notify.NewMailer(config.SMTPConfig); err != nil {
+			check(fmt.Errorf("REPORT_EMAIL_TO: %v", err))
+		}
+	}
+	sinks, err := notify.ParseSinks(config.NotifyConfig)
+	if err != nil {
+		check(fmt.Errorf("NOTIFY_SINKS: %v", err))
+	}
+	for _, sink := range sinks {
+		switch {
+		case sink == notify.SinkWebhook && config.NotifyConfig.WebhookURL == "":
+			check(fmt.Errorf("NOTIFY_SINKS %s requires NOTIFY_WEBHOOK_URL", sink))
+		case sink == notify.SinkExec && config.NotifyConfig.ExecCommand == "":
+			check(fmt.Errorf("NOTIFY_SINKS %s requires NOTIFY_EXEC_COMMAND", sink))
+		}
+	}
+	switch config.WebhookConfig.ValidateMode {
+	case cfg.WebhookDeny, cfg.WebhookWarn:
+	default:
+		check(fmt.Errorf("WEBHOOK_VALIDATE_MODE must be %s or %s, got %q", cfg.WebhookDeny, cfg.WebhookWarn, config.WebhookConfig.ValidateMode))
+	}
+	switch config.NotifyConfig.Format {
+	case notify.FormatSlack, notify.FormatJSON:
+	default:
+		check(fmt.Errorf("NOTIFY_FORMAT must be %s or %s, got %q", notify.FormatSlack, notify.FormatJSON, config.NotifyConfig.Format))
+	}
+	if _, err := notify.ParseTemplate(config.NotifyConfig.Template); err != nil {
+		check(fmt.Errorf("NOTIFY_TEMPLATE: %v", err))
+	}
+	return errors.Join(errs...)
+}
+
+// CheckAPITLS fails when the REST API would receive bearer tokens over plain HTTP
+// without BACKUP_API_INSECURE acknowledging it
+func CheckAPITLS(backupConfig cfg.BackupConfig) error {
+	if backupConfig.APIAddr != "" && backupConfig.APITLSCertFile == "" && !backupConfig.APIInsecure {
+		return fmt.Errorf("BACKUP_API_ADDR requires BACKUP_API_TLS_CERT_FILE since the bearer tokens are sent with every request, set BACKUP_API_INSECURE to serve plain HTTP behind a proxy terminating TLS")
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// verificationFilename is the name of the file holding the verification output in its snapshot
+const verificationFilename = "verification.txt"
+
+// shellCommand wraps a command line in the shell of the application pods. They run on
+// this node, so they share its OS.
+func shellCommand(command string) []string {
+	if runtime.GOOS == "windows" {
+		return []string{"cmd", "/c", command}
+	}
+	return []string{"sh", "-c", command}
+}
+
+// VerificationError reports a verification that failed, e.g. the verification command
+// of a backup or the snapshot counts of a migration
+type VerificationError struct {
+	Err error
+}
+
+func (e *VerificationError) Error() string {
+	return e.Err.Error()
+}
+
+// verifyBackup runs the verification command of a PVC in the pod mounting it and
+// stores the output (e.g. table counts or a checksum manifest) as a snapshot tagged
+// with the ID of the verified snapshot, so it can be compared after a restore
+func (m *Manager) verifyBackup(ctx context.Context, client *restic.Client, pvc k8s.PVCInfo, snapshotID string) error {
+	if pvc.Config.VerifyCommand == "" {
+		return nil
+	}
+	if pvc.Pod == "" {
+		return fmt.Errorf("no running pod mounts PVC %s/%s to run the verification command in", pvc.Namespace, pvc.Name)
+	}
+
+	m.log.WithFields(pvcFields(pvc)).Infof("Running verification command for PVC %s/%s in pod %s", pvc.Namespace, pvc.Name, pvc.Pod)
+
+	var stdout, stderr bytes.Buffer
+	command := shellCommand(pvc.Config.VerifyCommand)
+	if err := m.k8sClient.ExecInPod(ctx, pvc.Namespace, pvc.Pod, pvc.Config.HookContainer, command, nil, &stdout, &stderr); err != nil {
+		return fmt.Errorf("verification command failed: %v, output: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	opts := restic.BackupOptions{
+		PVCID:     pvc.UID,
+		PVCName:   pvc.Name,
+		Namespace: pvc.Namespace,
+		Tags:      []string{restic.VerificationTag(snapshotID)},
+	}
+	summary, err := client.BackupStdin(ctx, bytes.NewReader(stdout.Bytes()), verificationFilename, opts)
+	if err != nil {
+		return fmt.Errorf("failed to store verification output: %v", err)
+	}
+
+	m.log.Infof("Stored verification output of snapshot %s in snapshot %s", snapshotID, summary.SnapshotID)
+	return nil
+}
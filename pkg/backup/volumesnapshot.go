@@ -0,0 +1,73 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+)
+
+// Volume snapshot methods of the volume-snapshot annotation
+const (
+	VolumeSnapshotAuto  = "auto" // Picked from the filesystem of the PVC
+	VolumeSnapshotLVM   = "lvm"
+	VolumeSnapshotBtrfs = "btrfs"
+	VolumeSnapshotZFS   = "zfs"
+	VolumeSnapshotCSI   = "csi" // A CSI VolumeSnapshot restored into a clone PVC
+)
+
+// volumeSnapshotTools are the commands each volume snapshot method runs in the agent
+// container, which the released image does not ship
+var volumeSnapshotTools = map[string][]string{
+	VolumeSnapshotLVM:   {"lvs", "lvcreate", "lvchange", "lvremove", "mount"},
+	VolumeSnapshotBtrfs: {"btrfs"},
+	VolumeSnapshotZFS:   {"zfs", "mount"},
+}
+
+// checkVolumeSnapshot validates the volume snapshot method of a PVC
+func checkVolumeSnapshot(method string) error {
+	switch strings.ToLower(method) {
+	case VolumeSnapshotAuto, VolumeSnapshotLVM, VolumeSnapshotBtrfs, VolumeSnapshotZFS, VolumeSnapshotCSI:
+		return nil
+	}
+	return fmt.Errorf("unknown volume snapshot method %q, expected auto, lvm, btrfs, zfs or csi", method)
+}
+
+// checkVolumeSnapshots reports at startup the PVCs of the node whose volume snapshot
+// method this agent cannot run, instead of failing their backups one cycle at a time
+func (m *Manager) checkVolumeSnapshots(ctx context.Context) {
+	pvcs, err := m.k8sClient.GetPVCsToBackup(ctx)
+	if err != nil {
+		m.log.Errorf("Failed to check the volume snapshots of PVCs: %v", err)
+		return
+	}
+	for _, pvc := range pvcs {
+		if pvc.Config.VolumeSnapshot == "" {
+			continue
+		}
+		if _, _, err := snapshotMethod(pvc); err != nil {
+			m.log.WithFields(pvcFields(pvc)).Errorf("Backups of PVC %s/%s will fail: %v", pvc.Namespace, pvc.Name, err)
+		}
+	}
+}
+
+// volumeSnapshotName names the snapshot of the volume of a PVC. It is stable, so the
+// snapshot left over by an agent killed during a backup is replaced by the next one.
+func volumeSnapshotName(pvcUID string) string {
+	return "local-pvc-backup-" + pvcUID
+}
+
+// snapshotCSI clones a PVC from a CSI VolumeSnapshot and returns the directory of the
+// clone on this node
+func (m *Manager) snapshotCSI(ctx context.Context, pvc k8s.PVCInfo) (string, func(context.Context) error, error) {
+	opts := m.csiClone
+	opts.SnapshotClass = pvc.Config.VolumeSnapshotClass
+	clone, err := m.k8sClient.CreateCSIClone(ctx, pvc, opts)
+	if err != nil {
+		return "", nil, err
+	}
+	return clone.Path, func(ctx context.Context) error {
+		return m.k8sClient.DeleteCSIClone(ctx, clone)
+	}, nil
+}
@@ -0,0 +1,359 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+)
+
+// mountInfo describes a mount of /proc/self/mountinfo
+type mountInfo struct {
+	Root       string // Directory of the filesystem mounted at the mountpoint
+	Mountpoint string
+	FSType     string
+	Source     string // Device, or dataset for ZFS
+}
+
+// findMount returns the mount holding path
+func findMount(path string) (mountInfo, error) {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return mountInfo{}, err
+	}
+
+	var found mountInfo
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator < 5 || len(fields) < separator+3 {
+			continue
+		}
+		mount := mountInfo{
+			Root:       unescapeMountField(fields[3]),
+			Mountpoint: unescapeMountField(fields[4]),
+			FSType:     fields[separator+1],
+			Source:     unescapeMountField(fields[separator+2]),
+		}
+		if mount.Mountpoint != "/" && path != mount.Mountpoint && !strings.HasPrefix(path, mount.Mountpoint+"/") {
+			continue
+		}
+		// Later mounts on the same mountpoint hide the earlier ones
+		if len(mount.Mountpoint) >= len(found.Mountpoint) {
+			found = mount
+		}
+	}
+	if found.Mountpoint == "" {
+		return mountInfo{}, fmt.Errorf("no mount holds %s", path)
+	}
+	return found, nil
+}
+
+// unescapeMountField decodes the octal escapes of spaces, tabs, newlines and
+// backslashes in a field of /proc/self/mountinfo
+func unescapeMountField(field string) string {
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// pathInMount returns the path of path below the root of the filesystem of a mount
+// mounted at dir
+func pathInMount(mount mountInfo, dir, path string) (string, error) {
+	rel, err := filepath.Rel(mount.Mountpoint, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, mount.Root, rel), nil
+}
+
+// runTool runs a volume manager command, returning its output
+func runTool(ctx context.Context, name string, args ...string) (string, error) {
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// snapshotMethod resolves the volume snapshot method of a PVC on the filesystem of its
+// mount, and checks that the agent container can run it
+func snapshotMethod(pvc k8s.PVCInfo) (string, mountInfo, error) {
+	mount, err := findMount(pvc.Path)
+	if err != nil {
+		return "", mountInfo{}, err
+	}
+	method := strings.ToLower(pvc.Config.VolumeSnapshot)
+	if method == VolumeSnapshotAuto {
+		switch mount.FSType {
+		case VolumeSnapshotBtrfs, VolumeSnapshotZFS:
+			method = mount.FSType
+		default:
+			method = VolumeSnapshotLVM
+		}
+	}
+	if err := checkVolumeSnapshot(method); err != nil {
+		return "", mountInfo{}, err
+	}
+
+	// CSI snapshots are taken by the cluster, the others by the tools of the agent
+	tools := volumeSnapshotTools[method]
+	if len(tools) == 0 {
+		return method, mount, nil
+	}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			return "", mountInfo{}, fmt.Errorf("%s snapshots need %s in the agent image, use the -snapshots image", method, tool)
+		}
+	}
+	privileged, err := hasSysAdmin()
+	if err != nil {
+		return "", mountInfo{}, err
+	}
+	if !privileged {
+		return "", mountInfo{}, fmt.Errorf("%s snapshots need a privileged agent container, deploy deploy/volume-snapshots", method)
+	}
+	return method, mount, nil
+}
+
+// hasSysAdmin reports whether the agent holds CAP_SYS_ADMIN, which mounting snapshots
+// and managing volumes require
+func hasSysAdmin() (bool, error) {
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		value, ok := strings.CutPrefix(line, "CapEff:")
+		if !ok {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse capabilities %q: %v", value, err)
+		}
+		return caps&(1<<21) != 0, nil
+	}
+	return false, fmt.Errorf("no effective capabilities in /proc/self/status")
+}
+
+// snapshotVolume takes a read-only snapshot of the volume of a PVC and mounts it over
+// the PVC directory, until the returned function removes it. The mounts of the agent
+// container are private: the application keeps writing to the live volume while the
+// agent reads the snapshot under the usual path, so snapshots, restores and diffs see
+// the same paths as without volume snapshots.
+func (m *Manager) snapshotVolume(ctx context.Context, pvc k8s.PVCInfo) (func(), error) {
+	method, mount, err := snapshotMethod(pvc)
+	if err != nil {
+		return nil, err
+	}
+
+	name := volumeSnapshotName(pvc.UID)
+	var path string
+	var remove func(context.Context) error
+	switch method {
+	case VolumeSnapshotLVM:
+		path, remove, err = m.snapshotLVM(ctx, mount, name, pvc.Path)
+	case VolumeSnapshotBtrfs:
+		path, remove, err = snapshotBtrfs(ctx, name, pvc.Path)
+	case VolumeSnapshotZFS:
+		path, remove, err = snapshotZFS(ctx, mount, name, pvc.Path)
+	case VolumeSnapshotCSI:
+		path, remove, err = m.snapshotCSI(ctx, pvc)
+	default:
+		err = checkVolumeSnapshot(method)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to take %s snapshot of %s: %v", method, pvc.Path, err)
+	}
+
+	cleanup := context.WithoutCancel(ctx)
+	if err := syscall.Mount(path, pvc.Path, "", syscall.MS_BIND, ""); err != nil {
+		if err := remove(cleanup); err != nil {
+			m.log.Errorf("Failed to remove volume snapshot of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		}
+		return nil, fmt.Errorf("failed to mount snapshot over %s: %v", pvc.Path, err)
+	}
+	m.log.WithFields(pvcFields(pvc)).Infof("Backing up PVC %s/%s from a %s snapshot", pvc.Namespace, pvc.Name, method)
+
+	return func() {
+		if err := syscall.Unmount(pvc.Path, syscall.MNT_DETACH); err != nil {
+			m.log.Errorf("Failed to unmount snapshot from %s: %v", pvc.Path, err)
+		}
+		if err := remove(cleanup); err != nil {
+			m.log.Errorf("Failed to remove volume snapshot of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		}
+	}, nil
+}
+
+// mountSnapshot mounts a snapshot device or dataset read-only in a directory of its own
+func mountSnapshot(ctx context.Context, source, fsType, name string) (string, error) {
+	dir := filepath.Join(os.TempDir(), name)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	// An interrupted backup may have left the snapshot mounted
+	_ = syscall.Unmount(dir, syscall.MNT_DETACH)
+
+	options := "ro"
+	switch fsType {
+	case "xfs":
+		// The snapshot carries the UUID of its origin, and its log cannot be replayed read-only
+		options += ",nouuid,norecovery"
+	case "ext3", "ext4":
+		options += ",noload"
+	}
+	if _, err := runTool(ctx, "mount", "-t", fsType, "-o", options, source, dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// unmountSnapshot unmounts a snapshot mounted by mountSnapshot
+func unmountSnapshot(dir string) error {
+	if err := syscall.Unmount(dir, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount %s: %v", dir, err)
+	}
+	return os.Remove(dir)
+}
+
+// snapshotLVM snapshots the logical volume holding path. Thin volumes get a thin
+// snapshot, others one of BACKUP_LVM_SNAPSHOT_SIZE.
+func (m *Manager) snapshotLVM(ctx context.Context, mount mountInfo, name, path string) (string, func(context.Context) error, error) {
+	output, err := runTool(ctx, "lvs", "--noheadings", "--separator", "|", "-o", "vg_name,lv_name,pool_lv", mount.Source)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s is not a logical volume: %v", mount.Source, err)
+	}
+	fields := strings.Split(strings.TrimSpace(output), "|")
+	if len(fields) != 3 {
+		return "", nil, fmt.Errorf("unexpected lvs output for %s: %q", mount.Source, output)
+	}
+	group, volume, pool := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1]), strings.TrimSpace(fields[2])
+	snapshot := group + "/" + name
+	remove := func(ctx context.Context) error {
+		_, err := runTool(ctx, "lvremove", "--force", snapshot)
+		return err
+	}
+	exists := func() bool {
+		_, err := runTool(ctx, "lvs", snapshot)
+		return err == nil
+	}
+	if err := removeLeftover(ctx, exists, remove); err != nil {
+		return "", nil, err
+	}
+
+	args := []string{"--snapshot", "--name", name}
+	switch {
+	case pool != "":
+		// Thin snapshots are skipped on activation unless told otherwise
+		args = append(args, "--setactivationskip", "n")
+	case strings.HasSuffix(strings.ToUpper(m.lvmSnapshotSize), "%ORIGIN"):
+		args = append(args, "--extents", m.lvmSnapshotSize)
+	default:
+		args = append(args, "--size", m.lvmSnapshotSize)
+	}
+	if _, err := runTool(ctx, "lvcreate", append(args, group+"/"+volume)...); err != nil {
+		return "", nil, err
+	}
+
+	if pool != "" {
+		if _, err := runTool(ctx, "lvchange", "--activate", "y", snapshot); err != nil {
+			return "", nil, errors.Join(err, remove(ctx))
+		}
+	}
+	dir, err := mountSnapshot(ctx, "/dev/"+snapshot, mount.FSType, name)
+	if err != nil {
+		return "", nil, errors.Join(err, remove(ctx))
+	}
+	release := func(ctx context.Context) error {
+		return errors.Join(unmountSnapshot(dir), remove(ctx))
+	}
+	snapshotPath, err := pathInMount(mount, dir, path)
+	if err != nil {
+		return "", nil, errors.Join(err, release(ctx))
+	}
+	return snapshotPath, release, nil
+}
+
+// removeLeftover removes a snapshot of the same name left over by an agent killed
+// during a backup, which would make taking the new snapshot fail. The removal is
+// attempted blindly, its error only matters when the snapshot exists.
+func removeLeftover(ctx context.Context, exists func() bool, remove func(context.Context) error) error {
+	if err := remove(ctx); err != nil && exists() {
+		return fmt.Errorf("failed to remove leftover snapshot: %v", err)
+	}
+	return nil
+}
+
+// snapshotBtrfs snapshots the subvolume of a PVC next to it
+func snapshotBtrfs(ctx context.Context, name, path string) (string, func(context.Context) error, error) {
+	snapshot := filepath.Join(filepath.Dir(path), "."+name)
+	remove := func(ctx context.Context) error {
+		_, err := runTool(ctx, "btrfs", "subvolume", "delete", snapshot)
+		return err
+	}
+	exists := func() bool {
+		_, err := os.Stat(snapshot)
+		return err == nil
+	}
+	if err := removeLeftover(ctx, exists, remove); err != nil {
+		return "", nil, err
+	}
+	if _, err := runTool(ctx, "btrfs", "subvolume", "snapshot", "-r", path, snapshot); err != nil {
+		return "", nil, fmt.Errorf("only PVCs stored in a subvolume of their own can be snapshotted: %v", err)
+	}
+	return snapshot, remove, nil
+}
+
+// snapshotZFS snapshots the dataset holding path
+func snapshotZFS(ctx context.Context, mount mountInfo, name, path string) (string, func(context.Context) error, error) {
+	snapshot := mount.Source + "@" + name
+	remove := func(ctx context.Context) error {
+		_, err := runTool(ctx, "zfs", "destroy", snapshot)
+		return err
+	}
+	exists := func() bool {
+		_, err := runTool(ctx, "zfs", "list", "-t", "snapshot", snapshot)
+		return err == nil
+	}
+	if err := removeLeftover(ctx, exists, remove); err != nil {
+		return "", nil, err
+	}
+	if _, err := runTool(ctx, "zfs", "snapshot", snapshot); err != nil {
+		return "", nil, err
+	}
+	dir, err := mountSnapshot(ctx, snapshot, "zfs", name)
+	if err != nil {
+		return "", nil, errors.Join(err, remove(ctx))
+	}
+	release := func(ctx context.Context) error {
+		return errors.Join(unmountSnapshot(dir), remove(ctx))
+	}
+	snapshotPath, err := pathInMount(mount, dir, path)
+	if err != nil {
+		return "", nil, errors.Join(err, release(ctx))
+	}
+	return snapshotPath, release, nil
+}
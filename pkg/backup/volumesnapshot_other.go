@@ -0,0 +1,23 @@
+//go:build !linux
+
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+)
+
+// snapshotMethod is only supported on Linux
+func snapshotMethod(pvc k8s.PVCInfo) (string, mountInfo, error) {
+	return "", mountInfo{}, fmt.Errorf("volume snapshots are only supported on Linux")
+}
+
+// mountInfo is only read on Linux
+type mountInfo struct{}
+
+// snapshotVolume is only supported on Linux
+func (m *Manager) snapshotVolume(ctx context.Context, pvc k8s.PVCInfo) (func(), error) {
+	return nil, fmt.Errorf("volume snapshots are only supported on Linux")
+}
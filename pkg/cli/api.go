@@ -0,0 +1,38 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/api"
+	"github.com/monlor/local-pvc-backup/pkg/backup"
+)
+
+// serveAPI serves the REST API of the agent until ctx is cancelled
+func serveAPI(ctx context.Context, manager *backup.Manager) {
+	server := &http.Server{
+		Addr:              cfg.BackupConfig.APIAddr,
+		Handler:           api.New(ctx, manager, k8sClient, cfg.BackupConfig.APIAudience, log).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	var err error
+	if cfg.BackupConfig.APITLSCertFile != "" {
+		log.Infof("Serving API on %s with TLS", server.Addr)
+		err = server.ListenAndServeTLS(cfg.BackupConfig.APITLSCertFile, cfg.BackupConfig.APITLSKeyFile)
+	} else {
+		log.Warnf("Serving API on %s over plain HTTP, BACKUP_API_INSECURE is set", server.Addr)
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("API server error: %v", err)
+	}
+}
@@ -0,0 +1,1019 @@
+// Package cli implements the local-pvc-backup command line. Custom builds registering
+// their own discovery sources or path resolvers call Execute from their main package.
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/backup"
+	"github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/logging"
+	"github.com/monlor/local-pvc-backup/pkg/metrics"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+	"github.com/monlor/local-pvc-backup/pkg/storage"
+	"github.com/monlor/local-pvc-backup/pkg/tracing"
+	"github.com/monlor/local-pvc-backup/pkg/version"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cfg          *config.Config
+	configPath   string            // Config file given with --config, empty when unset
+	fileSettings map[string]string // Settings read from the config file
+	log          *logrus.Logger
+	k8sClient    *k8s.Client
+	resticClient *restic.Client
+	root         = &cobra.Command{
+		Use:   "local-pvc-backup",
+		Short: "Local PVC backup tool",
+		Long:  `A tool for backing up local PVCs using restic`,
+	}
+)
+
+// setup loads the configuration. It runs from Execute rather than an init function, so
+// discovery plugins are registered by then.
+func setup(configFile string) {
+	// Initialize logger
+	log = logrus.New()
+	log.SetFormatter(&logrus.TextFormatter{
+		FullTimestamp: true,
+	})
+
+	// Load configuration from the config file, overridden by environment variables
+	var err error
+	cfg, fileSettings, err = config.Load(configFile)
+	if err != nil {
+		failWith(exitConfig, "%v", err)
+	}
+	configPath = configFile
+	setLogLevel(cfg.BackupConfig.LogLevel)
+	if err := logging.SetFormat(log, cfg.BackupConfig.LogFormat, os.Getenv("KUBERNETES_NODE_NAME")); err != nil {
+		failWith(exitConfig, "%v", err)
+	}
+	if cfg.BackupConfig.LogFile != "" {
+		maxSize, err := config.ParseSize(cfg.BackupConfig.LogFileMaxSize)
+		if err != nil {
+			failWith(exitConfig, "Invalid log file size: %v", err)
+		}
+		file, err := logging.OpenRotatingFile(cfg.BackupConfig.LogFile, int64(maxSize), cfg.BackupConfig.LogFileMaxFiles)
+		if err != nil {
+			// The logs still reach the container output
+			log.Warnf("Not writing logs to %s: %v", cfg.BackupConfig.LogFile, err)
+		} else {
+			log.SetOutput(io.MultiWriter(os.Stderr, file))
+		}
+	}
+
+	// Mask the credentials of the configuration in the logs, even at debug level
+	redact := logging.NewRedactHook()
+	settings, err := config.Settings(fileSettings)
+	if err != nil {
+		failWith(exitConfig, "%v", err)
+	}
+	for _, setting := range settings {
+		if config.SecretSetting(setting.Name) {
+			redact.Add(setting.Value)
+		}
+	}
+	log.AddHook(redact)
+}
+
+// setupClients creates the clients used by the commands, run before any command except
+// the config commands, which work without a cluster or repository
+func setupClients() {
+	var err error
+
+	// Initialize k8s client
+	k8sClient, err = k8s.NewClient(cfg.BackupConfig, log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create k8s client: %v", err)
+	}
+
+	// Initialize restic client
+	resticClient, err = restic.NewClient(cfg, k8sClient.GetNodeName(), log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create restic client: %v", err)
+	}
+}
+
+// Execute runs the command line
+func Execute() {
+	// The config file is needed before cobra parses the flags of the commands
+	configFile, args := configFlag(os.Args[1:])
+	root.SetArgs(args)
+	root.PersistentFlags().String("config", "", "YAML config file, environment variables override its settings")
+	root.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		setupClients()
+	}
+	setup(configFile)
+
+	// Add run command
+	var runOnce, runDryRun bool
+	runCmd := &cobra.Command{
+		Use:   "run",
+		Short: "Run the backup service",
+		Run: func(cmd *cobra.Command, args []string) {
+			if runDryRun {
+				runPlanCommand(false)
+				return
+			}
+			runBackupService(runOnce)
+		},
+	}
+	runCmd.Flags().BoolVar(&runOnce, "once", false, "Perform a single backup cycle and exit, e.g. in a CronJob")
+	runCmd.Flags().BoolVar(&runDryRun, "dry-run", false, "Print the backups a cycle would take, like the plan command, and exit")
+
+	// Add restic command
+	resticCmd := &cobra.Command{
+		Use:                "restic [restic command]",
+		Short:              "Execute restic command with injected environment variables",
+		Long:               "Execute restic command with all environment variables from configuration",
+		DisableFlagParsing: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 0 {
+				failWith(exitConfig, "Please provide a restic command")
+			}
+			runResticCommand(args)
+		},
+	}
+
+	// Add backup command
+	var backupNamespace, backupPVC, backupDescription string
+	backupCmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Back up a PVC on this node now",
+		Long:  "Perform an on-demand backup of a PVC enabled for backup on this node, optionally tagged with a description",
+		Run: func(cmd *cobra.Command, args []string) {
+			runOnDemandBackup(backupNamespace, backupPVC, backupDescription)
+		},
+	}
+	backupCmd.Flags().StringVarP(&backupNamespace, "namespace", "n", "default", "Namespace of the PVC")
+	backupCmd.Flags().StringVar(&backupPVC, "pvc", "", "Name of the PVC")
+	backupCmd.Flags().StringVar(&backupDescription, "description", "", "Description stored with the snapshot, e.g. \"pre-upgrade v2.3\"")
+	backupCmd.MarkFlagRequired("pvc")
+
+	// Add seed command
+	seedOpts := &seedOptions{}
+	seedCmd := &cobra.Command{
+		Use:   "seed",
+		Short: "Perform the first full backup of the PVCs on this node",
+		Long:  "Back up the PVCs on this node one at a time with a bandwidth cap, reporting progress after each PVC. Seeded PVCs are recorded in a checkpoint file, so an interrupted seed resumes with the next PVC when run again",
+		Run: func(cmd *cobra.Command, args []string) {
+			runSeedCommand(seedOpts)
+		},
+	}
+	seedCmd.Flags().StringVar(&seedOpts.limitUpload, "limit-upload", "", "Upload bandwidth per second, e.g. \"50MiB\" (default: the backup policy)")
+	seedCmd.Flags().StringVar(&seedOpts.checkpoint, "checkpoint", "", "Checkpoint file (default: seed-checkpoint.json in RESTIC_CACHE_DIR)")
+	seedCmd.Flags().BoolVar(&seedOpts.restart, "restart", false, "Discard the checkpoint and seed every PVC again")
+
+	// Add restore and rollback commands
+	restoreOpts := &restoreOptions{}
+	restoreCmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore a PVC on this node from a snapshot",
+		Long:  "Restore a snapshot of a PVC, by ID or as it was at --at. In-place restores first take a safety snapshot of the current data so they can be undone with rollback. With --selector the latest snapshots of all matching PVCs on this node are restored, in StatefulSet ordinal order",
+		Run: func(cmd *cobra.Command, args []string) {
+			runRestoreCommand(restoreOpts)
+		},
+	}
+	restoreCmd.Flags().StringVarP(&restoreOpts.namespace, "namespace", "n", "default", "Namespace of the PVC")
+	restoreCmd.Flags().StringVar(&restoreOpts.pvc, "pvc", "", "Name of the PVC")
+	restoreCmd.Flags().StringVarP(&restoreOpts.selector, "selector", "l", "", "Label selector of the PVCs to restore instead of --pvc, e.g. app=shop")
+	restoreCmd.Flags().StringVar(&restoreOpts.snapshot, "snapshot", "", "ID of the snapshot to restore")
+	restoreCmd.Flags().StringVar(&restoreOpts.at, "at", "", "Restore the latest snapshot taken at or before this time (default: now)")
+	restoreCmd.Flags().StringVar(&restoreOpts.target, "target", "", "Directory to restore into, with a subdirectory per PVC for --selector (default: the PVC directory, in place)")
+	restoreCmd.Flags().BoolVar(&restoreOpts.delete, "delete", false, "Delete files missing from the snapshot")
+	restoreCmd.Flags().BoolVar(&restoreOpts.verify, "verify", false, "Check the type, size and modification time of the restored files against the snapshot")
+	restoreCmd.MarkFlagsOneRequired("pvc", "selector")
+	restoreCmd.MarkFlagsMutuallyExclusive("pvc", "selector")
+	restoreCmd.MarkFlagsMutuallyExclusive("snapshot", "selector")
+
+	var rollbackNamespace, rollbackPVC string
+	var rollbackDelete bool
+	rollbackCmd := &cobra.Command{
+		Use:   "rollback",
+		Short: "Undo the last in-place restore of a PVC on this node",
+		Long:  "Restore the safety snapshot taken before the last in-place restore of a PVC",
+		Run: func(cmd *cobra.Command, args []string) {
+			runRollbackCommand(rollbackNamespace, rollbackPVC, rollbackDelete)
+		},
+	}
+	rollbackCmd.Flags().StringVarP(&rollbackNamespace, "namespace", "n", "default", "Namespace of the PVC")
+	rollbackCmd.Flags().StringVar(&rollbackPVC, "pvc", "", "Name of the PVC")
+	rollbackCmd.Flags().BoolVar(&rollbackDelete, "delete", false, "Delete files missing from the safety snapshot")
+	rollbackCmd.MarkFlagRequired("pvc")
+
+	// Add check command
+	var checkReadDataSubset string
+	checkCmd := &cobra.Command{
+		Use:   "check",
+		Short: "Check the repositories of the PVCs on this node",
+		Long:  "Run restic check on the repositories of the PVCs on this node, reading a subset of their data with --read-data-subset",
+		Run: func(cmd *cobra.Command, args []string) {
+			runCheckCommand(checkReadDataSubset)
+		},
+	}
+	checkCmd.Flags().StringVar(&checkReadDataSubset, "read-data-subset", "", "Subset of the data to read and verify, e.g. \"5%\" or \"1/10\" (default: none, only the structure is checked)")
+
+	// Add ls and du commands
+	lsOpts := &browseOptions{}
+	lsCmd := &cobra.Command{
+		Use:   "ls [path...]",
+		Short: "List the files of a PVC as they were at a given time",
+		Long:  "Resolve the latest snapshot of a PVC taken at or before --at and list its files",
+		Run: func(cmd *cobra.Command, args []string) {
+			runLsCommand(lsOpts, args)
+		},
+	}
+	lsOpts.addFlags(lsCmd)
+
+	duOpts := &browseOptions{}
+	duCmd := &cobra.Command{
+		Use:   "du [path]",
+		Short: "Show the disk usage of a PVC as it was at a given time",
+		Long:  "Resolve the latest snapshot of a PVC taken at or before --at and summarize the size of each entry",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			runDuCommand(duOpts, args)
+		},
+	}
+	duOpts.addFlags(duCmd)
+
+	// Add diff command
+	diffOpts := &diffOptions{}
+	diffCmd := &cobra.Command{
+		Use:   "diff",
+		Short: "Compare a snapshot of a PVC on this node with its current data",
+		Long:  "Report the files added, modified or deleted since a snapshot, by ID or as it was at --at, without restoring it. Useful before a restore and to spot unexpected mass changes",
+		Run: func(cmd *cobra.Command, args []string) {
+			runDiffCommand(diffOpts)
+		},
+	}
+	diffCmd.Flags().StringVarP(&diffOpts.namespace, "namespace", "n", "default", "Namespace of the PVC")
+	diffCmd.Flags().StringVar(&diffOpts.pvc, "pvc", "", "Name of the PVC")
+	diffCmd.Flags().StringVar(&diffOpts.snapshot, "snapshot", "", "ID of the snapshot to compare")
+	diffCmd.Flags().StringVar(&diffOpts.at, "at", "", "Compare the latest snapshot taken at or before this time (default: now)")
+	diffCmd.Flags().BoolVar(&diffOpts.summary, "summary", false, "Only print the number of changed files")
+	diffCmd.MarkFlagRequired("pvc")
+
+	// Add snapshots command
+	var snapshotsNamespace, snapshotsPVC string
+	var snapshotsJSON bool
+	snapshotsCmd := &cobra.Command{
+		Use:   "snapshots",
+		Short: "List the snapshots of a PVC on this node",
+		Run: func(cmd *cobra.Command, args []string) {
+			runSnapshotsCommand(snapshotsNamespace, snapshotsPVC, snapshotsJSON)
+		},
+	}
+	snapshotsCmd.Flags().StringVarP(&snapshotsNamespace, "namespace", "n", "default", "Namespace of the PVC")
+	snapshotsCmd.Flags().StringVar(&snapshotsPVC, "pvc", "", "Name of the PVC")
+	snapshotsCmd.Flags().BoolVar(&snapshotsJSON, "json", false, "Print the snapshots as JSON")
+	snapshotsCmd.MarkFlagRequired("pvc")
+
+	// Add migrate command
+	migrateOpts := backup.MigrateOptions{}
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Migrate per-node repositories into a single shared repository",
+		Long:  "Copy the snapshots of all node-* repositories into the shared repository, verify them and switch the agents to BACKUP_REPO_LAYOUT=shared",
+		Run: func(cmd *cobra.Command, args []string) {
+			if cfg.BackendType != config.BackendS3 {
+				failWith(exitConfig, "Migration is only supported with the %s backend", config.BackendS3)
+			}
+			storageClient, err := storage.NewClient(cfg.S3Config, cfg.ResticConfig.ProxyConfig, log)
+			if err != nil {
+				failWith(exitConfig, "Failed to create S3 client: %v", err)
+			}
+			if err := backup.MigrateToSharedRepository(context.Background(), resticClient, storageClient, k8sClient, migrateOpts, log); err != nil {
+				fail("Migration failed: %v", err)
+			}
+		},
+	}
+	migrateCmd.Flags().BoolVar(&migrateOpts.DryRun, "dry-run", false, "Only print the repositories that would be migrated")
+	migrateCmd.Flags().StringVar(&migrateOpts.DaemonSetName, "daemonset", "local-pvc-backup", "DaemonSet of the agents to switch over, empty to skip")
+	migrateCmd.Flags().StringVar(&migrateOpts.DaemonSetNamespace, "daemonset-namespace", "default", "Namespace of the agents DaemonSet")
+
+	// Add rollout-status command
+	rolloutOpts := &rolloutOptions{}
+	rolloutCmd := &cobra.Command{
+		Use:   "rollout-status",
+		Short: "Show the version and health reported by the agents",
+		Long:  "List the version and last backup cycle reported by each agent. With --version, exit with an error until the selected nodes run that version and completed a successful backup cycle with it",
+		Run: func(cmd *cobra.Command, args []string) {
+			runRolloutStatusCommand(rolloutOpts)
+		},
+	}
+	rolloutCmd.Flags().StringVar(&rolloutOpts.version, "version", "", "Version the selected nodes must run")
+	rolloutCmd.Flags().StringSliceVar(&rolloutOpts.nodes, "nodes", nil, "Nodes to check, e.g. the canary nodes (default: all reporting nodes)")
+
+	// Add report command
+	var reportSend, reportJSON bool
+	reportCmd := &cobra.Command{
+		Use:   "report",
+		Short: "Summarize the backup protection of the cluster",
+		Long:  "Summarize the local PVCs with and without a backup since the last report, the repository growth and the failed backups by namespace. With --send, post it to REPORT_WEBHOOK_URL, email it to REPORT_EMAIL_TO and record it as the last report",
+		Run: func(cmd *cobra.Command, args []string) {
+			runReportCommand(reportSend, reportJSON)
+		},
+	}
+	reportCmd.Flags().BoolVar(&reportSend, "send", false, "Post the report to REPORT_WEBHOOK_URL and email it to REPORT_EMAIL_TO")
+	reportCmd.Flags().BoolVar(&reportJSON, "json", false, "Print the report as JSON")
+
+	// Add plan command
+	var planJSON bool
+	planCmd := &cobra.Command{
+		Use:   "plan",
+		Short: "Print the backups this node would take",
+		Long:  "Print the PVCs on this node the backup cycles would back up, with their paths, include and exclude patterns, snapshot tags and schedules, without contacting the repository. Useful to validate annotation changes",
+		Run: func(cmd *cobra.Command, args []string) {
+			runPlanCommand(planJSON)
+		},
+	}
+	planCmd.Flags().BoolVar(&planJSON, "json", false, "Print the plan as JSON")
+
+	root.AddCommand(runCmd)
+	root.AddCommand(resticCmd)
+	root.AddCommand(backupCmd)
+	root.AddCommand(seedCmd)
+	root.AddCommand(restoreCmd)
+	root.AddCommand(rollbackCmd)
+	root.AddCommand(checkCmd)
+	root.AddCommand(lsCmd)
+	root.AddCommand(duCmd)
+	root.AddCommand(diffCmd)
+	root.AddCommand(snapshotsCmd)
+	root.AddCommand(migrateCmd)
+	root.AddCommand(rolloutCmd)
+	root.AddCommand(reportCmd)
+	root.AddCommand(planCmd)
+	root.AddCommand(newTenantCommand())
+	root.AddCommand(newHoldCommand())
+	root.AddCommand(newStateCommand())
+	root.AddCommand(newKeysCommand())
+	root.AddCommand(newConfigCommand())
+	root.AddCommand(newControllerCommand())
+	root.AddCommand(newWebhookCommand())
+
+	// Wrappers offering the tenant commands hold the repository credentials, the other
+	// commands, e.g. the restic passthrough, would bypass the tenant checks
+	if cfg.BackupConfig.TenantMode {
+		if cmd, _, err := root.Find(args); err == nil && !tenantCommand(cmd) {
+			failWith(exitConfig, "Only the tenant commands are available with BACKUP_TENANT_MODE")
+		}
+	}
+
+	// Cobra reports invalid commands and flags
+	if err := root.Execute(); err != nil {
+		failWith(exitConfig, "%v", err)
+	}
+}
+
+// configFlag extracts the --config flag from the arguments, returning its value and the
+// other arguments
+func configFlag(args []string) (string, []string) {
+	var file string
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--config" && i+1 < len(args):
+			file = args[i+1]
+			i++
+		case strings.HasPrefix(args[i], "--config="):
+			file = strings.TrimPrefix(args[i], "--config=")
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return file, rest
+}
+
+func runBackupService(once bool) {
+	registry := serveDiagnostics()
+
+	// Prepare the bucket before restic initializes the repository in it
+	if cfg.BackendType == config.BackendS3 && (cfg.S3Config.CreateBucket || cfg.S3Config.Versioning || cfg.S3Config.SSE != "") {
+		if err := ensureBucket(); err != nil {
+			fail("Failed to prepare bucket: %v", err)
+		}
+	}
+
+	// Create backup manager
+	manager, err := backup.NewManager(cfg, k8sClient, resticClient, registry, log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create backup manager: %v", err)
+	}
+
+	// Trace the backup cycles when a collector is configured
+	tracer, err := tracing.New(cfg.TracingConfig, k8sClient.GetNodeName(), cfg.BackupConfig.ProxyConfig, log)
+	if err != nil {
+		failWith(exitConfig, "Failed to set up tracing: %v", err)
+	}
+	defer shutdownTracer(tracer)
+
+	// Create context with cancellation
+	ctx, cancel := context.WithCancel(tracing.WithTracer(context.Background(), tracer))
+	defer cancel()
+
+	// Handle shutdown signals
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigChan
+		log.Infof("Received shutdown signal: %v", sig)
+		cancel()
+	}()
+
+	if once {
+		if err := manager.RunOnce(ctx); err != nil {
+			shutdownTracer(tracer)
+			fail("Backup cycle failed: %v", err)
+		}
+		return
+	}
+
+	if configPath != "" {
+		go watchConfig(ctx, manager)
+	}
+	if cfg.BackupConfig.APIAddr != "" {
+		if err := backup.CheckAPITLS(cfg.BackupConfig); err != nil {
+			failWith(exitConfig, "%v", err)
+		}
+		go serveAPI(ctx, manager)
+	}
+
+	// Start backup loop
+	log.Infof("Starting backup service %s...", version.Version)
+	if err := manager.StartBackupLoop(ctx); err != nil {
+		shutdownTracer(tracer)
+		fail("Backup service error: %v", err)
+	}
+}
+
+// serveDiagnostics creates the metrics registry, serving it and the profiling
+// endpoints when configured
+func serveDiagnostics() *metrics.Registry {
+	registry := metrics.NewRegistry()
+	if cfg.BackupConfig.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry.Handler())
+		go func() {
+			log.Infof("Serving metrics on %s", cfg.BackupConfig.MetricsAddr)
+			if err := http.ListenAndServe(cfg.BackupConfig.MetricsAddr, mux); err != nil {
+				log.Errorf("Metrics server error: %v", err)
+			}
+		}()
+	}
+	if cfg.BackupConfig.PprofAddr != "" {
+		go serveProfiling(cfg.BackupConfig.PprofAddr)
+	}
+	return registry
+}
+
+// shutdownTracer exports the remaining spans before the agent exits
+func shutdownTracer(tracer *tracing.Tracer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tracer.Shutdown(ctx)
+}
+
+// ensureBucket validates the access to the S3 bucket, creates it when missing and
+// applies its versioning and encryption settings
+func ensureBucket() error {
+	if cfg.S3Config.Anonymous {
+		return fmt.Errorf("S3_CREATE_BUCKET, S3_VERSIONING and S3_SSE require credentials, unset S3_ANONYMOUS")
+	}
+	storageClient, err := storage.NewClient(cfg.S3Config, cfg.ResticConfig.ProxyConfig, log)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return storageClient.EnsureBucket(ctx, storage.BucketOptions{
+		Create:     cfg.S3Config.CreateBucket,
+		Versioning: cfg.S3Config.Versioning,
+		Encryption: cfg.S3Config.SSE,
+		KMSKeyID:   cfg.S3Config.SSEKMSKeyID,
+	})
+}
+
+func runOnDemandBackup(namespace, pvcName, description string) {
+	manager, err := backup.NewManager(cfg, k8sClient, resticClient, metrics.NewRegistry(), log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create backup manager: %v", err)
+	}
+
+	if err := manager.BackupPVC(context.Background(), namespace, pvcName, description); err != nil {
+		fail("Backup failed: %v", err)
+	}
+}
+
+// seedOptions holds the flags of the seed command
+type seedOptions struct {
+	limitUpload string
+	checkpoint  string
+	restart     bool
+}
+
+func runSeedCommand(opts *seedOptions) {
+	limit, err := config.ParseSize(opts.limitUpload)
+	if err != nil {
+		failWith(exitConfig, "Invalid upload limit: %v", err)
+	}
+	checkpoint := opts.checkpoint
+	if checkpoint == "" {
+		checkpoint = filepath.Join(cfg.ResticConfig.CachePath, backup.SeedCheckpointFile)
+	}
+
+	manager, err := backup.NewManager(cfg, k8sClient, resticClient, metrics.NewRegistry(), log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create backup manager: %v", err)
+	}
+
+	err = manager.Seed(context.Background(), backup.SeedOptions{
+		Checkpoint:  checkpoint,
+		LimitUpload: limit,
+		Restart:     opts.restart,
+	}, printSeedProgress)
+	if err != nil {
+		fail("Seed interrupted, run it again to resume: %v", err)
+	}
+	fmt.Println("Seed complete")
+}
+
+// printSeedProgress prints a seeded PVC with the throughput of the seed so far
+func printSeedProgress(p backup.SeedProgress) {
+	name := fmt.Sprintf("%s/%s", p.PVC.Namespace, p.PVC.Name)
+	if p.Resumed {
+		fmt.Printf("[%d/%d] %s: already seeded\n", p.Index, p.Total, name)
+		return
+	}
+
+	rate := uint64(0)
+	if seconds := p.Elapsed.Seconds(); seconds > 0 {
+		rate = uint64(float64(p.Bytes) / seconds)
+	}
+	fmt.Printf("[%d/%d] %s: snapshot %s, %s processed, %s added in %v (seed: %s in %v, %s/s)\n",
+		p.Index, p.Total, name, p.Summary.SnapshotID,
+		backup.FormatBytes(p.Summary.TotalBytesProcessed), backup.FormatBytes(p.Summary.DataAdded), p.Summary.Duration().Round(time.Second),
+		backup.FormatBytes(p.Bytes), p.Elapsed.Round(time.Second), backup.FormatBytes(rate))
+}
+
+// restoreOptions holds the flags of the restore command
+type restoreOptions struct {
+	namespace string
+	pvc       string
+	selector  string
+	snapshot  string
+	at        string
+	target    string
+	delete    bool
+	verify    bool
+}
+
+func runRestoreCommand(opts *restoreOptions) {
+	at, err := backup.ParseTime(opts.at)
+	if err != nil {
+		failWith(exitConfig, "%v", err)
+	}
+
+	manager, err := backup.NewManager(cfg, k8sClient, resticClient, metrics.NewRegistry(), log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create backup manager: %v", err)
+	}
+
+	restoreOpts := backup.RestoreOptions{
+		SnapshotID: opts.snapshot,
+		At:         at,
+		Target:     opts.target,
+		Delete:     opts.delete,
+		Verify:     opts.verify,
+	}
+	if opts.selector != "" {
+		restored := 0
+		err := manager.RestoreSelector(context.Background(), opts.namespace, opts.selector, restoreOpts, func(r backup.BatchRestoreResult) {
+			switch {
+			case r.Skipped != "":
+				fmt.Printf("%s: skipped, %s\n", r.Name, r.Skipped)
+			case r.Err == nil:
+				restored++
+				fmt.Printf("%s: ", r.Name)
+				printRestoreResult(opts.namespace, r.Name, r.Result)
+			}
+		})
+		if err != nil && restored > 0 {
+			failWith(exitPartial, "Restore failed after restoring %d PVCs: %v", restored, err)
+		}
+		if err != nil {
+			fail("Restore failed: %v", err)
+		}
+		return
+	}
+
+	result, err := manager.Restore(context.Background(), opts.namespace, opts.pvc, restoreOpts)
+	if err != nil {
+		fail("Restore failed: %v", err)
+	}
+	printRestoreResult(opts.namespace, opts.pvc, result)
+}
+
+func runRollbackCommand(namespace, pvcName string, delete bool) {
+	manager, err := backup.NewManager(cfg, k8sClient, resticClient, metrics.NewRegistry(), log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create backup manager: %v", err)
+	}
+
+	result, err := manager.Rollback(context.Background(), namespace, pvcName, delete)
+	if err != nil {
+		fail("Rollback failed: %v", err)
+	}
+	printRestoreResult(namespace, pvcName, result)
+}
+
+func runCheckCommand(readDataSubset string) {
+	manager, err := backup.NewManager(cfg, k8sClient, resticClient, metrics.NewRegistry(), log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create backup manager: %v", err)
+	}
+
+	err = manager.CheckRepositories(context.Background(), readDataSubset, func(c backup.RepositoryCheck) {
+		switch {
+		case c.Skipped != "":
+			fmt.Printf("%s: skipped, %s\n", c.Repository, c.Skipped)
+		case c.Err != nil:
+			fmt.Printf("%s: failed\n", c.Repository)
+		default:
+			fmt.Printf("%s: ok\n", c.Repository)
+		}
+	})
+	if err != nil {
+		fail("Repository check failed: %v", err)
+	}
+}
+
+// printRestoreResult prints the restored snapshot and the safety snapshot paired with it
+func printRestoreResult(namespace, pvcName string, result *backup.RestoreResult) {
+	fmt.Printf("Restored snapshot %s taken at %s into %s\n",
+		result.Snapshot.ShortID, result.Snapshot.Time.Local().Format(time.RFC3339), result.Target)
+	if result.SafetySnapshotID == "" {
+		return
+	}
+	fmt.Printf("Safety snapshot of the previous data: %s\n", result.SafetySnapshotID)
+	fmt.Printf("Undo with: local-pvc-backup rollback -n %s --pvc %s\n", namespace, pvcName)
+}
+
+func runResticCommand(args []string) {
+	// Select the repository of a PVC with a leading --pvc namespace/name
+	client := resticClient
+	if len(args) >= 2 && args[0] == "--pvc" {
+		namespace, name, ok := strings.Cut(args[1], "/")
+		if !ok {
+			log.Fatalf("Invalid PVC %s, expected namespace/name", args[1])
+		}
+		client = resticClient.ForPVC(namespace, name)
+		args = args[2:]
+	} else if resticClient.Sharded() {
+		log.Fatal("Sharded repositories require selecting a PVC, e.g. restic --pvc namespace/name snapshots")
+	}
+
+	// Create restic command
+	cmd := exec.Command("restic", append(client.Flags(), args...)...)
+
+	// Set environment variables from config
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, fmt.Sprintf("RESTIC_REPOSITORY=%s", client.GetRepository()))
+	env, err := client.Env(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	cmd.Env = append(cmd.Env, env...)
+
+	// Set command output to current process output
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// Coordinate with the backup service running against the same repository
+	command, err := restic.Subcommand(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if command == "forget" || command == "prune" {
+		if err := backup.CheckHold(context.Background(), k8sClient, cfg.BackupConfig.LeaseNamespace); err != nil {
+			log.Fatal(err)
+		}
+	}
+	unlock, err := client.Lock(context.Background(), restic.IsExclusiveCommand(command))
+	if err != nil {
+		log.Fatalf("Failed to lock repository: %v", err)
+	}
+	defer unlock()
+
+	// Run the command, passing the exit code of restic on as one of ours
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			unlock()
+			os.Exit(resticExitCode(exitErr.ExitCode()))
+		}
+		log.Fatalf("Failed to execute restic command: %v", err)
+	}
+}
+
+// browseOptions holds the flags shared by the ls and du commands
+type browseOptions struct {
+	namespace string
+	pvc       string
+	at        string
+}
+
+func (o *browseOptions) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&o.namespace, "namespace", "n", "default", "Namespace of the PVC")
+	cmd.Flags().StringVar(&o.pvc, "pvc", "", "Name of the PVC")
+	cmd.Flags().StringVar(&o.at, "at", "", "Point in time to look at, e.g. \"2024-05-01 12:00\" (default: now)")
+	cmd.MarkFlagRequired("pvc")
+}
+
+// resolveSnapshot finds the snapshot matching the browse options and the client of its repository
+func (o *browseOptions) resolveSnapshot(ctx context.Context) (*restic.Client, *restic.Snapshot) {
+	at, err := backup.ParseTime(o.at)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client := resticClient.ForPVC(o.namespace, o.pvc)
+	snapshot, err := backup.ResolveSnapshotAt(ctx, client, o.namespace, o.pvc, at)
+	if err != nil {
+		log.Fatalf("Failed to resolve snapshot: %v", err)
+	}
+
+	fmt.Printf("Snapshot %s taken at %s", snapshot.ShortID, snapshot.Time.Local().Format(time.RFC3339))
+	if description := snapshot.Description(); description != "" {
+		fmt.Printf(" (%s)", description)
+	}
+	fmt.Print("\n\n")
+	return client, snapshot
+}
+
+func runLsCommand(opts *browseOptions, paths []string) {
+	ctx := context.Background()
+	client, snapshot := opts.resolveSnapshot(ctx)
+
+	nodes, err := client.ListFiles(ctx, snapshot.ID, paths...)
+	if err != nil {
+		log.Fatalf("Failed to list files: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, node := range nodes {
+		size := ""
+		if node.Type == "file" {
+			size = backup.FormatBytes(node.Size)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", node.Type, size, node.MTime.Local().Format("2006-01-02 15:04:05"), node.Path)
+	}
+	w.Flush()
+}
+
+func runDuCommand(opts *browseOptions, paths []string) {
+	ctx := context.Background()
+	client, snapshot := opts.resolveSnapshot(ctx)
+
+	base := backup.CommonDir(snapshot.Paths)
+	if len(paths) > 0 {
+		base = paths[0]
+	}
+
+	nodes, err := client.ListFiles(ctx, snapshot.ID, base)
+	if err != nil {
+		log.Fatalf("Failed to list files: %v", err)
+	}
+
+	var total uint64
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, usage := range backup.SummarizeUsage(nodes, base) {
+		total += usage.Size
+		fmt.Fprintf(w, "%s\t%d files\t%s\n", backup.FormatBytes(usage.Size), usage.Files, usage.Path)
+	}
+	fmt.Fprintf(w, "%s\t\ttotal\n", backup.FormatBytes(total))
+	w.Flush()
+}
+
+// diffOptions holds the flags of the diff command
+type diffOptions struct {
+	namespace string
+	pvc       string
+	snapshot  string
+	at        string
+	summary   bool
+}
+
+func runDiffCommand(opts *diffOptions) {
+	at, err := backup.ParseTime(opts.at)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	manager, err := backup.NewManager(cfg, k8sClient, resticClient, metrics.NewRegistry(), log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create backup manager: %v", err)
+	}
+
+	snapshot, changes, err := manager.DiffAgainstLive(context.Background(), opts.namespace, opts.pvc, backup.DiffOptions{
+		SnapshotID: opts.snapshot,
+		At:         at,
+	})
+	if err != nil {
+		log.Fatalf("Diff failed: %v", err)
+	}
+
+	fmt.Printf("Snapshot %s taken at %s\n\n", snapshot.ShortID, snapshot.Time.Local().Format(time.RFC3339))
+	counts := make(map[string]int)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, change := range changes {
+		counts[change.Change]++
+		if opts.summary {
+			continue
+		}
+		sizes := ""
+		switch change.Change {
+		case backup.ChangeAdded:
+			sizes = backup.FormatBytes(change.LiveSize)
+		case backup.ChangeDeleted:
+			sizes = backup.FormatBytes(change.SnapshotSize)
+		case backup.ChangeModified:
+			sizes = backup.FormatBytes(change.SnapshotSize) + " -> " + backup.FormatBytes(change.LiveSize)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", change.Change, sizes, change.Path)
+	}
+	w.Flush()
+
+	fmt.Printf("\n%d added, %d modified, %d deleted\n", counts[backup.ChangeAdded], counts[backup.ChangeModified], counts[backup.ChangeDeleted])
+}
+
+func runSnapshotsCommand(namespace, pvcName string, asJSON bool) {
+	manager, err := backup.NewManager(cfg, k8sClient, resticClient, metrics.NewRegistry(), log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create backup manager: %v", err)
+	}
+
+	snapshots, err := manager.PVCSnapshots(context.Background(), namespace, pvcName)
+	if err != nil {
+		fail("Failed to list snapshots: %v", err)
+	}
+	if asJSON {
+		data, err := json.MarshalIndent(snapshots, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to encode snapshots: %v", err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tADDED\tDESCRIPTION")
+	for _, snapshot := range snapshots {
+		added := ""
+		if snapshot.Summary != nil {
+			added = backup.FormatBytes(snapshot.Summary.DataAdded)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", snapshot.ShortID, snapshot.Time.Local().Format(time.RFC3339), added, snapshot.Description())
+	}
+	w.Flush()
+}
+
+// rolloutOptions holds the flags of the rollout-status command
+type rolloutOptions struct {
+	version string
+	nodes   []string
+}
+
+func runReportCommand(send, asJSON bool) {
+	ctx := context.Background()
+	manager, err := backup.NewManager(cfg, k8sClient, resticClient, metrics.NewRegistry(), log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create backup manager: %v", err)
+	}
+
+	report, next, err := manager.BuildReport(ctx)
+	if err != nil {
+		log.Fatalf("Failed to build report: %v", err)
+	}
+	if asJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to encode report: %v", err)
+		}
+		fmt.Println(string(data))
+	} else {
+		fmt.Print(backup.FormatReport(report))
+	}
+
+	if send {
+		if err := manager.SendReport(ctx, report); err != nil {
+			log.Fatalf("Failed to send report: %v", err)
+		}
+		if err := manager.RecordReport(ctx, next); err != nil {
+			log.Fatalf("Failed to record report: %v", err)
+		}
+	}
+}
+
+func runPlanCommand(asJSON bool) {
+	manager, err := backup.NewOfflineManager(cfg, k8sClient, resticClient, log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create backup manager: %v", err)
+	}
+
+	backups, err := manager.PlanBackups(context.Background())
+	if backups == nil && err != nil {
+		fail("Failed to plan backups: %v", err)
+	}
+	if asJSON {
+		data, err := json.MarshalIndent(backups, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to encode plan: %v", err)
+		}
+		fmt.Println(string(data))
+	} else {
+		fmt.Print(backup.FormatPlannedBackups(backups))
+	}
+	// Invalid plans and schedules are reported after the valid backups
+	if err != nil {
+		fail("Plan is incomplete: %v", err)
+	}
+}
+
+func runRolloutStatusCommand(opts *rolloutOptions) {
+	statuses, err := k8sClient.ListNodeStatuses(context.Background(), cfg.BackupConfig.LeaseNamespace)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	byNode := make(map[string]k8s.NodeStatus, len(statuses))
+	for _, status := range statuses {
+		byNode[status.Node] = status
+	}
+	nodes := opts.nodes
+	if len(nodes) == 0 {
+		for _, status := range statuses {
+			nodes = append(nodes, status.Node)
+		}
+	}
+
+	now := time.Now()
+	ready := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tVERSION\tSTARTED\tLAST SUCCESS\tSTATE")
+	for _, node := range nodes {
+		status, ok := byNode[node]
+		if !ok {
+			fmt.Fprintf(w, "%s\t-\t-\t-\tnot reporting\n", node)
+			continue
+		}
+
+		state := "ready"
+		switch {
+		case status.Stale(now):
+			state = fmt.Sprintf("stale, last report %s", status.RenewedAt.Local().Format(time.RFC3339))
+		case opts.version != "" && status.Version != opts.version:
+			state = "outdated"
+		case status.LastError != "":
+			state = "failing: " + status.LastError
+		case !status.Healthy():
+			state = "waiting for first backup cycle"
+		default:
+			ready++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", node, status.Version, formatStatusTime(status.StartedAt), formatStatusTime(status.LastSuccess), state)
+	}
+	w.Flush()
+
+	fmt.Printf("\n%d/%d nodes ready\n", ready, len(nodes))
+	if opts.version != "" && ready < len(nodes) {
+		os.Exit(1)
+	}
+}
+
+// formatStatusTime formats a reported time, "-" when never reported
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,118 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/backup"
+	"github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+	"github.com/spf13/cobra"
+)
+
+// newConfigCommand returns the config command, inspecting the configuration without
+// the clients the other commands need
+func newConfigCommand() *cobra.Command {
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+		// The configuration is checked before any client is created from it
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+	}
+
+	var offline bool
+	validateCmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Validate the configuration and the access to the repository",
+		Long:  "Check the settings of the environment and config file, including the backend credentials, policy, retention and quota syntax, then open the repository with the password. Exits with 3 on configuration problems and 4 when the repository cannot be reached, e.g. as a Helm pre-install hook",
+		Run: func(cmd *cobra.Command, args []string) {
+			runConfigValidate(offline)
+		},
+	}
+	validateCmd.Flags().BoolVar(&offline, "offline", false, "Skip the connectivity test")
+
+	var changed bool
+	showCmd := &cobra.Command{
+		Use:   "show",
+		Short: "Print the effective configuration with credentials masked",
+		Long:  "Print every setting with the value taking effect and where it comes from: the environment, the config file or the default. Passwords, keys, tokens and the credentials of URLs are masked",
+		Run: func(cmd *cobra.Command, args []string) {
+			runConfigShow(changed)
+		},
+	}
+	showCmd.Flags().BoolVar(&changed, "changed", false, "Only print the settings set in the environment or config file")
+
+	configCmd.AddCommand(validateCmd)
+	configCmd.AddCommand(showCmd)
+	return configCmd
+}
+
+func runConfigShow(changed bool) {
+	settings, err := config.Settings(fileSettings)
+	if err != nil {
+		failWith(exitFailure, "Failed to list settings: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVALUE\tSOURCE")
+	for _, setting := range settings {
+		if changed && setting.Source == config.SourceDefault {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", setting.Name, config.Redact(setting.Name, setting.Value), setting.Source)
+	}
+	w.Flush()
+}
+
+func runConfigValidate(offline bool) {
+	// Without a node, the name of the repository the connectivity test opens does not matter
+	nodeName := os.Getenv("KUBERNETES_NODE_NAME")
+	if nodeName == "" {
+		nodeName, _ = os.Hostname()
+	}
+
+	var problems []error
+	client, err := restic.NewClient(cfg, nodeName, log)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	if err := backup.ValidateConfig(cfg); err != nil {
+		problems = append(problems, err)
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			for _, line := range strings.Split(problem.Error(), "\n") {
+				fmt.Fprintf(os.Stderr, "invalid: %s\n", line)
+			}
+		}
+		failWith(exitConfig, "Configuration is invalid")
+	}
+	fmt.Println("Configuration is valid")
+
+	if offline {
+		return
+	}
+	if client.Sharded() {
+		fmt.Println("Repositories are created per PVC or namespace, skipping the connectivity test")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if err := client.Ping(ctx); err != nil {
+		if restic.IsMissingRepositoryError(err) {
+			// The agents initialize the repository on their first start
+			fmt.Printf("Storage is reachable, repository %s will be initialized by the agents\n", client.GetRepository())
+			return
+		}
+		if ctx.Err() != nil {
+			failWith(exitUnreachable, "Repository %s did not answer: %v", client.GetRepository(), err)
+		}
+		fail("Connectivity test failed: %v", err)
+	}
+	fmt.Printf("Repository %s is reachable\n", client.GetRepository())
+}
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/monlor/local-pvc-backup/pkg/backup"
+	"github.com/monlor/local-pvc-backup/pkg/tracing"
+	"github.com/monlor/local-pvc-backup/pkg/version"
+	"github.com/spf13/cobra"
+)
+
+// newControllerCommand creates the command running the cluster controller, which
+// takes the repository maintenance, the reports and the backup slots off the agents
+func newControllerCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "controller",
+		Short: "Run the cluster controller of the node agents",
+		Long:  "Run the prunes, checks and reports over the repositories of all nodes, and spread the backup cycles of the agents over the backup interval. Set BACKUP_CONTROLLER=true on the agents so they leave these tasks to the controller",
+		Run: func(cmd *cobra.Command, args []string) {
+			runController()
+		},
+	}
+}
+
+func runController() {
+	registry := serveDiagnostics()
+
+	manager, err := backup.NewManager(cfg, k8sClient, resticClient, registry, log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create backup manager: %v", err)
+	}
+
+	tracer, err := tracing.New(cfg.TracingConfig, k8sClient.GetNodeName(), cfg.BackupConfig.ProxyConfig, log)
+	if err != nil {
+		failWith(exitConfig, "Failed to set up tracing: %v", err)
+	}
+	defer shutdownTracer(tracer)
+
+	ctx, cancel := context.WithCancel(tracing.WithTracer(context.Background(), tracer))
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigChan
+		log.Infof("Received shutdown signal: %v", sig)
+		cancel()
+	}()
+
+	log.Infof("Starting controller %s...", version.Version)
+	if err := manager.RunController(ctx); err != nil {
+		shutdownTracer(tracer)
+		fail("Controller error: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"errors"
+	"os"
+
+	"github.com/monlor/local-pvc-backup/pkg/backup"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+)
+
+// Exit codes of the commands, a stable contract for scripts, CI pipelines and CronJobs
+const (
+	exitOK           = 0
+	exitFailure      = 1 // Any other failure
+	exitPartial      = 2 // Some PVCs were processed, others failed
+	exitConfig       = 3 // Invalid configuration, flags or repository password
+	exitUnreachable  = 4 // The repository could not be reached or does not exist
+	exitVerification = 5 // A verification failed, e.g. the verification command of a backup
+	exitMount        = 6 // A PVC directory was an unhealthy mount and skipped
+)
+
+// exitCode returns the exit code of a failed command
+func exitCode(err error) int {
+	var partial *backup.PartialError
+	var verification *backup.VerificationError
+	var mount *backup.MountError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &verification):
+		return exitVerification
+	case errors.As(err, &partial):
+		return exitPartial
+	case errors.As(err, &mount):
+		return exitMount
+	case restic.IsPasswordError(err):
+		return exitConfig
+	case restic.IsUnreachableError(err):
+		return exitUnreachable
+	}
+	return exitFailure
+}
+
+// Exit codes of restic, see its documentation on scripting
+const (
+	resticExitIncomplete  = 3  // The backup could not read some source data
+	resticExitNoRepo      = 10 // The repository does not exist
+	resticExitBadPassword = 12 // The password is wrong
+)
+
+// resticExitCode maps the exit code of a restic command run by the restic command onto
+// the exit codes of the commands
+func resticExitCode(code int) int {
+	switch code {
+	case exitOK:
+		return exitOK
+	case resticExitIncomplete:
+		return exitPartial
+	case resticExitNoRepo:
+		return exitUnreachable
+	case resticExitBadPassword:
+		return exitConfig
+	}
+	return exitFailure
+}
+
+// fail logs a failed command and exits with the exit code of its error
+func fail(format string, err error) {
+	failWith(exitCode(err), format, err)
+}
+
+// failWith logs a failed command and exits with the given exit code
+func failWith(code int, format string, args ...any) {
+	log.Errorf(format, args...)
+	os.Exit(code)
+}
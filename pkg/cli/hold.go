@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/backup"
+	"github.com/spf13/cobra"
+)
+
+// newHoldCommand creates the commands managing the repository hold, which keeps every
+// agent from deleting backup data, e.g. while a security incident is investigated
+func newHoldCommand() *cobra.Command {
+	holdCmd := &cobra.Command{
+		Use:   "hold",
+		Short: "Hold the repositories, refusing forget and prune on every node",
+		Long:  "Manage the repository hold. While held, the agents of all nodes skip retention, TTL expiry and prunes, and the restic passthrough refuses forget and prune, until the hold is released",
+	}
+
+	var reason string
+	setCmd := &cobra.Command{
+		Use:   "set",
+		Short: "Hold the repositories",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := backup.SetHold(context.Background(), k8sClient, cfg.BackupConfig.LeaseNamespace, reason); err != nil {
+				log.Fatalf("Failed to set hold: %v", err)
+			}
+			fmt.Println("Repositories held, forget and prune are refused until released")
+		},
+	}
+	setCmd.Flags().StringVar(&reason, "reason", "", "Why the repositories are held, e.g. an incident ticket")
+	setCmd.MarkFlagRequired("reason")
+
+	releaseCmd := &cobra.Command{
+		Use:   "release",
+		Short: "Release the hold of the repositories",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := backup.ReleaseHold(context.Background(), k8sClient, cfg.BackupConfig.LeaseNamespace); err != nil {
+				log.Fatalf("Failed to release hold: %v", err)
+			}
+			fmt.Println("Hold released")
+		},
+	}
+
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show whether the repositories are held",
+		Run: func(cmd *cobra.Command, args []string) {
+			hold, err := backup.GetHold(context.Background(), k8sClient, cfg.BackupConfig.LeaseNamespace)
+			if err != nil {
+				log.Fatalf("Failed to get hold: %v", err)
+			}
+			if hold == nil {
+				fmt.Println("Not held")
+				return
+			}
+			fmt.Printf("Held since %s by %s: %s\n", hold.Since.Local().Format(time.RFC3339), hold.By, hold.Reason)
+		},
+	}
+
+	holdCmd.AddCommand(setCmd, releaseCmd, statusCmd)
+	return holdCmd
+}
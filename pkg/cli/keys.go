@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/monlor/local-pvc-backup/pkg/backup"
+	"github.com/monlor/local-pvc-backup/pkg/metrics"
+	"github.com/spf13/cobra"
+)
+
+// newKeysCommand creates the commands managing the keys of the repositories
+func newKeysCommand() *cobra.Command {
+	keysCmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Manage the keys of the repositories",
+	}
+
+	var newPasswordFile string
+	rotateCmd := &cobra.Command{
+		Use:   "rotate",
+		Short: "Rotate the repository password",
+		Long:  "Add a key with the new password to every repository found in the storage, including those of deleted PVCs, verify that the new password opens it and remove the key of the configured password. Update the password of the agents right after",
+		Run: func(cmd *cobra.Command, args []string) {
+			runRotateKeys(newPasswordFile)
+		},
+	}
+	rotateCmd.Flags().StringVar(&newPasswordFile, "new-password-file", "", "File holding the new password")
+	rotateCmd.MarkFlagRequired("new-password-file")
+
+	keysCmd.AddCommand(rotateCmd)
+	return keysCmd
+}
+
+func runRotateKeys(newPasswordFile string) {
+	if cfg.SecretsConfig.Provider != "" {
+		failWith(exitConfig, "Per-namespace passwords are rotated in the secret manager, add the new key with restic --pvc namespace/name key add first")
+	}
+
+	manager, err := backup.NewManager(cfg, k8sClient, resticClient, metrics.NewRegistry(), log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create backup manager: %v", err)
+	}
+
+	err = manager.RotateKeys(context.Background(), newPasswordFile, func(r backup.KeyRotation) {
+		if r.Skipped != "" {
+			fmt.Printf("%s: skipped, %s\n", r.Repository, r.Skipped)
+			return
+		}
+		fmt.Printf("%s: replaced key %.8s with %.8s\n", r.Repository, r.OldKey, r.NewKey)
+	})
+	if err != nil {
+		fail("Key rotation failed, run it again to resume: %v", err)
+	}
+	fmt.Println("Keys rotated, update the repository password of the agents now")
+}
@@ -0,0 +1,22 @@
+package cli
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// serveProfiling exposes the runtime profiles on their own listener, kept off the
+// metrics endpoint so scrapers and network policies never reach them
+func serveProfiling(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	log.Warnf("Serving pprof profiles on %s, do not expose it outside the node", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("pprof server error: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/backup"
+	"github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// configPollInterval is how often the config file is checked for changes. ConfigMap
+// mounts are updated by swapping a symlink, which file notifications miss, so the file
+// is read and compared instead.
+const configPollInterval = 10 * time.Second
+
+// reloadableSettings are the settings applied without a restart
+var reloadableSettings = map[string]bool{
+	"BACKUP_LOG_LEVEL":        true,
+	"BACKUP_INTERVAL":         true,
+	"BACKUP_RETENTION":        true,
+	"BACKUP_POLICY":           true,
+	"BACKUP_NAMESPACE_QUOTAS": true,
+	"BACKUP_FEATURES":         true,
+	"BACKUP_AUTO_UNLOCK":      true,
+}
+
+// setLogLevel sets the level of the logger, falling back to info when invalid
+func setLogLevel(name string) {
+	level, err := logrus.ParseLevel(name)
+	if err != nil {
+		log.Warnf("Invalid log level %s, using info", name)
+		level = logrus.InfoLevel
+	}
+	log.SetLevel(level)
+}
+
+// watchConfig applies changes of the config file to the running backup service until
+// the context is done. Changes of settings that need a restart are only reported.
+func watchConfig(ctx context.Context, manager *backup.Manager) {
+	last, err := os.ReadFile(configPath)
+	if err != nil {
+		log.Warnf("Failed to read config file, changes are not applied: %v", err)
+		return
+	}
+	log.Infof("Watching config file %s for changes", configPath)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			log.Warnf("Failed to read config file: %v", err)
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+		reloadConfig(manager)
+	}
+}
+
+// reloadConfig loads the changed config file and applies its reloadable settings. An
+// invalid file is reported and the running configuration kept.
+func reloadConfig(manager *backup.Manager) {
+	updated, settings, err := config.Load(configPath)
+	if err != nil {
+		log.Errorf("Ignoring changed config file: %v", err)
+		return
+	}
+	if err := manager.Reload(updated); err != nil {
+		log.Errorf("Ignoring changed config file: %v", err)
+		return
+	}
+
+	var changed []string
+	for name := range settings {
+		if settings[name] != fileSettings[name] {
+			changed = append(changed, name)
+		}
+	}
+	for name := range fileSettings {
+		if _, ok := settings[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	for _, name := range changed {
+		switch {
+		case os.Getenv(name) != "":
+			log.Warnf("Setting %s changed in the config file but is overridden by the environment", name)
+		case !reloadableSettings[name]:
+			log.Warnf("Setting %s changed in the config file, restart the agent to apply it", name)
+		}
+	}
+
+	setLogLevel(updated.BackupConfig.LogLevel)
+	cfg.BackupConfig.LogLevel = updated.BackupConfig.LogLevel
+	fileSettings = settings
+	log.Infof("Reloaded config file %s", configPath)
+}
@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/monlor/local-pvc-backup/pkg/backup"
+	"github.com/spf13/cobra"
+)
+
+// newStateCommand creates the commands moving the local state of an agent to the agent
+// of a replacement node
+func newStateCommand() *cobra.Command {
+	stateCmd := &cobra.Command{
+		Use:   "state",
+		Short: "Export and import the local state of the agent",
+		Long:  "Move the local state of an agent (change baselines, seed checkpoint, SFTP host keys) to the agent of a replacement node, so it does not start over",
+	}
+
+	var output string
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export the local state of the agent on this node",
+		Run: func(cmd *cobra.Command, args []string) {
+			state, err := backup.ExportLocalState(cfg.ResticConfig.CachePath, k8sClient.GetNodeName())
+			if err != nil {
+				log.Fatalf("Failed to export state: %v", err)
+			}
+			data, err := json.MarshalIndent(state, "", "  ")
+			if err != nil {
+				log.Fatalf("Failed to encode state: %v", err)
+			}
+			if output == "" || output == "-" {
+				fmt.Println(string(data))
+				return
+			}
+			if err := os.WriteFile(output, data, 0o600); err != nil {
+				log.Fatalf("Failed to write state: %v", err)
+			}
+		},
+	}
+	exportCmd.Flags().StringVarP(&output, "output", "o", "", "File to write the state to (default: stdout)")
+
+	var input string
+	var overwrite bool
+	importCmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import the local state exported on a replaced node",
+		Run: func(cmd *cobra.Command, args []string) {
+			var data []byte
+			var err error
+			if input == "" || input == "-" {
+				data, err = io.ReadAll(os.Stdin)
+			} else {
+				data, err = os.ReadFile(input)
+			}
+			if err != nil {
+				log.Fatalf("Failed to read state: %v", err)
+			}
+			var state backup.LocalState
+			if err := json.Unmarshal(data, &state); err != nil {
+				log.Fatalf("Failed to parse state: %v", err)
+			}
+
+			node := k8sClient.GetNodeName()
+			names, err := backup.ImportLocalState(cfg.ResticConfig.CachePath, node, &state, overwrite)
+			if err != nil {
+				log.Fatalf("Failed to import state: %v", err)
+			}
+			for _, name := range names {
+				fmt.Printf("Imported %s from node %s\n", name, state.Node)
+			}
+			fmt.Println("Restart the agent on this node to load the imported state")
+		},
+	}
+	importCmd.Flags().StringVarP(&input, "input", "i", "", "File to read the state from (default: stdin)")
+	importCmd.Flags().BoolVar(&overwrite, "overwrite", false, "Replace the state files the agent already has")
+
+	stateCmd.AddCommand(exportCmd, importCmd)
+	return stateCmd
+}
@@ -0,0 +1,188 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/restic"
+	"github.com/spf13/cobra"
+)
+
+// Verbs on PVCs a tenant needs, to browse backups and to restore them
+const (
+	tenantReadVerb    = "get"
+	tenantRestoreVerb = "update"
+)
+
+// newTenantCommand creates the tenant commands, which only expose the backups of the
+// namespaces the tenant may access
+func newTenantCommand() *cobra.Command {
+	identity := &k8s.TenantIdentity{}
+	tenantCmd := &cobra.Command{
+		Use:   "tenant",
+		Short: "Browse and restore backups with the permissions of a tenant",
+		Long:  "Self-service commands for application teams. Each command checks the RBAC permissions of the tenant with its own kubeconfig or token, and only exposes the PVCs of the namespaces it may access",
+	}
+	tenantCmd.PersistentFlags().StringVar(&identity.Kubeconfig, "kubeconfig", "", "Kubeconfig of the tenant")
+	tenantCmd.PersistentFlags().StringVar(&identity.TokenFile, "token-file", "", "File holding a bearer token of the tenant, instead of a kubeconfig")
+
+	snapshotsOpts := &tenantSnapshotsOptions{}
+	snapshotsCmd := &cobra.Command{
+		Use:   "snapshots",
+		Short: "List the snapshots of the PVCs of a namespace",
+		Run: func(cmd *cobra.Command, args []string) {
+			runTenantSnapshotsCommand(tenantAccess(identity), snapshotsOpts)
+		},
+	}
+	snapshotsCmd.Flags().StringVarP(&snapshotsOpts.namespace, "namespace", "n", "default", "Namespace of the PVCs")
+	snapshotsCmd.Flags().StringVar(&snapshotsOpts.pvc, "pvc", "", "Only list the snapshots of this PVC")
+	snapshotsCmd.Flags().BoolVarP(&snapshotsOpts.allNamespaces, "all-namespaces", "A", false, "List the snapshots of all namespaces the tenant may access")
+
+	lsOpts := &browseOptions{}
+	lsCmd := &cobra.Command{
+		Use:   "ls [path...]",
+		Short: "List the files of a PVC as they were at a given time",
+		Run: func(cmd *cobra.Command, args []string) {
+			authorizeTenant(tenantAccess(identity), lsOpts.namespace, tenantReadVerb)
+			runLsCommand(lsOpts, args)
+		},
+	}
+	lsOpts.addFlags(lsCmd)
+
+	duOpts := &browseOptions{}
+	duCmd := &cobra.Command{
+		Use:   "du [path]",
+		Short: "Show the disk usage of a PVC as it was at a given time",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			authorizeTenant(tenantAccess(identity), duOpts.namespace, tenantReadVerb)
+			runDuCommand(duOpts, args)
+		},
+	}
+	duOpts.addFlags(duCmd)
+
+	// Restores into arbitrary directories of the node are not offered to tenants
+	restoreOpts := &restoreOptions{}
+	restoreCmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore a PVC in place from a snapshot",
+		Long:  "Restore a snapshot of a PVC in place, by ID or as it was at --at, after taking a safety snapshot of the current data",
+		Run: func(cmd *cobra.Command, args []string) {
+			authorizeTenant(tenantAccess(identity), restoreOpts.namespace, tenantRestoreVerb)
+			runRestoreCommand(restoreOpts)
+		},
+	}
+	restoreCmd.Flags().StringVarP(&restoreOpts.namespace, "namespace", "n", "default", "Namespace of the PVC")
+	restoreCmd.Flags().StringVar(&restoreOpts.pvc, "pvc", "", "Name of the PVC")
+	restoreCmd.Flags().StringVar(&restoreOpts.snapshot, "snapshot", "", "ID of the snapshot to restore")
+	restoreCmd.Flags().StringVar(&restoreOpts.at, "at", "", "Restore the latest snapshot taken at or before this time (default: now)")
+	restoreCmd.Flags().BoolVar(&restoreOpts.delete, "delete", false, "Delete files missing from the snapshot")
+	restoreCmd.MarkFlagRequired("pvc")
+
+	tenantCmd.AddCommand(snapshotsCmd, lsCmd, duCmd, restoreCmd)
+	return tenantCmd
+}
+
+// tenantAccess creates the access checker of the tenant selected by the flags
+func tenantAccess(identity *k8s.TenantIdentity) *k8s.AccessChecker {
+	access, err := k8sClient.NewAccessChecker(context.Background(), *identity)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return access
+}
+
+// tenantCommand reports whether a command may run in tenant mode: the tenant commands
+// and the help
+func tenantCommand(cmd *cobra.Command) bool {
+	if !cmd.HasParent() || cmd.Name() == "help" {
+		return true
+	}
+	for ; cmd.HasParent(); cmd = cmd.Parent() {
+		if cmd.Name() == "tenant" && !cmd.Parent().HasParent() {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeTenant exits unless the tenant may perform verb on the PVCs of a namespace
+func authorizeTenant(access *k8s.AccessChecker, namespace, verb string) {
+	if err := access.Authorize(context.Background(), namespace, verb); err != nil {
+		log.Fatalf("Access denied: %v", err)
+	}
+}
+
+// tenantSnapshotsOptions holds the flags of the tenant snapshots command
+type tenantSnapshotsOptions struct {
+	namespace     string
+	pvc           string
+	allNamespaces bool
+}
+
+func runTenantSnapshotsCommand(access *k8s.AccessChecker, opts *tenantSnapshotsOptions) {
+	ctx := context.Background()
+
+	var snapshots []restic.Snapshot
+	if opts.allNamespaces {
+		if resticClient.Sharded() {
+			log.Fatal("Sharded repositories require selecting a namespace")
+		}
+		all, err := resticClient.Snapshots(ctx, nil)
+		if err != nil {
+			log.Fatalf("Failed to list snapshots: %v", err)
+		}
+
+		// Check each namespace once, hiding the ones the tenant may not access
+		allowed := make(map[string]bool)
+		for _, snapshot := range all {
+			namespace := snapshot.TagValue(restic.NamespaceTagPrefix)
+			if namespace == "" {
+				continue
+			}
+			ok, checked := allowed[namespace]
+			if !checked {
+				var err error
+				if ok, err = access.Allowed(ctx, namespace, tenantReadVerb); err != nil {
+					log.Fatal(err)
+				}
+				allowed[namespace] = ok
+			}
+			if ok && (opts.pvc == "" || snapshot.TagValue(restic.PVCNameTagPrefix) == opts.pvc) {
+				snapshots = append(snapshots, snapshot)
+			}
+		}
+	} else {
+		authorizeTenant(access, opts.namespace, tenantReadVerb)
+		if cfg.BackupConfig.RepoLayout == config.RepoLayoutPVC && opts.pvc == "" {
+			log.Fatal("Per-PVC repositories require selecting a PVC")
+		}
+
+		tags := []string{restic.NamespaceTag(opts.namespace)}
+		if opts.pvc != "" {
+			tags = restic.PVCTags(opts.namespace, opts.pvc)
+		}
+		var err error
+		snapshots, err = resticClient.ForPVC(opts.namespace, opts.pvc).Snapshots(ctx, tags)
+		if err != nil {
+			log.Fatalf("Failed to list snapshots: %v", err)
+		}
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tNAMESPACE\tPVC\tDESCRIPTION")
+	for _, snapshot := range snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", snapshot.ShortID, snapshot.Time.Local().Format(time.RFC3339),
+			snapshot.TagValue(restic.NamespaceTagPrefix), snapshot.TagValue(restic.PVCNameTagPrefix), snapshot.Description())
+	}
+	w.Flush()
+}
@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/webhook"
+	"github.com/spf13/cobra"
+)
+
+// newWebhookCommand creates the command serving the admission webhook, which needs
+// neither a node nor the repository
+func newWebhookCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "webhook",
+		Short: "Serve the admission webhook checking backup annotations",
+		Long:  "Serve the validating admission webhook rejecting, or warning about with WEBHOOK_VALIDATE_MODE=warn, pods and PVCs with malformed backup annotations: unknown keys, invalid patterns, durations, plans and compression levels",
+		// The webhook only reads the objects sent by the API server
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+		Run: func(cmd *cobra.Command, args []string) {
+			runWebhook()
+		},
+	}
+}
+
+func runWebhook() {
+	webhookConfig := cfg.WebhookConfig
+	if webhookConfig.TLSCertFile == "" || webhookConfig.TLSKeyFile == "" {
+		failWith(exitConfig, "WEBHOOK_TLS_CERT_FILE and WEBHOOK_TLS_KEY_FILE are required, the API server only calls webhooks over HTTPS")
+	}
+	handler, err := webhook.New(webhookConfig, log)
+	if err != nil {
+		failWith(exitConfig, "Failed to create webhook: %v", err)
+	}
+
+	server := &http.Server{
+		Addr:              webhookConfig.Addr,
+		Handler:           handler.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Infof("Serving admission webhook on %s", webhookConfig.Addr)
+	if err := server.ListenAndServeTLS(webhookConfig.TLSCertFile, webhookConfig.TLSKeyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		failWith(exitFailure, "Webhook server error: %v", err)
+	}
+}
@@ -1,40 +1,404 @@
 package config
 
 import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
+
+	"golang.org/x/net/http/httpproxy"
 )
 
 // Config represents the main configuration for the backup service
 type Config struct {
-	S3Config     S3Config     `envPrefix:"S3_"`
-	BackupConfig BackupConfig `envPrefix:"BACKUP_"`
-	ResticConfig ResticConfig `envPrefix:"RESTIC_"`
+	BackendType    string         `env:"BACKEND_TYPE" envDefault:"s3"` // Storage backend of the repositories: s3, gcs, azure, b2, sftp, rest, rclone or local
+	S3Config       S3Config       `envPrefix:"S3_"`
+	GCSConfig      GCSConfig      `envPrefix:"GCS_"`
+	AzureConfig    AzureConfig    `envPrefix:"AZURE_"`
+	B2Config       B2Config       `envPrefix:"B2_"`
+	SFTPConfig     SFTPConfig     `envPrefix:"SFTP_"`
+	RESTConfig     RESTConfig     `envPrefix:"REST_"`
+	RcloneConfig   RcloneConfig   `envPrefix:"RCLONE_"`
+	LocalConfig    LocalConfig    `envPrefix:"LOCAL_"`
+	BackupConfig   BackupConfig   `envPrefix:"BACKUP_"`
+	ResticConfig   ResticConfig   `envPrefix:"RESTIC_"`
+	ReplicaConfig  ReplicaConfig  `envPrefix:"REPLICA_"`
+	ArtifactConfig ArtifactConfig `envPrefix:"ARTIFACT_"`
+	ReportConfig   ReportConfig   `envPrefix:"REPORT_"`
+	NotifyConfig   NotifyConfig   `envPrefix:"NOTIFY_"`
+	SMTPConfig     SMTPConfig     `envPrefix:"SMTP_"`
+	TracingConfig  TracingConfig  `envPrefix:"TRACING_"`
+	WebhookConfig  WebhookConfig  `envPrefix:"WEBHOOK_"`
+	SecretsConfig  SecretsConfig  `envPrefix:"SECRETS_"`
 }
 
 // S3Config holds the S3 storage configuration
 type S3Config struct {
-	Endpoint  string `env:"ENDPOINT,required"`
-	Bucket    string `env:"BUCKET,required"`
-	AccessKey string `env:"ACCESS_KEY,required"`
-	SecretKey string `env:"SECRET_KEY,required"`
-	Region    string `env:"REGION,required"`
-	Path      string `env:"PATH" envDefault:""` // S3 存储路径前缀
+	Endpoint         string `env:"ENDPOINT"`
+	Bucket           string `env:"BUCKET"`
+	AccessKey        string `env:"ACCESS_KEY"` // Empty uses the AWS default credential chain, e.g. IRSA
+	SecretKey        string `env:"SECRET_KEY"`
+	AccessKeyFile    string `env:"ACCESS_KEY_FILE" envDefault:""`    // File holding the access key, re-read before each restic run
+	SecretKeyFile    string `env:"SECRET_KEY_FILE" envDefault:""`    // File holding the secret key, re-read before each restic run
+	SessionToken     string `env:"SESSION_TOKEN" envDefault:""`      // Session token of temporary credentials
+	SessionTokenFile string `env:"SESSION_TOKEN_FILE" envDefault:""` // File holding the session token, re-read before each restic run
+	Region           string `env:"REGION"`
+	Path             string `env:"PATH" envDefault:""`               // S3 存储路径前缀
+	CACertFile       string `env:"CA_CERT_FILE" envDefault:""`       // CA certificate of an endpoint with a private certificate
+	InsecureTLS      bool   `env:"INSECURE_TLS" envDefault:"false"`  // Skip the verification of the endpoint certificate
+	StorageClass     string `env:"STORAGE_CLASS" envDefault:""`      // Storage class of the uploaded data, e.g. STANDARD_IA
+	CreateBucket     bool   `env:"CREATE_BUCKET" envDefault:"false"` // Validate access to the bucket at startup and create it when missing
+	Versioning       bool   `env:"VERSIONING" envDefault:"false"`    // Enable object versioning on the bucket at startup
+	SSE              string `env:"SSE" envDefault:""`                // Default server-side encryption of the bucket, AES256 or aws:kms
+	SSEKMSKeyID      string `env:"SSE_KMS_KEY_ID" envDefault:""`     // KMS key of aws:kms encryption, empty uses the AWS managed key
+	Anonymous        bool   `env:"ANONYMOUS" envDefault:"false"`     // Access the bucket without credentials from the agent, e.g. a public MinIO bucket
+}
+
+// Token returns the session token, read from SessionTokenFile when set
+func (c S3Config) Token() (string, error) {
+	return readSecret(c.SessionToken, c.SessionTokenFile, "session token")
+}
+
+// StaticKeys reports whether static keys are configured, directly or in files
+func (c S3Config) StaticKeys() bool {
+	return c.AccessKey != "" || c.AccessKeyFile != ""
+}
+
+// Keys returns the access and secret key, read from AccessKeyFile and SecretKeyFile
+// when set, so keys rotated in a mounted Secret are picked up without a restart
+func (c S3Config) Keys() (string, string, error) {
+	accessKey, err := readSecret(c.AccessKey, c.AccessKeyFile, "access key")
+	if err != nil {
+		return "", "", err
+	}
+	secretKey, err := readSecret(c.SecretKey, c.SecretKeyFile, "secret key")
+	if err != nil {
+		return "", "", err
+	}
+	return accessKey, secretKey, nil
+}
+
+// readSecret returns the content of file when set, otherwise value
+func readSecret(value, file, name string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// GCSConfig holds the Google Cloud Storage configuration
+type GCSConfig struct {
+	ProjectID       string `env:"PROJECT_ID"`
+	Bucket          string `env:"BUCKET"`
+	Path            string `env:"PATH" envDefault:""`
+	CredentialsFile string `env:"CREDENTIALS_FILE" envDefault:""` // Service account key file, empty uses workload identity
+}
+
+// AzureConfig holds the Azure Blob Storage configuration
+type AzureConfig struct {
+	AccountName    string `env:"ACCOUNT_NAME"`
+	AccountKey     string `env:"ACCOUNT_KEY" envDefault:""` // Empty uses the managed identity of the node
+	Container      string `env:"CONTAINER"`
+	Path           string `env:"PATH" envDefault:""`
+	EndpointSuffix string `env:"ENDPOINT_SUFFIX" envDefault:""` // e.g. core.chinacloudapi.cn for sovereign clouds
+}
+
+// B2Config holds the Backblaze B2 configuration
+type B2Config struct {
+	AccountID  string `env:"ACCOUNT_ID"`  // Application key ID
+	AccountKey string `env:"ACCOUNT_KEY"` // Application key
+	Bucket     string `env:"BUCKET"`
+	Path       string `env:"PATH" envDefault:""`
+}
+
+// SFTPConfig holds the SFTP storage configuration
+type SFTPConfig struct {
+	Host           string `env:"HOST"`
+	Port           int    `env:"PORT" envDefault:"22"`
+	User           string `env:"USER"`
+	Path           string `env:"PATH" envDefault:""`             // Absolute directory holding the repositories, empty uses the home directory
+	KeyFile        string `env:"KEY_FILE" envDefault:""`         // Private key mounted from a Secret, empty uses the default ssh keys
+	KnownHostsFile string `env:"KNOWN_HOSTS_FILE" envDefault:""` // Known host keys of the server, empty trusts the key seen first
+}
+
+// RESTConfig holds the restic REST server configuration
+type RESTConfig struct {
+	URL         string `env:"URL"` // e.g. https://backup.example.com:8000
+	Username    string `env:"USERNAME" envDefault:""`
+	Password    string `env:"PASSWORD" envDefault:""`
+	Path        string `env:"PATH" envDefault:""`
+	CACertFile  string `env:"CA_CERT_FILE" envDefault:""`      // CA certificate of a server with a private certificate
+	InsecureTLS bool   `env:"INSECURE_TLS" envDefault:"false"` // Skip the verification of the server certificate
+	AppendOnly  bool   `env:"APPEND_ONLY" envDefault:"false"`  // The server runs with --append-only, agents never forget or prune
+}
+
+// RcloneConfig holds the configuration of repositories stored through rclone
+type RcloneConfig struct {
+	Remote     string `env:"REMOTE"`               // Name of the rclone remote
+	Path       string `env:"PATH" envDefault:""`   // Path of the repositories in the remote
+	ConfigFile string `env:"CONFIG" envDefault:""` // rclone.conf mounted from a Secret, read by rclone itself
+}
+
+// LocalConfig holds the configuration of repositories stored in a directory of the node
+type LocalConfig struct {
+	Path         string `env:"PATH"`                             // Mounted directory, e.g. an NFS share or a USB disk
+	MinFreeSpace string `env:"MIN_FREE_SPACE" envDefault:"1GiB"` // Backups are refused below this free space
 }
 
 // ResticConfig holds the restic configuration
 type ResticConfig struct {
-	Password  string `env:"PASSWORD,required"` // 用于加密的密码
-	CachePath string `env:"CACHE_PATH" envDefault:"/var/cache/restic"`
+	Password     string `env:"PASSWORD" envDefault:""`      // 用于加密的密码
+	PasswordFile string `env:"PASSWORD_FILE" envDefault:""` // File holding the password instead of RESTIC_PASSWORD, e.g. a mounted secret
+	// Command printing the password instead of RESTIC_PASSWORD, e.g. a secret manager CLI
+	PasswordCommand string `env:"PASSWORD_COMMAND" envDefault:""`
+	CachePath       string `env:"CACHE_PATH" envDefault:"/var/cache/restic"`
+	CacheMaxSize    string `env:"CACHE_MAX_SIZE" envDefault:""` // Size of the cache directory above which least recently used cache files are evicted, empty for no limit
+	ProxyConfig            // Proxy of the repository traffic, the agent's own traffic is not affected
+	PackSize        string `env:"PACK_SIZE" envDefault:""` // Target size of the pack files, e.g. 64MiB, empty uses the restic default of 16MiB
+}
+
+// ProxyConfig holds the proxy settings of outbound HTTP traffic
+type ProxyConfig struct {
+	HTTPProxy  string `env:"HTTP_PROXY" envDefault:""`  // Proxy of the HTTP traffic
+	HTTPSProxy string `env:"HTTPS_PROXY" envDefault:""` // Proxy of the HTTPS traffic
+	NoProxy    string `env:"NO_PROXY" envDefault:""`    // Hosts, domains and CIDRs (IPv4 or IPv6) reached without the proxy
+}
+
+// Enabled reports whether a proxy is configured
+func (p ProxyConfig) Enabled() bool {
+	return p.HTTPProxy != "" || p.HTTPSProxy != ""
+}
+
+// Func returns the proxy function of HTTP transports
+func (p ProxyConfig) Func() func(*http.Request) (*url.URL, error) {
+	proxy := (&httpproxy.Config{
+		HTTPProxy:  p.HTTPProxy,
+		HTTPSProxy: p.HTTPSProxy,
+		NoProxy:    p.NoProxy,
+	}).ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// ArtifactConfig holds the configuration of the artifacts uploaded next to the
+// repositories, such as the backup cycle manifests
+type ArtifactConfig struct {
+	Manifests        bool   `env:"MANIFESTS" envDefault:"false"`     // Upload a manifest of each backup cycle, requires the S3 backend
+	Compression      string `env:"COMPRESSION" envDefault:"gzip"`    // Compression of the artifacts: gzip or none
+	AgeRecipients    string `env:"AGE_RECIPIENTS" envDefault:""`     // Comma-separated age public keys the artifacts are encrypted to
+	GPGRecipientFile string `env:"GPG_RECIPIENT_FILE" envDefault:""` // OpenPGP public key file the artifacts are encrypted to
+}
+
+// SecretsConfig holds the configuration of the per-namespace repository passwords read
+// from an external secret manager
+type SecretsConfig struct {
+	Provider     string        `env:"PROVIDER" envDefault:""`                                  // Secret manager: aws or gcp, empty uses the repository password for all namespaces
+	NameTemplate string        `env:"NAME_TEMPLATE" envDefault:"local-pvc-backup-{namespace}"` // Name of the secret holding the password of a namespace
+	AWSRegion    string        `env:"AWS_REGION" envDefault:""`                                // Region of AWS Secrets Manager, empty uses the region of the environment
+	GCPProject   string        `env:"GCP_PROJECT" envDefault:""`                               // Project of GCP Secret Manager
+	CacheTTL     time.Duration `env:"CACHE_TTL" envDefault:"5m"`                               // Time a password is used before it is read again
+}
+
+// TracingConfig holds the configuration of the traces of the agent's operations
+type TracingConfig struct {
+	Endpoint    string `env:"ENDPOINT" envDefault:""`                     // OTLP/HTTP endpoint of the collector, e.g. http://otel-collector:4318, empty disables tracing
+	ServiceName string `env:"SERVICE_NAME" envDefault:"local-pvc-backup"` // Service name of the spans
+	Headers     string `env:"HEADERS" envDefault:""`                      // Comma-separated name=value headers of the export requests, e.g. for authentication
+}
+
+// WebhookConfig holds the configuration of the admission webhook checking the backup
+// annotations of pods and PVCs
+type WebhookConfig struct {
+	Addr         string `env:"ADDR" envDefault:":8443"`         // Listen address of the webhook
+	TLSCertFile  string `env:"TLS_CERT_FILE" envDefault:""`     // Certificate the API server trusts, e.g. issued by cert-manager
+	TLSKeyFile   string `env:"TLS_KEY_FILE" envDefault:""`      // Private key of the certificate
+	ValidateMode string `env:"VALIDATE_MODE" envDefault:"deny"` // deny rejects malformed annotations, warn only returns warnings
+	// Backup defaults the mutating webhook adds to the pods and PVCs created without them
+	DefaultInclude string `env:"DEFAULT_INCLUDE" envDefault:""` // Include patterns, empty adds none
+	DefaultExclude string `env:"DEFAULT_EXCLUDE" envDefault:""` // Exclude patterns, empty adds none
+}
+
+// Modes of the validating webhook
+const (
+	WebhookDeny = "deny"
+	WebhookWarn = "warn"
+)
+
+// ReportConfig holds the configuration of the protection summary reports
+type ReportConfig struct {
+	Interval   time.Duration `env:"INTERVAL" envDefault:"0"`   // Interval of the reports, e.g. 168h for weekly, 0 disables them
+	WebhookURL string        `env:"WEBHOOK_URL" envDefault:""` // Endpoint the reports are posted to as JSON
+	EmailTo    string        `env:"EMAIL_TO" envDefault:""`    // Comma-separated recipients the reports are emailed to through the SMTP server
+	Cluster    string        `env:"CLUSTER" envDefault:""`     // Name of the cluster in the reports
+}
+
+// Recipients returns the addresses the reports are emailed to
+func (c ReportConfig) Recipients() []string {
+	var recipients []string
+	for _, recipient := range strings.Split(c.EmailTo, ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			recipients = append(recipients, recipient)
+		}
+	}
+	return recipients
+}
+
+// Deliverable reports whether the reports have at least one destination
+func (c ReportConfig) Deliverable() bool {
+	return c.WebhookURL != "" || len(c.Recipients()) > 0
+}
+
+// SMTPConfig holds the SMTP server the reports are emailed through
+type SMTPConfig struct {
+	Host     string `env:"HOST" envDefault:""`
+	Port     int    `env:"PORT" envDefault:"587"`
+	Security string `env:"SECURITY" envDefault:"starttls"` // Connection security: starttls, tls or none
+	Username string `env:"USERNAME" envDefault:""`         // Empty sends without authentication
+	Password string `env:"PASSWORD" envDefault:""`
+	From     string `env:"FROM" envDefault:""` // Sender address of the emails
+}
+
+// NotifyConfig holds the configuration of the failure notifications
+type NotifyConfig struct {
+	Sinks       string        `env:"SINKS" envDefault:""`           // Comma-separated notifiers: webhook, stdout, event and exec, empty for the webhook when its URL is set
+	WebhookURL  string        `env:"WEBHOOK_URL" envDefault:""`     // Endpoint the failures are posted to
+	Format      string        `env:"FORMAT" envDefault:"slack"`     // Payload format: slack for a text message, json to add the event fields
+	Template    string        `env:"TEMPLATE" envDefault:""`        // Go template of the message text, empty for the default one
+	ExecCommand string        `env:"EXEC_COMMAND" envDefault:""`    // Command run with the event as JSON on its standard input
+	ExecTimeout time.Duration `env:"EXEC_TIMEOUT" envDefault:"30s"` // Time the command has to complete, 0 for no limit
+	PingURL     string        `env:"PING_URL" envDefault:""`        // Dead man's switch pinged after each backup cycle, {node} is replaced by the node name
+	PingStart   bool          `env:"PING_START" envDefault:"true"`  // Also ping <url>/start when a cycle starts
+}
+
+// ReplicaConfig holds the configuration of the secondary repository backups are copied to
+type ReplicaConfig struct {
+	Endpoint         string        `env:"ENDPOINT" envDefault:""` // Secondary S3 endpoint, empty disables replication
+	Bucket           string        `env:"BUCKET" envDefault:""`
+	AccessKey        string        `env:"ACCESS_KEY" envDefault:""`
+	SecretKey        string        `env:"SECRET_KEY" envDefault:""`
+	AccessKeyFile    string        `env:"ACCESS_KEY_FILE" envDefault:""`
+	SecretKeyFile    string        `env:"SECRET_KEY_FILE" envDefault:""`
+	SessionToken     string        `env:"SESSION_TOKEN" envDefault:""`
+	SessionTokenFile string        `env:"SESSION_TOKEN_FILE" envDefault:""`
+	Region           string        `env:"REGION" envDefault:""`
+	Path             string        `env:"PATH" envDefault:""`
+	CACertFile       string        `env:"CA_CERT_FILE" envDefault:""`
+	InsecureTLS      bool          `env:"INSECURE_TLS" envDefault:"false"`
+	StorageClass     string        `env:"STORAGE_CLASS" envDefault:""`
+	Password         string        `env:"PASSWORD" envDefault:""`    // Secondary repository password, defaults to the primary one
+	Interval         time.Duration `env:"INTERVAL" envDefault:"24h"` // Replication interval
+	Retention        string        `env:"RETENTION" envDefault:""`   // Retention policy of the secondary repository, empty keeps every copied snapshot
 }
 
 // BackupConfig holds the backup configuration
 type BackupConfig struct {
-	StoragePath    string        `env:"STORAGE_PATH" envDefault:"/data"`
-	LogLevel       string        `env:"LOG_LEVEL" envDefault:"info"`
-	BackupInterval time.Duration `env:"INTERVAL" envDefault:"1h"`   // Backup interval
-	Retention      string        `env:"RETENTION" envDefault:"14d"` // Retention policy: keep backups within 7 days, 30 days, and 365 days
+	StoragePath      string        `env:"STORAGE_PATH" envDefault:"/data"`
+	PathTemplate     string        `env:"PATH_TEMPLATE" envDefault:"{pv}_{namespace}_{pvc}"` // Directory of a PVC under the storage path
+	PathResolver     string        `env:"PATH_RESOLVER" envDefault:"template"`               // Resolver locating PVC directories, template or a custom one
+	LogLevel         string        `env:"LOG_LEVEL" envDefault:"info"`
+	LogFormat        string        `env:"LOG_FORMAT" envDefault:"text"`          // Log format: text or json
+	LogFile          string        `env:"LOG_FILE" envDefault:""`                // File the logs are also written to, e.g. on a hostPath, empty disables it
+	LogFileMaxSize   string        `env:"LOG_FILE_MAX_SIZE" envDefault:"10MiB"`  // Size at which the log file is rotated
+	LogFileMaxFiles  int           `env:"LOG_FILE_MAX_FILES" envDefault:"5"`     // Number of rotated log files kept
+	BackupInterval   time.Duration `env:"INTERVAL" envDefault:"1h"`              // Backup interval
+	Retention        string        `env:"RETENTION" envDefault:"14d"`            // Retention policy: keep backups within 7 days, 30 days, and 365 days
+	DiscoveryMode    string        `env:"DISCOVERY_MODE" envDefault:"pod"`       // PVC discovery mode: pod or pvc
+	RepoLayout       string        `env:"REPO_LAYOUT" envDefault:"node"`         // Repository layout: node, shared or per-pvc
+	ShardByNamespace bool          `env:"SHARD_BY_NAMESPACE" envDefault:"false"` // Insert the PVC namespace into the repository path
+	MetricsAddr      string        `env:"METRICS_ADDR" envDefault:""`            // Listen address of the metrics endpoint, empty disables it
+	PprofAddr        string        `env:"PPROF_ADDR" envDefault:""`              // Listen address of the pprof profiling endpoint, empty disables it
+	APIAddr          string        `env:"API_ADDR" envDefault:""`                // Listen address of the REST API, empty disables it
+	APITLSCertFile   string        `env:"API_TLS_CERT_FILE" envDefault:""`       // Certificate of the REST API, empty serves plain HTTP
+	APITLSKeyFile    string        `env:"API_TLS_KEY_FILE" envDefault:""`        // Private key of the REST API certificate
+	ProxyConfig                    // Proxy of the agent's own HTTP traffic, e.g. webhooks, the Kubernetes API is reached directly
+
+	APIAudience string `env:"API_AUDIENCE" envDefault:"local-pvc-backup"` // Audience the bearer tokens of the REST API must be issued for
+	APIInsecure bool   `env:"API_INSECURE" envDefault:"false"`            // Serve the REST API over plain HTTP, e.g. behind a proxy terminating TLS
+
+	CheckInterval       time.Duration `env:"CHECK_INTERVAL" envDefault:"0"`                           // Deep repository check interval, 0 disables it
+	CheckReadDataSubset string        `env:"CHECK_READ_DATA_SUBSET" envDefault:"5%"`                  // Subset of pack data read by the deep check
+	PruneInterval       time.Duration `env:"PRUNE_INTERVAL" envDefault:"0"`                           // Repository prune interval, 0 prunes after every backup cycle
+	ClockSkewThreshold  time.Duration `env:"CLOCK_SKEW_THRESHOLD" envDefault:"1m"`                    // Warn when the node clock drifts further from the S3 clock, 0 disables it
+	AutoUnlock          bool          `env:"AUTO_UNLOCK" envDefault:"true"`                           // Remove stale repository locks and retry when restic finds the repository locked
+	RestoreThroughput   string        `env:"RESTORE_THROUGHPUT" envDefault:"50MiB"`                   // Assumed restore throughput per second until one is observed
+	Policy              string        `env:"POLICY" envDefault:""`                                    // Time of day rules limiting backup concurrency and bandwidth
+	NamespaceQuotas     string        `env:"NAMESPACE_QUOTAS" envDefault:""`                          // Per-namespace limits of stored bytes or snapshots
+	ClassPolicies       string        `env:"CLASS_POLICIES" envDefault:""`                            // Destinations, keys and retention allowed per data classification
+	AnomalyFactor       float64       `env:"ANOMALY_FACTOR" envDefault:"10"`                          // Warn when a backup changes this many times more than usual, 0 disables it
+	AnomalyMinSize      string        `env:"ANOMALY_MIN_SIZE" envDefault:"100MiB"`                    // Data added by a backup below which volume anomalies are ignored
+	Compression         string        `env:"COMPRESSION" envDefault:""`                               // restic compression of the backups: off, auto or max, empty uses the restic default
+	IgnoreFile          string        `env:"IGNORE_FILE" envDefault:".backupignore"`                  // File of gitignore-style exclude patterns at the root of each PVC, empty disables it
+	OneFileSystem       bool          `env:"ONE_FILE_SYSTEM" envDefault:"false"`                      // Do not back up other filesystems mounted inside the PVC directories
+	SkipSpecialFiles    bool          `env:"SKIP_SPECIAL_FILES" envDefault:"false"`                   // Do not back up sockets, named pipes and device files
+	ExcludeCaches       bool          `env:"EXCLUDE_CACHES" envDefault:"false"`                       // Skip directories tagged with CACHEDIR.TAG, overridden by the PVC annotation
+	Estimate            string        `env:"ESTIMATE" envDefault:"off"`                               // Estimate the data of backups with a restic dry-run first: off, new or always
+	ChangeDetection     string        `env:"CHANGE_DETECTION" envDefault:"off"`                       // Skip the regular backups of unchanged PVCs: off, mtime or dry-run
+	ChangeMaxAge        time.Duration `env:"CHANGE_MAX_AGE" envDefault:"24h"`                         // Back up unchanged PVCs once their last backup is this old, 0 for never
+	DiffReport          bool          `env:"DIFF_REPORT" envDefault:"false"`                          // Report the changes of each backup against the previous snapshot with restic diff
+	RepoMaxSize         string        `env:"REPO_MAX_SIZE" envDefault:""`                             // Size above which retention is applied early to a repository, empty for no limit
+	RepoQuotaPause      bool          `env:"REPO_QUOTA_PAUSE" envDefault:"false"`                     // Skip the backups into repositories over the size quota
+	MountCheckTimeout   time.Duration `env:"MOUNT_CHECK_TIMEOUT" envDefault:"10s"`                    // Time a PVC directory has to answer the pre-backup mount check, 0 disables it
+	HookTimeout         time.Duration `env:"HOOK_TIMEOUT" envDefault:"5m"`                            // Time the pre and post-backup hooks have to complete, 0 for no limit
+	FreezeTimeout       time.Duration `env:"FREEZE_TIMEOUT" envDefault:"10m"`                         // Time after which a frozen PVC filesystem is thawed, failing its backup
+	LVMSnapshotSize     string        `env:"LVM_SNAPSHOT_SIZE" envDefault:"10%ORIGIN"`                // Size of the snapshots of thick logical volumes
+	CSIReaderImage      string        `env:"CSI_READER_IMAGE" envDefault:"registry.k8s.io/pause:3.9"` // Image of the pods mounting CSI clones
+	CSITimeout          time.Duration `env:"CSI_TIMEOUT" envDefault:"10m"`                            // Time a CSI snapshot and its clone have to become ready
+	KubeletDir          string        `env:"KUBELET_DIR" envDefault:"/var/lib/kubelet"`               // Kubelet directory, mounted at the same path in the agent
+	DeviceConcurrency   int           `env:"DEVICE_CONCURRENCY" envDefault:"0"`                       // Number of PVCs on the same device backed up in parallel, 0 only applies the policy concurrency
+	StatusAnnotations   bool          `env:"STATUS_ANNOTATIONS" envDefault:"true"`                    // Annotate the PVCs with the outcome of their last backup
+	StatusResource      string        `env:"STATUS_RESOURCE" envDefault:"auto"`                       // Store of the PVC backup statuses: auto, crd, configmap or off
+	Operator            bool          `env:"OPERATOR" envDefault:"false"`                             // Back up the PVCs selected by BackupSchedule resources
+	Controller          bool          `env:"CONTROLLER" envDefault:"false"`                           // Leave maintenance, reports and scheduling to the cluster controller
+	Features            string        `env:"FEATURES" envDefault:""`                                  // Feature flags, e.g. anomaly-detection=off, overridden per node by the features annotation
+	TenantMode          bool          `env:"TENANT_MODE" envDefault:"false"`                          // Only offer the tenant commands, for wrappers exposing them to application teams
+
+	LeaderElection bool   `env:"LEADER_ELECTION" envDefault:"false"`                   // Elect a single node running prune and check
+	LeaseNamespace string `env:"LEASE_NAMESPACE" envDefault:"default"`                 // Namespace of the maintenance Lease
+	LeaseName      string `env:"LEASE_NAME" envDefault:"local-pvc-backup-maintenance"` // Name of the maintenance Lease
 }
 
+// Backend types
+const (
+	BackendS3     = "s3"
+	BackendGCS    = "gcs"
+	BackendAzure  = "azure"
+	BackendB2     = "b2"
+	BackendSFTP   = "sftp"
+	BackendREST   = "rest"
+	BackendRclone = "rclone"
+	BackendLocal  = "local"
+)
+
+// Discovery modes
+const (
+	// DiscoveryModePod discovers PVCs through the pods running on the node
+	DiscoveryModePod = "pod"
+	// DiscoveryModePVC discovers all PVCs whose PV is local to the node, mounted or not
+	DiscoveryModePVC = "pvc"
+)
+
+// Repository layouts
+const (
+	// RepoLayoutNode stores the backups of each node in its own node-{name} repository
+	RepoLayoutNode = "node"
+	// RepoLayoutShared stores the backups of all nodes in a single repository, told apart by tags
+	RepoLayoutShared = "shared"
+	// RepoLayoutPVC stores the backups of each PVC in its own {namespace}/{pvc} repository
+	RepoLayoutPVC = "per-pvc"
+
+	// NodeRepositoryPrefix prefixes the names of per-node repositories
+	NodeRepositoryPrefix = "node-"
+	// SharedRepositoryName is the name of the repository shared by all nodes
+	SharedRepositoryName = "shared"
+)
+
 // Annotations for backup configuration
 const (
 	// Base annotation prefix
@@ -44,13 +408,80 @@ const (
 	AnnotationEnabled = AnnotationPrefix + "/enabled"
 	AnnotationInclude = AnnotationPrefix + "/include"
 	AnnotationExclude = AnnotationPrefix + "/exclude"
+	// AnnotationDescription sets a human readable description stored as a snapshot tag
+	AnnotationDescription = AnnotationPrefix + "/description"
+	// AnnotationVerifyCommand runs in the application pod after each backup, its output is stored with the snapshot
+	AnnotationVerifyCommand = AnnotationPrefix + "/verify-command"
+	// AnnotationPreHook runs in the application pod before each backup, e.g. to flush its state to disk
+	AnnotationPreHook = AnnotationPrefix + "/pre-hook"
+	// AnnotationPostHook runs in the application pod after each backup, e.g. to resume writes
+	AnnotationPostHook = AnnotationPrefix + "/post-hook"
+	// AnnotationDumpCommand runs in the application pod at each backup, its output is stored as a snapshot
+	AnnotationDumpCommand = AnnotationPrefix + "/dump-command"
+	// AnnotationDumpFilename names the file holding the dump in its snapshot
+	AnnotationDumpFilename = AnnotationPrefix + "/dump-filename"
+	// AnnotationDumpOnly backs up the dump instead of the files of the PVC
+	AnnotationDumpOnly = AnnotationPrefix + "/dump-only"
+	// AnnotationFreeze freezes the filesystem of the PVC while its files are backed up
+	AnnotationFreeze = AnnotationPrefix + "/freeze"
+	// AnnotationVolumeSnapshot backs up the PVC from a snapshot of its volume: auto, lvm, btrfs or zfs
+	AnnotationVolumeSnapshot = AnnotationPrefix + "/volume-snapshot"
+	// AnnotationVolumeSnapshotClass selects the VolumeSnapshotClass of the csi volume snapshots
+	AnnotationVolumeSnapshotClass = AnnotationPrefix + "/volume-snapshot-class"
+	// AnnotationExcludeIfPresent lists files whose presence excludes the content of their directory
+	AnnotationExcludeIfPresent = AnnotationPrefix + "/exclude-if-present"
+	// AnnotationExcludeLargerThan skips the files of the PVC larger than a size, e.g. 1G
+	AnnotationExcludeLargerThan = AnnotationPrefix + "/exclude-larger-than"
+	// AnnotationExcludeCaches overrides whether directories tagged with CACHEDIR.TAG are backed up
+	AnnotationExcludeCaches = AnnotationPrefix + "/exclude-caches"
+	// AnnotationHookContainer selects the container commands run in, defaults to the first container
+	AnnotationHookContainer = AnnotationPrefix + "/hook-container"
+	// AnnotationPlans declares additional backup plans, each with its own schedule, retention and repository
+	AnnotationPlans = AnnotationPrefix + "/plans"
+	// AnnotationTTL sets how long the snapshots of a PVC are kept after the PVC is deleted
+	AnnotationTTL = AnnotationPrefix + "/ttl"
+	// AnnotationArchive marks a PVC holding a frozen dataset, backed up once and then skipped
+	AnnotationArchive = AnnotationPrefix + "/archive"
+	// AnnotationCompression overrides the restic compression of the backups of a PVC
+	AnnotationCompression = AnnotationPrefix + "/compression"
+
+	// AnnotationLastBackupTime is written by the agents with the time of the last successful backup of a PVC
+	AnnotationLastBackupTime = AnnotationPrefix + "/last-backup-time"
+	// AnnotationLastSnapshotID is written by the agents with the snapshot of the last successful backup of a PVC
+	AnnotationLastSnapshotID = AnnotationPrefix + "/last-snapshot-id"
+	// AnnotationLastStatus is written by the agents with the outcome of the last backup of a PVC
+	AnnotationLastStatus = AnnotationPrefix + "/last-status"
+
+	// AnnotationFeatures is the node annotation overriding the feature flags of its agent
+	AnnotationFeatures = AnnotationPrefix + "/features"
+
+	// LabelClassification is the namespace label holding the data classification of its PVCs
+	LabelClassification = AnnotationPrefix + "/classification"
 )
 
 // PVCBackupConfig represents the backup configuration for a specific PVC
 type PVCBackupConfig struct {
-	Enabled bool
-	Include string
-	Exclude string
+	Enabled             bool
+	Include             string
+	Exclude             string
+	ExcludeCaches       *bool // Overrides BACKUP_EXCLUDE_CACHES when set
+	ExcludeIfPresent    string
+	ExcludeLargerThan   string
+	Description         string
+	VerifyCommand       string
+	PreHook             string
+	PostHook            string
+	DumpCommand         string
+	DumpFilename        string
+	DumpOnly            bool
+	Freeze              bool
+	VolumeSnapshot      string
+	VolumeSnapshotClass string
+	HookContainer       string
+	Plans               string
+	TTL                 string
+	Archive             bool
+	Compression         string
 }
 
 // DefaultPVCBackupConfig returns the default backup configuration
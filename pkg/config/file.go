@@ -0,0 +1,134 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/caarlos0/env/v10"
+	"sigs.k8s.io/yaml"
+)
+
+// Load parses the configuration from the environment and the optional config file,
+// returning it with the settings of the file
+func Load(path string) (*Config, map[string]string, error) {
+	settings := make(map[string]string)
+	if path != "" {
+		var err error
+		if settings, err = LoadFile(path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	environment := make(map[string]string, len(settings))
+	for name, value := range settings {
+		environment[name] = value
+	}
+	for name, value := range env.ToMap(os.Environ()) {
+		environment[name] = value
+	}
+	config := &Config{}
+	if err := env.ParseWithOptions(config, env.Options{Environment: environment}); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse configuration: %v", err)
+	}
+	return config, settings, nil
+}
+
+// LoadFile reads a YAML config file and returns its settings under the names of their
+// environment variables. Nested keys are joined with underscores, so the s3 section's
+// endpoint key becomes S3_ENDPOINT, and lists are joined with commas. Environment
+// variables take precedence over the file.
+func LoadFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var settings map[string]any
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	env := make(map[string]string)
+	if err := flatten(env, "", settings); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return env, nil
+}
+
+// Setting is a setting of the effective configuration
+type Setting struct {
+	Name   string
+	Value  string
+	Source string // Where the value comes from: env, file or default
+}
+
+// Setting sources
+const (
+	SourceEnv     = "env"
+	SourceFile    = "file"
+	SourceDefault = "default"
+)
+
+// Settings returns every setting of the configuration, in declaration order, with the
+// value taking effect given the settings of the config file
+func Settings(fileSettings map[string]string) ([]Setting, error) {
+	params, err := env.GetFieldParams(&Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	settings := make([]Setting, 0, len(params))
+	for _, param := range params {
+		setting := Setting{Name: param.Key, Value: param.DefaultValue, Source: SourceDefault}
+		if value, ok := os.LookupEnv(param.Key); ok {
+			setting.Value, setting.Source = value, SourceEnv
+		} else if value, ok := fileSettings[param.Key]; ok {
+			setting.Value, setting.Source = value, SourceFile
+		}
+		settings = append(settings, setting)
+	}
+	return settings, nil
+}
+
+// flatten stores the values of a config section under their environment variable names
+func flatten(env map[string]string, prefix string, settings map[string]any) error {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := prefix + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		switch value := settings[key].(type) {
+		case nil:
+		case map[string]any:
+			if err := flatten(env, name+"_", value); err != nil {
+				return err
+			}
+		case []any:
+			items := make([]string, 0, len(value))
+			for _, item := range value {
+				if _, ok := item.(map[string]any); ok {
+					return fmt.Errorf("%s: lists hold plain values only", key)
+				}
+				items = append(items, scalar(item))
+			}
+			env[name] = strings.Join(items, ",")
+		default:
+			env[name] = scalar(value)
+		}
+	}
+	return nil
+}
+
+// scalar formats a plain YAML value like it would be written in an environment variable
+func scalar(value any) string {
+	// Numbers are decoded as float64, whole numbers keep their integer form
+	if number, ok := value.(float64); ok && number == float64(int64(number)) {
+		return fmt.Sprintf("%d", int64(number))
+	}
+	return fmt.Sprint(value)
+}
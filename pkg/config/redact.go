@@ -0,0 +1,55 @@
+package config
+
+import (
+	"net/url"
+	"strings"
+)
+
+// redacted replaces the values of credentials
+const redacted = "********"
+
+// Redact masks the value of a setting when it holds credentials: passwords, keys and
+// tokens, the passwords of URLs and the paths of webhook and ping URLs, which often
+// embed a token. Password commands are masked too, their arguments may carry the token
+// of the tool, while other settings naming a file or command are not.
+func Redact(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if SecretSetting(name) || strings.HasSuffix(name, "PASSWORD_COMMAND") {
+		return redacted
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return value
+	}
+	if (strings.HasSuffix(name, "WEBHOOK_URL") || strings.HasSuffix(name, "PING_URL")) && strings.Trim(u.Path, "/") != "" {
+		u.Path, u.RawQuery = "", ""
+		return u.Redacted() + "/" + redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		return u.Redacted()
+	}
+	return value
+}
+
+// SecretSetting reports whether the setting of the given name holds a credential
+func SecretSetting(name string) bool {
+	words := strings.Split(name, "_")
+	switch words[len(words)-1] {
+	case "FILE", "COMMAND":
+		return false
+	}
+	for i, word := range words {
+		switch word {
+		case "PASSWORD", "SECRET", "TOKEN", "HEADERS":
+			return true
+		case "KEY":
+			if i > 0 && (words[i-1] == "ACCESS" || words[i-1] == "ACCOUNT") {
+				return true
+			}
+		}
+	}
+	return false
+}
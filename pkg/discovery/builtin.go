@@ -0,0 +1,171 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PathResolverTemplate is the name of the built-in path resolver expanding BACKUP_PATH_TEMPLATE
+const PathResolverTemplate = "template"
+
+func init() {
+	RegisterSource(cfg.DiscoveryModePod, func(cfg.BackupConfig) (Source, error) {
+		return podSource{}, nil
+	})
+	RegisterSource(cfg.DiscoveryModePVC, func(cfg.BackupConfig) (Source, error) {
+		return volumeSource{}, nil
+	})
+	RegisterPathResolver(PathResolverTemplate, func(config cfg.BackupConfig) (PathResolver, error) {
+		return &templateResolver{storagePath: config.StoragePath, template: config.PathTemplate}, nil
+	})
+}
+
+// podSource discovers PVCs through the annotated pods running on the node
+type podSource struct{}
+
+func (podSource) Discover(ctx context.Context, node *Node) ([]PVCInfo, error) {
+	pods, err := node.ListPods(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use map to deduplicate PVCs
+	pvcMap := make(map[string]PVCInfo)
+
+	for _, pod := range pods {
+		node.Log.Debugf("Processing pod %s/%s", pod.Namespace, pod.Name)
+
+		// Get backup config from pod annotations
+		config := ApplyBackupAnnotations(cfg.DefaultPVCBackupConfig(), pod.Annotations)
+		if !config.Enabled {
+			node.Log.Debugf("  - Backup not enabled for pod %s/%s", pod.Namespace, pod.Name)
+			continue
+		}
+
+		// Process pod volumes
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim == nil {
+				continue
+			}
+
+			pvcName := volume.PersistentVolumeClaim.ClaimName
+			// Create unique key for PVC
+			key := fmt.Sprintf("%s/%s", pod.Namespace, pvcName)
+
+			// Get PVC object
+			pvc, err := node.Clientset.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(ctx, pvcName, metav1.GetOptions{})
+			if err != nil {
+				node.Log.Errorf("Failed to get PVC %s/%s: %v", pod.Namespace, pvcName, err)
+				continue
+			}
+
+			node.Log.Debugf("  - Checking PVC %s", key)
+			info, err := node.NewPVCInfo(ctx, pvc, config)
+			if err != nil {
+				node.Log.Errorf("%v", err)
+				continue
+			}
+			if pod.Status.Phase == corev1.PodRunning {
+				info.Pod = pod.Name
+			}
+
+			pvcMap[key] = info
+		}
+	}
+
+	return node.collectPVCs(pvcMap), nil
+}
+
+// volumeSource discovers all bound PVCs whose PV is local to the node, including
+// PVCs that are not mounted by any pod. Pod annotations only refine the
+// configuration taken from the PVC annotations.
+type volumeSource struct{}
+
+func (volumeSource) Discover(ctx context.Context, node *Node) ([]PVCInfo, error) {
+	pvs, err := node.Clientset.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list persistent volumes: %v", err)
+	}
+
+	pods, err := node.ListPods(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Index pod annotations and running pods by the PVCs they mount
+	podAnnotations := make(map[string][]map[string]string)
+	runningPods := make(map[string]string)
+	for _, pod := range pods {
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim == nil {
+				continue
+			}
+			key := fmt.Sprintf("%s/%s", pod.Namespace, volume.PersistentVolumeClaim.ClaimName)
+			podAnnotations[key] = append(podAnnotations[key], pod.Annotations)
+			if pod.Status.Phase == corev1.PodRunning {
+				runningPods[key] = pod.Name
+			}
+		}
+	}
+
+	pvcMap := make(map[string]PVCInfo)
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.ClaimRef == nil || !node.IsLocal(ctx, pv) {
+			continue
+		}
+
+		namespace, pvcName := pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name
+		key := fmt.Sprintf("%s/%s", namespace, pvcName)
+		node.Log.Debugf("Processing PV %s bound to %s", pv.Name, key)
+
+		pvc, err := node.Clientset.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, pvcName, metav1.GetOptions{})
+		if err != nil {
+			node.Log.Errorf("Failed to get PVC %s: %v", key, err)
+			continue
+		}
+
+		config := ApplyBackupAnnotations(cfg.DefaultPVCBackupConfig(), pvc.Annotations)
+		for _, annotations := range podAnnotations[key] {
+			config = ApplyBackupAnnotations(config, annotations)
+		}
+		if !config.Enabled {
+			node.Log.Debugf("  - Backup not enabled for PVC %s", key)
+			continue
+		}
+
+		info, err := node.NewPVCInfo(ctx, pvc, config)
+		if err != nil {
+			node.Log.Errorf("%v", err)
+			continue
+		}
+		info.Pod = runningPods[key]
+
+		pvcMap[key] = info
+	}
+
+	return node.collectPVCs(pvcMap), nil
+}
+
+// templateResolver locates PVCs under the storage path by expanding a template with
+// {pv}, {namespace} and {pvc} placeholders, which may use / on any OS
+type templateResolver struct {
+	storagePath string
+	template    string
+}
+
+func (r *templateResolver) ResolvePath(_ context.Context, pvc *corev1.PersistentVolumeClaim) (string, error) {
+	pvcPath := strings.NewReplacer(
+		"{pv}", pvc.Spec.VolumeName,
+		"{namespace}", pvc.Namespace,
+		"{pvc}", pvc.Name,
+	).Replace(r.template)
+	return filepath.Join(r.storagePath, filepath.FromSlash(pvcPath)), nil
+}
@@ -0,0 +1,132 @@
+// Package discovery finds the PVCs to back up on a node.
+//
+// Discovery sources and path resolvers are looked up by name, from the
+// BACKUP_DISCOVERY_MODE and BACKUP_PATH_RESOLVER settings, in a registry holding the
+// built-in implementations. Custom implementations, e.g. for bespoke provisioners,
+// are compiled in by registering them from an init function and building a main
+// package importing them along with the CLI:
+//
+//	func init() {
+//		discovery.RegisterPathResolver("my-provisioner", func(config cfg.BackupConfig) (discovery.PathResolver, error) {
+//			return &myResolver{root: config.StoragePath}, nil
+//		})
+//	}
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// PVCInfo is a PVC found by a discovery source, with the local directory resolved for
+// its data and the backup configuration read from its annotations and its pods'
+type PVCInfo struct {
+	Name      string
+	Namespace string
+	Path      string
+	Config    cfg.PVCBackupConfig
+	UID       string
+	Pod       string // Running pod mounting the PVC, empty when unmounted
+}
+
+// Node gives discovery sources access to the cluster and to the node they discover PVCs on
+type Node struct {
+	Clientset kubernetes.Interface
+	Name      string
+	Resolver  PathResolver
+	Log       *logrus.Logger
+
+	hostname   string // kubernetes.io/hostname label of the node, read on first use
+	hostnameMu sync.Mutex
+}
+
+// Source discovers the PVCs to back up on a node
+type Source interface {
+	Discover(ctx context.Context, node *Node) ([]PVCInfo, error)
+}
+
+// PathResolver returns the local directory holding the data of a bound PVC
+type PathResolver interface {
+	ResolvePath(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (string, error)
+}
+
+// SourceFactory creates a discovery source from the backup configuration
+type SourceFactory func(config cfg.BackupConfig) (Source, error)
+
+// PathResolverFactory creates a path resolver from the backup configuration
+type PathResolverFactory func(config cfg.BackupConfig) (PathResolver, error)
+
+var (
+	registryMu sync.RWMutex
+	sources    = make(map[string]SourceFactory)
+	resolvers  = make(map[string]PathResolverFactory)
+)
+
+// RegisterSource makes a discovery source available under the given name. It panics
+// when the name is already taken.
+func RegisterSource(name string, factory SourceFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := sources[name]; ok {
+		panic(fmt.Sprintf("discovery: source %q registered twice", name))
+	}
+	sources[name] = factory
+}
+
+// RegisterPathResolver makes a path resolver available under the given name. It
+// panics when the name is already taken.
+func RegisterPathResolver(name string, factory PathResolverFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := resolvers[name]; ok {
+		panic(fmt.Sprintf("discovery: path resolver %q registered twice", name))
+	}
+	resolvers[name] = factory
+}
+
+// NewSource creates the discovery source registered under the given name
+func NewSource(name string, config cfg.BackupConfig) (Source, error) {
+	registryMu.RLock()
+	factory, ok := sources[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported discovery mode: %s, available: %s", name, strings.Join(names(sources), ", "))
+	}
+	return factory(config)
+}
+
+// NewPathResolver creates the path resolver registered under the given name
+func NewPathResolver(name string, config cfg.BackupConfig) (PathResolver, error) {
+	registryMu.RLock()
+	factory, ok := resolvers[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported path resolver: %s, available: %s", name, strings.Join(names(resolvers), ", "))
+	}
+	return factory(config)
+}
+
+// names returns the sorted names of a registry
+func names[T any](registry map[string]T) []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	result := make([]string, 0, len(registry))
+	for name := range registry {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,212 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ListPods returns the pods scheduled on the node
+func (n *Node) ListPods(ctx context.Context) ([]corev1.Pod, error) {
+	pods, err := n.Clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("spec.nodeName=%s", n.Name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods on node %s: %v", n.Name, err)
+	}
+
+	n.Log.Debugf("Found %d pods on node %s", len(pods.Items), n.Name)
+	return pods.Items, nil
+}
+
+// Hostname returns the kubernetes.io/hostname label of the node, which local
+// provisioners pin PVs to and which may differ from the node name. The name is
+// returned when the label cannot be read.
+func (n *Node) Hostname(ctx context.Context) string {
+	n.hostnameMu.Lock()
+	defer n.hostnameMu.Unlock()
+	if n.hostname != "" {
+		return n.hostname
+	}
+
+	node, err := n.Clientset.CoreV1().Nodes().Get(ctx, n.Name, metav1.GetOptions{})
+	if err != nil {
+		n.Log.Warnf("Failed to read the hostname label of node %s, matching PVs on its name: %v", n.Name, err)
+		return n.Name
+	}
+	n.hostname = node.Labels[corev1.LabelHostname]
+	if n.hostname == "" {
+		n.hostname = n.Name
+	}
+	return n.hostname
+}
+
+// IsLocal reports whether the PV is pinned to the node through its node affinity, on
+// the kubernetes.io/hostname label of the node or on its name
+func (n *Node) IsLocal(ctx context.Context, pv *corev1.PersistentVolume) bool {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return false
+	}
+
+	in := func(requirement corev1.NodeSelectorRequirement, value string) bool {
+		if requirement.Operator != corev1.NodeSelectorOpIn {
+			return false
+		}
+		for _, v := range requirement.Values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == corev1.LabelHostname && in(expr, n.Hostname(ctx)) {
+				return true
+			}
+		}
+		for _, field := range term.MatchFields {
+			if field.Key == "metadata.name" && in(field, n.Name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewPVCInfo resolves the local path of a PVC and builds its backup info
+func (n *Node) NewPVCInfo(ctx context.Context, pvc *corev1.PersistentVolumeClaim, config cfg.PVCBackupConfig) (PVCInfo, error) {
+	// Get PV name from PVC
+	if pvc.Spec.VolumeName == "" {
+		return PVCInfo{}, fmt.Errorf("PVC %s/%s has no volume name", pvc.Namespace, pvc.Name)
+	}
+
+	fullPath, err := n.Resolver.ResolvePath(ctx, pvc)
+	if err != nil {
+		return PVCInfo{}, fmt.Errorf("failed to resolve path of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+
+	n.Log.Debugf("    - PVC name: %s", pvc.Name)
+	n.Log.Debugf("    - PV name: %s", pvc.Spec.VolumeName)
+	n.Log.Debugf("    - Full path: %s", fullPath)
+
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		return PVCInfo{}, fmt.Errorf("PVC %s/%s does not exist on node %s", pvc.Namespace, pvc.Name, n.Name)
+	}
+
+	n.Log.Debugf("    - Path exists, adding to backup list")
+
+	return PVCInfo{
+		Name:      pvc.Name,
+		Namespace: pvc.Namespace,
+		Path:      fullPath,
+		Config:    config,
+		UID:       string(pvc.UID),
+	}, nil
+}
+
+// collectPVCs converts the deduplicated PVC map to a slice
+func (n *Node) collectPVCs(pvcMap map[string]PVCInfo) []PVCInfo {
+	var pvcs []PVCInfo
+	for _, pvc := range pvcMap {
+		pvcs = append(pvcs, pvc)
+	}
+
+	n.Log.Debugf("Found %d PVCs to backup", len(pvcs))
+	return pvcs
+}
+
+// ApplyBackupAnnotations overlays the backup annotations found in annotations onto config
+func ApplyBackupAnnotations(config cfg.PVCBackupConfig, annotations map[string]string) cfg.PVCBackupConfig {
+	if enabled, ok := annotations[cfg.AnnotationEnabled]; ok {
+		config.Enabled = strings.ToLower(enabled) == "true"
+	}
+
+	if include, ok := annotations[cfg.AnnotationInclude]; ok {
+		config.Include = include
+	}
+
+	if exclude, ok := annotations[cfg.AnnotationExclude]; ok {
+		config.Exclude = exclude
+	}
+
+	if markers, ok := annotations[cfg.AnnotationExcludeIfPresent]; ok {
+		config.ExcludeIfPresent = markers
+	}
+
+	if size, ok := annotations[cfg.AnnotationExcludeLargerThan]; ok {
+		config.ExcludeLargerThan = size
+	}
+
+	if excludeCaches, ok := annotations[cfg.AnnotationExcludeCaches]; ok {
+		enabled := strings.ToLower(excludeCaches) == "true"
+		config.ExcludeCaches = &enabled
+	}
+
+	if description, ok := annotations[cfg.AnnotationDescription]; ok {
+		config.Description = description
+	}
+
+	if command, ok := annotations[cfg.AnnotationVerifyCommand]; ok {
+		config.VerifyCommand = command
+	}
+
+	if hook, ok := annotations[cfg.AnnotationPreHook]; ok {
+		config.PreHook = hook
+	}
+
+	if hook, ok := annotations[cfg.AnnotationPostHook]; ok {
+		config.PostHook = hook
+	}
+
+	if command, ok := annotations[cfg.AnnotationDumpCommand]; ok {
+		config.DumpCommand = command
+	}
+
+	if filename, ok := annotations[cfg.AnnotationDumpFilename]; ok {
+		config.DumpFilename = filename
+	}
+
+	if dumpOnly, ok := annotations[cfg.AnnotationDumpOnly]; ok {
+		config.DumpOnly = strings.ToLower(dumpOnly) == "true"
+	}
+
+	if freeze, ok := annotations[cfg.AnnotationFreeze]; ok {
+		config.Freeze = strings.ToLower(freeze) == "true"
+	}
+
+	if method, ok := annotations[cfg.AnnotationVolumeSnapshot]; ok {
+		config.VolumeSnapshot = strings.ToLower(method)
+	}
+
+	if class, ok := annotations[cfg.AnnotationVolumeSnapshotClass]; ok {
+		config.VolumeSnapshotClass = class
+	}
+
+	if container, ok := annotations[cfg.AnnotationHookContainer]; ok {
+		config.HookContainer = container
+	}
+
+	if plans, ok := annotations[cfg.AnnotationPlans]; ok {
+		config.Plans = plans
+	}
+
+	if ttl, ok := annotations[cfg.AnnotationTTL]; ok {
+		config.TTL = ttl
+	}
+
+	if archive, ok := annotations[cfg.AnnotationArchive]; ok {
+		config.Archive = strings.ToLower(archive) == "true"
+	}
+
+	if compression, ok := annotations[cfg.AnnotationCompression]; ok {
+		config.Compression = strings.ToLower(compression)
+	}
+
+	return config
+}
@@ -0,0 +1,94 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// TenantIdentity holds the credentials of the tenant, whose identity is taken from them
+type TenantIdentity struct {
+	Kubeconfig string // Kubeconfig of the tenant
+	TokenFile  string // File holding a bearer token of the tenant, e.g. from kubectl create token
+}
+
+// AccessChecker authorizes tenant commands with the RBAC permissions of a tenant on PVCs
+type AccessChecker struct {
+	clientset kubernetes.Interface
+	identity  string
+}
+
+// NewAccessChecker creates a checker asking the API server what the tenant may do with
+// its own credentials. The identity is the one the API server authenticates them as,
+// the caller cannot choose it.
+func (c *Client) NewAccessChecker(ctx context.Context, identity TenantIdentity) (*AccessChecker, error) {
+	var restConfig *rest.Config
+	switch {
+	case identity.Kubeconfig != "" && identity.TokenFile != "":
+		return nil, fmt.Errorf("a kubeconfig and a token cannot be used together")
+	case identity.Kubeconfig != "":
+		var err error
+		restConfig, err = clientcmd.BuildConfigFromFlags("", identity.Kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
+		}
+	case identity.TokenFile != "":
+		token, err := os.ReadFile(identity.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token: %v", err)
+		}
+		// Only the address of the API server is kept from the agent configuration
+		restConfig = rest.AnonymousClientConfig(c.config)
+		restConfig.BearerToken = strings.TrimSpace(string(token))
+	default:
+		return nil, fmt.Errorf("tenant commands require the kubeconfig or a token of the tenant")
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create k8s client: %v", err)
+	}
+	review, err := clientset.AuthenticationV1().SelfSubjectReviews().Create(ctx, &authenticationv1.SelfSubjectReview{}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to authenticate tenant: %v", err)
+	}
+	return &AccessChecker{clientset: clientset, identity: review.Status.UserInfo.Username}, nil
+}
+
+// Allowed reports whether the tenant may perform verb on the PVCs of a namespace
+func (a *AccessChecker) Allowed(ctx context.Context, namespace, verb string) (bool, error) {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Resource:  "persistentvolumeclaims",
+			},
+		},
+	}
+	result, err := a.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to check access of %s: %v", a.identity, err)
+	}
+	return result.Status.Allowed, nil
+}
+
+// Authorize fails unless the tenant may perform verb on the PVCs of a namespace
+func (a *AccessChecker) Authorize(ctx context.Context, namespace, verb string) error {
+	allowed, err := a.Allowed(ctx, namespace, verb)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("%s may not %s persistentvolumeclaims in namespace %s", a.identity, verb, namespace)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// NewWorkstationClient creates a client from a kubeconfig for tools running outside
+// the cluster, e.g. the kubectl plugin. It is bound to no node and discovers no PVCs.
+// An empty kubeconfig follows the kubectl rules (KUBECONFIG, then ~/.kube/config) and
+// an empty context selects the current one.
+func NewWorkstationClient(kubeconfig, kubeContext string, log *logrus.Logger) (*Client, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create k8s client: %v", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create k8s client: %v", err)
+	}
+	return &Client{clientset: clientset, dynamic: dynamicClient, config: restConfig, log: log}, nil
+}
+
+// PVCNode returns the node the PV of a PVC is pinned to, the node whose agent backs
+// it up
+func (c *Client) PVCNode(ctx context.Context, namespace, name string) (string, error) {
+	pvc, err := c.clientset.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get PVC %s/%s: %v", namespace, name, err)
+	}
+	if pvc.Spec.VolumeName == "" {
+		return "", fmt.Errorf("PVC %s/%s is not bound", namespace, name)
+	}
+	pv, err := c.clientset.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get PV %s: %v", pvc.Spec.VolumeName, err)
+	}
+	node := pinnedNode(pv)
+	if node == "" {
+		return "", fmt.Errorf("PV %s of PVC %s/%s is not local to a node", pv.Name, namespace, name)
+	}
+	return node, nil
+}
+
+// FindAgentPod returns the name of the running agent pod of a node, selected among the
+// pods of a namespace by a label selector, e.g. app=local-pvc-backup
+func (c *Client) FindAgentPod(ctx context.Context, namespace, selector, node string) (string, error) {
+	pods, err := c.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: selector,
+		FieldSelector: "spec.nodeName=" + node,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list agent pods: %v", err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil {
+			return pod.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no running agent pod matching %s in namespace %s on node %s", selector, namespace, node)
+}
+
+// PortForward forwards a local port of the loopback interface to a port of a pod
+// through the API server until ctx is done, returning the local port once ready
+func (c *Client) PortForward(ctx context.Context, namespace, pod string, port int) (int, error) {
+	transport, upgrader, err := spdy.RoundTripperFor(c.config)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create port-forward transport: %v", err)
+	}
+	url := c.clientset.CoreV1().RESTClient().Post().Resource("pods").Namespace(namespace).Name(pod).SubResource("portforward").URL()
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, url)
+
+	ready := make(chan struct{})
+	forwarder, err := portforward.NewOnAddresses(dialer, []string{"127.0.0.1"}, []string{fmt.Sprintf("0:%d", port)}, ctx.Done(), ready, io.Discard, io.Discard)
+	if err != nil {
+		return 0, fmt.Errorf("failed to forward port %d of pod %s/%s: %v", port, namespace, pod, err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- forwarder.ForwardPorts()
+	}()
+	select {
+	case <-ready:
+	case err := <-errs:
+		return 0, fmt.Errorf("failed to forward port %d of pod %s/%s: %v", port, namespace, pod, err)
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	ports, err := forwarder.GetPorts()
+	if err != nil || len(ports) == 0 {
+		return 0, fmt.Errorf("failed to forward port %d of pod %s/%s: %v", port, namespace, pod, err)
+	}
+	return int(ports[0].Local), nil
+}
+
+// CreateToken returns a short-lived token of a service account issued for an
+// audience, as kubectl create token does
+func (c *Client) CreateToken(ctx context.Context, namespace, serviceAccount, audience string, expiry time.Duration) (string, error) {
+	seconds := int64(expiry.Seconds())
+	request := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{Audiences: []string{audience}, ExpirationSeconds: &seconds},
+	}
+	response, err := c.clientset.CoreV1().ServiceAccounts(namespace).CreateToken(ctx, serviceAccount, request, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create token of service account %s/%s: %v", namespace, serviceAccount, err)
+	}
+	return response.Status.Token, nil
+}
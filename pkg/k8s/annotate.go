@@ -0,0 +1,31 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// AnnotatePVC sets annotations on a PVC with a merge patch, leaving the others alone.
+// The UID of the patch is a precondition, a PVC recreated under the same name is not
+// annotated.
+func (c *Client) AnnotatePVC(ctx context.Context, pvc PVCInfo, annotations map[string]string) error {
+	patch := map[string]any{
+		"metadata": map[string]any{
+			"uid":         pvc.UID,
+			"annotations": annotations,
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return fmt.Errorf("failed to encode annotations: %v", err)
+	}
+	_, err = c.clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(ctx, pvc.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to annotate PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// Stores of the backup status of the PVCs
+const (
+	// StatusResourceAuto uses the PVCBackupStatus resource when its CRD is installed and
+	// a ConfigMap otherwise
+	StatusResourceAuto = "auto"
+	// StatusResourceCRD uses the PVCBackupStatus resource
+	StatusResourceCRD = "crd"
+	// StatusResourceConfigMap uses a ConfigMap next to the PVC
+	StatusResourceConfigMap = "configmap"
+	// StatusResourceOff keeps no backup status
+	StatusResourceOff = "off"
+)
+
+// backupStatusResource is the PVCBackupStatus resource of deploy/crd-pvcbackupstatus.yaml
+var backupStatusResource = schema.GroupVersionResource{
+	Group:    config.AnnotationPrefix,
+	Version:  "v1alpha1",
+	Resource: "pvcbackupstatuses",
+}
+
+// backupStatusKind is the kind of the PVCBackupStatus resource
+const backupStatusKind = "PVCBackupStatus"
+
+// backupStatusSuffix suffixes the name of the PVC in the name of its status ConfigMap
+const backupStatusSuffix = "-backup-status"
+
+// backupStatusKey is the key of the status in the ConfigMap
+const backupStatusKey = "status"
+
+// PVCBackupStatus is the backup status of a PVC, kept by the agent of its node
+type PVCBackupStatus struct {
+	Node           string         `json:"node"`
+	LastSuccess    *time.Time     `json:"lastSuccess,omitempty"`
+	LastFailure    *time.Time     `json:"lastFailure,omitempty"`
+	LastError      string         `json:"lastError,omitempty"`
+	LastSkip       *time.Time     `json:"lastSkip,omitempty"` // Last backup skipped by quota, classification or unchanged data
+	LastSkipReason string         `json:"lastSkipReason,omitempty"`
+	NextRun        *time.Time     `json:"nextRun,omitempty"`
+	Size           BackupSize     `json:"size"`
+	History        []BackupRecord `json:"history,omitempty"` // Latest backups, most recent first
+}
+
+// BackupSize holds the size of the data of a PVC at its last successful backup
+type BackupSize struct {
+	Bytes      uint64 `json:"bytes"`
+	Files      int    `json:"files"`
+	AddedBytes uint64 `json:"addedBytes"` // Data the last backup added to the repository
+}
+
+// BackupRecord is a backup of a PVC in its status history
+type BackupRecord struct {
+	Time       time.Time `json:"time"`
+	Status     string    `json:"status"`
+	SnapshotID string    `json:"snapshotID,omitempty"`
+	Duration   string    `json:"duration,omitempty"`
+	AddedBytes uint64    `json:"addedBytes,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Plan       string    `json:"plan,omitempty"` // Plan or schedule of the backup, empty for the regular backups
+}
+
+// ResolveStatusResource returns the store of the backup status for the configured one,
+// looking up the PVCBackupStatus CRD for auto
+func (c *Client) ResolveStatusResource(resource string) (string, error) {
+	switch resource {
+	case StatusResourceCRD, StatusResourceConfigMap, StatusResourceOff:
+		return resource, nil
+	case StatusResourceAuto:
+	default:
+		return "", fmt.Errorf("unknown status resource %q, expected %s, %s, %s or %s", resource, StatusResourceAuto, StatusResourceCRD, StatusResourceConfigMap, StatusResourceOff)
+	}
+
+	resources, err := c.clientset.Discovery().ServerResourcesForGroupVersion(backupStatusResource.GroupVersion().String())
+	if apierrors.IsNotFound(err) {
+		return StatusResourceConfigMap, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the %s resource: %v", backupStatusKind, err)
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == backupStatusResource.Resource {
+			return StatusResourceCRD, nil
+		}
+	}
+	return StatusResourceConfigMap, nil
+}
+
+// UpdatePVCBackupStatus applies update to the backup status of a PVC in the given
+// store, creating it if needed. The status is owned by the PVC and deleted with it.
+func (c *Client) UpdatePVCBackupStatus(ctx context.Context, resource string, pvc PVCInfo, update func(status *PVCBackupStatus)) error {
+	var err error
+	switch resource {
+	case StatusResourceCRD:
+		err = c.updateStatusResource(ctx, pvc, update)
+	case StatusResourceConfigMap:
+		err = c.updateStatusConfigMap(ctx, pvc, update)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update backup status of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+	return nil
+}
+
+// statusOwner references the PVC owning its backup status
+func statusOwner(pvc PVCInfo) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "PersistentVolumeClaim",
+		Name:       pvc.Name,
+		UID:        types.UID(pvc.UID),
+	}
+}
+
+// updateStatusResource keeps the status in the PVCBackupStatus named after the PVC
+func (c *Client) updateStatusResource(ctx context.Context, pvc PVCInfo, update func(status *PVCBackupStatus)) error {
+	resources := c.dynamic.Resource(backupStatusResource).Namespace(pvc.Namespace)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		object, err := resources.Get(ctx, pvc.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			object = &unstructured.Unstructured{}
+			object.SetAPIVersion(backupStatusResource.GroupVersion().String())
+			object.SetKind(backupStatusKind)
+			object.SetName(pvc.Name)
+			object.SetNamespace(pvc.Namespace)
+			object.SetOwnerReferences([]metav1.OwnerReference{statusOwner(pvc)})
+		} else if err != nil {
+			return err
+		}
+
+		var status PVCBackupStatus
+		if data, ok := object.Object["status"]; ok {
+			encoded, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			json.Unmarshal(encoded, &status)
+		}
+		update(&status)
+		encoded, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		var data map[string]any
+		if err := json.Unmarshal(encoded, &data); err != nil {
+			return err
+		}
+		object.Object["status"] = data
+
+		if object.GetResourceVersion() == "" {
+			_, err = resources.Create(ctx, object, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				return apierrors.NewConflict(backupStatusResource.GroupResource(), pvc.Name, err)
+			}
+			return err
+		}
+		_, err = resources.Update(ctx, object, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// updateStatusConfigMap keeps the status as JSON in a ConfigMap next to the PVC, for
+// clusters without the PVCBackupStatus CRD
+func (c *Client) updateStatusConfigMap(ctx context.Context, pvc PVCInfo, update func(status *PVCBackupStatus)) error {
+	configMaps := c.clientset.CoreV1().ConfigMaps(pvc.Namespace)
+	name := pvc.Name + backupStatusSuffix
+	if len(name) > 253 {
+		name = pvc.UID + backupStatusSuffix
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			configMap = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            name,
+					Namespace:       pvc.Namespace,
+					Labels:          map[string]string{"app.kubernetes.io/managed-by": eventComponent},
+					OwnerReferences: []metav1.OwnerReference{statusOwner(pvc)},
+				},
+			}
+		} else if err != nil {
+			return err
+		}
+
+		var status PVCBackupStatus
+		json.Unmarshal([]byte(configMap.Data[backupStatusKey]), &status)
+		update(&status)
+		encoded, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+		configMap.Data = map[string]string{backupStatusKey: string(encoded)}
+
+		if configMap.ResourceVersion == "" {
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				return apierrors.NewConflict(corev1.Resource("configmaps"), name, err)
+			}
+			return err
+		}
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// GetPVCBackupStatus returns the backup status of a PVC kept in the given store, nil
+// when it has none yet or no status is kept
+func (c *Client) GetPVCBackupStatus(ctx context.Context, resource string, pvc PVCInfo) (*PVCBackupStatus, error) {
+	var status PVCBackupStatus
+	switch resource {
+	case StatusResourceCRD:
+		object, err := c.dynamic.Resource(backupStatusResource).Namespace(pvc.Namespace).Get(ctx, pvc.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get backup status of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		}
+		data, ok := object.Object["status"]
+		if !ok {
+			return nil, nil
+		}
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(encoded, &status); err != nil {
+			return nil, fmt.Errorf("invalid backup status of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		}
+	case StatusResourceConfigMap:
+		name := pvc.Name + backupStatusSuffix
+		if len(name) > 253 {
+			name = pvc.UID + backupStatusSuffix
+		}
+		configMap, err := c.clientset.CoreV1().ConfigMaps(pvc.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get backup status of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		}
+		if err := json.Unmarshal([]byte(configMap.Data[backupStatusKey]), &status); err != nil {
+			return nil, fmt.Errorf("invalid backup status of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		}
+	default:
+		return nil, nil
+	}
+	return &status, nil
+}
@@ -8,8 +8,12 @@ import (
 	"strings"
 
 	"github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/discovery"
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -19,27 +23,38 @@ import (
 // Client represents a Kubernetes client wrapper
 type Client struct {
 	clientset *kubernetes.Clientset
+	dynamic   dynamic.Interface // Custom resources, e.g. PVCBackupStatus
+	config    *rest.Config
 	nodeName  string
+	source    discovery.Source
+	node      *discovery.Node
 	log       *logrus.Logger
 }
 
+// PVCInfo contains information about a PVC that needs to be backed up
+type PVCInfo = discovery.PVCInfo
+
 // NewClient creates a new Kubernetes client
-func NewClient(log *logrus.Logger) (*Client, error) {
-	var config *rest.Config
+func NewClient(backupConfig config.BackupConfig, log *logrus.Logger) (*Client, error) {
+	var restConfig *rest.Config
 	var err error
 
 	// Try in-cluster config first
-	config, err = rest.InClusterConfig()
+	restConfig, err = rest.InClusterConfig()
 	if err != nil {
 		// Fall back to kubeconfig
 		kubeconfig := filepath.Join(homedir.HomeDir(), ".kube", "config")
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		restConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create k8s config: %v", err)
 		}
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create k8s client: %v", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create k8s client: %v", err)
 	}
@@ -50,10 +65,28 @@ func NewClient(log *logrus.Logger) (*Client, error) {
 		return nil, fmt.Errorf("KUBERNETES_NODE_NAME environment variable not set")
 	}
 
+	source, err := discovery.NewSource(backupConfig.DiscoveryMode, backupConfig)
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := discovery.NewPathResolver(backupConfig.PathResolver, backupConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Client{
 		clientset: clientset,
+		dynamic:   dynamicClient,
+		config:    restConfig,
 		nodeName:  nodeName,
-		log:       log,
+		source:    source,
+		node: &discovery.Node{
+			Clientset: clientset,
+			Name:      nodeName,
+			Resolver:  resolver,
+			Log:       log,
+		},
+		log: log,
 	}, nil
 }
 
@@ -62,113 +95,142 @@ func (c *Client) GetNodeName() string {
 	return c.nodeName
 }
 
-// GetPVCsToBackup returns a list of PVCs that need to be backed up on the current node
-func (c *Client) GetPVCsToBackup(ctx context.Context) ([]PVCInfo, error) {
-	// Get pods running on this node
-	pods, err := c.clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{
-		FieldSelector: fmt.Sprintf("spec.nodeName=%s", c.nodeName),
-	})
+// GetNodeAnnotations returns the annotations of the current node
+func (c *Client) GetNodeAnnotations(ctx context.Context) (map[string]string, error) {
+	node, err := c.clientset.CoreV1().Nodes().Get(ctx, c.nodeName, metav1.GetOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to list pods on node %s: %v", c.nodeName, err)
+		return nil, fmt.Errorf("failed to get node %s: %v", c.nodeName, err)
 	}
+	return node.Annotations, nil
+}
 
-	c.log.Debugf("Found %d pods on node %s", len(pods.Items), c.nodeName)
-
-	// Use map to deduplicate PVCs
-	pvcMap := make(map[string]PVCInfo)
-
-	for _, pod := range pods.Items {
-		c.log.Debugf("Processing pod %s/%s", pod.Namespace, pod.Name)
-
-		// Get backup config from pod annotations
-		cfg := getBackupConfig(pod.Annotations)
-		if !cfg.Enabled {
-			c.log.Debugf("  - Backup not enabled for pod %s/%s", pod.Namespace, pod.Name)
-			continue
-		}
-
-		// Process pod volumes
-		for _, volume := range pod.Spec.Volumes {
-			if volume.PersistentVolumeClaim == nil {
-				continue
-			}
+// GetNamespaceLabels returns the labels of a namespace
+func (c *Client) GetNamespaceLabels(ctx context.Context, name string) (map[string]string, error) {
+	namespace, err := c.clientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get namespace %s: %v", name, err)
+	}
+	return namespace.Labels, nil
+}
 
-			pvcName := volume.PersistentVolumeClaim.ClaimName
-			// Create unique key for PVC
-			key := fmt.Sprintf("%s/%s", pod.Namespace, pvcName)
+// PVCExists reports whether the PVC with the given UID still exists
+func (c *Client) PVCExists(ctx context.Context, namespace, name, uid string) (bool, error) {
+	pvc, err := c.clientset.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get PVC %s/%s: %v", namespace, name, err)
+	}
+	// A PVC recreated under the same name is another PVC
+	return string(pvc.UID) == uid, nil
+}
 
-			// Get PVC object
-			pvc, err := c.clientset.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(ctx, pvcName, metav1.GetOptions{})
-			if err != nil {
-				c.log.Errorf("Failed to get PVC %s/%s: %v", pod.Namespace, pvcName, err)
-				continue
-			}
+// ListPVCNames returns the names of the PVCs of a namespace matching a label selector
+func (c *Client) ListPVCNames(ctx context.Context, namespace, selector string) ([]string, error) {
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PVCs in namespace %s: %v", namespace, err)
+	}
+	names := make([]string, 0, len(pvcs.Items))
+	for _, pvc := range pvcs.Items {
+		names = append(names, pvc.Name)
+	}
+	return names, nil
+}
 
-			// Get PV name from PVC
-			if pvc.Spec.VolumeName == "" {
-				c.log.Errorf("PVC %s/%s has no volume name", pod.Namespace, pvcName)
-				continue
-			}
+// LocalPVC identifies a bound PVC whose PV is pinned to a node
+type LocalPVC struct {
+	Namespace string
+	Name      string
+	UID       string
+	Node      string
+	Plans     string // Value of the plans annotation of the PVC
+}
 
-			// Construct the path using PV name
-			pvcPath := fmt.Sprintf("%s_%s_%s", pvc.Spec.VolumeName, pod.Namespace, pvcName)
-			fullPath := filepath.Join("/data", pvcPath)
+// ListLocalPVCs returns the bound PVCs of the cluster whose PV is pinned to a single
+// node through its node affinity, the PVCs the agents can back up
+func (c *Client) ListLocalPVCs(ctx context.Context) ([]LocalPVC, error) {
+	pvs, err := c.clientset.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PVs: %v", err)
+	}
+	claims, err := c.clientset.CoreV1().PersistentVolumeClaims("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PVCs: %v", err)
+	}
+	plans := make(map[string]string)
+	for _, claim := range claims.Items {
+		plans[string(claim.UID)] = claim.Annotations[config.AnnotationPlans]
+	}
 
-			c.log.Debugf("  - Checking PVC %s", key)
-			c.log.Debugf("    - PVC name: %s", pvcName)
-			c.log.Debugf("    - PV name: %s", pvc.Spec.VolumeName)
-			c.log.Debugf("    - Full path: %s", fullPath)
+	var pvcs []LocalPVC
+	for _, pv := range pvs.Items {
+		claim := pv.Spec.ClaimRef
+		if claim == nil || pv.Status.Phase != corev1.VolumeBound {
+			continue
+		}
+		node := pinnedNode(&pv)
+		if node == "" {
+			continue
+		}
+		pvcs = append(pvcs, LocalPVC{Namespace: claim.Namespace, Name: claim.Name, UID: string(claim.UID), Node: node, Plans: plans[string(claim.UID)]})
+	}
+	return pvcs, nil
+}
 
-			if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-				c.log.Errorf("PVC %s/%s does not exist on node %s", pod.Namespace, pvcName, c.nodeName)
+// pinnedNode returns the node a PV is pinned to, empty when it may be used on several
+func pinnedNode(pv *corev1.PersistentVolume) string {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return ""
+	}
+	node := ""
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			// Zonal volumes are not local to a node
+			if expr.Operator != corev1.NodeSelectorOpIn || strings.Contains(expr.Key, "zone") || strings.Contains(expr.Key, "region") {
 				continue
 			}
-
-			c.log.Debugf("    - Path exists, adding to backup list")
-
-			pvcMap[key] = PVCInfo{
-				Name:      pvcName,
-				Namespace: pvc.Namespace,
-				Path:      fullPath,
-				Config:    cfg,
-				UID:       string(pvc.UID),
+			for _, value := range expr.Values {
+				if node != "" && node != value {
+					return ""
+				}
+				node = value
 			}
 		}
 	}
-
-	// Convert map to slice
-	var pvcs []PVCInfo
-	for _, pvc := range pvcMap {
-		pvcs = append(pvcs, pvc)
-	}
-
-	c.log.Debugf("Found %d PVCs to backup", len(pvcs))
-	return pvcs, nil
+	return node
 }
 
-// PVCInfo contains information about a PVC that needs to be backed up
-type PVCInfo struct {
-	Name      string
-	Namespace string
-	Path      string
-	Config    config.PVCBackupConfig
-	UID       string
+// GetPVCsToBackup returns a list of PVCs that need to be backed up on the current node
+func (c *Client) GetPVCsToBackup(ctx context.Context) ([]PVCInfo, error) {
+	return c.source.Discover(ctx, c.node)
 }
 
-func getBackupConfig(annotations map[string]string) config.PVCBackupConfig {
-	cfg := config.DefaultPVCBackupConfig()
-
-	if enabled, ok := annotations[config.AnnotationEnabled]; ok {
-		cfg.Enabled = strings.ToLower(enabled) == "true"
+// SetDaemonSetEnv sets an environment variable on all containers of a DaemonSet,
+// which rolls the DaemonSet pods out with the new value
+func (c *Client) SetDaemonSetEnv(ctx context.Context, namespace, name, key, value string) error {
+	ds, err := c.clientset.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get daemonset %s/%s: %v", namespace, name, err)
 	}
 
-	if include, ok := annotations[config.AnnotationInclude]; ok {
-		cfg.Include = include
+	for i := range ds.Spec.Template.Spec.Containers {
+		container := &ds.Spec.Template.Spec.Containers[i]
+		found := false
+		for j := range container.Env {
+			if container.Env[j].Name == key {
+				container.Env[j] = corev1.EnvVar{Name: key, Value: value}
+				found = true
+			}
+		}
+		if !found {
+			container.Env = append(container.Env, corev1.EnvVar{Name: key, Value: value})
+		}
 	}
 
-	if exclude, ok := annotations[config.AnnotationExclude]; ok {
-		cfg.Exclude = exclude
+	if _, err := c.clientset.AppsV1().DaemonSets(namespace).Update(ctx, ds, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update daemonset %s/%s: %v", namespace, name, err)
 	}
-
-	return cfg
+	return nil
 }
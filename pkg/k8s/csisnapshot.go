@@ -0,0 +1,285 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// volumeSnapshotResource is the VolumeSnapshot resource of the CSI external snapshotter
+var volumeSnapshotResource = schema.GroupVersionResource{
+	Group:    "snapshot.storage.k8s.io",
+	Version:  "v1",
+	Resource: "volumesnapshots",
+}
+
+// cloneOfLabel labels the VolumeSnapshots, PVCs and pods of a CSI clone with the UID of
+// the PVC it clones, so the leftovers of an agent killed during a backup are found
+const cloneOfLabel = "backup.local-pvc.io/clone-of"
+
+// readerUser is the unprivileged user of the reader pods, which only keep the clone
+// mounted while the agent reads it through the kubelet directory
+const readerUser int64 = 65534
+
+// clonePollInterval is the interval at which the state of a CSI clone is polled
+const clonePollInterval = 2 * time.Second
+
+// CSICloneOptions configures the CSI clones of PVCs
+type CSICloneOptions struct {
+	SnapshotClass string        // VolumeSnapshotClass, empty for the default class of the driver
+	ReaderImage   string        // Image of the pod mounting the clone on the node
+	KubeletDir    string        // Root directory of the kubelet, mounted at the same path in the agent
+	Timeout       time.Duration // Time the snapshot and the clone have to become ready
+}
+
+// CSIClone is a PVC restored from a CSI VolumeSnapshot of another PVC, mounted on this
+// node by a reader pod
+type CSIClone struct {
+	Namespace string
+	Name      string // Name of the VolumeSnapshot, the clone PVC and the reader pod
+	Path      string // Directory of the clone mounted in the reader pod
+}
+
+// CreateCSIClone snapshots a PVC with CSI, restores the snapshot into a new PVC and
+// mounts it read-only in a pod on this node, whose volume directory the agent reads
+// through the kubelet directory. A clone that cannot be completed is deleted.
+func (c *Client) CreateCSIClone(ctx context.Context, pvc PVCInfo, opts CSICloneOptions) (*CSIClone, error) {
+	source, err := c.clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(ctx, pvc.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+	if source.Spec.VolumeMode != nil && *source.Spec.VolumeMode == corev1.PersistentVolumeBlock {
+		return nil, fmt.Errorf("PVC %s/%s is a block volume, only filesystem volumes can be backed up", pvc.Namespace, pvc.Name)
+	}
+	if err := c.DeleteCSIClones(ctx, pvc); err != nil {
+		c.log.Warnf("Failed to delete leftover CSI clones of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	clone := &CSIClone{
+		Namespace: pvc.Namespace,
+		Name:      fmt.Sprintf("local-pvc-backup-%s-%d", pvc.UID[:min(8, len(pvc.UID))], time.Now().Unix()),
+	}
+	if err := c.createCSIClone(ctx, pvc, source, clone, opts); err != nil {
+		if deleteErr := c.DeleteCSIClone(context.WithoutCancel(ctx), clone); deleteErr != nil {
+			err = errors.Join(err, deleteErr)
+		}
+		return nil, err
+	}
+	return clone, nil
+}
+
+// createCSIClone creates the VolumeSnapshot, the clone PVC and the reader pod of a clone
+func (c *Client) createCSIClone(ctx context.Context, pvc PVCInfo, source *corev1.PersistentVolumeClaim, clone *CSIClone, opts CSICloneOptions) error {
+	labels := map[string]string{cloneOfLabel: pvc.UID}
+
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{"persistentVolumeClaimName": pvc.Name},
+	}
+	if opts.SnapshotClass != "" {
+		spec["volumeSnapshotClassName"] = opts.SnapshotClass
+	}
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": volumeSnapshotResource.GroupVersion().String(),
+		"kind":       "VolumeSnapshot",
+		"metadata":   map[string]interface{}{"name": clone.Name, "namespace": clone.Namespace},
+		"spec":       spec,
+	}}
+	snapshot.SetLabels(labels)
+	snapshots := c.dynamic.Resource(volumeSnapshotResource).Namespace(clone.Namespace)
+	if _, err := snapshots.Create(ctx, snapshot, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create VolumeSnapshot %s/%s: %v", clone.Namespace, clone.Name, err)
+	}
+
+	// The clone must be at least as large as the snapshot
+	var restoreSize resource.Quantity
+	err := c.pollClone(ctx, "VolumeSnapshot", clone, func() (bool, error) {
+		object, err := snapshots.Get(ctx, clone.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if message, _, _ := unstructured.NestedString(object.Object, "status", "error", "message"); message != "" {
+			return false, errors.New(message)
+		}
+		ready, _, _ := unstructured.NestedBool(object.Object, "status", "readyToUse")
+		if size, _, _ := unstructured.NestedString(object.Object, "status", "restoreSize"); size != "" {
+			if restoreSize, err = resource.ParseQuantity(size); err != nil {
+				return false, err
+			}
+		}
+		return ready, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	size := source.Spec.Resources.Requests[corev1.ResourceStorage]
+	if restoreSize.Cmp(size) > 0 {
+		size = restoreSize
+	}
+	apiGroup := volumeSnapshotResource.Group
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: clone.Name, Namespace: clone.Namespace, Labels: labels},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      source.Spec.AccessModes,
+			StorageClassName: source.Spec.StorageClassName,
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+			},
+			DataSource: &corev1.TypedLocalObjectReference{APIGroup: &apiGroup, Kind: "VolumeSnapshot", Name: clone.Name},
+		},
+	}
+	if _, err := c.clientset.CoreV1().PersistentVolumeClaims(clone.Namespace).Create(ctx, claim, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create clone PVC %s/%s: %v", clone.Namespace, clone.Name, err)
+	}
+
+	// Local volumes are provisioned on the node of their first consumer, so the reader
+	// pod goes through the scheduler, pinned to this node
+	runAsNonRoot, allowPrivilegeEscalation, user := true, false, readerUser
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: clone.Name, Namespace: clone.Namespace, Labels: labels},
+		Spec: corev1.PodSpec{
+			Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+						MatchFields: []corev1.NodeSelectorRequirement{{
+							Key:      "metadata.name",
+							Operator: corev1.NodeSelectorOpIn,
+							Values:   []string{c.nodeName},
+						}},
+					}},
+				},
+			}},
+			Tolerations:                   []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+			RestartPolicy:                 corev1.RestartPolicyNever,
+			TerminationGracePeriodSeconds: new(int64),
+			SecurityContext: &corev1.PodSecurityContext{
+				RunAsNonRoot:   &runAsNonRoot,
+				RunAsUser:      &user,
+				RunAsGroup:     &user,
+				SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+			},
+			Containers: []corev1.Container{{
+				Name:         "reader",
+				Image:        opts.ReaderImage,
+				VolumeMounts: []corev1.VolumeMount{{Name: "clone", MountPath: "/data", ReadOnly: true}},
+				SecurityContext: &corev1.SecurityContext{
+					AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+					Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+				},
+			}},
+			Volumes: []corev1.Volume{{
+				Name: "clone",
+				VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: clone.Name,
+					ReadOnly:  true,
+				}},
+			}},
+		},
+	}
+	created, err := c.clientset.CoreV1().Pods(clone.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to create reader pod %s/%s: %v", clone.Namespace, clone.Name, err)
+	}
+
+	var volumeName string
+	err = c.pollClone(ctx, "reader pod", clone, func() (bool, error) {
+		pod, err := c.clientset.CoreV1().Pods(clone.Namespace).Get(ctx, clone.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded {
+			return false, fmt.Errorf("reader pod %s", pod.Status.Phase)
+		}
+		claim, err := c.clientset.CoreV1().PersistentVolumeClaims(clone.Namespace).Get(ctx, clone.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		volumeName = claim.Spec.VolumeName
+		return pod.Status.Phase == corev1.PodRunning && volumeName != "", nil
+	})
+	if err != nil {
+		return err
+	}
+
+	clone.Path = filepath.Join(opts.KubeletDir, "pods", string(created.UID), "volumes", "kubernetes.io~csi", volumeName, "mount")
+	return nil
+}
+
+// pollClone waits for a part of a clone to be ready
+func (c *Client) pollClone(ctx context.Context, what string, clone *CSIClone, ready func() (bool, error)) error {
+	ticker := time.NewTicker(clonePollInterval)
+	defer ticker.Stop()
+	for {
+		ok, err := ready()
+		if err != nil {
+			return fmt.Errorf("%s of clone %s/%s failed: %v", what, clone.Namespace, clone.Name, err)
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s of clone %s/%s not ready in time", what, clone.Namespace, clone.Name)
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeleteCSIClone deletes the reader pod, the clone PVC and the VolumeSnapshot of a clone
+func (c *Client) DeleteCSIClone(ctx context.Context, clone *CSIClone) error {
+	var errs []error
+	if err := c.clientset.CoreV1().Pods(clone.Namespace).Delete(ctx, clone.Name, metav1.DeleteOptions{GracePeriodSeconds: new(int64)}); err != nil && !apierrors.IsNotFound(err) {
+		errs = append(errs, fmt.Errorf("failed to delete reader pod %s/%s: %v", clone.Namespace, clone.Name, err))
+	}
+	if err := c.clientset.CoreV1().PersistentVolumeClaims(clone.Namespace).Delete(ctx, clone.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		errs = append(errs, fmt.Errorf("failed to delete clone PVC %s/%s: %v", clone.Namespace, clone.Name, err))
+	}
+	if err := c.dynamic.Resource(volumeSnapshotResource).Namespace(clone.Namespace).Delete(ctx, clone.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		errs = append(errs, fmt.Errorf("failed to delete VolumeSnapshot %s/%s: %v", clone.Namespace, clone.Name, err))
+	}
+	return errors.Join(errs...)
+}
+
+// DeleteCSIClones deletes the clones of a PVC left over by an agent killed during a backup
+func (c *Client) DeleteCSIClones(ctx context.Context, pvc PVCInfo) error {
+	pods, err := c.clientset.CoreV1().Pods(pvc.Namespace).List(ctx, metav1.ListOptions{LabelSelector: cloneOfLabel + "=" + pvc.UID})
+	if err != nil {
+		return err
+	}
+	claims, err := c.clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace).List(ctx, metav1.ListOptions{LabelSelector: cloneOfLabel + "=" + pvc.UID})
+	if err != nil {
+		return err
+	}
+	snapshots, err := c.dynamic.Resource(volumeSnapshotResource).Namespace(pvc.Namespace).List(ctx, metav1.ListOptions{LabelSelector: cloneOfLabel + "=" + pvc.UID})
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, pod := range pods.Items {
+		names[pod.Name] = true
+	}
+	for _, claim := range claims.Items {
+		names[claim.Name] = true
+	}
+	for _, snapshot := range snapshots.Items {
+		names[snapshot.GetName()] = true
+	}
+
+	var errs []error
+	for name := range names {
+		c.log.Infof("Deleting leftover CSI clone %s/%s of PVC %s", pvc.Namespace, name, pvc.Name)
+		errs = append(errs, c.DeleteCSIClone(ctx, &CSIClone{Namespace: pvc.Namespace, Name: name}))
+	}
+	return errors.Join(errs...)
+}
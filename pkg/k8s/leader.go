@@ -0,0 +1,51 @@
+package k8s
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// RunLeaderElection takes part in the Lease based election identified by
+// namespace/name until ctx is done, calling onChange whenever this node gains
+// or loses the leadership
+func (c *Client) RunLeaderElection(ctx context.Context, namespace, name string, onChange func(leading bool)) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+		Client: c.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: c.nodeName,
+		},
+	}
+
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   60 * time.Second,
+			RenewDeadline:   40 * time.Second,
+			RetryPeriod:     10 * time.Second,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(context.Context) {
+					c.log.Infof("Acquired lease %s/%s", namespace, name)
+					onChange(true)
+				},
+				OnStoppedLeading: func() {
+					c.log.Infof("Lost lease %s/%s", namespace, name)
+					onChange(false)
+				},
+				OnNewLeader: func(identity string) {
+					if identity != c.nodeName {
+						c.log.Infof("Lease %s/%s is held by %s", namespace, name, identity)
+					}
+				},
+			},
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Caller is a user authenticated by the API server, e.g. a service account
+type Caller struct {
+	Name   string
+	UID    string
+	Groups []string
+	Extra  map[string]authorizationv1.ExtraValue
+}
+
+// AuthenticateToken asks the API server who a bearer token belongs to, failing when
+// the token is invalid, expired or not issued for audience. A dedicated audience keeps
+// the agent from accepting tokens meant for the Kubernetes API, which it could replay.
+func (c *Client) AuthenticateToken(ctx context.Context, token, audience string) (*Caller, error) {
+	review := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: []string{audience}},
+	}
+	result, err := c.clientset.AuthenticationV1().TokenReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to review token: %v", err)
+	}
+	if !result.Status.Authenticated {
+		if result.Status.Error != "" {
+			return nil, fmt.Errorf("token not authenticated: %s", result.Status.Error)
+		}
+		return nil, fmt.Errorf("token not authenticated")
+	}
+	if !slices.Contains(result.Status.Audiences, audience) {
+		return nil, fmt.Errorf("token not issued for audience %s", audience)
+	}
+
+	user := result.Status.User
+	caller := &Caller{Name: user.Username, UID: user.UID, Groups: user.Groups}
+	if len(user.Extra) > 0 {
+		caller.Extra = make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+		for key, value := range user.Extra {
+			caller.Extra[key] = authorizationv1.ExtraValue(value)
+		}
+	}
+	return caller, nil
+}
+
+// CallerAllowed reports whether a caller may perform verb on the PVCs of a namespace,
+// with the same RBAC rules as the tenant commands
+func (c *Client) CallerAllowed(ctx context.Context, caller *Caller, namespace, verb string) (bool, error) {
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   caller.Name,
+			UID:    caller.UID,
+			Groups: caller.Groups,
+			Extra:  caller.Extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Resource:  "persistentvolumeclaims",
+			},
+		},
+	}
+	result, err := c.clientset.AuthorizationV1().SubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to check access of %s: %v", caller.Name, err)
+	}
+	return result.Status.Allowed, nil
+}
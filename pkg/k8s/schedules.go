@@ -0,0 +1,236 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/discovery"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Operator resources of deploy/crd-operator.yaml
+var (
+	backupScheduleResource = schema.GroupVersionResource{Group: config.AnnotationPrefix, Version: "v1alpha1", Resource: "backupschedules"}
+	backupTargetResource   = schema.GroupVersionResource{Group: config.AnnotationPrefix, Version: "v1alpha1", Resource: "backuptargets"}
+)
+
+// BackupSchedule backs up the local PVCs it selects into a target on its own interval
+// and retention, declared by a cluster scoped BackupSchedule resource
+type BackupSchedule struct {
+	Name              string
+	Target            string
+	Interval          time.Duration
+	Retention         string
+	NamespaceSelector labels.Selector
+	Selector          labels.Selector
+	Include           string // Overrides the include annotation of the PVCs when set
+	Exclude           string // Overrides the exclude annotation of the PVCs when set
+}
+
+// Matches reports whether the schedule selects a PVC
+func (s BackupSchedule) Matches(pvc NodePVC) bool {
+	return s.NamespaceSelector.Matches(labels.Set(pvc.NamespaceLabels)) && s.Selector.Matches(labels.Set(pvc.Labels))
+}
+
+// BackupTarget is a destination of the backups of schedules, declared by a cluster
+// scoped BackupTarget resource
+type BackupTarget struct {
+	Name        string
+	Destination string            // Storage of the repositories, primary or replica
+	Repository  *TargetRepository // S3 storage of the repositories instead of the configured ones, nil when unset
+}
+
+// TargetRepository is the S3 storage of the repositories of a BackupTarget, with the
+// credentials read from a Secret of the agents' namespace
+type TargetRepository struct {
+	Endpoint  string `json:"endpoint"`
+	Bucket    string `json:"bucket"`
+	Path      string `json:"path"`
+	Region    string `json:"region"`
+	SecretRef struct {
+		Name string `json:"name"`
+	} `json:"secretRef"`
+}
+
+type backupScheduleSpec struct {
+	Target            string                `json:"target"`
+	Interval          string                `json:"interval"`
+	Retention         string                `json:"retention"`
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector"`
+	Selector          *metav1.LabelSelector `json:"selector"`
+	Include           string                `json:"include"`
+	Exclude           string                `json:"exclude"`
+}
+
+type backupTargetSpec struct {
+	Destination string            `json:"destination"`
+	Repository  *TargetRepository `json:"repository"`
+}
+
+// ListBackupSchedules returns the BackupSchedules of the cluster. Invalid schedules
+// are reported in the error along with the valid ones.
+func (c *Client) ListBackupSchedules(ctx context.Context) ([]BackupSchedule, error) {
+	list, err := c.dynamic.Resource(backupScheduleResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup schedules: %v", err)
+	}
+
+	var schedules []BackupSchedule
+	var errs []error
+	for _, item := range list.Items {
+		var spec backupScheduleSpec
+		if err := decodeSpec(item, &spec); err != nil {
+			errs = append(errs, fmt.Errorf("BackupSchedule %s: %v", item.GetName(), err))
+			continue
+		}
+		schedule, err := newBackupSchedule(item.GetName(), spec)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("BackupSchedule %s: %v", item.GetName(), err))
+			continue
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, errors.Join(errs...)
+}
+
+func newBackupSchedule(name string, spec backupScheduleSpec) (BackupSchedule, error) {
+	schedule := BackupSchedule{
+		Name:      name,
+		Target:    spec.Target,
+		Retention: spec.Retention,
+		Include:   spec.Include,
+		Exclude:   spec.Exclude,
+	}
+	if schedule.Target == "" {
+		return BackupSchedule{}, fmt.Errorf("target is required")
+	}
+	interval, err := time.ParseDuration(spec.Interval)
+	if err != nil || interval <= 0 {
+		return BackupSchedule{}, fmt.Errorf("invalid interval %q", spec.Interval)
+	}
+	schedule.Interval = interval
+
+	// A missing selector selects everything, as in network policies
+	if schedule.NamespaceSelector, err = labelSelector(spec.NamespaceSelector); err != nil {
+		return BackupSchedule{}, fmt.Errorf("invalid namespaceSelector: %v", err)
+	}
+	if schedule.Selector, err = labelSelector(spec.Selector); err != nil {
+		return BackupSchedule{}, fmt.Errorf("invalid selector: %v", err)
+	}
+	return schedule, nil
+}
+
+func labelSelector(selector *metav1.LabelSelector) (labels.Selector, error) {
+	if selector == nil {
+		return labels.Everything(), nil
+	}
+	return metav1.LabelSelectorAsSelector(selector)
+}
+
+// ListBackupTargets returns the BackupTargets of the cluster by name
+func (c *Client) ListBackupTargets(ctx context.Context) (map[string]BackupTarget, error) {
+	list, err := c.dynamic.Resource(backupTargetResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup targets: %v", err)
+	}
+
+	targets := make(map[string]BackupTarget, len(list.Items))
+	for _, item := range list.Items {
+		var spec backupTargetSpec
+		if err := decodeSpec(item, &spec); err != nil {
+			return nil, fmt.Errorf("BackupTarget %s: %v", item.GetName(), err)
+		}
+		if repository := spec.Repository; repository != nil && (repository.Endpoint == "" || repository.Bucket == "" || repository.SecretRef.Name == "") {
+			return nil, fmt.Errorf("BackupTarget %s: repository requires endpoint, bucket and secretRef", item.GetName())
+		}
+		targets[item.GetName()] = BackupTarget{Name: item.GetName(), Destination: spec.Destination, Repository: spec.Repository}
+	}
+	return targets, nil
+}
+
+// GetSecretData returns the data of the Secret holding the credentials of a target
+func (c *Client) GetSecretData(ctx context.Context, namespace, name string) (map[string][]byte, error) {
+	secret, err := c.clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s: %v", namespace, name, err)
+	}
+	return secret.Data, nil
+}
+
+// decodeSpec decodes the spec of a custom resource
+func decodeSpec(item unstructured.Unstructured, spec any) error {
+	data, err := json.Marshal(item.Object["spec"])
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return fmt.Errorf("invalid spec: %v", err)
+	}
+	return nil
+}
+
+// NodePVC is a bound PVC local to the node, backed up or not, with the labels the
+// backup schedules select it by
+type NodePVC struct {
+	Info            PVCInfo
+	Labels          map[string]string
+	NamespaceLabels map[string]string
+}
+
+// ListNodePVCs returns the bound PVCs whose PV is pinned to the node, regardless of
+// their backup annotations, which still configure their backups
+func (c *Client) ListNodePVCs(ctx context.Context) ([]NodePVC, error) {
+	pvs, err := c.clientset.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PVs: %v", err)
+	}
+
+	// A single list of the PVCs serves every PV of the node
+	claims, err := c.clientset.CoreV1().PersistentVolumeClaims("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PVCs: %v", err)
+	}
+	claimsByName := make(map[string]*corev1.PersistentVolumeClaim, len(claims.Items))
+	for i := range claims.Items {
+		claimsByName[claims.Items[i].Namespace+"/"+claims.Items[i].Name] = &claims.Items[i]
+	}
+
+	namespaceLabels := make(map[string]map[string]string)
+	var pvcs []NodePVC
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		claim := pv.Spec.ClaimRef
+		if claim == nil || pv.Status.Phase != corev1.VolumeBound || pinnedNode(pv) != c.nodeName {
+			continue
+		}
+
+		pvc, ok := claimsByName[claim.Namespace+"/"+claim.Name]
+		if !ok {
+			c.log.Errorf("PVC %s/%s of PV %s not found", claim.Namespace, claim.Name, pv.Name)
+			continue
+		}
+		info, err := c.node.NewPVCInfo(ctx, pvc, discovery.ApplyBackupAnnotations(config.DefaultPVCBackupConfig(), pvc.Annotations))
+		if err != nil {
+			c.log.Errorf("%v", err)
+			continue
+		}
+
+		if _, ok := namespaceLabels[pvc.Namespace]; !ok {
+			nsLabels, err := c.GetNamespaceLabels(ctx, pvc.Namespace)
+			if err != nil {
+				return nil, err
+			}
+			namespaceLabels[pvc.Namespace] = nsLabels
+		}
+		pvcs = append(pvcs, NodePVC{Info: info, Labels: pvc.Labels, NamespaceLabels: namespaceLabels[pvc.Namespace]})
+	}
+	return pvcs, nil
+}
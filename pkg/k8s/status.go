@@ -0,0 +1,176 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/config"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Node status Leases, one per agent, report the version and health of the agents
+const (
+	// StatusLeasePrefix prefixes the names of node status Leases
+	StatusLeasePrefix = "local-pvc-backup-node-"
+
+	// The label selecting the node status Leases
+	statusLabel         = "app.kubernetes.io/component"
+	statusLabelValue    = "agent-status"
+	statusLabelSelector = statusLabel + "=" + statusLabelValue
+
+	annotationVersion     = config.AnnotationPrefix + "/agent-version"
+	annotationStartedAt   = config.AnnotationPrefix + "/started-at"
+	annotationLastCycle   = config.AnnotationPrefix + "/last-cycle"
+	annotationLastSuccess = config.AnnotationPrefix + "/last-success"
+	annotationLastError   = config.AnnotationPrefix + "/last-error"
+	annotationFailures    = config.AnnotationPrefix + "/failures"
+)
+
+// NodeStatus is the state an agent reports about itself
+type NodeStatus struct {
+	Node        string
+	Version     string
+	StartedAt   time.Time // Start of the agent process
+	LastCycle   time.Time // End of the last backup cycle, zero before the first one
+	LastSuccess time.Time // End of the last successful backup cycle
+	LastError   string    // Error of the last backup cycle, empty when it succeeded
+	RenewedAt   time.Time
+	Expiry      time.Duration // Time after which a status not renewed is stale
+	// Failures counts the failed PVC backups of the node by namespace, since its
+	// status Lease was created
+	Failures map[string]int
+	// CycleFailures counts the failed PVC backups of the last cycle by namespace,
+	// added to Failures when reported
+	CycleFailures map[string]int
+}
+
+// Healthy reports whether the running agent completed a successful backup cycle
+func (s NodeStatus) Healthy() bool {
+	return !s.LastSuccess.IsZero() && !s.LastSuccess.Before(s.StartedAt) && s.LastError == ""
+}
+
+// Stale reports whether the agent stopped renewing its status
+func (s NodeStatus) Stale(now time.Time) bool {
+	return s.Expiry > 0 && now.Sub(s.RenewedAt) > s.Expiry
+}
+
+// ReportNodeStatus creates or updates the status Lease of this node
+func (c *Client) ReportNodeStatus(ctx context.Context, namespace string, status NodeStatus) error {
+	leases := c.clientset.CoordinationV1().Leases(namespace)
+	name := StatusLeasePrefix + c.nodeName
+
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels:    map[string]string{statusLabel: statusLabelValue},
+			},
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to get status lease %s/%s: %v", namespace, name, err)
+	}
+
+	annotations := map[string]string{
+		annotationVersion:   status.Version,
+		annotationStartedAt: formatTime(status.StartedAt),
+	}
+	if !status.LastCycle.IsZero() {
+		annotations[annotationLastCycle] = formatTime(status.LastCycle)
+	}
+	if !status.LastSuccess.IsZero() {
+		annotations[annotationLastSuccess] = formatTime(status.LastSuccess)
+	}
+	if status.LastError != "" {
+		annotations[annotationLastError] = status.LastError
+	}
+	// The failure counters survive agent restarts in the Lease
+	failures := parseFailures(lease.Annotations[annotationFailures])
+	for namespace, count := range status.CycleFailures {
+		failures[namespace] += count
+	}
+	if len(failures) > 0 {
+		data, err := json.Marshal(failures)
+		if err != nil {
+			return fmt.Errorf("failed to encode failures: %v", err)
+		}
+		annotations[annotationFailures] = string(data)
+	}
+	lease.Annotations = annotations
+
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(status.Expiry / time.Second)
+	lease.Spec.HolderIdentity = &c.nodeName
+	lease.Spec.RenewTime = &now
+	lease.Spec.LeaseDurationSeconds = &seconds
+
+	if lease.ResourceVersion == "" {
+		_, err = leases.Create(ctx, lease, metav1.CreateOptions{})
+	} else {
+		_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update status lease %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+// ListNodeStatuses returns the statuses reported by all agents, sorted by node
+func (c *Client) ListNodeStatuses(ctx context.Context, namespace string) ([]NodeStatus, error) {
+	leases, err := c.clientset.CoordinationV1().Leases(namespace).List(ctx, metav1.ListOptions{LabelSelector: statusLabelSelector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list status leases: %v", err)
+	}
+
+	statuses := make([]NodeStatus, 0, len(leases.Items))
+	for _, lease := range leases.Items {
+		status := NodeStatus{
+			Version:     lease.Annotations[annotationVersion],
+			StartedAt:   parseTime(lease.Annotations[annotationStartedAt]),
+			LastCycle:   parseTime(lease.Annotations[annotationLastCycle]),
+			LastSuccess: parseTime(lease.Annotations[annotationLastSuccess]),
+			LastError:   lease.Annotations[annotationLastError],
+			Failures:    parseFailures(lease.Annotations[annotationFailures]),
+		}
+		if lease.Spec.HolderIdentity != nil {
+			status.Node = *lease.Spec.HolderIdentity
+		}
+		if lease.Spec.RenewTime != nil {
+			status.RenewedAt = lease.Spec.RenewTime.Time
+		}
+		if lease.Spec.LeaseDurationSeconds != nil {
+			status.Expiry = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Node < statuses[j].Node
+	})
+	return statuses, nil
+}
+
+// parseFailures parses the failure counters annotation, empty when missing or invalid
+func parseFailures(value string) map[string]int {
+	failures := make(map[string]int)
+	if value != "" {
+		json.Unmarshal([]byte(value), &failures)
+	}
+	return failures
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// parseTime parses an RFC 3339 annotation, returning the zero time when missing or invalid
+func parseTime(value string) time.Time {
+	t, _ := time.Parse(time.RFC3339, value)
+	return t
+}
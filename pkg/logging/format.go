@@ -0,0 +1,63 @@
+package logging
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Fields of the structured log entries, named consistently across operations so log
+// pipelines can index them
+const (
+	FieldNode       = "node"
+	FieldNamespace  = "namespace"
+	FieldPVC        = "pvc"
+	FieldSnapshotID = "snapshot_id"
+	FieldDuration   = "duration" // Seconds
+)
+
+// SetFormat sets the format of the log output. JSON entries carry the node of the
+// agent in every entry, text output stays unchanged.
+func SetFormat(log *logrus.Logger, format, node string) error {
+	switch format {
+	case FormatText, "":
+		log.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp: true,
+		})
+	case FormatJSON:
+		log.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		})
+		if node != "" {
+			log.AddHook(&fieldHook{fields: logrus.Fields{FieldNode: node}})
+		}
+	default:
+		return fmt.Errorf("unsupported log format %q, expected %s or %s", format, FormatText, FormatJSON)
+	}
+	return nil
+}
+
+// fieldHook adds fields to every log entry not setting them itself
+type fieldHook struct {
+	fields logrus.Fields
+}
+
+func (h *fieldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *fieldHook) Fire(entry *logrus.Entry) error {
+	for key, value := range h.fields {
+		if _, ok := entry.Data[key]; !ok {
+			entry.Data[key] = value
+		}
+	}
+	return nil
+}
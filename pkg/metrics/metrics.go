@@ -0,0 +1,272 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric types
+const (
+	TypeGauge     = "gauge"
+	TypeCounter   = "counter"
+	TypeHistogram = "histogram"
+)
+
+// Content types of the exposition formats
+const (
+	contentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Labels represents the label set of a metric sample
+type Labels map[string]string
+
+// Registry holds the agent metrics and renders them in the Prometheus text format, or
+// in the OpenMetrics format with the exemplars of the histogram samples
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+	names   []string
+}
+
+type metric struct {
+	help    string
+	typ     string
+	buckets []float64 // Upper bounds of the histogram buckets, without +Inf
+	samples map[string]*sample
+}
+
+type sample struct {
+	labels    Labels
+	value     float64     // Value of a gauge or counter, sum of the observations of a histogram
+	counts    []uint64    // Cumulative observation counts of the histogram buckets, +Inf last
+	exemplars []*exemplar // Latest exemplar of each histogram bucket, +Inf last
+}
+
+// exemplar links a histogram observation to external data, e.g. the trace of the
+// operation observed
+type exemplar struct {
+	labels Labels
+	value  float64
+	time   time.Time
+}
+
+// NewRegistry creates a new metrics registry
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]*metric),
+	}
+}
+
+// Register declares a metric with its help text and type
+func (r *Registry) Register(name, help, typ string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.metrics[name]; ok {
+		return
+	}
+	r.metrics[name] = &metric{
+		help:    help,
+		typ:     typ,
+		samples: make(map[string]*sample),
+	}
+	r.names = append(r.names, name)
+	sort.Strings(r.names)
+}
+
+// RegisterHistogram declares a histogram with its help text and bucket upper bounds
+func (r *Registry) RegisterHistogram(name, help string, buckets []float64) {
+	r.Register(name, help, TypeHistogram)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics[name].buckets = buckets
+}
+
+// Observe adds an observation to a histogram sample. The exemplar labels, e.g. the
+// trace ID of the observed operation, are kept as latest exemplar of the bucket of
+// the observation unless empty.
+func (r *Registry) Observe(name string, labels Labels, value float64, exemplarLabels Labels) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := r.metrics[name]
+	if m == nil || m.typ != TypeHistogram {
+		return
+	}
+	s := r.sample(name, labels)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(m.buckets)+1)
+		s.exemplars = make([]*exemplar, len(m.buckets)+1)
+	}
+
+	s.value += value
+	observed := len(m.buckets)
+	for i := len(m.buckets) - 1; i >= 0 && value <= m.buckets[i]; i-- {
+		observed = i
+	}
+	for i := observed; i < len(s.counts); i++ {
+		s.counts[i]++
+	}
+	if len(exemplarLabels) > 0 {
+		s.exemplars[observed] = &exemplar{labels: exemplarLabels, value: value, time: time.Now()}
+	}
+}
+
+// Set sets the value of a gauge sample
+func (r *Registry) Set(name string, labels Labels, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sample(name, labels).value = value
+}
+
+// Add adds delta to the value of a counter or gauge sample
+func (r *Registry) Add(name string, labels Labels, delta float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sample(name, labels).value += delta
+}
+
+// Delete removes the sample with the given labels
+func (r *Registry) Delete(name string, labels Labels) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.metrics[name]; ok {
+		delete(m.samples, labels.String())
+	}
+}
+
+// sample returns the sample for the given labels, creating it if needed. Callers must hold the lock.
+func (r *Registry) sample(name string, labels Labels) *sample {
+	m, ok := r.metrics[name]
+	if !ok {
+		m = &metric{typ: TypeGauge, samples: make(map[string]*sample)}
+		r.metrics[name] = m
+		r.names = append(r.names, name)
+		sort.Strings(r.names)
+	}
+
+	key := labels.String()
+	s, ok := m.samples[key]
+	if !ok {
+		s = &sample{labels: labels}
+		m.samples[key] = s
+	}
+	return s
+}
+
+// Render writes all metrics in the Prometheus text exposition format
+func (r *Registry) Render() string {
+	return r.render(false)
+}
+
+// RenderOpenMetrics writes all metrics in the OpenMetrics text format, with exemplars
+func (r *Registry) RenderOpenMetrics() string {
+	return r.render(true)
+}
+
+func (r *Registry) render(openMetrics bool) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+	for _, name := range r.names {
+		m := r.metrics[name]
+
+		// OpenMetrics names counter families without the _total suffix of their samples
+		family, sampleName := name, name
+		if openMetrics && m.typ == TypeCounter {
+			family = strings.TrimSuffix(name, "_total")
+			sampleName = family + "_total"
+		}
+		if m.help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", family, m.help)
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", family, m.typ)
+
+		keys := make([]string, 0, len(m.samples))
+		for key := range m.samples {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := m.samples[key]
+			if m.typ == TypeHistogram {
+				if s.counts == nil {
+					continue
+				}
+				renderHistogram(&b, name, m.buckets, s, openMetrics)
+				continue
+			}
+			fmt.Fprintf(&b, "%s%s %g\n", sampleName, key, s.value)
+		}
+	}
+	if openMetrics {
+		b.WriteString("# EOF\n")
+	}
+	return b.String()
+}
+
+// renderHistogram writes the bucket, sum and count samples of a histogram sample
+func renderHistogram(b *strings.Builder, name string, buckets []float64, s *sample, openMetrics bool) {
+	for i, count := range s.counts {
+		bound := "+Inf"
+		if i < len(buckets) {
+			bound = fmt.Sprintf("%g", buckets[i])
+		}
+		labels := Labels{"le": bound}
+		for key, value := range s.labels {
+			labels[key] = value
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d", name, labels, count)
+		if e := s.exemplars[i]; openMetrics && e != nil {
+			fmt.Fprintf(b, " # %s %g %.3f", e.labels, e.value, float64(e.time.UnixMilli())/1000)
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(b, "%s_sum%s %g\n", name, s.labels, s.value)
+	fmt.Fprintf(b, "%s_count%s %d\n", name, s.labels, s.counts[len(s.counts)-1])
+}
+
+// Handler returns an HTTP handler serving the metrics, in the OpenMetrics format to
+// scrapers asking for it, e.g. Prometheus with exemplar storage enabled
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text") {
+			w.Header().Set("Content-Type", contentTypeOpenMetrics)
+			fmt.Fprint(w, r.RenderOpenMetrics())
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeText)
+		fmt.Fprint(w, r.Render())
+	})
+}
+
+// String renders the label set in the Prometheus format, e.g. {a="1",b="2"}
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(l))
+	for key := range l {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(l[key])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, key, value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,213 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+)
+
+// Event kinds
+const (
+	EventBackupFailed = "backup_failed"
+	EventCheckFailed  = "check_failed"
+	EventPruneFailed  = "prune_failed"
+	EventOverQuota    = "repository_over_quota"
+)
+
+// DefaultTemplate is the message of a notification when NOTIFY_TEMPLATE is not set
+const DefaultTemplate = `{{.Title}} on node {{.Node}}{{if .PVC}} for PVC {{.Namespace}}/{{.PVC}}{{end}}: {{.Error}}`
+
+// maxErrorLength is the length of the error excerpt in the notifications
+const maxErrorLength = 500
+
+var eventTitles = map[string]string{
+	EventBackupFailed: "Backup failed",
+	EventCheckFailed:  "Repository check failed",
+	EventPruneFailed:  "Repository prune failed",
+	EventOverQuota:    "Repository over its size quota",
+}
+
+// Event describes a failure worth notifying
+type Event struct {
+	Kind       string    `json:"kind"`
+	Title      string    `json:"title"`
+	Node       string    `json:"node"`
+	Namespace  string    `json:"namespace,omitempty"`
+	PVC        string    `json:"pvc,omitempty"`
+	PVCUID     string    `json:"pvc_uid,omitempty"`
+	Repository string    `json:"repository,omitempty"`
+	Error      string    `json:"error"`
+	Message    string    `json:"message"` // Rendered NOTIFY_TEMPLATE
+	Time       time.Time `json:"time"`
+}
+
+// Notifier delivers failure events to a notification channel
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// Options are the settings and clients the notifiers are created with
+type Options struct {
+	Config     cfg.NotifyConfig
+	Node       string
+	Proxy      cfg.ProxyConfig
+	Kubernetes *k8s.Client
+}
+
+// Factory creates a notifier from its settings
+type Factory func(options Options) (Notifier, error)
+
+var (
+	factories   = make(map[string]Factory)
+	factoriesMu sync.Mutex
+)
+
+// Register makes a notifier selectable by name in NOTIFY_SINKS
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[name] = factory
+}
+
+// Sinks returns the names of the registered notifiers
+func Sinks() []string {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseSinks returns the notifiers selected by NOTIFY_SINKS, the webhook alone when it
+// is empty and NOTIFY_WEBHOOK_URL is set
+func ParseSinks(config cfg.NotifyConfig) ([]string, error) {
+	if strings.TrimSpace(config.Sinks) == "" {
+		if config.WebhookURL != "" {
+			return []string{SinkWebhook}, nil
+		}
+		return nil, nil
+	}
+
+	var sinks []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(config.Sinks, ",") {
+		if name = strings.TrimSpace(name); name == "" || seen[name] {
+			continue
+		}
+		factoriesMu.Lock()
+		_, ok := factories[name]
+		factoriesMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown notification sink %q, expected one of %s", name, strings.Join(Sinks(), ", "))
+		}
+		seen[name] = true
+		sinks = append(sinks, name)
+	}
+	return sinks, nil
+}
+
+// ParseTemplate parses a notification message template, the default one when empty,
+// rendering it once so references to unknown fields fail before the first failure
+func ParseTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultTemplate
+	}
+	tmpl, err := template.New("notification").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+	if err := tmpl.Execute(io.Discard, Event{}); err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// sink is a notifier selected in NOTIFY_SINKS
+type sink struct {
+	name     string
+	notifier Notifier
+}
+
+// Dispatcher completes failure events and delivers them to every selected notifier
+type Dispatcher struct {
+	sinks    []sink
+	template *template.Template
+	node     string
+}
+
+// New creates the notifiers selected in NOTIFY_SINKS, nil when none is
+func New(options Options) (*Dispatcher, error) {
+	names, err := ParseSinks(options.Config)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	tmpl, err := ParseTemplate(options.Config.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Dispatcher{template: tmpl, node: options.Node}
+	for _, name := range names {
+		factoriesMu.Lock()
+		factory := factories[name]
+		factoriesMu.Unlock()
+		notifier, err := factory(options)
+		if err != nil {
+			return nil, fmt.Errorf("%s notifications: %v", name, err)
+		}
+		d.sinks = append(d.sinks, sink{name: name, notifier: notifier})
+	}
+	return d, nil
+}
+
+// Notify completes the title, node, time, error excerpt and message of an event and
+// delivers it to every notifier, returning the failed deliveries. A nil dispatcher
+// discards it.
+func (d *Dispatcher) Notify(ctx context.Context, event Event) error {
+	if d == nil {
+		return nil
+	}
+	event.Title = eventTitles[event.Kind]
+	event.Node = d.node
+	event.Time = time.Now().UTC()
+	event.Error = excerpt(event.Error)
+
+	var message strings.Builder
+	if err := d.template.Execute(&message, event); err != nil {
+		return fmt.Errorf("failed to render notification: %v", err)
+	}
+	event.Message = message.String()
+
+	var errs []error
+	for _, sink := range d.sinks {
+		if err := sink.notifier.Notify(ctx, event); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", sink.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// excerpt shortens an error message to its first line and maxErrorLength characters,
+// restic output can run over many lines
+func excerpt(message string) string {
+	message, _, _ = strings.Cut(strings.TrimSpace(message), "\n")
+	if runes := []rune(message); len(runes) > maxErrorLength {
+		message = string(runes[:maxErrorLength]) + "…"
+	}
+	return message
+}
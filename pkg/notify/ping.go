@@ -0,0 +1,114 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+)
+
+// Ping attempts, a missed ping raises a false alarm on the monitoring side
+const (
+	pingAttempts = 3
+	pingTimeout  = 10 * time.Second
+	pingBackoff  = 5 * time.Second
+)
+
+// maxPingBody is the size of the error posted with a failure ping, Healthchecks.io
+// keeps the first 100 kB
+const maxPingBody = 10000
+
+// Pinger pings a dead man's switch such as Healthchecks.io at the start and end of
+// each backup cycle, which alerts when the pings stop, e.g. because the whole agent
+// is down
+type Pinger struct {
+	url    string
+	start  bool
+	client *http.Client
+}
+
+// NewPinger creates a pinger for url, with {node} replaced by the node name so each
+// agent pings its own check, nil when pinging is disabled
+func NewPinger(config cfg.NotifyConfig, node string, proxy cfg.ProxyConfig) *Pinger {
+	if config.PingURL == "" {
+		return nil
+	}
+	client := &http.Client{Timeout: pingTimeout}
+	if proxy.Enabled() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = proxy.Func()
+		client.Transport = transport
+	}
+	return &Pinger{
+		url:    strings.TrimSuffix(strings.ReplaceAll(config.PingURL, "{node}", node), "/"),
+		start:  config.PingStart,
+		client: client,
+	}
+}
+
+// Start signals the start of a cycle, letting the monitoring measure its duration
+// and alert on cycles that never end
+func (p *Pinger) Start(ctx context.Context) error {
+	if p == nil || !p.start {
+		return nil
+	}
+	return p.ping(ctx, p.url+"/start", "")
+}
+
+// Finish signals the end of a cycle, on the failure URL with the error when it failed
+func (p *Pinger) Finish(ctx context.Context, err error) error {
+	if p == nil {
+		return nil
+	}
+	if err != nil {
+		message := err.Error()
+		if len(message) > maxPingBody {
+			message = message[:maxPingBody]
+		}
+		return p.ping(ctx, p.url+"/fail", message)
+	}
+	return p.ping(ctx, p.url, "")
+}
+
+// ping posts to target, retrying a few times since a lost ping raises a false alarm
+func (p *Pinger) ping(ctx context.Context, target, body string) error {
+	var err error
+	for attempt := 1; attempt <= pingAttempts; attempt++ {
+		if err = p.post(ctx, target, body); err == nil {
+			return nil
+		}
+		if attempt < pingAttempts {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(pingBackoff):
+			}
+		}
+	}
+	return err
+}
+
+func (p *Pinger) post(ctx context.Context, target, body string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create ping request: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		// Leave out the URL, its path is the key of the check
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("failed to ping: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("ping returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+)
+
+// Built-in notifiers
+const (
+	SinkWebhook = "webhook"
+	SinkStdout  = "stdout"
+	SinkEvent   = "event"
+	SinkExec    = "exec"
+)
+
+// Webhook message formats
+const (
+	FormatSlack = "slack"
+	FormatJSON  = "json"
+)
+
+func init() {
+	Register(SinkWebhook, newWebhookNotifier)
+	Register(SinkStdout, newStdoutNotifier)
+	Register(SinkEvent, newEventNotifier)
+	Register(SinkExec, newExecNotifier)
+}
+
+// webhookNotifier posts the events to NOTIFY_WEBHOOK_URL
+type webhookNotifier struct {
+	webhook *Webhook
+	format  string
+}
+
+func newWebhookNotifier(options Options) (Notifier, error) {
+	if options.Config.WebhookURL == "" {
+		return nil, fmt.Errorf("NOTIFY_WEBHOOK_URL is not set")
+	}
+	switch options.Config.Format {
+	case FormatSlack, FormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown format %q, expected %s or %s", options.Config.Format, FormatSlack, FormatJSON)
+	}
+	return &webhookNotifier{webhook: NewWebhook(options.Config.WebhookURL, options.Proxy), format: options.Config.Format}, nil
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, event Event) error {
+	// Slack and compatible chat tools only read text, other receivers get the event
+	if n.format == FormatSlack {
+		return n.webhook.Send(ctx, struct {
+			Text string `json:"text"`
+		}{event.Message})
+	}
+	return n.webhook.Send(ctx, struct {
+		Text  string `json:"text"`
+		Event Event  `json:"event"`
+	}{event.Message, event})
+}
+
+// stdoutNotifier writes the events as JSON lines to the standard output, apart from
+// the logs on the standard error, for log collectors
+type stdoutNotifier struct {
+	out io.Writer
+	mu  sync.Mutex
+}
+
+func newStdoutNotifier(options Options) (Notifier, error) {
+	return &stdoutNotifier{out: os.Stdout}, nil
+}
+
+func (n *stdoutNotifier) Notify(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err = n.out.Write(append(data, '\n'))
+	return err
+}
+
+// eventReasons are the reasons of the Kubernetes events by kind
+var eventReasons = map[string]string{
+	EventBackupFailed: "BackupFailed",
+	EventCheckFailed:  "RepositoryCheckFailed",
+	EventPruneFailed:  "RepositoryPruneFailed",
+	EventOverQuota:    "RepositoryOverQuota",
+}
+
+// eventNotifier records the events as Kubernetes warning events, on the PVC of a
+// failed backup and on the node otherwise
+type eventNotifier struct {
+	client *k8s.Client
+}
+
+func newEventNotifier(options Options) (Notifier, error) {
+	if options.Kubernetes == nil {
+		return nil, fmt.Errorf("no Kubernetes client")
+	}
+	return &eventNotifier{client: options.Kubernetes}, nil
+}
+
+func (n *eventNotifier) Notify(ctx context.Context, event Event) error {
+	reason := eventReasons[event.Kind]
+	if event.PVC != "" {
+		pvc := k8s.PVCInfo{Namespace: event.Namespace, Name: event.PVC, UID: event.PVCUID}
+		return n.client.RecordPVCEvent(ctx, pvc, reason, event.Message)
+	}
+	return n.client.RecordNodeEvent(ctx, reason, event.Message)
+}
+
+// execNotifier runs NOTIFY_EXEC_COMMAND with the event as JSON on its standard input
+// and its fields in NOTIFY_* environment variables
+type execNotifier struct {
+	command string
+	timeout time.Duration
+}
+
+func newExecNotifier(options Options) (Notifier, error) {
+	if options.Config.ExecCommand == "" {
+		return nil, fmt.Errorf("NOTIFY_EXEC_COMMAND is not set")
+	}
+	return &execNotifier{command: options.Config.ExecCommand, timeout: options.Config.ExecTimeout}, nil
+}
+
+func (n *execNotifier) Notify(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+	if n.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.timeout)
+		defer cancel()
+	}
+
+	shell := []string{"sh", "-c", n.command}
+	if runtime.GOOS == "windows" {
+		shell = []string{"cmd", "/c", n.command}
+	}
+	cmd := exec.CommandContext(ctx, shell[0], shell[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(),
+		"NOTIFY_KIND="+event.Kind,
+		"NOTIFY_TITLE="+event.Title,
+		"NOTIFY_NODE="+event.Node,
+		"NOTIFY_NAMESPACE="+event.Namespace,
+		"NOTIFY_PVC="+event.PVC,
+		"NOTIFY_REPOSITORY="+event.Repository,
+		"NOTIFY_ERROR="+event.Error,
+		"NOTIFY_MESSAGE="+event.Message,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("notification command failed: %v: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/api"
+	"github.com/monlor/local-pvc-backup/pkg/backup"
+)
+
+// agentClient calls the REST API of an agent through a forwarded local port
+type agentClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func newAgentClient(port int, useTLS bool, token string) *agentClient {
+	scheme := "http"
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if useTLS {
+		scheme = "https"
+		// The port-forward reaches the selected pod through the API server, which already
+		// authenticated the tunnel, and the certificate of the agent does not name
+		// localhost
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &agentClient{
+		baseURL: fmt.Sprintf("%s://127.0.0.1:%d", scheme, port),
+		token:   token,
+		http:    &http.Client{Transport: transport},
+	}
+}
+
+// call sends a request to the API and decodes its JSON response into out
+func (a *agentClient) call(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call the agent: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&failure); err != nil || failure.Error == "" {
+			return fmt.Errorf("agent answered %s", resp.Status)
+		}
+		return fmt.Errorf("%s", failure.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// listSnapshots prints the snapshots of a PVC
+func listSnapshots(ctx context.Context, agent *agentClient, namespace, name string, asJSON bool) error {
+	var list api.SnapshotList
+	if err := agent.call(ctx, http.MethodGet, fmt.Sprintf("/api/v1/pvcs/%s/%s/snapshots", namespace, name), nil, &list); err != nil {
+		return err
+	}
+	if asJSON {
+		data, err := json.MarshalIndent(list.Snapshots, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tADDED\tDESCRIPTION")
+	for _, snapshot := range list.Snapshots {
+		added := ""
+		if snapshot.Summary != nil {
+			added = backup.FormatBytes(snapshot.Summary.DataAdded)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", snapshot.ShortID, snapshot.Time.Local().Format(time.RFC3339), added, snapshot.Description())
+	}
+	return w.Flush()
+}
+
+// runBackup triggers a backup of a PVC and waits for its outcome
+func runBackup(ctx context.Context, agent *agentClient, request api.BackupRequest) error {
+	var status api.BackupStatus
+	if err := agent.call(ctx, http.MethodPost, "/api/v1/backups", request, &status); err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/api/v1/backups/%s/%s", request.Namespace, request.Name)
+	for status.State == api.StateRunning {
+		if err := wait(ctx); err != nil {
+			return err
+		}
+		if err := agent.call(ctx, http.MethodGet, path, nil, &status); err != nil {
+			return err
+		}
+	}
+	if status.State == api.StateFailed {
+		return fmt.Errorf("backup failed: %s", status.Error)
+	}
+	fmt.Printf("Backed up PVC %s/%s\n", request.Namespace, request.Name)
+	return nil
+}
+
+// runRestore triggers an in-place restore of a PVC and waits for its outcome
+func runRestore(ctx context.Context, agent *agentClient, request api.RestoreRequest) error {
+	var status api.RestoreStatus
+	if err := agent.call(ctx, http.MethodPost, "/api/v1/restores", request, &status); err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/api/v1/restores/%s/%s", request.Namespace, request.Name)
+	for status.State == api.StateRunning {
+		if err := wait(ctx); err != nil {
+			return err
+		}
+		if err := agent.call(ctx, http.MethodGet, path, nil, &status); err != nil {
+			return err
+		}
+	}
+	if status.State == api.StateFailed {
+		return fmt.Errorf("restore failed: %s", status.Error)
+	}
+
+	fmt.Printf("Restored snapshot %s taken at %s\n", status.Snapshot, status.SnapshotTime.Local().Format(time.RFC3339))
+	if status.SafetySnapshot != "" {
+		fmt.Printf("Safety snapshot of the previous data: %s\n", status.SafetySnapshot)
+		fmt.Printf("Undo with: local-pvc-backup rollback -n %s --pvc %s, in the agent pod\n", request.Namespace, request.Name)
+	}
+	return nil
+}
+
+// wait waits for the next poll of a running operation
+func wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(pollInterval):
+		return nil
+	}
+}
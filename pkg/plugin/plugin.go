@@ -0,0 +1,185 @@
+// Package plugin implements kubectl pvc-backup, a kubectl plugin running the commands
+// of the agents from a workstation. It finds the node a PVC is stored on and calls the
+// REST API of the agent pod of that node through a port-forward, so nobody has to look
+// up the pod or exec into the privileged agent.
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/monlor/local-pvc-backup/pkg/api"
+	"github.com/monlor/local-pvc-backup/pkg/backup"
+	"github.com/monlor/local-pvc-backup/pkg/k8s"
+	"github.com/monlor/local-pvc-backup/pkg/version"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// options holds the flags locating the agents and authenticating to their API
+type options struct {
+	kubeconfig     string
+	kubeContext    string
+	namespace      string
+	agentNamespace string
+	agentSelector  string
+	apiPort        int
+	apiHTTP        bool
+	token          string
+	serviceAccount string
+	audience       string
+}
+
+// tokenExpiry is the lifetime of the tokens created for --service-account
+const tokenExpiry = 10 * time.Minute
+
+// pollInterval is the interval the state of a triggered backup or restore is read at
+const pollInterval = 2 * time.Second
+
+// Execute runs the plugin
+func Execute() {
+	if err := newRootCommand().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func newRootCommand() *cobra.Command {
+	opts := &options{}
+	root := &cobra.Command{
+		Use:          "kubectl pvc-backup",
+		Short:        "Back up and restore local PVCs through the local-pvc-backup agents",
+		Long:         "Run the commands of the local-pvc-backup agents from a workstation. Each command finds the node the PV of the PVC is pinned to and calls the REST API of the agent pod of that node through a port-forward",
+		Version:      version.Version,
+		SilenceUsage: true,
+	}
+	flags := root.PersistentFlags()
+	flags.StringVar(&opts.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file (default: KUBECONFIG or ~/.kube/config)")
+	flags.StringVar(&opts.kubeContext, "context", "", "Kubeconfig context to use (default: the current context)")
+	flags.StringVarP(&opts.namespace, "namespace", "n", "default", "Namespace of the PVC")
+	flags.StringVar(&opts.agentNamespace, "agent-namespace", "default", "Namespace of the agent DaemonSet")
+	flags.StringVar(&opts.agentSelector, "agent-selector", "app in (local-pvc-backup, local-pvc-backup-windows)", "Label selector of the agent pods")
+	flags.IntVar(&opts.apiPort, "api-port", 8443, "Port of the REST API of the agents, BACKUP_API_ADDR")
+	flags.BoolVar(&opts.apiHTTP, "api-http", false, "Talk plain HTTP to agents serving the REST API with BACKUP_API_INSECURE")
+	flags.StringVar(&opts.token, "token", "", "Bearer token issued for the audience of the REST API")
+	flags.StringVar(&opts.serviceAccount, "service-account", "", "Service account to create a short-lived token of instead of --token, as namespace/name")
+	flags.StringVar(&opts.audience, "audience", "local-pvc-backup", "Audience of the tokens created for --service-account, BACKUP_API_AUDIENCE")
+	root.MarkFlagsMutuallyExclusive("token", "service-account")
+
+	var snapshotsJSON bool
+	snapshotsCmd := &cobra.Command{
+		Use:   "snapshots PVC",
+		Short: "List the snapshots of a PVC",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.run(args[0], func(ctx context.Context, agent *agentClient) error {
+				return listSnapshots(ctx, agent, opts.namespace, args[0], snapshotsJSON)
+			})
+		},
+	}
+	snapshotsCmd.Flags().BoolVar(&snapshotsJSON, "json", false, "Print the snapshots as JSON")
+
+	var description string
+	backupCmd := &cobra.Command{
+		Use:   "backup PVC",
+		Short: "Back up a PVC right away",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.run(args[0], func(ctx context.Context, agent *agentClient) error {
+				return runBackup(ctx, agent, api.BackupRequest{Namespace: opts.namespace, Name: args[0], Description: description})
+			})
+		},
+	}
+	backupCmd.Flags().StringVar(&description, "description", "", "Description stored with the snapshot, e.g. pre-upgrade v2.3")
+
+	var snapshot, at string
+	var deleteFiles, yes bool
+	restoreCmd := &cobra.Command{
+		Use:   "restore PVC",
+		Short: "Restore a PVC from a snapshot",
+		Long:  "Restore a snapshot of a PVC in place, by ID or as it was at --at. The restore takes a safety snapshot first and can be undone with the rollback command of the agent",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			request := api.RestoreRequest{Namespace: opts.namespace, Name: args[0], Snapshot: snapshot, Delete: deleteFiles}
+			if at != "" {
+				t, err := backup.ParseTime(at)
+				if err != nil {
+					return err
+				}
+				request.At = &t
+			}
+			if !yes && !confirm(fmt.Sprintf("Restore PVC %s/%s in place, overwriting its current data?", opts.namespace, args[0])) {
+				return fmt.Errorf("restore cancelled")
+			}
+			return opts.run(args[0], func(ctx context.Context, agent *agentClient) error {
+				return runRestore(ctx, agent, request)
+			})
+		},
+	}
+	restoreCmd.Flags().StringVar(&snapshot, "snapshot", "", "ID of the snapshot to restore")
+	restoreCmd.Flags().StringVar(&at, "at", "", "Restore the latest snapshot taken at or before this time (default: now)")
+	restoreCmd.Flags().BoolVar(&deleteFiles, "delete", false, "Delete files missing from the snapshot")
+	restoreCmd.Flags().BoolVarP(&yes, "yes", "y", false, "Restore in place without asking for confirmation")
+	restoreCmd.MarkFlagsMutuallyExclusive("snapshot", "at")
+
+	root.AddCommand(snapshotsCmd, backupCmd, restoreCmd)
+	return root
+}
+
+// run calls the REST API of the agent pod of the node of a PVC through a port-forward
+func (o *options) run(pvcName string, call func(ctx context.Context, agent *agentClient) error) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log := logrus.New()
+	log.SetLevel(logrus.WarnLevel)
+	client, err := k8s.NewWorkstationClient(o.kubeconfig, o.kubeContext, log)
+	if err != nil {
+		return err
+	}
+	token, err := o.bearerToken(ctx, client)
+	if err != nil {
+		return err
+	}
+	node, err := client.PVCNode(ctx, o.namespace, pvcName)
+	if err != nil {
+		return err
+	}
+	pod, err := client.FindAgentPod(ctx, o.agentNamespace, o.agentSelector, node)
+	if err != nil {
+		return err
+	}
+	port, err := client.PortForward(ctx, o.agentNamespace, pod, o.apiPort)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Calling agent pod %s/%s on node %s\n", o.agentNamespace, pod, node)
+	return call(ctx, newAgentClient(port, !o.apiHTTP, token))
+}
+
+// bearerToken returns the token the API is called with, --token or a token created
+// for --service-account
+func (o *options) bearerToken(ctx context.Context, client *k8s.Client) (string, error) {
+	if o.token != "" {
+		return o.token, nil
+	}
+	namespace, name, ok := strings.Cut(o.serviceAccount, "/")
+	if !ok || namespace == "" || name == "" {
+		return "", fmt.Errorf("--token or --service-account namespace/name is required")
+	}
+	return client.CreateToken(ctx, namespace, name, o.audience, tokenExpiry)
+}
+
+// confirm asks a yes/no question on the terminal
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,480 @@
+package restic
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+)
+
+// Backend is the storage service holding the repositories
+type Backend interface {
+	// RepositoryURL returns the restic URL of the repository with the given name,
+	// the URL prefix of all repositories for an empty name
+	RepositoryURL(name string) string
+	// Env returns the environment variables giving restic access to the backend
+	Env() []string
+	// Flags returns the global restic flags giving access to the backend
+	Flags() []string
+}
+
+// NewBackend creates the backend selected by the configuration
+func NewBackend(config *cfg.Config) (Backend, error) {
+	switch config.BackendType {
+	case cfg.BackendS3:
+		if err := requireSettings(
+			"S3_ENDPOINT", config.S3Config.Endpoint,
+			"S3_BUCKET", config.S3Config.Bucket,
+			"S3_REGION", config.S3Config.Region,
+		); err != nil {
+			return nil, err
+		}
+		if err := CheckEndpoint("S3_ENDPOINT", config.S3Config.Endpoint); err != nil {
+			return nil, err
+		}
+		if config.S3Config.StaticKeys() != (config.S3Config.SecretKey != "" || config.S3Config.SecretKeyFile != "") {
+			return nil, fmt.Errorf("S3_ACCESS_KEY and S3_SECRET_KEY must be set together")
+		}
+		if _, _, err := config.S3Config.Keys(); err != nil {
+			return nil, err
+		}
+		if _, err := config.S3Config.Token(); err != nil {
+			return nil, err
+		}
+		if err := CheckStorageClass(config.S3Config.StorageClass); err != nil {
+			return nil, err
+		}
+		if err := checkEncryption(config.S3Config.SSE, config.S3Config.SSEKMSKeyID); err != nil {
+			return nil, err
+		}
+		return newS3Backend(config.S3Config), nil
+	case cfg.BackendGCS:
+		if err := requireSettings(
+			"GCS_PROJECT_ID", config.GCSConfig.ProjectID,
+			"GCS_BUCKET", config.GCSConfig.Bucket,
+		); err != nil {
+			return nil, err
+		}
+		return &gcsBackend{config: config.GCSConfig}, nil
+	case cfg.BackendAzure:
+		if err := requireSettings(
+			"AZURE_ACCOUNT_NAME", config.AzureConfig.AccountName,
+			"AZURE_CONTAINER", config.AzureConfig.Container,
+		); err != nil {
+			return nil, err
+		}
+		return &azureBackend{config: config.AzureConfig}, nil
+	case cfg.BackendB2:
+		if err := requireSettings(
+			"B2_ACCOUNT_ID", config.B2Config.AccountID,
+			"B2_ACCOUNT_KEY", config.B2Config.AccountKey,
+			"B2_BUCKET", config.B2Config.Bucket,
+		); err != nil {
+			return nil, err
+		}
+		return &b2Backend{config: config.B2Config}, nil
+	case cfg.BackendSFTP:
+		if err := requireSettings(
+			"SFTP_HOST", config.SFTPConfig.Host,
+			"SFTP_USER", config.SFTPConfig.User,
+		); err != nil {
+			return nil, err
+		}
+		return &sftpBackend{config: config.SFTPConfig, cachePath: config.ResticConfig.CachePath}, nil
+	case cfg.BackendREST:
+		if err := requireSettings("REST_URL", config.RESTConfig.URL); err != nil {
+			return nil, err
+		}
+		if err := CheckEndpoint("REST_URL", config.RESTConfig.URL); err != nil {
+			return nil, err
+		}
+		return &restBackend{config: config.RESTConfig}, nil
+	case cfg.BackendRclone:
+		if err := requireSettings("RCLONE_REMOTE", config.RcloneConfig.Remote); err != nil {
+			return nil, err
+		}
+		return &rcloneBackend{config: config.RcloneConfig}, nil
+	case cfg.BackendLocal:
+		return newLocalBackend(config.LocalConfig)
+	default:
+		return nil, fmt.Errorf("invalid backend type %q", config.BackendType)
+	}
+}
+
+// spaceChecker is implemented by backends on filesystems the agent can see run full
+type spaceChecker interface {
+	// CheckSpace fails when the storage is too full to take a backup
+	CheckSpace() error
+}
+
+// requireSettings takes pairs of setting names and values and fails on the first empty value
+func requireSettings(settings ...string) error {
+	for i := 0; i+1 < len(settings); i += 2 {
+		if settings[i+1] == "" {
+			return fmt.Errorf("%s is required", settings[i])
+		}
+	}
+	return nil
+}
+
+// CheckEndpoint fails for endpoints with an IPv6 address outside brackets, whose last
+// group cannot be told apart from a port
+func CheckEndpoint(name, endpoint string) error {
+	host := endpoint
+	if _, rest, ok := strings.Cut(host, "://"); ok {
+		host = rest
+	}
+	host, _, _ = strings.Cut(host, "/")
+	if strings.Count(host, ":") > 1 && !strings.HasPrefix(host, "[") {
+		return fmt.Errorf("invalid %s %s, enclose IPv6 addresses in brackets, e.g. [2001:db8::1]:9000", name, endpoint)
+	}
+	return nil
+}
+
+// joinPath joins the non empty elements of a path inside a bucket
+func joinPath(elems ...string) string {
+	var parts []string
+	for _, elem := range elems {
+		if elem = strings.Trim(elem, "/"); elem != "" {
+			parts = append(parts, elem)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// s3Backend stores repositories in an S3 compatible bucket
+type s3Backend struct {
+	config cfg.S3Config
+
+	// Last credentials read, used when the credential files cannot be read
+	mu        sync.Mutex
+	accessKey string
+	secretKey string
+	token     string
+}
+
+func newS3Backend(config cfg.S3Config) *s3Backend {
+	return &s3Backend{config: config, accessKey: config.AccessKey, secretKey: config.SecretKey, token: config.SessionToken}
+}
+
+func (b *s3Backend) RepositoryURL(name string) string {
+	return fmt.Sprintf("s3:%s/%s/", b.config.Endpoint, joinPath(b.config.Bucket, b.config.Path)) + name
+}
+
+// Env passes the static keys when configured, otherwise restic falls back to the AWS
+// default credential chain: the environment of the agent (e.g. IRSA web identity), the
+// shared credentials file or the instance profile
+func (b *s3Backend) Env() []string {
+	env := []string{fmt.Sprintf("AWS_DEFAULT_REGION=%s", b.config.Region)}
+	accessKey, secretKey, token := b.credentials()
+	if accessKey != "" {
+		env = append(env,
+			fmt.Sprintf("AWS_ACCESS_KEY_ID=%s", accessKey),
+			fmt.Sprintf("AWS_SECRET_ACCESS_KEY=%s", secretKey),
+		)
+	}
+	if token != "" {
+		env = append(env, fmt.Sprintf("AWS_SESSION_TOKEN=%s", token))
+	}
+	return env
+}
+
+// credentials re-reads the keys and the session token, so credentials rotated in a
+// mounted Secret, by STS or by Vault are picked up by the next restic run. Files
+// being rewritten keep the last credentials read.
+func (b *s3Backend) credentials() (string, string, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if accessKey, secretKey, err := b.config.Keys(); err == nil && accessKey != "" && secretKey != "" {
+		b.accessKey, b.secretKey = accessKey, secretKey
+	}
+	if token, err := b.config.Token(); err == nil {
+		b.token = token
+	}
+	return b.accessKey, b.secretKey, b.token
+}
+
+func (b *s3Backend) Flags() []string {
+	var flags []string
+	if b.config.CACertFile != "" {
+		flags = append(flags, "--cacert", b.config.CACertFile)
+	}
+	if b.config.InsecureTLS {
+		flags = append(flags, "--insecure-tls")
+	}
+	if b.config.StorageClass != "" {
+		flags = append(flags, "-o", "s3.storage-class="+b.config.StorageClass)
+	}
+	return flags
+}
+
+// CheckStorageClass rejects the archive storage classes, restic reads the data back for
+// restores, checks and prunes and cannot restore objects from them first
+func CheckStorageClass(class string) error {
+	switch strings.ToUpper(class) {
+	case "GLACIER", "DEEP_ARCHIVE":
+		return fmt.Errorf("storage class %s is not supported, its objects cannot be read without a restore request, use GLACIER_IR instead", class)
+	}
+	return nil
+}
+
+// Server-side encryption modes of S3 buckets
+const (
+	SSEAES256 = "AES256"
+	SSEKMS    = "aws:kms"
+)
+
+// checkEncryption validates the server-side encryption settings
+func checkEncryption(sse, kmsKeyID string) error {
+	switch sse {
+	case "", SSEAES256, SSEKMS:
+	default:
+		return fmt.Errorf("invalid S3_SSE %s, expected %s or %s", sse, SSEAES256, SSEKMS)
+	}
+	if kmsKeyID != "" && sse != SSEKMS {
+		return fmt.Errorf("S3_SSE_KMS_KEY_ID requires S3_SSE=%s", SSEKMS)
+	}
+	return nil
+}
+
+// gcsBackend stores repositories in a Google Cloud Storage bucket
+type gcsBackend struct {
+	config cfg.GCSConfig
+}
+
+func (b *gcsBackend) RepositoryURL(name string) string {
+	if path := joinPath(b.config.Path); path != "" {
+		return fmt.Sprintf("gs:%s:/%s/", b.config.Bucket, path) + name
+	}
+	return fmt.Sprintf("gs:%s:/", b.config.Bucket) + name
+}
+
+func (b *gcsBackend) Env() []string {
+	env := []string{fmt.Sprintf("GOOGLE_PROJECT_ID=%s", b.config.ProjectID)}
+	// Without a key file restic falls back to the application default credentials,
+	// e.g. GKE workload identity
+	if b.config.CredentialsFile != "" {
+		env = append(env, fmt.Sprintf("GOOGLE_APPLICATION_CREDENTIALS=%s", b.config.CredentialsFile))
+	}
+	return env
+}
+
+func (b *gcsBackend) Flags() []string {
+	return nil
+}
+
+// azureBackend stores repositories in an Azure Blob Storage container
+type azureBackend struct {
+	config cfg.AzureConfig
+}
+
+func (b *azureBackend) RepositoryURL(name string) string {
+	if path := joinPath(b.config.Path); path != "" {
+		return fmt.Sprintf("azure:%s:/%s/", b.config.Container, path) + name
+	}
+	return fmt.Sprintf("azure:%s:/", b.config.Container) + name
+}
+
+func (b *azureBackend) Env() []string {
+	env := []string{fmt.Sprintf("AZURE_ACCOUNT_NAME=%s", b.config.AccountName)}
+	// Without an account key restic authenticates with the default Azure
+	// credentials, e.g. the managed identity of the node
+	if b.config.AccountKey != "" {
+		env = append(env, fmt.Sprintf("AZURE_ACCOUNT_KEY=%s", b.config.AccountKey))
+	}
+	if b.config.EndpointSuffix != "" {
+		env = append(env, fmt.Sprintf("AZURE_ENDPOINT_SUFFIX=%s", b.config.EndpointSuffix))
+	}
+	return env
+}
+
+func (b *azureBackend) Flags() []string {
+	return nil
+}
+
+// b2Backend stores repositories in a Backblaze B2 bucket
+type b2Backend struct {
+	config cfg.B2Config
+}
+
+func (b *b2Backend) RepositoryURL(name string) string {
+	if path := joinPath(b.config.Path); path != "" {
+		return fmt.Sprintf("b2:%s:%s/", b.config.Bucket, path) + name
+	}
+	return fmt.Sprintf("b2:%s:", b.config.Bucket) + name
+}
+
+func (b *b2Backend) Env() []string {
+	return []string{
+		fmt.Sprintf("B2_ACCOUNT_ID=%s", b.config.AccountID),
+		fmt.Sprintf("B2_ACCOUNT_KEY=%s", b.config.AccountKey),
+	}
+}
+
+func (b *b2Backend) Flags() []string {
+	return nil
+}
+
+// KnownHostsFile is the file of the cache directory keeping the SFTP host keys seen first
+const KnownHostsFile = "known_hosts"
+
+// sftpBackend stores repositories in a directory of an SSH server
+type sftpBackend struct {
+	config    cfg.SFTPConfig
+	cachePath string
+}
+
+func (b *sftpBackend) RepositoryURL(name string) string {
+	// JoinHostPort encloses IPv6 addresses in brackets
+	host := net.JoinHostPort(strings.Trim(b.config.Host, "[]"), strconv.Itoa(b.config.Port))
+	prefix := fmt.Sprintf("sftp://%s@%s/", b.config.User, host)
+	if path := joinPath(b.config.Path); path != "" {
+		// A double slash makes the path absolute instead of relative to the home directory
+		return prefix + "/" + path + "/" + name
+	}
+	return prefix + name
+}
+
+func (b *sftpBackend) Env() []string {
+	return nil
+}
+
+func (b *sftpBackend) Flags() []string {
+	// restic runs ssh, which must never prompt for a password or a host key
+	args := []string{"-o", "BatchMode=yes"}
+	if b.config.KeyFile != "" {
+		args = append(args, "-i", b.config.KeyFile)
+	}
+	if b.config.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+b.config.KnownHostsFile, "-o", "StrictHostKeyChecking=yes")
+	} else {
+		// Trust the host key seen first, kept in the cache directory across restarts
+		args = append(args, "-o", "UserKnownHostsFile="+filepath.Join(b.cachePath, KnownHostsFile), "-o", "StrictHostKeyChecking=accept-new")
+	}
+	return []string{"-o", "sftp.args=" + strings.Join(args, " ")}
+}
+
+// restBackend stores repositories on a restic REST server
+type restBackend struct {
+	config cfg.RESTConfig
+}
+
+func (b *restBackend) RepositoryURL(name string) string {
+	prefix := "rest:" + strings.TrimRight(b.config.URL, "/") + "/"
+	if path := joinPath(b.config.Path); path != "" {
+		prefix += path + "/"
+	}
+	return prefix + name
+}
+
+func (b *restBackend) Env() []string {
+	if b.config.Username == "" {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("RESTIC_REST_USERNAME=%s", b.config.Username),
+		fmt.Sprintf("RESTIC_REST_PASSWORD=%s", b.config.Password),
+	}
+}
+
+func (b *restBackend) Flags() []string {
+	var flags []string
+	if b.config.CACertFile != "" {
+		flags = append(flags, "--cacert", b.config.CACertFile)
+	}
+	if b.config.InsecureTLS {
+		flags = append(flags, "--insecure-tls")
+	}
+	return flags
+}
+
+// rcloneBackend stores repositories in any storage supported by rclone, which restic
+// runs as a subprocess
+type rcloneBackend struct {
+	config cfg.RcloneConfig
+}
+
+func (b *rcloneBackend) RepositoryURL(name string) string {
+	remote := strings.TrimSuffix(b.config.Remote, ":")
+	if path := joinPath(b.config.Path); path != "" {
+		return fmt.Sprintf("rclone:%s:%s/", remote, path) + name
+	}
+	return fmt.Sprintf("rclone:%s:", remote) + name
+}
+
+func (b *rcloneBackend) Env() []string {
+	// Remotes can also be defined without a file, with RCLONE_CONFIG_<NAME>_<OPTION>
+	// variables passed through from the agent environment
+	if b.config.ConfigFile == "" {
+		return nil
+	}
+	return []string{fmt.Sprintf("RCLONE_CONFIG=%s", b.config.ConfigFile)}
+}
+
+func (b *rcloneBackend) Flags() []string {
+	return nil
+}
+
+// localBackend stores repositories in a directory of the node, e.g. a mounted NFS share
+type localBackend struct {
+	path         string
+	minFreeSpace uint64
+}
+
+func newLocalBackend(config cfg.LocalConfig) (*localBackend, error) {
+	if err := requireSettings("LOCAL_PATH", config.Path); err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(config.Path) {
+		return nil, fmt.Errorf("LOCAL_PATH must be absolute, got %s", config.Path)
+	}
+	minFreeSpace, err := cfg.ParseSize(config.MinFreeSpace)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LOCAL_MIN_FREE_SPACE: %v", err)
+	}
+
+	// An unmounted volume would silently fill the node disk, the directory must exist
+	info, err := os.Stat(config.Path)
+	if err != nil {
+		return nil, fmt.Errorf("repository directory %s is not available: %v", config.Path, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("repository path %s is not a directory", config.Path)
+	}
+	probe, err := os.CreateTemp(config.Path, ".write-test-*")
+	if err != nil {
+		return nil, fmt.Errorf("repository directory %s is not writable: %v", config.Path, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	return &localBackend{path: config.Path, minFreeSpace: minFreeSpace}, nil
+}
+
+func (b *localBackend) RepositoryURL(name string) string {
+	return "local:" + strings.TrimRight(filepath.ToSlash(b.path), "/") + "/" + name
+}
+
+func (b *localBackend) Env() []string {
+	return nil
+}
+
+func (b *localBackend) Flags() []string {
+	return nil
+}
+
+func (b *localBackend) CheckSpace() error {
+	free, err := freeSpace(b.path)
+	if err != nil {
+		return fmt.Errorf("failed to get free space of %s: %v", b.path, err)
+	}
+	if free < b.minFreeSpace {
+		return fmt.Errorf("only %d MiB free in %s, below the minimum of %d MiB", free>>20, b.path, b.minFreeSpace>>20)
+	}
+	return nil
+}
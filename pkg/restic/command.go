@@ -0,0 +1,57 @@
+package restic
+
+import (
+	"errors"
+	"unicode"
+)
+
+// splitCommand splits a password command into its arguments the way restic splits
+// --password-command, without a shell: single and double quotes group arguments, and
+// a backslash escapes a quote. The agent runs the command the same way as restic, so
+// both read the same password.
+func splitCommand(command string) ([]string, error) {
+	var (
+		args       []string
+		quote      rune
+		last       rune
+		fieldStart = -1
+	)
+	isSplit := func(c rune) bool {
+		if last != '\\' {
+			switch {
+			case quote != 0 && c == quote:
+				quote = 0
+				return true
+			case quote == 0 && (c == '"' || c == '\''):
+				quote = c
+				return true
+			}
+		}
+		last = c
+		if quote != 0 {
+			return false
+		}
+		return c == '\\' || unicode.IsSpace(c)
+	}
+
+	for i, c := range command {
+		if isSplit(c) {
+			if fieldStart >= 0 {
+				args = append(args, command[fieldStart:i])
+				fieldStart = -1
+			}
+		} else if fieldStart == -1 {
+			fieldStart = i
+		}
+	}
+	if fieldStart >= 0 {
+		args = append(args, command[fieldStart:])
+	}
+	if quote != 0 {
+		return nil, errors.New("unbalanced quotes")
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
@@ -0,0 +1,92 @@
+package restic
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// inflightPattern matches the marker files of backups in progress. A marker left
+// behind means the backup never completed, e.g. because the agent was killed or
+// restic failed mid-upload, and the packs it uploaded are not referenced by any
+// snapshot.
+const inflightPattern = "backup-*.inflight"
+
+// beginBackup records a backup of the repository in progress and returns the function
+// removing the record once the backup completed
+func (c *Client) beginBackup() (func(), error) {
+	if err := os.MkdirAll(c.cachePath, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %v", err)
+	}
+
+	file, err := os.CreateTemp(c.cachePath, inflightPattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record backup in progress: %v", err)
+	}
+	_, err = file.WriteString(c.GetRepository())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("failed to record backup in progress: %v", err)
+	}
+
+	return func() {
+		os.Remove(file.Name())
+	}, nil
+}
+
+// inflightMarkers returns the marker files of unfinished backups by repository
+func (c *Client) inflightMarkers() (map[string][]string, error) {
+	paths, err := filepath.Glob(filepath.Join(c.cachePath, inflightPattern))
+	if err != nil {
+		return nil, err
+	}
+
+	markers := make(map[string][]string)
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read backup marker: %v", err)
+		}
+		repository := strings.TrimSpace(string(content))
+		markers[repository] = append(markers[repository], path)
+	}
+	return markers, nil
+}
+
+// InterruptedRepositories returns the repositories with backups that never completed
+func (c *Client) InterruptedRepositories() ([]string, error) {
+	markers, err := c.inflightMarkers()
+	if err != nil {
+		return nil, err
+	}
+
+	repositories := make([]string, 0, len(markers))
+	for repository := range markers {
+		repositories = append(repositories, repository)
+	}
+	sort.Strings(repositories)
+	return repositories, nil
+}
+
+// ClearInterrupted forgets the unfinished backups of the repository once cleaned up
+func (c *Client) ClearInterrupted() error {
+	markers, err := c.inflightMarkers()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range markers[c.GetRepository()] {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove backup marker: %v", err)
+		}
+	}
+	return nil
+}
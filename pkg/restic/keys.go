@@ -0,0 +1,70 @@
+package restic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Key is a key of a repository, each key encrypts the master key with its own password
+type Key struct {
+	ID       string `json:"id"`
+	Current  bool   `json:"current"` // The key opened with the password of the client
+	UserName string `json:"userName"`
+	HostName string `json:"hostName"`
+	Created  string `json:"created"`
+}
+
+// Keys lists the keys of the repository
+func (c *Client) Keys(ctx context.Context) ([]Key, error) {
+	output, err := c.run(ctx, []string{"key", "list", "--repo", c.GetRepository(), "--json"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys: %v", err)
+	}
+
+	var keys []Key
+	if err := json.Unmarshal(output, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse keys: %v", err)
+	}
+	return keys, nil
+}
+
+// CurrentKey returns the ID of the key opened with the password of the client
+func (c *Client) CurrentKey(ctx context.Context) (string, error) {
+	keys, err := c.Keys(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		if key.Current {
+			return key.ID, nil
+		}
+	}
+	return "", fmt.Errorf("no current key in the key list of %s", c.GetRepository())
+}
+
+// AddKey adds a key with the password stored in newPasswordFile to the repository
+func (c *Client) AddKey(ctx context.Context, newPasswordFile string) error {
+	if _, err := c.run(ctx, []string{"key", "add", "--repo", c.GetRepository(), "--new-password-file", newPasswordFile}); err != nil {
+		return fmt.Errorf("failed to add key: %v", err)
+	}
+	return nil
+}
+
+// RemoveKey removes a key from the repository, restic refuses to remove the current key
+func (c *Client) RemoveKey(ctx context.Context, id string) error {
+	if _, err := c.run(ctx, []string{"key", "remove", "--repo", c.GetRepository(), id}); err != nil {
+		return fmt.Errorf("failed to remove key %s: %v", id, err)
+	}
+	return nil
+}
+
+// WithPassword returns a copy of the client opening the repository with another password
+func (c *Client) WithPassword(password string) *Client {
+	clone := *c
+	clone.password = password
+	clone.passwordFile = ""
+	clone.passwordCommand = ""
+	clone.passwords = nil
+	return &clone
+}
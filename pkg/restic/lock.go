@@ -0,0 +1,188 @@
+package restic
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Commands taking an exclusive local lock on the repository, all other commands
+// share it. This keeps forget, prune and check from racing with each other or
+// with backups started by other processes, e.g. on-demand backups or the restic
+// passthrough command.
+var exclusiveCommands = map[string]bool{
+	"init":          true,
+	"copy":          true,
+	"tag":           true,
+	"forget":        true,
+	"prune":         true,
+	"check":         true,
+	"rebuild-index": true,
+	"repair":        true,
+	"key":           true,
+	"migrate":       true,
+}
+
+// IsExclusiveCommand reports whether a restic command needs the exclusive local lock
+func IsExclusiveCommand(command string) bool {
+	return exclusiveCommands[command]
+}
+
+// Global restic flags taking a value as the next argument
+var valueFlags = map[string]bool{
+	"--cacert":                true,
+	"--cache-dir":             true,
+	"--compression":           true,
+	"--http-user-agent":       true,
+	"--key-hint":              true,
+	"--limit-download":        true,
+	"--limit-upload":          true,
+	"-o":                      true,
+	"--option":                true,
+	"--pack-size":             true,
+	"--password-command":      true,
+	"-p":                      true,
+	"--password-file":         true,
+	"-r":                      true,
+	"--repo":                  true,
+	"--repository-file":       true,
+	"--retry-lock":            true,
+	"--stuck-request-timeout": true,
+	"--tls-client-cert":       true,
+}
+
+// Global restic flags without a value
+var switchFlags = map[string]bool{
+	"--cleanup-cache":        true,
+	"-h":                     true,
+	"--help":                 true,
+	"--insecure-no-password": true,
+	"--insecure-tls":         true,
+	"--json":                 true,
+	"--no-cache":             true,
+	"--no-extra-verify":      true,
+	"--no-lock":              true,
+	"-q":                     true,
+	"--quiet":                true,
+	"-v":                     true,
+	"-vv":                    true,
+	"-vvv":                   true,
+	"--verbose":              true,
+}
+
+// Subcommand returns the command of restic arguments, skipping the global flags before
+// it, empty when there is none. Unknown flags before the command fail, since whether
+// they take a value decides which argument is the command.
+func Subcommand(args []string) (string, error) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			if i+1 < len(args) {
+				return args[i+1], nil
+			}
+			return "", nil
+		case !strings.HasPrefix(arg, "-"):
+			return arg, nil
+		case strings.HasPrefix(arg, "--") && strings.Contains(arg, "="):
+			name, _, _ := strings.Cut(arg, "=")
+			if !valueFlags[name] && !switchFlags[name] {
+				return "", fmt.Errorf("unknown restic flag %s before the command, pass it after the command", name)
+			}
+		case valueFlags[arg]:
+			i++
+		case switchFlags[arg]:
+		default:
+			return "", fmt.Errorf("unknown restic flag %s before the command, pass it after the command", arg)
+		}
+	}
+	return "", nil
+}
+
+// Lock acquires the local lock of the repository, shared by all processes using the
+// same cache directory, and returns the function releasing it. It waits until the
+// lock is available or ctx is done.
+func (c *Client) Lock(ctx context.Context, exclusive bool) (func(), error) {
+	if err := os.MkdirAll(c.cachePath, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %v", err)
+	}
+
+	sum := sha256.Sum256([]byte(c.GetRepository()))
+	path := filepath.Join(c.cachePath, fmt.Sprintf("repository-%x.lock", sum[:8]))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+
+	waiting := false
+	for {
+		locked, err := tryLockFile(file, exclusive)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock repository: %v", err)
+		}
+		if locked {
+			break
+		}
+		if !waiting {
+			c.log.Infof("Waiting for another operation on repository %s to finish", c.GetRepository())
+			waiting = true
+		}
+
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+// IsLockedError reports whether a restic command failed because the repository is locked
+func IsLockedError(err error) bool {
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	return strings.Contains(cmdErr.Output, "repository is already locked")
+}
+
+// lockDetails extracts the lock owner and age restic reports for a locked repository
+func lockDetails(err error) string {
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		return err.Error()
+	}
+
+	var details []string
+	for _, line := range strings.Split(cmdErr.Output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.Contains(line, "locked") || strings.HasPrefix(line, "lock was created") {
+			details = append(details, line)
+		}
+	}
+	if len(details) == 0 {
+		return strings.TrimSpace(cmdErr.Output)
+	}
+	return strings.Join(details, "; ")
+}
+
+// Unlock removes stale locks. restic only considers a lock stale when it has not
+// been refreshed for 30 minutes or when its process is gone from this host, so
+// locks of running operations are left alone.
+func (c *Client) Unlock(ctx context.Context) error {
+	if _, err := c.exec(ctx, nil, []string{"unlock", "--repo", c.GetRepository()}, nil); err != nil {
+		return fmt.Errorf("failed to unlock repository: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+
+package restic
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLockFile takes a shared or exclusive lock on the file without waiting and
+// reports false when another process holds a conflicting lock
+func tryLockFile(file *os.File, exclusive bool) (bool, error) {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unlockFile releases the lock taken by tryLockFile
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
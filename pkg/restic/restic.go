@@ -1,114 +1,713 @@
 package restic
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/logging"
+	"github.com/monlor/local-pvc-backup/pkg/secrets"
+	"github.com/monlor/local-pvc-backup/pkg/tracing"
 	"github.com/sirupsen/logrus"
 )
 
 // Client represents a restic client
 type Client struct {
-	s3Endpoint  string
-	s3Bucket    string
-	s3Path      string
-	s3AccessKey string
-	s3SecretKey string
-	s3Region    string
-	password    string
-	cachePath   string
-	nodeName    string
-	log         *logrus.Logger
+	backend  Backend
+	password string
+	// passwordFile holds the password instead of password when set, restic reads it itself
+	passwordFile string
+	// passwordCommand prints the password instead of password when set, run by restic
+	passwordCommand string
+	// passwords resolves the passwords of repositories sharded by namespace, nil uses
+	// the password above for all repositories
+	passwords  *secrets.Passwords
+	cachePath  string
+	nodeName   string
+	layout     string
+	repository string       // overrides the layout derived repository when set
+	autoUnlock *atomic.Bool // Shared by the copies of the client, switched at runtime
+	proxyEnv   []string     // Proxy settings of the repository traffic
+	packSize   uint64       // Target pack size in MiB, 0 uses the restic default
+	// shardByNamespace inserts the PVC namespace into the repository path
+	shardByNamespace bool
+	log              *logrus.Logger
 }
 
 // NewClient creates a new restic client
-func NewClient(s3Endpoint, s3Bucket, s3Path, s3AccessKey, s3SecretKey, s3Region, password, cachePath, nodeName string, log *logrus.Logger) *Client {
+func NewClient(config *cfg.Config, nodeName string, log *logrus.Logger) (*Client, error) {
+	backend, err := NewBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	packSize, err := parsePackSize(config.ResticConfig.PackSize)
+	if err != nil {
+		return nil, err
+	}
+	sources := 0
+	for _, source := range []string{config.ResticConfig.Password, config.ResticConfig.PasswordFile, config.ResticConfig.PasswordCommand} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, fmt.Errorf("exactly one of RESTIC_PASSWORD, RESTIC_PASSWORD_FILE and RESTIC_PASSWORD_COMMAND must be set")
+	}
+	if config.ResticConfig.PasswordCommand != "" {
+		if _, err := splitCommand(config.ResticConfig.PasswordCommand); err != nil {
+			return nil, fmt.Errorf("invalid RESTIC_PASSWORD_COMMAND: %v", err)
+		}
+	}
+	passwords, err := secrets.NewPasswords(config.SecretsConfig, config.BackupConfig.ProxyConfig, log)
+	if err != nil {
+		return nil, err
+	}
+	if passwords != nil && config.BackupConfig.RepoLayout != cfg.RepoLayoutPVC && !config.BackupConfig.ShardByNamespace {
+		return nil, fmt.Errorf("per-namespace passwords require repositories sharded by namespace, set BACKUP_SHARD_BY_NAMESPACE or the pvc layout")
+	}
+
+	autoUnlock := &atomic.Bool{}
+	autoUnlock.Store(config.BackupConfig.AutoUnlock)
+
 	return &Client{
-		s3Endpoint:  s3Endpoint,
-		s3Bucket:    s3Bucket,
-		s3Path:      s3Path,
-		s3AccessKey: s3AccessKey,
-		s3SecretKey: s3SecretKey,
-		s3Region:    s3Region,
-		password:    password,
-		cachePath:   cachePath,
-		nodeName:    nodeName,
-		log:         log,
+		backend:          backend,
+		password:         config.ResticConfig.Password,
+		passwordFile:     config.ResticConfig.PasswordFile,
+		passwordCommand:  config.ResticConfig.PasswordCommand,
+		passwords:        passwords,
+		cachePath:        config.ResticConfig.CachePath,
+		nodeName:         nodeName,
+		layout:           config.BackupConfig.RepoLayout,
+		autoUnlock:       autoUnlock,
+		proxyEnv:         proxyEnv(config.ResticConfig),
+		packSize:         packSize,
+		shardByNamespace: config.BackupConfig.ShardByNamespace,
+		log:              log,
+	}, nil
+}
+
+// parsePackSize parses the pack size in MiB. Bare numbers are MiB like restic's own
+// RESTIC_PACK_SIZE, restic accepts 4 to 128 MiB.
+func parsePackSize(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
 	}
+	if _, err := strconv.ParseUint(value, 10, 64); err == nil {
+		value += "MiB"
+	}
+	size, err := cfg.ParseSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid pack size: %v", err)
+	}
+	if size%(1<<20) != 0 || size < 4<<20 || size > 128<<20 {
+		return 0, fmt.Errorf("invalid pack size %s, expected whole MiB from 4MiB to 128MiB", value)
+	}
+	return size >> 20, nil
+}
+
+// proxyEnv returns the proxy variables of restic and the tools it runs, in both cases
+// since tools differ in the one they read first
+func proxyEnv(config cfg.ResticConfig) []string {
+	var env []string
+	for _, variable := range []struct{ name, value string }{
+		{"HTTP_PROXY", config.HTTPProxy},
+		{"HTTPS_PROXY", config.HTTPSProxy},
+		{"NO_PROXY", config.NoProxy},
+	} {
+		if variable.value != "" {
+			env = append(env,
+				variable.name+"="+variable.value,
+				strings.ToLower(variable.name)+"="+variable.value,
+			)
+		}
+	}
+	return env
+}
+
+// WithRepository returns a copy of the client operating on the given repository
+func (c *Client) WithRepository(repository string) *Client {
+	clone := *c
+	clone.repository = repository
+	return &clone
+}
+
+// SetAutoUnlock switches the removal of stale locks on this client and its copies
+func (c *Client) SetAutoUnlock(enabled bool) {
+	c.autoUnlock.Store(enabled)
 }
 
 // GetRepository returns the S3 repository URL
 func (c *Client) GetRepository() string {
-	if c.s3Path == "" {
-		return fmt.Sprintf("s3:%s/%s/node-%s", c.s3Endpoint, c.s3Bucket, c.nodeName)
+	if c.repository != "" {
+		return c.repository
+	}
+	if c.layout == cfg.RepoLayoutShared {
+		return c.SharedRepository()
+	}
+	return c.NodeRepository(c.nodeName)
+}
+
+// Sharded reports whether the repository depends on the PVC being backed up, which
+// is the case with the per-PVC layout or when sharding by namespace
+func (c *Client) Sharded() bool {
+	return c.repository == "" && (c.layout == cfg.RepoLayoutPVC || c.shardByNamespace)
+}
+
+// ForNode returns a copy of the client operating on the repositories of another node,
+// to read its backups
+func (c *Client) ForNode(nodeName string) *Client {
+	clone := *c
+	clone.nodeName = nodeName
+	return &clone
+}
+
+// ForPVC returns the client operating on the repository holding the backups of a
+// PVC, which is this client unless repositories are sharded
+func (c *Client) ForPVC(namespace, pvcName string) *Client {
+	if !c.Sharded() {
+		return c
+	}
+
+	switch {
+	case c.layout == cfg.RepoLayoutPVC:
+		return c.WithRepository(c.repositoryURL(namespace + "/" + pvcName))
+	case c.layout == cfg.RepoLayoutShared:
+		return c.WithRepository(c.repositoryURL(namespace + "/" + cfg.SharedRepositoryName))
+	default:
+		return c.WithRepository(c.repositoryURL(namespace + "/" + cfg.NodeRepositoryPrefix + c.nodeName))
+	}
+}
+
+// ForRepository returns a copy of the client operating on the repository stored under
+// name, e.g. a name listed from the storage
+func (c *Client) ForRepository(name string) *Client {
+	return c.WithRepository(c.repositoryURL(name))
+}
+
+// Replica returns a client operating on the secondary repository mirroring the
+// repository of this client, stored under the same name in the replica bucket
+func (c *Client) Replica(config cfg.ReplicaConfig) *Client {
+	name := strings.TrimPrefix(c.GetRepository(), c.repositoryURL(""))
+
+	replica := *c
+	replica.backend = newS3Backend(cfg.S3Config{
+		Endpoint:         config.Endpoint,
+		Bucket:           config.Bucket,
+		AccessKey:        config.AccessKey,
+		SecretKey:        config.SecretKey,
+		AccessKeyFile:    config.AccessKeyFile,
+		SecretKeyFile:    config.SecretKeyFile,
+		SessionToken:     config.SessionToken,
+		SessionTokenFile: config.SessionTokenFile,
+		Region:           config.Region,
+		Path:             config.Path,
+		CACertFile:       config.CACertFile,
+		InsecureTLS:      config.InsecureTLS,
+		StorageClass:     config.StorageClass,
+	})
+	if config.Password != "" {
+		replica.password = config.Password
+		replica.passwordFile = ""
+		replica.passwordCommand = ""
+		replica.passwords = nil
+	}
+	replica.repository = replica.repositoryURL(name)
+	return &replica
+}
+
+// Stores reports whether a repository URL belongs to the backend of this client
+func (c *Client) Stores(repository string) bool {
+	return strings.HasPrefix(repository, c.repositoryURL(""))
+}
+
+// NodeRepository returns the URL of the per-node repository of the given node
+func (c *Client) NodeRepository(nodeName string) string {
+	return c.repositoryURL(cfg.NodeRepositoryPrefix + nodeName)
+}
+
+// SharedRepository returns the URL of the repository shared by all nodes
+func (c *Client) SharedRepository() string {
+	return c.repositoryURL(cfg.SharedRepositoryName)
+}
+
+// repositoryURL returns the URL of a repository stored under the configured bucket and path
+func (c *Client) repositoryURL(name string) string {
+	return c.backend.RepositoryURL(name)
+}
+
+// GetPassword returns the repository password, read from the secret of the namespace
+// of the repository, the password file or printed by the password command when one is
+// configured
+func (c *Client) GetPassword(ctx context.Context) (string, error) {
+	if namespace := c.repositoryNamespace(); c.passwords != nil && namespace != "" {
+		return c.passwords.Password(ctx, namespace)
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case c.passwordFile != "":
+		if data, err = os.ReadFile(c.passwordFile); err != nil {
+			return "", fmt.Errorf("failed to read password file: %v", err)
+		}
+	case c.passwordCommand != "":
+		args, err := splitCommand(c.passwordCommand)
+		if err != nil {
+			return "", fmt.Errorf("invalid password command: %v", err)
+		}
+		if data, err = exec.CommandContext(ctx, args[0], args[1:]...).Output(); err != nil {
+			return "", fmt.Errorf("failed to run password command: %v", err)
+		}
+	default:
+		return c.password, nil
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	logging.AddSecret(c.log, password)
+	return password, nil
+}
+
+// repositoryNamespace returns the namespace of a repository sharded by namespace, the
+// first element of its name, empty for other repositories
+func (c *Client) repositoryNamespace() string {
+	if c.layout != cfg.RepoLayoutPVC && !c.shardByNamespace {
+		return ""
 	}
-	return fmt.Sprintf("s3:%s/%s/%s/node-%s", c.s3Endpoint, c.s3Bucket, c.s3Path, c.nodeName)
+	name := strings.TrimPrefix(c.GetRepository(), c.repositoryURL(""))
+	namespace, _, ok := strings.Cut(name, "/")
+	if !ok {
+		return ""
+	}
+	return namespace
 }
 
-// getEnv returns the environment variables for restic
-func (c *Client) getEnv() []string {
-	return []string{
-		fmt.Sprintf("RESTIC_PASSWORD=%s", c.password),
+// passwordEnv returns the variable passing the repository password to restic under
+// the given prefix, RESTIC or RESTIC_FROM. A password file or command is passed as is
+// so the password never shows up in the environment of restic.
+func (c *Client) passwordEnv(ctx context.Context, prefix string) (string, error) {
+	if namespace := c.repositoryNamespace(); c.passwords != nil && namespace != "" {
+		password, err := c.passwords.Password(ctx, namespace)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s_PASSWORD=%s", prefix, password), nil
+	}
+
+	switch {
+	case c.passwordFile != "":
+		return fmt.Sprintf("%s_PASSWORD_FILE=%s", prefix, c.passwordFile), nil
+	case c.passwordCommand != "":
+		return fmt.Sprintf("%s_PASSWORD_COMMAND=%s", prefix, c.passwordCommand), nil
+	}
+	return fmt.Sprintf("%s_PASSWORD=%s", prefix, c.password), nil
+}
+
+// Env returns the environment variables for restic
+func (c *Client) Env(ctx context.Context) ([]string, error) {
+	password, err := c.passwordEnv(ctx, "RESTIC")
+	if err != nil {
+		return nil, err
+	}
+	env := []string{
+		password,
 		fmt.Sprintf("RESTIC_CACHE_DIR=%s", c.cachePath),
-		fmt.Sprintf("AWS_ACCESS_KEY_ID=%s", c.s3AccessKey),
-		fmt.Sprintf("AWS_SECRET_ACCESS_KEY=%s", c.s3SecretKey),
-		fmt.Sprintf("AWS_DEFAULT_REGION=%s", c.s3Region),
 		fmt.Sprintf("TMPDIR=%s", c.cachePath),
 	}
+	env = append(env, c.proxyEnv...)
+	if c.packSize > 0 {
+		env = append(env, fmt.Sprintf("RESTIC_PACK_SIZE=%d", c.packSize))
+	}
+	return append(env, c.backend.Env()...), nil
+}
+
+// checkSpace fails when the backend is too full to take a backup
+func (c *Client) checkSpace() error {
+	if checker, ok := c.backend.(spaceChecker); ok {
+		return checker.CheckSpace()
+	}
+	return nil
+}
+
+// Flags returns the global restic flags giving access to the backend
+func (c *Client) Flags() []string {
+	return c.backend.Flags()
+}
+
+// sourceFlags returns the flags of the client when its repository is only read from,
+// without the storage class: restic options are global and it would override the
+// storage class of the destination
+func (c *Client) sourceFlags() []string {
+	flags := c.Flags()
+	var source []string
+	for i := 0; i < len(flags); i++ {
+		if flags[i] == "-o" && i+1 < len(flags) && strings.HasPrefix(flags[i+1], "s3.storage-class=") {
+			i++
+			continue
+		}
+		source = append(source, flags[i])
+	}
+	return source
+}
+
+// sourceEnv returns the environment giving restic access to the repository of another
+// client read with --from-repo: its password and its storage credentials, e.g. those of
+// a primary repository on another provider. restic reads the storage credentials of
+// both repositories from the same variables: the variables both backends set keep the
+// values of this client, which must then be allowed to read the source too.
+func (c *Client) sourceEnv(ctx context.Context, from *Client) ([]string, error) {
+	password, err := from.passwordEnv(ctx, "RESTIC_FROM")
+	if err != nil {
+		return nil, err
+	}
+
+	own := make(map[string]bool)
+	for _, variable := range c.backend.Env() {
+		name, _, _ := strings.Cut(variable, "=")
+		own[name] = true
+	}
+	env := []string{password}
+	for _, variable := range from.backend.Env() {
+		if name, _, _ := strings.Cut(variable, "="); !own[name] {
+			env = append(env, variable)
+		}
+	}
+	return env, nil
+}
+
+// CommandError is returned when a restic command fails
+type CommandError struct {
+	Err    error
+	Output string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%v, output: %s", e.Err, strings.TrimSpace(e.Output))
+}
+
+// unreachableMessages are restic and Go network errors of a repository that cannot be
+// reached or does not exist
+var unreachableMessages = []string{
+	"no such host",
+	"connection refused",
+	"i/o timeout",
+	"network is unreachable",
+	"TLS handshake timeout",
+	"Is there a repository at the following location?",
+}
+
+// IsUnreachableError reports whether restic failed to reach the repository. The
+// message is matched since callers wrap restic errors with their output.
+func IsUnreachableError(err error) bool {
+	return containsAny(err, unreachableMessages)
+}
+
+// IsPasswordError reports whether restic failed to open the repository with the
+// configured password
+func IsPasswordError(err error) bool {
+	return containsAny(err, []string{"wrong password or no key found"})
+}
+
+// IsIntegrityError reports whether restic check found errors in the repository
+func IsIntegrityError(err error) bool {
+	return containsAny(err, []string{"repository contains errors"})
+}
+
+// IsMissingRepositoryError reports whether restic found no repository at the location
+func IsMissingRepositoryError(err error) bool {
+	return containsAny(err, []string{"repository does not exist"})
+}
+
+// containsAny reports whether the message of err contains one of messages
+func containsAny(err error, messages []string) bool {
+	if err == nil {
+		return false
+	}
+	for _, message := range messages {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// run executes restic under the local repository lock and returns its standard
+// output. When the repository is locked and auto unlock is enabled, stale locks
+// are removed and the command is retried once.
+func (c *Client) run(ctx context.Context, args []string, env ...string) ([]byte, error) {
+	return c.runInput(ctx, nil, args, env...)
+}
+
+// runInput is like run but feeds stdin to restic. The command is only retried after
+// removing stale locks when stdin can be rewound.
+func (c *Client) runInput(ctx context.Context, stdin io.Reader, args []string, env ...string) ([]byte, error) {
+	unlock, err := c.Lock(ctx, IsExclusiveCommand(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	output, err := c.exec(ctx, stdin, args, env)
+	if err == nil || !c.autoUnlock.Load() || !IsLockedError(err) {
+		return output, err
+	}
+	seeker, rewindable := stdin.(io.Seeker)
+	if stdin != nil && !rewindable {
+		return output, err
+	}
+
+	c.log.Warnf("Repository %s is locked: %s", c.GetRepository(), lockDetails(err))
+	if unlockErr := c.Unlock(ctx); unlockErr != nil {
+		c.log.Errorf("Failed to remove stale locks: %v", unlockErr)
+		return output, err
+	}
+
+	if rewindable {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind input: %v", err)
+		}
+	}
+
+	c.log.Infof("Removed stale locks, retrying restic %s", args[0])
+	return c.exec(ctx, stdin, args, env)
+}
+
+// exec executes restic once and returns its standard output
+func (c *Client) exec(ctx context.Context, stdin io.Reader, args []string, env []string) ([]byte, error) {
+	resticEnv, err := c.Env(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, "restic", append(c.Flags(), args...)...)
+	cmd.Env = append(os.Environ(), resticEnv...)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = stdin
+
+	// Log the full command with all arguments
+	c.log.Debugf("Executing command: restic %s", strings.Join(args, " "))
+
+	_, span := tracing.StartClient(ctx, "restic "+args[0], "restic.repository", c.GetRepository())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		err = &CommandError{Err: err, Output: stderr.String()}
+	}
+	span.End(err)
+	return output, err
 }
 
 // InitRepository initializes a new restic repository
 func (c *Client) InitRepository(ctx context.Context) error {
-	cmd := exec.CommandContext(ctx, "restic", "init", "--repo", c.GetRepository())
-	cmd.Env = append(os.Environ(), c.getEnv()...)
-	c.log.Debugf("Executing command: restic init --repo %s", c.GetRepository())
-	output, err := cmd.CombinedOutput()
+	if _, err := c.run(ctx, []string{"init", "--repo", c.GetRepository()}); err != nil {
+		return fmt.Errorf("failed to initialize repository: %v", err)
+	}
+	return nil
+}
+
+// InitRepositoryFrom initializes a new repository sharing the chunker parameters of
+// the repository of another client, so snapshots copied between them deduplicate
+func (c *Client) InitRepositoryFrom(ctx context.Context, from *Client) error {
+	args := []string{"init", "--repo", c.GetRepository(), "--from-repo", from.GetRepository(), "--copy-chunker-params"}
+	args = append(args, from.sourceFlags()...)
+	fromEnv, err := c.sourceEnv(ctx, from)
 	if err != nil {
-		return fmt.Errorf("failed to initialize repository: %v, output: %s", err, string(output))
+		return err
+	}
+	if _, err := c.run(ctx, args, fromEnv...); err != nil {
+		return fmt.Errorf("failed to initialize repository: %v", err)
 	}
 	return nil
 }
 
-// Backup performs a backup of the specified paths
-func (c *Client) Backup(ctx context.Context, sourcePaths []string, excludePatterns []string, pvcID, pvcName, namespace string) error {
+// Copy copies all snapshots of the repository of another client into this one.
+// Snapshots copied before are skipped by restic.
+func (c *Client) Copy(ctx context.Context, from *Client) error {
+	args := []string{"copy", "--repo", c.GetRepository(), "--from-repo", from.GetRepository()}
+	args = append(args, from.sourceFlags()...)
+	fromEnv, err := c.sourceEnv(ctx, from)
+	if err != nil {
+		return err
+	}
+	if _, err := c.run(ctx, args, fromEnv...); err != nil {
+		return fmt.Errorf("failed to copy snapshots: %v", err)
+	}
+	return nil
+}
+
+// ForgetSnapshots removes the given snapshots, their data is removed by the next prune
+func (c *Client) ForgetSnapshots(ctx context.Context, ids []string) error {
+	args := append([]string{"forget", "--repo", c.GetRepository()}, ids...)
+	if _, err := c.run(ctx, args); err != nil {
+		return fmt.Errorf("failed to forget snapshots: %v", err)
+	}
+	return nil
+}
+
+// BackupOptions holds the settings of a single backup
+type BackupOptions struct {
+	PVCID           string
+	PVCName         string
+	Namespace       string
+	ExcludePatterns []string
+	Tags            []string // Extra tags added to the snapshot
+	LimitUpload     uint64   // Upload bandwidth in bytes per second, 0 is unlimited
+	Compression     string   // Compression mode, empty uses the restic default
+	ExcludeCaches   bool     // Skip the content of directories tagged with a CACHEDIR.TAG file
+	// Skip the content of directories holding one of these files, as name[:header]
+	ExcludeIfPresent []string
+	// Skip files larger than this many bytes, 0 for no limit
+	ExcludeLargerThan uint64
+	ExcludeFile       string // File of exclude patterns, one per line
+	OneFileSystem     bool   // Do not cross into other filesystems mounted below the paths
+}
+
+// CheckCompression validates a restic compression mode
+func CheckCompression(mode string) error {
+	switch mode {
+	case "", "off", "auto", "max":
+		return nil
+	}
+	return fmt.Errorf("invalid compression %s, expected off, auto or max", mode)
+}
+
+// SnapshotTags returns the tags of the snapshots taken with the given options
+func (c *Client) SnapshotTags(opts BackupOptions) []string {
+	tags := []string{
+		fmt.Sprintf("node=%s", c.nodeName),
+		PVCIDTagPrefix + opts.PVCID,
+		PVCNameTagPrefix + opts.PVCName,
+		NamespaceTag(opts.Namespace),
+	}
+	return append(tags, opts.Tags...)
+}
+
+// backupArgs returns the arguments common to all backups
+func (c *Client) backupArgs(opts BackupOptions) []string {
 	args := []string{
 		"backup",
 		"--repo", c.GetRepository(),
+		"--json",
 		"--host", c.nodeName,
-		"--tag", fmt.Sprintf("node=%s", c.nodeName),
-		"--tag", fmt.Sprintf("pvc-id=%s", pvcID),
-		"--tag", fmt.Sprintf("pvc-name=%s", pvcName),
-		"--tag", fmt.Sprintf("namespace=%s", namespace),
 	}
+	for _, tag := range c.SnapshotTags(opts) {
+		args = append(args, "--tag", tag)
+	}
+	if opts.LimitUpload > 0 {
+		// restic limits bandwidth in KiB/s
+		args = append(args, "--limit-upload", strconv.FormatUint(max(opts.LimitUpload/1024, 1), 10))
+	}
+	if opts.Compression != "" {
+		args = append(args, "--compression", opts.Compression)
+	}
+	return args
+}
+
+// Backup performs a backup of the specified paths
+func (c *Client) Backup(ctx context.Context, sourcePaths []string, opts BackupOptions) (*BackupSummary, error) {
+	args := c.fileBackupArgs(sourcePaths, opts)
+	if err := c.checkSpace(); err != nil {
+		return nil, err
+	}
+	done, err := c.beginBackup()
+	if err != nil {
+		return nil, err
+	}
+	output, err := c.run(ctx, args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to backup: %v", err)
+	}
+	done()
+
+	summary, err := parseBackupSummary(output)
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// EstimateBackup runs a backup of the specified paths with --dry-run, which reads the
+// files and reports the data a backup would add without storing anything
+func (c *Client) EstimateBackup(ctx context.Context, sourcePaths []string, opts BackupOptions) (*BackupSummary, error) {
+	args := append(c.fileBackupArgs(sourcePaths, opts), "--dry-run")
+	output, err := c.run(ctx, args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to estimate backup: %v", err)
+	}
+	return parseBackupSummary(output)
+}
+
+// fileBackupArgs returns the arguments of a backup of the specified paths
+func (c *Client) fileBackupArgs(sourcePaths []string, opts BackupOptions) []string {
+	args := c.backupArgs(opts)
 
 	// Add exclude patterns
-	for _, pattern := range excludePatterns {
+	for _, pattern := range opts.ExcludePatterns {
 		if pattern != "" {
 			args = append(args, "--exclude", pattern)
 		}
 	}
+	if opts.ExcludeCaches {
+		args = append(args, "--exclude-caches")
+	}
+	for _, marker := range opts.ExcludeIfPresent {
+		args = append(args, "--exclude-if-present", marker)
+	}
+	if opts.ExcludeLargerThan > 0 {
+		args = append(args, "--exclude-larger-than", strconv.FormatUint(opts.ExcludeLargerThan, 10))
+	}
+	if opts.ExcludeFile != "" {
+		args = append(args, "--exclude-file", opts.ExcludeFile)
+	}
+	if opts.OneFileSystem {
+		args = append(args, "--one-file-system")
+	}
 
 	// Add all source paths
-	args = append(args, sourcePaths...)
-
-	cmd := exec.CommandContext(ctx, "restic", args...)
-	cmd.Env = append(os.Environ(), c.getEnv()...)
+	return append(args, sourcePaths...)
+}
 
-	// Log the full command with all arguments
-	c.log.Debugf("Executing command: restic %s", strings.Join(args, " "))
+// BackupStdin stores the content read from stdin as a snapshot holding a single file
+func (c *Client) BackupStdin(ctx context.Context, stdin io.Reader, filename string, opts BackupOptions) (*BackupSummary, error) {
+	args := append(c.backupArgs(opts), "--stdin", "--stdin-filename", filename)
 
-	output, err := cmd.CombinedOutput()
+	if err := c.checkSpace(); err != nil {
+		return nil, err
+	}
+	done, err := c.beginBackup()
+	if err != nil {
+		return nil, err
+	}
+	output, err := c.runInput(ctx, stdin, args)
 	if err != nil {
-		return fmt.Errorf("failed to backup: %v, output: %s", err, string(output))
+		return nil, fmt.Errorf("failed to backup stdin: %v", err)
+	}
+	done()
+	return parseBackupSummary(output)
+}
+
+// Restore restores the content of a snapshot directory into target. Files missing
+// from the snapshot are deleted from target when delete is set.
+func (c *Client) Restore(ctx context.Context, snapshotID, dir, target string, delete bool) error {
+	args := []string{"restore", "--repo", c.GetRepository(), fmt.Sprintf("%s:%s", snapshotID, SnapshotPath(dir)), "--target", target}
+	if delete {
+		args = append(args, "--delete")
+	}
+
+	if _, err := c.run(ctx, args); err != nil {
+		return fmt.Errorf("failed to restore snapshot %s: %v", snapshotID, err)
 	}
 	return nil
 }
 
-// Forget removes old snapshots according to the retention policy
-func (c *Client) Forget(ctx context.Context, retention string) error {
+// Forget removes old snapshots according to the retention policy, pruning the
+// unreferenced data right away when prune is set
+func (c *Client) Forget(ctx context.Context, retention string, prune bool) error {
 	// Parse retention policy
 	keepFlags := []string{}
 	for _, policy := range strings.Split(retention, ",") {
@@ -123,37 +722,59 @@ func (c *Client) Forget(ctx context.Context, retention string) error {
 		return nil
 	}
 
+	// Only forget the snapshots of this node, other nodes may share the repository
 	args := []string{
 		"forget",
 		"--repo", c.GetRepository(),
-		"--prune",
+		"--host", c.nodeName,
+	}
+	if prune {
+		args = append(args, "--prune")
 	}
 	args = append(args, keepFlags...)
 
-	cmd := exec.CommandContext(ctx, "restic", args...)
-	cmd.Env = append(os.Environ(), c.getEnv()...)
-
-	// Log the full command with all arguments
-	c.log.Debugf("Executing command: restic %s", strings.Join(args, " "))
+	if _, err := c.run(ctx, args); err != nil {
+		return fmt.Errorf("failed to forget old snapshots: %v", err)
+	}
+	return nil
+}
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to forget old snapshots: %v, output: %s", err, string(output))
+// Prune removes the data no longer referenced by any snapshot
+func (c *Client) Prune(ctx context.Context) error {
+	if _, err := c.run(ctx, []string{"prune", "--repo", c.GetRepository()}); err != nil {
+		return fmt.Errorf("failed to prune repository: %v", err)
 	}
 	return nil
 }
 
-// Check verifies the repository
-func (c *Client) Check(ctx context.Context) error {
-	cmd := exec.CommandContext(ctx, "restic", "check", "--repo", c.GetRepository())
-	cmd.Env = append(os.Environ(), c.getEnv()...)
+// Check verifies the repository. When readDataSubset is set (e.g. "5%" or "1/10"),
+// the given subset of pack data is also read and verified.
+func (c *Client) Check(ctx context.Context, readDataSubset string) error {
+	args := []string{"check", "--repo", c.GetRepository()}
+	if readDataSubset != "" {
+		args = append(args, fmt.Sprintf("--read-data-subset=%s", readDataSubset))
+	}
 
-	// Log the full command
-	c.log.Debugf("Executing command: restic check --repo %s", c.GetRepository())
+	if _, err := c.run(ctx, args); err != nil {
+		return fmt.Errorf("repository check failed: %v", err)
+	}
+	return nil
+}
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("repository check failed: %v, output: %s", err, string(output))
+// Ping verifies the repository can be reached and opened with the password, without
+// reading more than its config
+func (c *Client) Ping(ctx context.Context) error {
+	if _, err := c.run(ctx, []string{"cat", "config", "--repo", c.GetRepository()}); err != nil {
+		return fmt.Errorf("failed to open repository %s: %v", c.GetRepository(), err)
+	}
+	return nil
+}
+
+// CleanupCache removes the cache directories of repositories restic has not used for
+// 30 days. It does not touch the repository and takes no repository lock.
+func (c *Client) CleanupCache(ctx context.Context) error {
+	if _, err := c.exec(ctx, nil, []string{"cache", "--cleanup"}, nil); err != nil {
+		return fmt.Errorf("failed to clean up cache: %v", err)
 	}
 	return nil
 }
@@ -161,7 +782,7 @@ func (c *Client) Check(ctx context.Context) error {
 // EnsureRepository ensures the repository exists and is accessible
 func (c *Client) EnsureRepository(ctx context.Context) error {
 	// Try to check the repository
-	err := c.Check(ctx)
+	err := c.Check(ctx, "")
 	if err != nil {
 		c.log.Infof("Repository check failed, trying to initialize...")
 		// If check fails, try to initialize
@@ -0,0 +1,297 @@
+package restic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Snapshot represents a restic snapshot
+type Snapshot struct {
+	ID       string           `json:"id"`
+	ShortID  string           `json:"short_id"`
+	Time     time.Time        `json:"time"`
+	Hostname string           `json:"hostname"`
+	Paths    []string         `json:"paths"`
+	Tags     []string         `json:"tags"`
+	Summary  *SnapshotSummary `json:"summary,omitempty"` // Recorded by restic 0.17 and later
+}
+
+// SnapshotSummary holds the statistics of the backup that created a snapshot
+type SnapshotSummary struct {
+	TotalFilesProcessed uint64 `json:"total_files_processed"`
+	TotalBytesProcessed uint64 `json:"total_bytes_processed"`
+	DataAdded           uint64 `json:"data_added"`
+}
+
+// Node represents a file or directory stored in a snapshot
+type Node struct {
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Path       string    `json:"path"`
+	Size       uint64    `json:"size"`
+	MTime      time.Time `json:"mtime"`
+	StructType string    `json:"struct_type"`
+}
+
+// Tags of snapshots holding auxiliary data rather than a PVC backup
+const (
+	// DescriptionTagPrefix prefixes the tag holding the snapshot description
+	DescriptionTagPrefix = "description="
+	// VerificationTagPrefix prefixes the tag linking a verification output to the verified snapshot
+	VerificationTagPrefix = "verifies="
+	// DumpTag marks the snapshots holding the output of a dump command instead of files
+	DumpTag = "dump"
+	// SafetyTagPrefix prefixes the tag of safety snapshots taken before an in-place restore
+	SafetyTagPrefix = "pre-restore-of="
+)
+
+// Tags identifying the PVC of a snapshot
+const (
+	PVCIDTagPrefix     = "pvc-id="
+	PVCNameTagPrefix   = "pvc-name="
+	NamespaceTagPrefix = "namespace="
+	// TTLTagPrefix prefixes the tag holding how long the snapshots of a PVC outlive it
+	TTLTagPrefix = "ttl="
+)
+
+// TagValue returns the value of the first tag with the given prefix, if any
+func (s *Snapshot) TagValue(prefix string) string {
+	for _, tag := range s.Tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix)
+		}
+	}
+	return ""
+}
+
+// TTLTag returns the tag holding how long the snapshots of a PVC outlive it
+func TTLTag(ttl string) string {
+	return TTLTagPrefix + ttl
+}
+
+// SafetyTag returns the tag of the safety snapshot taken before restoring the given snapshot
+func SafetyTag(snapshotID string) string {
+	return SafetyTagPrefix + snapshotID
+}
+
+// SafetyFor returns the ID of the snapshot whose restore this safety snapshot preceded, if any
+func (s *Snapshot) SafetyFor() string {
+	for _, tag := range s.Tags {
+		if strings.HasPrefix(tag, SafetyTagPrefix) {
+			return strings.TrimPrefix(tag, SafetyTagPrefix)
+		}
+	}
+	return ""
+}
+
+// VerificationTag returns the tag linking a verification output to the verified snapshot
+func VerificationTag(snapshotID string) string {
+	return VerificationTagPrefix + snapshotID
+}
+
+// IsVerification reports whether the snapshot holds the verification output of another snapshot
+func (s *Snapshot) IsVerification() bool {
+	for _, tag := range s.Tags {
+		if strings.HasPrefix(tag, VerificationTagPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDump reports whether the snapshot holds the output of a dump command
+func (s *Snapshot) IsDump() bool {
+	return s.HasTag(DumpTag)
+}
+
+// NamespaceTag returns the snapshot tag identifying the namespace of a PVC
+func NamespaceTag(namespace string) string {
+	return NamespaceTagPrefix + namespace
+}
+
+// PVCTags returns the snapshot tags identifying a PVC
+func PVCTags(namespace, pvcName string) []string {
+	return []string{
+		NamespaceTag(namespace),
+		PVCNameTagPrefix + pvcName,
+	}
+}
+
+// PlanTag returns the snapshot tag identifying the backup plan of a snapshot
+func PlanTag(plan string) string {
+	return fmt.Sprintf("plan=%s", plan)
+}
+
+// DescriptionTag returns the snapshot tag holding a human readable description.
+// Commas separate tags in restic, so they are replaced.
+func DescriptionTag(description string) string {
+	return DescriptionTagPrefix + strings.ReplaceAll(strings.TrimSpace(description), ",", ";")
+}
+
+// Description returns the description of the snapshot, if any
+func (s *Snapshot) Description() string {
+	for _, tag := range s.Tags {
+		if strings.HasPrefix(tag, DescriptionTagPrefix) {
+			return strings.TrimPrefix(tag, DescriptionTagPrefix)
+		}
+	}
+	return ""
+}
+
+// SnapshotPath returns the path restic stores a local path under in snapshots. Windows
+// paths are stored with the drive letter as first element, e.g. C:\data as /C/data.
+func SnapshotPath(path string) string {
+	if volume := filepath.VolumeName(path); volume != "" {
+		return "/" + strings.TrimSuffix(volume, ":") + filepath.ToSlash(path[len(volume):])
+	}
+	return filepath.ToSlash(path)
+}
+
+// Snapshots returns the snapshots carrying all of the given tags
+func (c *Client) Snapshots(ctx context.Context, tags []string) ([]Snapshot, error) {
+	args := []string{"snapshots", "--repo", c.GetRepository(), "--json"}
+	if len(tags) > 0 {
+		args = append(args, "--tag", strings.Join(tags, ","))
+	}
+
+	output, err := c.run(ctx, args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %v", err)
+	}
+
+	var snapshots []Snapshot
+	if err := json.Unmarshal(output, &snapshots); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshots: %v", err)
+	}
+	return snapshots, nil
+}
+
+// SnapshotExists reports whether the repository still holds a snapshot, e.g. not
+// forgotten by retention or another node since it was taken
+func (c *Client) SnapshotExists(ctx context.Context, snapshotID string) (bool, error) {
+	output, err := c.run(ctx, []string{"snapshots", "--repo", c.GetRepository(), "--json", snapshotID})
+	if err != nil {
+		// Recent restic versions fail on unknown IDs, older ones skip them
+		if strings.Contains(err.Error(), "no matching ID found") {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to look up snapshot %s: %v", snapshotID, err)
+	}
+
+	var snapshots []Snapshot
+	if err := json.Unmarshal(output, &snapshots); err != nil {
+		return false, fmt.Errorf("failed to parse snapshots: %v", err)
+	}
+	return len(snapshots) > 0, nil
+}
+
+// ListFiles returns the nodes stored in a snapshot, optionally limited to the given paths
+// and everything below them
+func (c *Client) ListFiles(ctx context.Context, snapshotID string, paths ...string) ([]Node, error) {
+	args := []string{"ls", "--repo", c.GetRepository(), "--json"}
+	// Without --recursive, restic only lists the direct children of the given paths
+	if len(paths) > 0 {
+		args = append(args, "--recursive")
+	}
+	args = append(args, snapshotID)
+	args = append(args, paths...)
+
+	output, err := c.run(ctx, args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+
+	// restic prints one JSON object per line: the snapshot first, then its nodes
+	var nodes []Node
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var node Node
+		if err := json.Unmarshal(scanner.Bytes(), &node); err != nil {
+			return nil, fmt.Errorf("failed to parse file listing: %v", err)
+		}
+		if node.StructType != "node" {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read file listing: %v", err)
+	}
+	return nodes, nil
+}
+
+// AddTags adds tags to the given snapshots
+func (c *Client) AddTags(ctx context.Context, snapshotIDs []string, tags []string) error {
+	if len(snapshotIDs) == 0 || len(tags) == 0 {
+		return nil
+	}
+
+	args := []string{"tag", "--repo", c.GetRepository(), "--add", strings.Join(tags, ",")}
+	args = append(args, snapshotIDs...)
+
+	if _, err := c.run(ctx, args); err != nil {
+		return fmt.Errorf("failed to tag snapshots: %v", err)
+	}
+	return nil
+}
+
+// HasTag reports whether the snapshot carries the given tag
+func (s *Snapshot) HasTag(tag string) bool {
+	for _, t := range s.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// DiffStats summarizes the changes from one snapshot to another
+type DiffStats struct {
+	ChangedFiles int       `json:"changed_files"` // Files whose content or metadata changed
+	Added        DiffCount `json:"added"`
+	Removed      DiffCount `json:"removed"`
+}
+
+// DiffCount counts the entries and data added or removed between two snapshots
+type DiffCount struct {
+	Files  int    `json:"files"`
+	Dirs   int    `json:"dirs"`
+	Others int    `json:"others"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+// Diff returns the statistics of the changes from one snapshot to another
+func (c *Client) Diff(ctx context.Context, fromID, toID string) (*DiffStats, error) {
+	output, err := c.run(ctx, []string{"diff", "--repo", c.GetRepository(), "--json", fromID, toID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff snapshots: %v", err)
+	}
+
+	// restic prints one JSON object per changed path, then the statistics
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var message struct {
+			MessageType string `json:"message_type"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil || message.MessageType != "statistics" {
+			continue
+		}
+		var stats DiffStats
+		if err := json.Unmarshal(scanner.Bytes(), &stats); err != nil {
+			return nil, fmt.Errorf("failed to parse diff statistics: %v", err)
+		}
+		return &stats, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read diff: %v", err)
+	}
+	return nil, fmt.Errorf("no statistics found in diff output")
+}
@@ -0,0 +1,33 @@
+package restic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Stats holds the repository statistics printed by restic stats --mode raw-data
+type Stats struct {
+	TotalSize      uint64 `json:"total_size"`
+	SnapshotsCount int    `json:"snapshots_count"`
+}
+
+// Stats returns the size of the repository data referenced by the snapshots carrying
+// all of the given tags, counted once however many snapshots reference it
+func (c *Client) Stats(ctx context.Context, tags []string) (*Stats, error) {
+	args := []string{"stats", "--repo", c.GetRepository(), "--json", "--mode", "raw-data"}
+	for _, tag := range tags {
+		args = append(args, "--tag", tag)
+	}
+
+	output, err := c.run(ctx, args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repository stats: %v", err)
+	}
+
+	var stats Stats
+	if err := json.Unmarshal(output, &stats); err != nil {
+		return nil, fmt.Errorf("failed to parse repository stats: %v", err)
+	}
+	return &stats, nil
+}
@@ -0,0 +1,52 @@
+package restic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// BackupSummary holds the summary restic prints at the end of a backup
+type BackupSummary struct {
+	FilesNew            int     `json:"files_new"`
+	FilesChanged        int     `json:"files_changed"`
+	FilesUnmodified     int     `json:"files_unmodified"`
+	DirsNew             int     `json:"dirs_new"`
+	DirsChanged         int     `json:"dirs_changed"`
+	DirsUnmodified      int     `json:"dirs_unmodified"`
+	DataAdded           uint64  `json:"data_added"`
+	DataAddedPacked     uint64  `json:"data_added_packed"`
+	TotalFilesProcessed int     `json:"total_files_processed"`
+	TotalBytesProcessed uint64  `json:"total_bytes_processed"`
+	TotalDuration       float64 `json:"total_duration"`
+	SnapshotID          string  `json:"snapshot_id"`
+}
+
+// Duration returns the duration of the backup
+func (s *BackupSummary) Duration() time.Duration {
+	return time.Duration(s.TotalDuration * float64(time.Second))
+}
+
+// parseBackupSummary extracts the summary message from the JSON lines printed by restic backup --json
+func parseBackupSummary(output []byte) (*BackupSummary, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var message struct {
+			MessageType string `json:"message_type"`
+		}
+		if err := json.Unmarshal(line, &message); err != nil || message.MessageType != "summary" {
+			continue
+		}
+
+		var summary BackupSummary
+		if err := json.Unmarshal(line, &summary); err != nil {
+			return nil, fmt.Errorf("failed to parse backup summary: %v", err)
+		}
+		return &summary, nil
+	}
+	return nil, fmt.Errorf("no summary found in backup output")
+}
@@ -0,0 +1,49 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+)
+
+// awsProvider reads secrets from AWS Secrets Manager, with the credentials of the AWS
+// default chain, e.g. IRSA
+type awsProvider struct {
+	client *secretsmanager.Client
+}
+
+// newAWSProvider creates the AWS provider in a region, empty for the region of the
+// environment
+func newAWSProvider(region string, proxy cfg.ProxyConfig) (*awsProvider, error) {
+	var options []func(*awsconfig.LoadOptions) error
+	if region != "" {
+		options = append(options, awsconfig.WithRegion(region))
+	}
+	if proxy.Enabled() {
+		options = append(options, awsconfig.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(func(transport *http.Transport) {
+			transport.Proxy = proxy.Func()
+		})))
+	}
+	awsConfig, err := awsconfig.LoadDefaultConfig(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %v", err)
+	}
+	return &awsProvider{client: secretsmanager.NewFromConfig(awsConfig)}, nil
+}
+
+func (p *awsProvider) Get(ctx context.Context, name string) (string, error) {
+	output, err := p.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(name)})
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %s from AWS Secrets Manager: %v", name, err)
+	}
+	if output.SecretString == nil {
+		return "", fmt.Errorf("secret %s of AWS Secrets Manager holds binary data, not a string", name)
+	}
+	return *output.SecretString, nil
+}
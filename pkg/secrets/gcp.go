@@ -0,0 +1,78 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// gcpScope is the OAuth scope of the Secret Manager API
+const gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// gcpProvider reads the latest version of secrets from GCP Secret Manager, with the
+// application default credentials, e.g. GKE Workload Identity
+type gcpProvider struct {
+	project string
+	client  *http.Client
+}
+
+func newGCPProvider(project string, proxy cfg.ProxyConfig) (*gcpProvider, error) {
+	base := &http.Client{Timeout: 30 * time.Second}
+	if proxy.Enabled() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = proxy.Func()
+		base.Transport = transport
+	}
+	// The token exchanges of the credentials go through the proxy as well, the metadata
+	// server of the node is reached directly by the SDK
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, base)
+	credentials, err := google.FindDefaultCredentials(ctx, gcpScope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find GCP credentials: %v", err)
+	}
+	client := oauth2.NewClient(ctx, credentials.TokenSource)
+	client.Timeout = base.Timeout
+	return &gcpProvider{project: project, client: client}, nil
+}
+
+func (p *gcpProvider) Get(ctx context.Context, name string) (string, error) {
+	secretURL := fmt.Sprintf("https://secretmanager.googleapis.com/v1/projects/%s/secrets/%s/versions/latest:access",
+		url.PathEscape(p.project), url.PathEscape(name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, secretURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %s from GCP Secret Manager: %v", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("failed to read secret %s from GCP Secret Manager: %s: %s", name, resp.Status, bytes.TrimSpace(body))
+	}
+	var secret struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("failed to decode secret %s: %v", name, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(secret.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode secret %s: %v", name, err)
+	}
+	return string(data), nil
+}
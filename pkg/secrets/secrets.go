@@ -0,0 +1,121 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// Providers of the per-namespace repository passwords
+const (
+	ProviderAWS = "aws"
+	ProviderGCP = "gcp"
+)
+
+// Provider reads secrets from an external secret manager
+type Provider interface {
+	Get(ctx context.Context, name string) (string, error)
+}
+
+// Passwords resolves the repository password of a namespace from a secret named after
+// it. Secrets are cached for a while so every restic run does not call the secret
+// manager, and a rotated secret is picked up once its cache entry expires.
+type Passwords struct {
+	provider Provider
+	template string
+	ttl      time.Duration
+	log      *logrus.Logger
+
+	mu    sync.Mutex
+	cache map[string]cachedSecret
+}
+
+// cachedSecret is a secret with the time it was read
+type cachedSecret struct {
+	value string
+	read  time.Time
+}
+
+// NewPasswords creates the per-namespace password resolver from the secrets
+// configuration, nil when no provider is configured. The secret manager is reached
+// through the proxy of the agent's own traffic.
+func NewPasswords(config cfg.SecretsConfig, proxy cfg.ProxyConfig, log *logrus.Logger) (*Passwords, error) {
+	switch config.Provider {
+	case "":
+		return nil, nil
+	case ProviderAWS:
+	case ProviderGCP:
+		if config.GCPProject == "" {
+			return nil, fmt.Errorf("SECRETS_GCP_PROJECT is required with the %s provider", ProviderGCP)
+		}
+	default:
+		return nil, fmt.Errorf("invalid secrets provider %s, expected %s or %s", config.Provider, ProviderAWS, ProviderGCP)
+	}
+	if !strings.Contains(config.NameTemplate, "{namespace}") {
+		return nil, fmt.Errorf("SECRETS_NAME_TEMPLATE must contain {namespace}")
+	}
+
+	var provider Provider
+	var err error
+	if config.Provider == ProviderAWS {
+		provider, err = newAWSProvider(config.AWSRegion, proxy)
+	} else {
+		provider, err = newGCPProvider(config.GCPProject, proxy)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Passwords{
+		provider: provider,
+		template: config.NameTemplate,
+		ttl:      config.CacheTTL,
+		log:      log,
+		cache:    make(map[string]cachedSecret),
+	}, nil
+}
+
+// SecretName returns the name of the secret holding the password of a namespace
+func (p *Passwords) SecretName(namespace string) string {
+	return strings.ReplaceAll(p.template, "{namespace}", namespace)
+}
+
+// Password returns the repository password of a namespace. When the secret manager
+// cannot be reached, the last password read is used until it answers again.
+func (p *Passwords) Password(ctx context.Context, namespace string) (string, error) {
+	name := p.SecretName(namespace)
+
+	p.mu.Lock()
+	cached, ok := p.cache[name]
+	p.mu.Unlock()
+	if ok && time.Since(cached.read) < p.ttl {
+		return cached.value, nil
+	}
+
+	value, err := p.provider.Get(ctx, name)
+	if err == nil && value == "" {
+		err = fmt.Errorf("secret %s is empty", name)
+	}
+	if err != nil {
+		if ok {
+			p.log.Warnf("Failed to refresh the password of namespace %s, using the cached one: %v", namespace, err)
+			return cached.value, nil
+		}
+		return "", fmt.Errorf("failed to get the password of namespace %s: %v", namespace, err)
+	}
+
+	logging.AddSecret(p.log, value)
+	if ok && cached.value != value {
+		p.log.Infof("Password of namespace %s was rotated in secret %s", namespace, name)
+	}
+	p.mu.Lock()
+	p.cache[name] = cachedSecret{value: value, read: time.Now()}
+	p.mu.Unlock()
+	return value, nil
+}
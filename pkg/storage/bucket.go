@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// BucketOptions selects how EnsureBucket prepares the bucket
+type BucketOptions struct {
+	Create     bool   // Create the bucket when it does not exist
+	Versioning bool   // Enable object versioning
+	Encryption string // Default server-side encryption, AES256 or aws:kms, empty leaves it unchanged
+	KMSKeyID   string // KMS key of aws:kms encryption, empty uses the AWS managed key
+}
+
+// EnsureBucket checks that the bucket is reachable with the configured credentials,
+// creates it when it does not exist and requested, and applies the versioning and
+// default encryption settings
+func (c *Client) EnsureBucket(ctx context.Context, opts BucketOptions) error {
+	_, err := c.s3.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(c.bucket)})
+	var notFound *types.NotFound
+	switch {
+	case err == nil:
+		c.log.Debugf("Bucket %s exists", c.bucket)
+	case errors.As(err, &notFound) && opts.Create:
+		if err := c.createBucket(ctx); err != nil {
+			return err
+		}
+	case errors.As(err, &notFound):
+		return fmt.Errorf("bucket %s does not exist, create it or set S3_CREATE_BUCKET", c.bucket)
+	default:
+		return bucketError(c.bucket, err)
+	}
+
+	if opts.Encryption != "" {
+		if err := c.setEncryption(ctx, opts.Encryption, opts.KMSKeyID); err != nil {
+			return err
+		}
+	}
+
+	if opts.Versioning {
+		_, err := c.s3.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+			Bucket: aws.String(c.bucket),
+			VersioningConfiguration: &types.VersioningConfiguration{
+				Status: types.BucketVersioningStatusEnabled,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to enable versioning of bucket %s: %v", c.bucket, err)
+		}
+	}
+	return nil
+}
+
+// setEncryption sets the default server-side encryption of the bucket. S3 applies it
+// to every object restic uploads, restic itself cannot send encryption headers.
+func (c *Client) setEncryption(ctx context.Context, sse, kmsKeyID string) error {
+	rule := &types.ServerSideEncryptionByDefault{SSEAlgorithm: types.ServerSideEncryption(sse)}
+	if kmsKeyID != "" {
+		rule.KMSMasterKeyID = aws.String(kmsKeyID)
+	}
+	_, err := c.s3.PutBucketEncryption(ctx, &s3.PutBucketEncryptionInput{
+		Bucket: aws.String(c.bucket),
+		ServerSideEncryptionConfiguration: &types.ServerSideEncryptionConfiguration{
+			Rules: []types.ServerSideEncryptionRule{{
+				ApplyServerSideEncryptionByDefault: rule,
+				// S3 Bucket Keys reduce the KMS requests of the many small pack files
+				BucketKeyEnabled: aws.Bool(types.ServerSideEncryption(sse) == types.ServerSideEncryptionAwsKms),
+			}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set encryption of bucket %s: %v", c.bucket, err)
+	}
+	c.log.Infof("Bucket %s encrypts new objects with %s", c.bucket, sse)
+	return nil
+}
+
+// createBucket creates the bucket in the configured region
+func (c *Client) createBucket(ctx context.Context) error {
+	input := &s3.CreateBucketInput{Bucket: aws.String(c.bucket)}
+	// us-east-1 is the default location and rejected as an explicit constraint
+	if c.region != "" && c.region != "us-east-1" {
+		input.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(c.region),
+		}
+	}
+
+	_, err := c.s3.CreateBucket(ctx, input)
+	var owned *types.BucketAlreadyOwnedByYou
+	var exists *types.BucketAlreadyExists
+	switch {
+	case err == nil:
+		c.log.Infof("Created bucket %s", c.bucket)
+		return nil
+	case errors.As(err, &owned):
+		// Another agent created it meanwhile
+		return nil
+	case errors.As(err, &exists):
+		return fmt.Errorf("bucket %s is owned by another account, bucket names are global", c.bucket)
+	default:
+		return bucketError(c.bucket, err)
+	}
+}
+
+// bucketError explains the common failures of bucket requests
+func bucketError(bucket string, err error) error {
+	var response *awshttp.ResponseError
+	if errors.As(err, &response) {
+		switch response.HTTPStatusCode() {
+		case http.StatusForbidden:
+			return fmt.Errorf("access to bucket %s denied, check S3_ACCESS_KEY, S3_SECRET_KEY and the bucket policy: %v", bucket, err)
+		case http.StatusMovedPermanently, http.StatusBadRequest:
+			return fmt.Errorf("bucket %s rejected the request, check S3_REGION: %v", bucket, err)
+		}
+	}
+	return fmt.Errorf("failed to reach bucket %s at the S3 endpoint: %v", bucket, err)
+}
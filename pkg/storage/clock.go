@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ClockSkew returns how far the local clock is ahead of the clock of the S3
+// endpoint, based on the Date header of its response
+func ClockSkew(ctx context.Context, client *http.Client, endpoint string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, EndpointURL(endpoint), nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	sent := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reach S3 endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+	received := time.Now()
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("S3 endpoint returned no valid Date header: %v", err)
+	}
+
+	// Compare against the middle of the round trip, the Date header has a one second resolution
+	local := sent.Add(received.Sub(sent) / 2)
+	return local.Sub(date).Round(time.Second), nil
+}
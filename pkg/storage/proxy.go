@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"net/http"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+)
+
+// HTTPClient returns the client reaching the storage endpoint like restic does, through
+// the repository proxy when one is configured
+func HTTPClient(proxy cfg.ProxyConfig) *http.Client {
+	if !proxy.Enabled() {
+		return http.DefaultClient
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy.Func()
+	return &http.Client{Transport: transport}
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Client represents an S3 client operating on the backup bucket
+type Client struct {
+	s3     *s3.Client
+	bucket string
+	region string
+	path   string
+	log    *logrus.Logger
+}
+
+// NewClient creates a new S3 client from the S3 configuration, reaching the endpoint
+// through the repository proxy like restic
+func NewClient(config cfg.S3Config, proxy cfg.ProxyConfig, log *logrus.Logger) (*Client, error) {
+	tlsConfig, err := TLSConfig(config.CACertFile, config.InsecureTLS)
+	if err != nil {
+		return nil, err
+	}
+
+	options := s3.Options{
+		Region:       config.Region,
+		BaseEndpoint: aws.String(EndpointURL(config.Endpoint)),
+		UsePathStyle: true,
+	}
+	switch {
+	case config.StaticKeys():
+		options.Credentials = credentialsProvider(config)
+	case config.Anonymous:
+		log.Debug("Accessing the bucket anonymously")
+	default:
+		// Like restic, fall back to the AWS default credential chain, e.g. IRSA or the
+		// instance profile
+		awsConfig, err := awsconfig.LoadDefaultConfig(context.Background(), awsconfig.WithRegion(config.Region))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS credentials: %v", err)
+		}
+		options.Credentials = awsConfig.Credentials
+	}
+	if tlsConfig != nil || proxy.Enabled() {
+		options.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(func(transport *http.Transport) {
+			if tlsConfig != nil {
+				transport.TLSClientConfig = tlsConfig
+			}
+			if proxy.Enabled() {
+				transport.Proxy = proxy.Func()
+			}
+		})
+	}
+	client := s3.New(options)
+
+	return &Client{
+		s3:     client,
+		bucket: config.Bucket,
+		region: config.Region,
+		path:   strings.Trim(config.Path, "/"),
+		log:    log,
+	}, nil
+}
+
+// credentialsProvider re-reads the keys and the session token for every request, so
+// credentials rotated in a mounted Secret are picked up without a restart
+func credentialsProvider(config cfg.S3Config) aws.CredentialsProvider {
+	return aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		accessKey, secretKey, err := config.Keys()
+		if err != nil {
+			return aws.Credentials{}, err
+		}
+		token, err := config.Token()
+		if err != nil {
+			return aws.Credentials{}, err
+		}
+		return aws.Credentials{AccessKeyID: accessKey, SecretAccessKey: secretKey, SessionToken: token}, nil
+	})
+}
+
+// EndpointURL turns a restic style S3 endpoint (host[:port] or URL) into a URL
+func EndpointURL(endpoint string) string {
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		return endpoint
+	}
+	return "https://" + endpoint
+}
+
+// PutObject stores data as key under the configured path
+func (c *Client) PutObject(ctx context.Context, key string, data []byte) error {
+	if c.path != "" {
+		key = c.path + "/" + key
+	}
+	_, err := c.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to bucket %s: %v", key, c.bucket, err)
+	}
+	return nil
+}
+
+// ListRepositories returns the names of the repositories stored under the
+// configured path whose name starts with prefix
+func (c *Client) ListRepositories(ctx context.Context, prefix string) ([]string, error) {
+	base := ""
+	if c.path != "" {
+		base = c.path + "/"
+	}
+
+	var names []string
+	paginator := s3.NewListObjectsV2Paginator(c.s3, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(c.bucket),
+		Prefix:    aws.String(base + prefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list bucket %s: %v", c.bucket, err)
+		}
+		for _, p := range page.CommonPrefixes {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(aws.ToString(p.Prefix), base), "/"))
+		}
+	}
+
+	c.log.Debugf("Found %d repositories with prefix %s in bucket %s", len(names), prefix, c.bucket)
+	return names, nil
+}
@@ -0,0 +1,258 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/monlor/local-pvc-backup/pkg/version"
+	"github.com/sirupsen/logrus"
+)
+
+// Export settings
+const (
+	// exportInterval is how often the ended spans are exported
+	exportInterval = 5 * time.Second
+	// maxQueuedSpans is the number of spans kept while the collector cannot be reached,
+	// newer spans are dropped beyond it
+	maxQueuedSpans = 4096
+)
+
+// Tracer collects ended spans and exports them in batches to an OTLP collector
+type Tracer struct {
+	endpoint string
+	headers  map[string]string
+	resource []attribute
+	client   *http.Client
+	mu       sync.Mutex
+	spans    []*Span
+	dropped  int
+	done     chan struct{}
+	stopped  chan struct{}
+	log      *logrus.Logger
+}
+
+// New creates a tracer exporting to the configured collector, nil when tracing is
+// disabled, and starts exporting in the background
+func New(config cfg.TracingConfig, node string, proxy cfg.ProxyConfig, log *logrus.Logger) (*Tracer, error) {
+	if config.Endpoint == "" {
+		return nil, nil
+	}
+
+	headers := make(map[string]string)
+	for _, header := range strings.Split(config.Headers, ",") {
+		if header = strings.TrimSpace(header); header == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(header, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid TRACING_HEADERS entry %q, expected name=value", header)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	if proxy.Enabled() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = proxy.Func()
+		client.Transport = transport
+	}
+
+	t := &Tracer{
+		endpoint: strings.TrimSuffix(config.Endpoint, "/") + "/v1/traces",
+		headers:  headers,
+		resource: attributes(map[string]any{
+			"service.name":    config.ServiceName,
+			"service.version": version.Version,
+			"host.name":       node,
+		}),
+		client:  client,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		log:     log,
+	}
+	go t.run()
+	return t, nil
+}
+
+// queue keeps an ended span for the next export
+func (t *Tracer) queue(span *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.spans) >= maxQueuedSpans {
+		t.dropped++
+		return
+	}
+	t.spans = append(t.spans, span)
+}
+
+// run exports the queued spans periodically until the tracer is shut down
+func (t *Tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			t.export(ctx)
+			cancel()
+		}
+	}
+}
+
+// Shutdown stops the background export and exports the remaining spans
+func (t *Tracer) Shutdown(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	close(t.done)
+	<-t.stopped
+	t.export(ctx)
+}
+
+// export sends the queued spans to the collector. Spans failing to export are kept
+// for the next attempt.
+func (t *Tracer) export(ctx context.Context) {
+	t.mu.Lock()
+	spans, dropped := t.spans, t.dropped
+	t.spans, t.dropped = nil, 0
+	t.mu.Unlock()
+	if dropped > 0 {
+		t.log.Warnf("Dropped %d spans while the trace collector was unreachable", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	if err := t.send(ctx, spans); err != nil {
+		t.log.Warnf("Failed to export %d spans: %v", len(spans), err)
+		t.mu.Lock()
+		t.spans = append(spans, t.spans...)
+		if len(t.spans) > maxQueuedSpans {
+			t.dropped += len(t.spans) - maxQueuedSpans
+			t.spans = t.spans[:maxQueuedSpans]
+		}
+		t.mu.Unlock()
+	}
+}
+
+// send posts spans as an OTLP JSON export request
+func (t *Tracer) send(ctx context.Context, spans []*Span) error {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		encoded = append(encoded, encodeSpan(span))
+	}
+	request := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": t.resource},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/monlor/local-pvc-backup", "version": version.Version},
+				"spans": encoded,
+			}},
+		}},
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode spans: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// otlpSpan is a span in the OTLP JSON encoding, with hex encoded IDs
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []attribute `json:"attributes,omitempty"`
+	Status            *status     `json:"status,omitempty"`
+}
+
+type attribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type status struct {
+	Code    int    `json:"code"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+func encodeSpan(span *Span) otlpSpan {
+	encoded := otlpSpan{
+		TraceID:           hex.EncodeToString(span.traceID[:]),
+		SpanID:            hex.EncodeToString(span.spanID[:]),
+		Name:              span.name,
+		Kind:              span.kind,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		Attributes:        attributes(span.attributes),
+	}
+	if span.parentID != [8]byte{} {
+		encoded.ParentSpanID = hex.EncodeToString(span.parentID[:])
+	}
+	if span.err != nil {
+		encoded.Status = &status{Code: 2, Message: span.err.Error()}
+	}
+	return encoded
+}
+
+// attributes encodes attribute values with their OTLP types
+func attributes(values map[string]any) []attribute {
+	encoded := make([]attribute, 0, len(values))
+	for key, value := range values {
+		var v map[string]any
+		switch value := value.(type) {
+		case string:
+			v = map[string]any{"stringValue": value}
+		case bool:
+			v = map[string]any{"boolValue": value}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+		case uint64:
+			v = map[string]any{"intValue": strconv.FormatUint(value, 10)}
+		case float64:
+			v = map[string]any{"doubleValue": value}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		encoded = append(encoded, attribute{Key: key, Value: v})
+	}
+	return encoded
+}
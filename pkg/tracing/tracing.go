@@ -0,0 +1,105 @@
+// Package tracing records the spans of the agent's operations and exports them to an
+// OpenTelemetry collector with OTLP over HTTP, in the JSON encoding.
+//
+// The tracer travels in the context: operations start spans with Start, which
+// returns a nil span, doing nothing, when the context holds no tracer.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Span kinds of OTLP
+const (
+	KindInternal = 1
+	KindClient   = 3
+)
+
+// Span is an operation of a trace
+type Span struct {
+	tracer     *Tracer
+	name       string
+	kind       int
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	start      time.Time
+	end        time.Time
+	attributes map[string]any
+	err        error
+}
+
+type tracerKey struct{}
+type spanKey struct{}
+
+// WithTracer returns a context whose operations are traced by t
+func WithTracer(ctx context.Context, t *Tracer) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// Start starts a span of an internal operation, a child of the span of ctx if any.
+// It returns a context holding the span and the span, nil when ctx holds no tracer.
+func Start(ctx context.Context, name string, attributes ...any) (context.Context, *Span) {
+	return start(ctx, name, KindInternal, attributes)
+}
+
+// StartClient starts a span of a call to another service, e.g. a restic invocation
+func StartClient(ctx context.Context, name string, attributes ...any) (context.Context, *Span) {
+	return start(ctx, name, KindClient, attributes)
+}
+
+func start(ctx context.Context, name string, kind int, attributes []any) (context.Context, *Span) {
+	t, _ := ctx.Value(tracerKey{}).(*Tracer)
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now(), attributes: make(map[string]any)}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+	span.SetAttributes(attributes...)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SetAttributes sets attributes of the span from alternating keys and values
+func (s *Span) SetAttributes(attributes ...any) {
+	if s == nil {
+		return
+	}
+	for i := 0; i+1 < len(attributes); i += 2 {
+		if key, ok := attributes[i].(string); ok {
+			s.attributes[key] = attributes[i+1]
+		}
+	}
+}
+
+// End ends the span, marking it failed when err is set, and queues it for export
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	s.tracer.queue(s)
+}
+
+// TraceID returns the hex encoded ID of the trace of the span of ctx, empty when
+// the operation is not traced
+func TraceID(ctx context.Context) string {
+	span, ok := ctx.Value(spanKey{}).(*Span)
+	if !ok {
+		return ""
+	}
+	return hex.EncodeToString(span.traceID[:])
+}
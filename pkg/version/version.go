@@ -0,0 +1,6 @@
+// Package version holds the version of the agent, set at build time with
+// -ldflags "-X github.com/monlor/local-pvc-backup/pkg/version.Version=v1.2.3"
+package version
+
+// Version of the running binary
+var Version = "dev"
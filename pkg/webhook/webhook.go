@@ -0,0 +1,231 @@
+// Package webhook implements the admission webhooks checking the backup annotations of
+// pods and PVCs when they are created or updated, and adding backup defaults to them
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/monlor/local-pvc-backup/pkg/backup"
+	cfg "github.com/monlor/local-pvc-backup/pkg/config"
+	"github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Server serves the admission reviews of the API server
+type Server struct {
+	config cfg.WebhookConfig
+	log    *logrus.Logger
+}
+
+// New creates the webhook server of a configuration
+func New(config cfg.WebhookConfig, log *logrus.Logger) (*Server, error) {
+	switch config.ValidateMode {
+	case cfg.WebhookDeny, cfg.WebhookWarn:
+	default:
+		return nil, fmt.Errorf("invalid validate mode %q, expected %s or %s", config.ValidateMode, cfg.WebhookDeny, cfg.WebhookWarn)
+	}
+	if report := backup.ValidateAnnotations(defaultAnnotations(config)); !report.Valid() {
+		return nil, fmt.Errorf("invalid defaults: %s", strings.Join(report.Errors, "; "))
+	}
+	return &Server{config: config, log: log}, nil
+}
+
+// defaultAnnotations returns the backup annotations the mutating webhook adds
+func defaultAnnotations(config cfg.WebhookConfig) map[string]string {
+	annotations := map[string]string{cfg.AnnotationEnabled: "true"}
+	if config.DefaultInclude != "" {
+		annotations[cfg.AnnotationInclude] = config.DefaultInclude
+	}
+	if config.DefaultExclude != "" {
+		annotations[cfg.AnnotationExclude] = config.DefaultExclude
+	}
+	return annotations
+}
+
+// Handler returns the handler of the webhook routes
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", func(w http.ResponseWriter, r *http.Request) {
+		s.serve(w, r, s.validate)
+	})
+	mux.HandleFunc("/mutate", func(w http.ResponseWriter, r *http.Request) {
+		s.serve(w, r, s.mutate)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+// serve decodes an admission review, answers it with review and writes the response
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, review func(*admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var admission admissionv1.AdmissionReview
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8<<20)).Decode(&admission); err != nil || admission.Request == nil {
+		http.Error(w, "invalid admission review", http.StatusBadRequest)
+		return
+	}
+
+	response := review(admission.Request)
+	response.UID = admission.Request.UID
+	admission.Request = nil
+	admission.Response = response
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(admission); err != nil {
+		s.log.Errorf("Failed to write admission response: %v", err)
+	}
+}
+
+// validate checks the backup annotations of the object of a request. Malformed
+// annotations are rejected in deny mode, unless an update leaves them unchanged, so
+// objects admitted before the webhook was installed can still be updated.
+func (s *Server) validate(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	object, err := objectMeta(request.Object.Raw)
+	if err != nil {
+		return &admissionv1.AdmissionResponse{Allowed: true, Warnings: []string{fmt.Sprintf("backup annotations not checked: %v", err)}}
+	}
+
+	report := backup.ValidateAnnotations(object.Annotations)
+	response := &admissionv1.AdmissionResponse{Allowed: true, Warnings: report.Warnings}
+	if report.Valid() {
+		return response
+	}
+
+	name := object.Name
+	if name == "" {
+		name = object.GenerateName
+	}
+	kind := strings.ToLower(request.Kind.Kind)
+	reject := s.config.ValidateMode == cfg.WebhookDeny
+	if reject && request.Operation == admissionv1.Update {
+		if old, err := objectMeta(request.OldObject.Raw); err == nil && !backupAnnotationsChanged(old.Annotations, object.Annotations) {
+			reject = false
+		}
+	}
+	if !reject {
+		response.Warnings = append(response.Warnings, report.Errors...)
+		return response
+	}
+
+	s.log.Infof("Rejected %s %s/%s with invalid backup annotations: %s", kind, request.Namespace, name, strings.Join(report.Errors, "; "))
+	response.Allowed = false
+	response.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Reason:  metav1.StatusReasonInvalid,
+		Code:    http.StatusUnprocessableEntity,
+		Message: "invalid backup annotations: " + strings.Join(report.Errors, "; "),
+	}
+	return response
+}
+
+// mutate adds the backup defaults to a pod or PVC being created, leaving the backup
+// annotations it already has, so owners can still opt out with enabled set to false
+// or choose their own patterns. Pods without PVCs are left alone.
+func (s *Server) mutate(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{Allowed: true}
+	if request.Operation != admissionv1.Create {
+		return response
+	}
+	object, err := objectMeta(request.Object.Raw)
+	if err != nil {
+		response.Warnings = []string{fmt.Sprintf("backup defaults not applied: %v", err)}
+		return response
+	}
+	if request.Kind.Kind == "Pod" {
+		var pod corev1.Pod
+		if err := json.Unmarshal(request.Object.Raw, &pod); err != nil || !mountsPVC(&pod) {
+			return response
+		}
+	}
+
+	var patch []jsonPatchOperation
+	if object.Annotations == nil {
+		patch = append(patch, jsonPatchOperation{Op: "add", Path: "/metadata/annotations", Value: map[string]string{}})
+	}
+	defaults := defaultAnnotations(s.config)
+	keys := make([]string, 0, len(defaults))
+	for key := range defaults {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok := object.Annotations[key]; ok {
+			continue
+		}
+		patch = append(patch, jsonPatchOperation{Op: "add", Path: "/metadata/annotations/" + escapeJSONPointer(key), Value: defaults[key]})
+	}
+	if len(patch) == 0 {
+		return response
+	}
+
+	encoded, err := json.Marshal(patch)
+	if err != nil {
+		response.Warnings = []string{fmt.Sprintf("backup defaults not applied: %v", err)}
+		return response
+	}
+	patchType := admissionv1.PatchTypeJSONPatch
+	response.Patch = encoded
+	response.PatchType = &patchType
+	return response
+}
+
+// jsonPatchOperation is an operation of a JSON patch (RFC 6902)
+type jsonPatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// escapeJSONPointer escapes a key for a JSON pointer (RFC 6901)
+func escapeJSONPointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// mountsPVC reports whether a pod mounts a PVC
+func mountsPVC(pod *corev1.Pod) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// objectMeta decodes the metadata of an object of a request
+func objectMeta(raw []byte) (*metav1.ObjectMeta, error) {
+	var object metav1.PartialObjectMetadata
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, fmt.Errorf("failed to decode object: %v", err)
+	}
+	return &object.ObjectMeta, nil
+}
+
+// backupAnnotationsChanged reports whether an update changes annotations of the
+// backup prefix or look-alikes of it
+func backupAnnotationsChanged(old, updated map[string]string) bool {
+	backupKey := func(key string) bool {
+		prefix, _, _ := strings.Cut(key, "/")
+		return strings.Contains(prefix, "local-pvc")
+	}
+	for key, value := range updated {
+		if backupKey(key) && old[key] != value {
+			return true
+		}
+	}
+	for key := range old {
+		if _, ok := updated[key]; backupKey(key) && !ok {
+			return true
+		}
+	}
+	return false
+}